@@ -0,0 +1,265 @@
+package address
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/bitcoin/base58"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// script opcodes used by the standard templates
+const (
+	op0           = 0x00
+	op1           = 0x51
+	op16          = 0x60
+	opReturn      = 0x6a
+	opDup         = 0x76
+	opEqual       = 0x87
+	opEqualVerify = 0x88
+	opHash160     = 0xa9
+	opCheckSig    = 0xac
+	opCheckMulti  = 0xae
+)
+
+type params struct {
+	hrp        string
+	pubkeyHash byte
+	scriptHash byte
+}
+
+var networkParams = [...]params{
+	bitcoin.Mainnet: {hrp: "bc", pubkeyHash: 0x00, scriptHash: 0x05},
+	bitcoin.Testnet: {hrp: "tb", pubkeyHash: 0x6f, scriptHash: 0xc4},
+	bitcoin.Regtest: {hrp: "bcrt", pubkeyHash: 0x6f, scriptHash: 0xc4},
+}
+
+// Type returns the bitcoind name of the standard template of scriptPubkey
+func Type(scriptPubkey []byte) string {
+	s := scriptPubkey
+	switch {
+	case len(s) == 25 && s[0] == opDup && s[1] == opHash160 &&
+		s[2] == 20 && s[23] == opEqualVerify && s[24] == opCheckSig:
+		return "pubkeyhash"
+	case len(s) == 23 && s[0] == opHash160 && s[1] == 20 &&
+		s[22] == opEqual:
+		return "scripthash"
+	case len(s) == 22 && s[0] == op0 && s[1] == 20:
+		return "witness_v0_keyhash"
+	case len(s) == 34 && s[0] == op0 && s[1] == 32:
+		return "witness_v0_scripthash"
+	case len(s) == 34 && s[0] == op1 && s[1] == 32:
+		return "witness_v1_taproot"
+	case witnessVersion(s) > 0:
+		return "witness_unknown"
+	case (len(s) == 35 && s[0] == 33 || len(s) == 67 && s[0] == 65) &&
+		s[len(s)-1] == opCheckSig:
+		return "pubkey"
+	case len(s) > 0 && s[0] == opReturn:
+		return "nulldata"
+	case len(s) > 3 && s[len(s)-1] == opCheckMulti &&
+		s[0] >= op1 && s[0] <= op16:
+		return "multisig"
+	}
+	return "nonstandard"
+}
+
+// FromScriptPubkey returns the address of scriptPubkey on net, false when
+// the script has no address form
+func FromScriptPubkey(
+	scriptPubkey []byte, net bitcoin.Network,
+) (string, bool) {
+	p := networkParams[net]
+	s := scriptPubkey
+	switch Type(s) {
+	case "pubkeyhash":
+		data := append([]byte{p.pubkeyHash}, s[3:23]...)
+		return base58.CheckEncode(data), true
+	case "scripthash":
+		data := append([]byte{p.scriptHash}, s[2:22]...)
+		return base58.CheckEncode(data), true
+	case "witness_v0_keyhash", "witness_v0_scripthash",
+		"witness_v1_taproot", "witness_unknown":
+		version := 0
+		if s[0] != op0 {
+			version = int(s[0]-op1) + 1
+		}
+		return segwitEncode(p.hrp, version, s[2:]), true
+	}
+	return "", false
+}
+
+// ToScriptPubkey returns the scriptPubkey paid by the base58 or bech32
+// address addr of net
+func ToScriptPubkey(addr string, net bitcoin.Network) ([]byte, error) {
+	p := networkParams[net]
+	if len(addr) > len(p.hrp) &&
+		strings.EqualFold(addr[:len(p.hrp)+1], p.hrp+"1") {
+		version, program, err := segwitDecode(p.hrp, addr)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		opVersion := byte(op0)
+		if version > 0 {
+			opVersion = byte(op1 + version - 1)
+		}
+		s := append([]byte{opVersion, byte(len(program))}, program...)
+		return s, nil
+	}
+	data, err := base58.CheckDecode(addr)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if len(data) != 21 {
+		return nil, fmt.Errorf("bad address size")
+	}
+	switch data[0] {
+	case p.pubkeyHash:
+		s := append([]byte{opDup, opHash160, 20}, data[1:]...)
+		return append(s, opEqualVerify, opCheckSig), nil
+	case p.scriptHash:
+		s := append([]byte{opHash160, 20}, data[1:]...)
+		return append(s, opEqual), nil
+	}
+	return nil, fmt.Errorf("bad address version")
+}
+
+// witnessVersion returns the version of a witness program, -1 when s is
+// not one
+func witnessVersion(s []byte) int {
+	if len(s) < 4 || len(s) > 42 || int(s[1]) != len(s)-2 {
+		return -1
+	}
+	switch {
+	case s[0] == op0:
+		return 0
+	case s[0] >= op1 && s[0] <= op16:
+		return int(s[0]-op1) + 1
+	}
+	return -1
+}
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+// bech32 checksum constants of BIP173 and BIP350
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+// segwitEncode encodes a witness program, bech32 for version 0 and
+// bech32m above
+func segwitEncode(hrp string, version int, program []byte) string {
+	program5, _ := convertBits(program, 8, 5, true)
+	data := append([]byte{byte(version)}, program5...)
+	checksum := uint32(bech32Const)
+	if version > 0 {
+		checksum = bech32mConst
+	}
+	values := append(hrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	mod := polymod(values) ^ checksum
+	for i := range 6 {
+		data = append(data, byte(mod>>(5*(5-i)))&31)
+	}
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range data {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+// segwitDecode decodes the witness program of addr, checking the bech32
+// checksum for version 0 and bech32m above
+func segwitDecode(hrp, addr string) (int, []byte, error) {
+	if len(addr) > 90 || strings.ToLower(addr) != addr &&
+		strings.ToUpper(addr) != addr {
+		return 0, nil, fmt.Errorf("bad bech32 string")
+	}
+	addr = strings.ToLower(addr)
+	if len(addr) < len(hrp)+1+1+6 {
+		return 0, nil, fmt.Errorf("bad bech32 size")
+	}
+	var data []byte
+	for i := len(hrp) + 1; i < len(addr); i++ {
+		v := strings.IndexByte(bech32Charset, addr[i])
+		if v < 0 {
+			return 0, nil, fmt.Errorf("bad bech32 character")
+		}
+		data = append(data, byte(v))
+	}
+	version := int(data[0])
+	checksum := uint32(bech32Const)
+	if version > 0 {
+		checksum = bech32mConst
+	}
+	if polymod(append(hrpExpand(hrp), data...)) != checksum {
+		return 0, nil, fmt.Errorf("bad bech32 checksum")
+	}
+	program, ok := convertBits(data[1:len(data)-6], 5, 8, false)
+	if !ok || version > 16 || len(program) < 2 || len(program) > 40 ||
+		version == 0 && len(program) != 20 && len(program) != 32 {
+		return 0, nil, fmt.Errorf("bad witness program")
+	}
+	return version, program, nil
+}
+
+func polymod(values []byte) uint32 {
+	gen := [5]uint32{
+		0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3,
+	}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := range 5 {
+			if (top>>i)&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func hrpExpand(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for i := range len(hrp) {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := range len(hrp) {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+// convertBits regroups data of from bits values into to bits values,
+// padding the last one when pad is set. Without pad it returns false when
+// the leftover bits are not zero padding.
+func convertBits(data []byte, from, to uint, pad bool) ([]byte, bool) {
+	var (
+		acc  uint32
+		bits uint
+		out  []byte
+		maxv = uint32(1)<<to - 1
+	)
+	for _, v := range data {
+		acc = acc<<from | uint32(v)
+		bits += from
+		for bits >= to {
+			bits -= to
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad && bits > 0 {
+		out = append(out, byte(acc<<(to-bits)&maxv))
+	}
+	if !pad && (bits >= from || acc<<(to-bits)&maxv != 0) {
+		return nil, false
+	}
+	return slices.Clip(out), true
+}
@@ -0,0 +1,128 @@
+package address
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+)
+
+func TestFromScriptPubkey(t *testing.T) {
+	for _, c := range []struct {
+		spk  string
+		net  bitcoin.Network
+		typ  string
+		addr string
+	}{
+		{
+			"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac",
+			bitcoin.Mainnet,
+			"pubkeyhash",
+			"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa",
+		},
+		{
+			"a914748284390f9e263a4b766a75d0633c50426eb87587",
+			bitcoin.Mainnet,
+			"scripthash",
+			"3CK4fEwbMP7heJarmU4eqA3sMbVJyEnU3V",
+		},
+		{
+			"0014751e76e8199196d454941c45d1b3a323f1433bd6",
+			bitcoin.Mainnet,
+			"witness_v0_keyhash",
+			"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+		},
+		{
+			"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c63296" +
+				"04903262",
+			bitcoin.Testnet,
+			"witness_v0_scripthash",
+			"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7",
+		},
+		{
+			"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b" +
+				"16f81798",
+			bitcoin.Mainnet,
+			"witness_v1_taproot",
+			"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0",
+		},
+		{
+			"6002751e",
+			bitcoin.Mainnet,
+			"witness_unknown",
+			"bc1sw50qgdz25j",
+		},
+		{
+			"0014751e76e8199196d454941c45d1b3a323f1433bd6",
+			bitcoin.Regtest,
+			"witness_v0_keyhash",
+			"bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080",
+		},
+		{
+			"6a0568656c6c6f",
+			bitcoin.Mainnet,
+			"nulldata",
+			"",
+		},
+	} {
+		spk, err := hex.DecodeString(c.spk)
+		assert.Must(t, err)
+		assert.MustEqual(t, c.typ, Type(spk))
+		addr, ok := FromScriptPubkey(spk, c.net)
+		assert.MustEqual(t, c.addr != "", ok)
+		assert.MustEqual(t, c.addr, addr)
+		if !ok {
+			continue
+		}
+		decoded, err := ToScriptPubkey(c.addr, c.net)
+		assert.Must(t, err)
+		assert.MustEqual(t, spk, decoded)
+	}
+	// bech32 is also valid all uppercase
+	spk, err := ToScriptPubkey(
+		"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", bitcoin.Mainnet,
+	)
+	assert.Must(t, err)
+	assert.MustEqual(
+		t, "0014751e76e8199196d454941c45d1b3a323f1433bd6",
+		hex.EncodeToString(spk),
+	)
+}
+
+func TestToScriptPubkeyInvalid(t *testing.T) {
+	for _, c := range []struct {
+		addr string
+		net  bitcoin.Network
+	}{
+		// BIP350 invalid addresses
+		{
+			"tc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq5zuyut",
+			bitcoin.Mainnet,
+		},
+		{
+			"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd",
+			bitcoin.Mainnet,
+		},
+		{
+			"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL",
+			bitcoin.Mainnet,
+		},
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh", bitcoin.Mainnet},
+		{
+			"bc1p38j9r5y49hruaue7wxjce0updqjuyyx0kh56v8s25huc6995vvpql3jow4",
+			bitcoin.Mainnet,
+		},
+		{"bc1pw5dgrnzv", bitcoin.Mainnet},
+		// mixed case
+		{"bc1QW508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", bitcoin.Mainnet},
+		// other network
+		{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4", bitcoin.Testnet},
+		{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNa", bitcoin.Testnet},
+		// bad base58 checksum
+		{"1A1zP1eP5QGefi2DMPTfTL5SLmv7DivfNb", bitcoin.Mainnet},
+	} {
+		_, err := ToScriptPubkey(c.addr, c.net)
+		assert.MustEqual(t, true, err != nil)
+	}
+}
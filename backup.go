@@ -0,0 +1,190 @@
+package epsgo
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ncodysoftware/eps-go/internal/filelock"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/database/sql/migrator"
+	"ncody.com/ncgo.git/database/sql/sqlite"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+var ErrBackupUnsupported = errors.New(
+	"backup is only supported with sqlite, use pg_dump for postgres",
+)
+
+// ErrDBInUse is returned by LockDB while another process holds the lock
+var ErrDBInUse = errors.New("database in use, eps-go must be stopped")
+
+// LockDB takes the lock file next to the sqlite database at opts.Path. The
+// server holds it while running, RestoreDB and the index repairs take it to
+// run only while the server is stopped. Backup does not need it.
+func LockDB(opts DBOpts) (*filelock.Lock, error) {
+	l, err := filelock.Acquire(opts.Path + ".lock")
+	if errors.Is(err, filelock.ErrLocked) {
+		return nil, fmt.Errorf("%s: %w", opts.Path, ErrDBInUse)
+	}
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return l, nil
+}
+
+// Backup writes a consistent copy of the database to dst while it is in
+// use. dst must not exist.
+func (d *DB) Backup(ctx context.Context, dst string) error {
+	if d.postgres {
+		return ErrBackupUnsupported
+	}
+	_, err := os.Stat(dst)
+	if err == nil {
+		return fmt.Errorf("backup %s already exists", dst)
+	}
+	// VACUUM INTO reads in one transaction, the sync keeps writing to the
+	// wal meanwhile
+	_, err = d.Exec(ctx, `VACUUM INTO $1`, dst)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// RestoreDB replaces the sqlite database at opts.Path with the backup at
+// src, it fails with ErrDBInUse while eps-go runs. The backup migrations
+// must be known to this build and check must accept it, the replaced
+// database is kept at opts.Path + ".old". reconcile runs once the backup is
+// in place, still holding the lock, to bring it in line with the headers
+// file that is not part of the backup.
+func RestoreDB(
+	ctx context.Context,
+	opts DBOpts,
+	src string,
+	check func(db sql.Database) error,
+	reconcile func() error,
+) error {
+	lock, err := LockDB(opts)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer lock.Unlock()
+	err = checkBackup(ctx, src, check)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	tmp := opts.Path + ".restore"
+	err = copyFile(tmp, src)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer os.Remove(tmp)
+	err = os.Rename(opts.Path, opts.Path+".old")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return stackerr.Wrap(err)
+	}
+	// the wal of the replaced database must not be applied to the backup
+	for _, suffix := range []string{"-wal", "-shm"} {
+		err = os.Rename(opts.Path+suffix, opts.Path+".old"+suffix)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return stackerr.Wrap(err)
+		}
+	}
+	err = os.Rename(tmp, opts.Path)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	err = reconcile()
+	if err != nil {
+		return fmt.Errorf("%s restored, reconcile: %w", opts.Path, err)
+	}
+	return nil
+}
+
+func checkBackup(
+	ctx context.Context,
+	src string,
+	check func(db sql.Database) error,
+) error {
+	_, err := os.Stat(src)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	db, err := sqlite.New(src)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer db.Close(ctx)
+	var m migrator.Migrations
+	err = m.LoadFromEmbedFS(migrations, "migrations")
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	rows, err := db.Query(ctx, `SELECT version, hash FROM migration`)
+	if err != nil {
+		return fmt.Errorf("backup %s: no migrations: %w", src, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			version int64
+			hash    []byte
+		)
+		err := rows.Scan(&version, &hash)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		i := len(m) - 1
+		for i >= 0 && m[i].Version != version {
+			i--
+		}
+		if i < 0 {
+			return fmt.Errorf(
+				"backup %s: migration v%d unknown to this build",
+				src,
+				version,
+			)
+		}
+		expect := sha256.Sum256(m[i].Sql)
+		if !bytes.Equal(expect[:], hash) {
+			return fmt.Errorf(
+				"backup %s: migration hash does not match at v%d",
+				src,
+				version,
+			)
+		}
+	}
+	err = check(db)
+	if err != nil {
+		return fmt.Errorf("backup %s: %w", src, err)
+	}
+	return nil
+}
+
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return stackerr.Wrap(err)
+	}
+	err = out.Sync()
+	if err != nil {
+		out.Close()
+		return stackerr.Wrap(err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,216 @@
+package blockdir
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+var ErrNotFound = errors.New("block not found in blocks dir")
+
+// Dir reads raw blocks from a Bitcoin Core blocks directory. Core's block
+// index is a leveldb database kept locked by the running node, so the
+// blk*.dat record headers are scanned to build an index of our own.
+type Dir struct {
+	path  string
+	magic [4]byte
+	// obfuscation key from xor.dat, zero when the files are plain
+	key [8]byte
+	//
+	mu sync.Mutex
+	// keyed by the first 8 bytes of the block hash, positions are checked
+	// against the full hash when reading
+	index map[uint64]blockPos
+	// file number to the offset scanned so far
+	scanned map[int]int64
+}
+
+type blockPos struct {
+	file   uint32
+	offset uint32
+}
+
+// Open prepares the blocks dir at path for reading, no block is indexed
+// until Scan is called
+func Open(path string, network bitcoin.Network) (*Dir, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if !st.IsDir() {
+		return nil, fmt.Errorf("not a directory: %s", path)
+	}
+	d := &Dir{
+		path:    path,
+		magic:   p2p.MagicBytes(network),
+		index:   make(map[uint64]blockPos),
+		scanned: make(map[int]int64),
+	}
+	key, err := os.ReadFile(filepath.Join(path, "xor.dat"))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, stackerr.Wrap(err)
+	}
+	if err == nil {
+		if len(key) != len(d.key) {
+			return nil, fmt.Errorf("bad xor.dat size: %d", len(key))
+		}
+		copy(d.key[:], key)
+	}
+	return d, nil
+}
+
+// Len returns the number of indexed blocks
+func (d *Dir) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.index)
+}
+
+// Scan indexes the blocks written since the last scan
+func (d *Dir) Scan() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	files, err := filepath.Glob(filepath.Join(d.path, "blk*.dat"))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	nums := make([]int, 0, len(files))
+	for _, f := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(
+			filepath.Base(f), "blk"), ".dat",
+		)
+		n, err := strconv.Atoi(name)
+		if err != nil {
+			continue
+		}
+		nums = append(nums, n)
+	}
+	slices.Sort(nums)
+	for _, n := range nums {
+		err := d.scanFile(n)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+func (d *Dir) scanFile(n int) error {
+	f, err := os.Open(d.fileName(n))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	var (
+		size   = st.Size()
+		offset = d.scanned[n]
+		rec    [8 + 80]byte
+	)
+	for offset+int64(len(rec)) <= size {
+		_, err := f.ReadAt(rec[:], offset)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		if [4]byte(rec[:4]) == [4]byte{} {
+			// space preallocated by the node, zeroed on disk even when
+			// the files are obfuscated
+			break
+		}
+		d.xor(rec[:], offset)
+		if [4]byte(rec[:4]) != d.magic {
+			return fmt.Errorf(
+				"bad record marker in %s at %d", d.fileName(n), offset,
+			)
+		}
+		blockSize := int64(binary.LittleEndian.Uint32(rec[4:8]))
+		if offset+8+blockSize > size {
+			// block still being written
+			break
+		}
+		hash := doubleSha256(rec[8:])
+		d.index[binary.LittleEndian.Uint64(hash[:8])] = blockPos{
+			file:   uint32(n),
+			offset: uint32(offset),
+		}
+		offset += 8 + blockSize
+	}
+	d.scanned[n] = offset
+	return nil
+}
+
+// Has reports whether a block with the given hash was indexed
+func (d *Dir) Has(hash *[32]byte) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	_, ok := d.index[binary.LittleEndian.Uint64(hash[:8])]
+	return ok
+}
+
+// ReadBlock returns the serialized block with the given hash
+func (d *Dir) ReadBlock(hash *[32]byte) ([]byte, error) {
+	d.mu.Lock()
+	pos, ok := d.index[binary.LittleEndian.Uint64(hash[:8])]
+	d.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	f, err := os.Open(d.fileName(int(pos.file)))
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer f.Close()
+	var rec [8]byte
+	offset := int64(pos.offset)
+	_, err = f.ReadAt(rec[:], offset)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	d.xor(rec[:], offset)
+	if [4]byte(rec[:4]) != d.magic {
+		return nil, fmt.Errorf("bad record marker at %d", offset)
+	}
+	raw := make([]byte, binary.LittleEndian.Uint32(rec[4:8]))
+	_, err = f.ReadAt(raw, offset+8)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, stackerr.Wrap(err)
+	}
+	d.xor(raw, offset+8)
+	if len(raw) < 80 || doubleSha256(raw[:80]) != *hash {
+		return nil, ErrNotFound
+	}
+	return raw, nil
+}
+
+func (d *Dir) fileName(n int) string {
+	return filepath.Join(d.path, fmt.Sprintf("blk%05d.dat", n))
+}
+
+func (d *Dir) xor(data []byte, offset int64) {
+	if d.key == [8]byte{} {
+		return
+	}
+	for i := range data {
+		data[i] ^= d.key[(offset+int64(i))%8]
+	}
+}
+
+func doubleSha256(data []byte) [32]byte {
+	hash := sha256.Sum256(data)
+	return sha256.Sum256(hash[:])
+}
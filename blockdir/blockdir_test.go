@@ -0,0 +1,100 @@
+package blockdir
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ncodysoftware/eps-go/internal/testdata"
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+)
+
+func TestDir(t *testing.T) {
+	for _, key := range [][]byte{nil, {1, 2, 3, 4, 5, 6, 7, 8}} {
+		tDir(t, key)
+	}
+}
+
+func tDir(t *testing.T, key []byte) {
+	dir := t.TempDir()
+	if key != nil {
+		err := os.WriteFile(filepath.Join(dir, "xor.dat"), key, 0o644)
+		assert.Must(t, err)
+	}
+	block919939, err := hex.DecodeString(
+		string(bytes.Trim(testdata.Block919939, "\n")),
+	)
+	assert.Must(t, err)
+	blocks := [][]byte{
+		block919939,
+		tFakeBlock(1),
+		tFakeBlock(2),
+		tFakeBlock(3),
+	}
+	// the node preallocates block files, unused space is zeroed
+	tWriteBlockFile(t, dir, 0, key, blocks[:2], 1024)
+	tWriteBlockFile(t, dir, 1, key, blocks[2:3], 0)
+	d, err := Open(dir, bitcoin.Regtest)
+	assert.Must(t, err)
+	err = d.Scan()
+	assert.Must(t, err)
+	assert.MustEqual(t, 3, d.Len())
+	for _, b := range blocks[:3] {
+		hash := doubleSha256(b[:80])
+		assert.MustEqual(t, true, d.Has(&hash))
+		raw, err := d.ReadBlock(&hash)
+		assert.Must(t, err)
+		assert.MustEqual(t, b, raw)
+	}
+	hash := doubleSha256(blocks[3][:80])
+	assert.MustEqual(t, false, d.Has(&hash))
+	_, err = d.ReadBlock(&hash)
+	assert.MustEqual(t, ErrNotFound, err)
+	// a block appended after the first scan is found by the next one
+	tWriteBlockFile(t, dir, 1, key, blocks[2:4], 0)
+	err = d.Scan()
+	assert.Must(t, err)
+	assert.MustEqual(t, 4, d.Len())
+	raw, err := d.ReadBlock(&hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, blocks[3], raw)
+}
+
+func tFakeBlock(n byte) []byte {
+	b := make([]byte, 200)
+	for i := range b {
+		b[i] = n + byte(i)
+	}
+	return b
+}
+
+func tWriteBlockFile(
+	t *testing.T,
+	dir string,
+	n int,
+	key []byte,
+	blocks [][]byte,
+	prealloc int,
+) {
+	magic := p2p.MagicBytes(bitcoin.Regtest)
+	var data []byte
+	for _, b := range blocks {
+		data = append(data, magic[:]...)
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(b)))
+		data = append(data, b...)
+	}
+	for i := range data {
+		if key != nil {
+			data[i] ^= key[i%len(key)]
+		}
+	}
+	data = append(data, make([]byte, prealloc)...)
+	d := &Dir{path: dir}
+	err := os.WriteFile(d.fileName(n), data, 0o644)
+	assert.Must(t, err)
+}
@@ -17,6 +17,7 @@ import (
 	"ncody.com/ncgo.git/bitcoin"
 	"ncody.com/ncgo.git/bitcoin/bip32"
 	"ncody.com/ncgo.git/bitcoin/scriptpubkey"
+	"ncody.com/ncgo.git/database/sql"
 	"ncody.com/ncgo.git/database/sql/migrator"
 	"ncody.com/ncgo.git/log"
 	"ncody.com/ncgo.git/stackerr"
@@ -56,16 +57,24 @@ func run() error {
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	wallets := getWallets()
-	if len(wallets) == 0 {
-		return fmt.Errorf("no wallets to track")
-	}
 	ctx := context.Background()
 	ctx, stop := signal.NotifyContext(ctx, syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 	logger := log.New(log.LevelFromString(cfg.LogLevel), "eps-go")
-	db, err := epsgo.OpenDB(
-		ctx, logger, cfg.SqliteDBPath, migrator.FlagMigrateAllowUpgrade,
+	if len(os.Args) > 1 {
+		return runCommand(ctx, logger, cfg, os.Args[1:])
+	}
+	wallets := getWallets()
+	if len(wallets) == 0 {
+		return fmt.Errorf("no wallets to track")
+	}
+	unlock, err := lockDB(cfg)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer unlock()
+	db, err := epsgo.OpenConfigDB(
+		ctx, logger, cfg, migrator.FlagMigrateAllowUpgrade,
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -76,11 +85,35 @@ func run() error {
 		return stackerr.Wrap(err)
 	}
 	w, err := walletmanager.New(
-		ctx, db, logger, bcli, wallets, cfg.Network,
+		ctx,
+		db,
+		logger,
+		bcli,
+		wallets,
+		cfg.Network,
+		walletmanager.Opts{
+			NodeAddr:           cfg.BTCNodeAddr,
+			BlocksDir:          cfg.BTCBlocksDir,
+			RPCURL:             cfg.BTCRPCURL,
+			ScanFromFirstBlock: cfg.ScanFromFirstBlock,
+			HeadersFile:        cfg.HeadersFile,
+			MaxHistory:         cfg.MaxHistory,
+		},
 	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	defer w.Close(ctx)
 	err = electrum.ListenAndServe(
-		ctx, cfg.ListenAddress, logger, w, func() {},
+		ctx,
+		cfg.ListenAddress,
+		logger,
+		w,
+		electrum.Opts{
+			Banner:          cfg.Banner,
+			DonationAddress: cfg.DonationAddress,
+		},
+		func() {},
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -88,6 +121,179 @@ func run() error {
 	return nil
 }
 
+const usage = `usage:
+	eps-go                 run the server
+	eps-go backup <file>   copy the database to file, also while running
+	eps-go restore <file>  replace the database with file, eps-go must be
+	                       stopped
+	eps-go verify          check the index consistency, eps-go must be
+	                       stopped
+	eps-go verify repair   roll the index back below the first problem
+	                       found, eps-go must be stopped`
+
+func runCommand(
+	ctx context.Context, logger *log.Logger, cfg *epsgo.Config, args []string,
+) error {
+	switch {
+	case len(args) == 2 && args[0] == "backup":
+		return backup(ctx, logger, cfg, args[1])
+	case len(args) == 2 && args[0] == "restore":
+		return restore(ctx, logger, cfg, args[1])
+	case len(args) == 1 && args[0] == "verify":
+		return verify(ctx, logger, cfg, false)
+	case len(args) == 2 && args[0] == "verify" && args[1] == "repair":
+		return verify(ctx, logger, cfg, true)
+	default:
+		return fmt.Errorf("%s", usage)
+	}
+}
+
+func backup(
+	ctx context.Context, logger *log.Logger, cfg *epsgo.Config, dst string,
+) error {
+	if cfg.PostgresDSN != "" {
+		return epsgo.ErrBackupUnsupported
+	}
+	_, err := os.Stat(cfg.SqliteDBPath)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	// no migration, the running server may be older than this build
+	db, err := epsgo.OpenDB(ctx, logger, cfg.DBOpts(), 0)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer db.Close(ctx)
+	err = db.Backup(ctx, dst)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	logger.Infof("database copied to %s", dst)
+	return nil
+}
+
+func restore(
+	ctx context.Context, logger *log.Logger, cfg *epsgo.Config, src string,
+) error {
+	if cfg.PostgresDSN != "" {
+		return epsgo.ErrBackupUnsupported
+	}
+	err := epsgo.RestoreDB(
+		ctx,
+		cfg.DBOpts(),
+		src,
+		func(db sql.Database) error {
+			return walletmanager.CheckNetwork(ctx, db, cfg.Network)
+		},
+		func() error {
+			return reconcile(ctx, logger, cfg)
+		},
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	logger.Infof(
+		"database restored from %s, the previous one is at %s.old",
+		src,
+		cfg.SqliteDBPath,
+	)
+	return nil
+}
+
+// reconcile rolls the restored database back below the blocks the headers
+// file replaced since the backup was taken
+func reconcile(
+	ctx context.Context, logger *log.Logger, cfg *epsgo.Config,
+) error {
+	// the server migrates the restored database on start too
+	db, err := epsgo.OpenConfigDB(
+		ctx, logger, cfg, migrator.FlagMigrateAllowUpgrade,
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer db.Close(ctx)
+	headers, err := walletmanager.OpenHeaders(cfg.HeadersFile, cfg.Network)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer headers.Close()
+	height, err := walletmanager.Reconcile(ctx, db, headers)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if height >= 0 {
+		logger.Warnf(
+			"index rolled back to height %d, it is rescanned on start",
+			height,
+		)
+	}
+	return nil
+}
+
+func verify(
+	ctx context.Context, logger *log.Logger, cfg *epsgo.Config, repair bool,
+) error {
+	if repair {
+		unlock, err := lockDB(cfg)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		defer unlock()
+	}
+	db, err := epsgo.OpenConfigDB(ctx, logger, cfg, 0)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer db.Close(ctx)
+	headers, err := walletmanager.OpenHeaders(cfg.HeadersFile, cfg.Network)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer headers.Close()
+	r, err := walletmanager.Verify(ctx, db, headers, repair)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	for _, p := range r.Problems {
+		logger.Errf("%s", p)
+	}
+	logger.Infof(
+		"verified %d headers, %d txs, %d unspent outputs",
+		r.Headers,
+		r.Transactions,
+		r.Utxos,
+	)
+	switch {
+	case len(r.Problems) == 0:
+		return nil
+	case r.Repaired:
+		logger.Warnf(
+			"index rolled back to height %d, it is rescanned on start",
+			r.RepairHeight,
+		)
+		return nil
+	case r.RepairHeight >= 0:
+		return fmt.Errorf(
+			"%d problems found, run `eps-go verify repair`", len(r.Problems),
+		)
+	default:
+		return fmt.Errorf("%d problems found", len(r.Problems))
+	}
+}
+
+// lockDB takes the sqlite database lock, Postgres is not locked
+func lockDB(cfg *epsgo.Config) (func(), error) {
+	if cfg.PostgresDSN != "" {
+		return func() {}, nil
+	}
+	lock, err := epsgo.LockDB(cfg.DBOpts())
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return func() { lock.Unlock() }, nil
+}
+
 func getWallets() []walletmanager.WalletConfig {
 	var w []walletmanager.WalletConfig
 	for _, v := range os.Environ() {
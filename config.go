@@ -4,9 +4,13 @@ import (
 	_ "embed"
 	"fmt"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/ncodysoftware/eps-go/address"
 	"ncody.com/ncgo.git/bitcoin"
 	"ncody.com/ncgo.git/dotenv"
 	"ncody.com/ncgo.git/env"
@@ -16,14 +20,28 @@ import (
 var appName = "eps-go"
 
 type Config struct {
-	SqliteDBPath  string
-	LogLevel      string
-	MigrateFresh  string
-	BTCNodeAddr   string
-	XDGDirs       xdg.Dirs
-	ListenAddress string
-	ConfigFile    string
-	Network       bitcoin.Network
+	SqliteDBPath       string
+	SqliteJournalMode  string
+	SqliteSynchronous  string
+	SqliteCacheSize    int
+	SqliteBusyTimeout  time.Duration
+	SqliteInitialSync  bool
+	PostgresDSN        string
+	PostgresSchema     string
+	HeadersFile        string
+	LogLevel           string
+	MigrateFresh       string
+	BTCNodeAddr        string
+	BTCBlocksDir       string
+	BTCRPCURL          string
+	ScanFromFirstBlock bool
+	MaxHistory         int
+	Banner             string
+	DonationAddress    string
+	XDGDirs            xdg.Dirs
+	ListenAddress      string
+	ConfigFile         string
+	Network            bitcoin.Network
 }
 
 var (
@@ -32,6 +50,14 @@ var (
 	cfgOnce sync.Once
 )
 
+// the values of the journal_mode and synchronous pragmas
+var (
+	sqliteJournalModes = []string{
+		"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF",
+	}
+	sqliteSynchronousModes = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
 //go:embed eps-go.conf.example
 var cfgExample []byte
 
@@ -79,13 +105,86 @@ func cfgInit() {
 	if strings.HasPrefix(cfg.SqliteDBPath, cfg.XDGDirs.XDGDataHome) {
 		os.MkdirAll(cfg.XDGDirs.XDGDataHome, 0o755)
 	}
+	// sqlite ignores an unknown journal mode and reads an unknown
+	// synchronous as NORMAL
+	cfg.SqliteJournalMode = strings.ToUpper(
+		env.EnvOrDefault("SQLITE_JOURNAL_MODE", "WAL"),
+	)
+	if !slices.Contains(sqliteJournalModes, cfg.SqliteJournalMode) {
+		cfgErr = fmt.Errorf(
+			"bad SQLITE_JOURNAL_MODE: %s, one of %s",
+			cfg.SqliteJournalMode,
+			strings.Join(sqliteJournalModes, ", "),
+		)
+		return
+	}
+	cfg.SqliteSynchronous = strings.ToUpper(
+		env.EnvOrDefault("SQLITE_SYNCHRONOUS", "NORMAL"),
+	)
+	if !slices.Contains(sqliteSynchronousModes, cfg.SqliteSynchronous) {
+		cfgErr = fmt.Errorf(
+			"bad SQLITE_SYNCHRONOUS: %s, one of %s",
+			cfg.SqliteSynchronous,
+			strings.Join(sqliteSynchronousModes, ", "),
+		)
+		return
+	}
+	cfg.SqliteCacheSize, err = strconv.Atoi(
+		env.EnvOrDefault("SQLITE_CACHE_SIZE", "65536"),
+	)
+	if err != nil {
+		cfgErr = fmt.Errorf("bad SQLITE_CACHE_SIZE: %w", err)
+		return
+	}
+	busyTimeout, err := strconv.Atoi(
+		env.EnvOrDefault("SQLITE_BUSY_TIMEOUT", "5000"),
+	)
+	if err != nil {
+		cfgErr = fmt.Errorf("bad SQLITE_BUSY_TIMEOUT: %w", err)
+		return
+	}
+	cfg.SqliteBusyTimeout = time.Duration(busyTimeout) * time.Millisecond
+	cfg.SqliteInitialSync = env.Getenv("SQLITE_INITIAL_SYNC") == "1"
+	cfg.PostgresDSN = env.Getenv("POSTGRES_DSN")
+	cfg.PostgresSchema = env.EnvOrDefault(
+		"POSTGRES_SCHEMA", DefaultPostgresSchema,
+	)
+	cfg.HeadersFile = env.EnvOrDefault(
+		"HEADERS_FILE", cfg.XDGDirs.XDGDataHome+"/headers.dat",
+	)
+	if strings.HasPrefix(cfg.HeadersFile, cfg.XDGDirs.XDGDataHome) {
+		os.MkdirAll(cfg.XDGDirs.XDGDataHome, 0o755)
+	}
 	cfg.MigrateFresh = env.Getenv("MIGRATE_FRESH")
 	cfg.LogLevel = env.EnvOrDefault("LOG_LEVEL", "INFO")
 	cfg.BTCNodeAddr = env.EnvOrDefault("BTC_NODE_ADDR", "127.0.0.1:8333")
+	cfg.BTCBlocksDir = env.Getenv("BTC_BLOCKS_DIR")
+	cfg.BTCRPCURL = env.Getenv("BTC_RPC_URL")
+	cfg.ScanFromFirstBlock = env.Getenv("SCAN_FROM_FIRST_BLOCK") == "1"
+	cfg.MaxHistory, err = strconv.Atoi(
+		env.EnvOrDefault("MAX_HISTORY", "100000"),
+	)
+	if err != nil {
+		cfgErr = fmt.Errorf("bad MAX_HISTORY: %w", err)
+		return
+	}
+	cfg.Banner = strings.ReplaceAll(env.Getenv("BANNER"), `\n`, "\n")
 	cfg.ListenAddress = env.EnvOrDefault(
 		"LISTEN_ADDRESS", "127.0.0.1:50002",
 	)
 	cfg.Network = bitcoin.NetworkFromString(
 		env.EnvOrDefault("BTC_NETWORK", "mainnet"),
 	)
+	cfg.DonationAddress = env.Getenv("DONATION_ADDRESS")
+	if cfg.DonationAddress != "" {
+		_, err = address.ToScriptPubkey(cfg.DonationAddress, cfg.Network)
+		if err != nil {
+			cfgErr = fmt.Errorf(
+				"bad DONATION_ADDRESS for %s: %w",
+				env.EnvOrDefault("BTC_NETWORK", "mainnet"),
+				err,
+			)
+			return
+		}
+	}
 }
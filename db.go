@@ -2,8 +2,19 @@ package epsgo
 
 import (
 	"context"
+	sqlp "database/sql"
+	"database/sql/driver"
 	"embed"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sync/atomic"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	msqlite "modernc.org/sqlite"
 	"ncody.com/ncgo.git/database/sql"
 	"ncody.com/ncgo.git/database/sql/migrator"
 	"ncody.com/ncgo.git/database/sql/sqlite"
@@ -14,6 +25,19 @@ import (
 //go:embed migrations
 var migrations embed.FS
 
+//go:embed migrations_postgres
+var migrationsPostgres embed.FS
+
+// DefaultPostgresSchema holds the tables when POSTGRES_SCHEMA is not set,
+// the instance may be shared with other services
+const DefaultPostgresSchema = "eps_go"
+
+// postgresSchemaName is the schema names accepted, they are put in the
+// queries unquoted
+var postgresSchemaName = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+const maxIdleConns = 2
+
 func must(err error) {
 	if err == nil {
 		return
@@ -21,24 +45,66 @@ func must(err error) {
 	panic(err)
 }
 
+// DBOpts are the sqlite settings, zero values keep the sqlite defaults
+type DBOpts struct {
+	Path string
+	// JournalMode is the journal_mode pragma, e.g. WAL
+	JournalMode string
+	// Synchronous is the synchronous pragma used once the index is at
+	// the tip, e.g. NORMAL
+	Synchronous string
+	// CacheSize is the page cache size in KiB
+	CacheSize int
+	// BusyTimeout is how long a connection waits for a lock
+	BusyTimeout time.Duration
+	// InitialSync turns synchronous off while the index catches up, see
+	// DB.SetInitialSync
+	InitialSync bool
+}
+
+func (c *Config) DBOpts() DBOpts {
+	return DBOpts{
+		Path:        c.SqliteDBPath,
+		JournalMode: c.SqliteJournalMode,
+		Synchronous: c.SqliteSynchronous,
+		CacheSize:   c.SqliteCacheSize,
+		BusyTimeout: c.SqliteBusyTimeout,
+		InitialSync: c.SqliteInitialSync,
+	}
+}
+
 func MustOpenDB(ctx context.Context, log *log.Logger, cfg Config) sql.Database {
-	dbFilePath := cfg.XDGDirs.XDGDataHome + "/db.sqlite3"
 	var flag uint64
 	flag = migrator.FlagMigrateAllowUpgrade
 	if cfg.MigrateFresh == "1" {
 		flag |= migrator.FlagMigrateFresh
 	}
-	db, err := OpenDB(ctx, log, dbFilePath, flag)
+	db, err := OpenConfigDB(ctx, log, &cfg, flag)
 	must(err)
 	return db
 }
 
+// OpenConfigDB opens Postgres when cfg.PostgresDSN is set, sqlite otherwise
+func OpenConfigDB(
+	ctx context.Context,
+	log *log.Logger,
+	cfg *Config,
+	migratorFlag uint64,
+) (*DB, error) {
+	if cfg.PostgresDSN != "" {
+		return OpenPostgresDB(
+			ctx, log, cfg.PostgresDSN, cfg.PostgresSchema, migratorFlag,
+		)
+	}
+	return OpenDB(ctx, log, cfg.DBOpts(), migratorFlag)
+}
+
 func OpenDB(
 	ctx context.Context,
 	log *log.Logger,
-	dbFilePath string,
+	opts DBOpts,
 	migratorFlag uint64,
-) (sql.Database, error) {
+) (*DB, error) {
 	var (
 		m migrator.Migrations
 	)
@@ -46,7 +112,7 @@ func OpenDB(
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
-	mg := migrator.NewSqlite(dbFilePath, m, migratorFlag)
+	mg := migrator.NewSqlite(opts.Path, m, migratorFlag)
 	count, err := mg.Migrate(ctx)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
@@ -54,9 +120,256 @@ func OpenDB(
 	if count != 0 {
 		log.Infof("%d migrations executed", count)
 	}
-	db, err := sqlite.New(dbFilePath)
+	d := &DB{opts: opts}
+	d.inner = sqlp.OpenDB(connector{d})
+	d.inner.SetMaxIdleConns(maxIdleConns)
+	err = d.inner.PingContext(ctx)
+	if err != nil {
+		d.inner.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	return d, nil
+}
+
+// OpenPostgresDB opens the database at dsn with the tables in schema,
+// DefaultPostgresSchema when empty. schema is the search_path of every
+// connection and is created when missing. migrator.FlagMigrateFresh drops
+// it and is refused for the public schema, which other services may use.
+func OpenPostgresDB(
+	ctx context.Context,
+	log *log.Logger,
+	dsn string,
+	schema string,
+	migratorFlag uint64,
+) (*DB, error) {
+	if schema == "" {
+		schema = DefaultPostgresSchema
+	}
+	if !postgresSchemaName.MatchString(schema) {
+		return nil, fmt.Errorf("bad postgres schema name: %q", schema)
+	}
+	fresh := migratorFlag&migrator.FlagMigrateFresh != 0
+	if fresh && schema == "public" {
+		return nil, fmt.Errorf(
+			"refusing to drop the public postgres schema, set POSTGRES_SCHEMA",
+		)
+	}
+	var (
+		m migrator.Migrations
+	)
+	err := m.LoadFromEmbedFS(migrationsPostgres, "migrations_postgres")
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	cfg, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	cfg.RuntimeParams["search_path"] = schema
+	d := &DB{postgres: true}
+	d.inner = stdlib.OpenDB(*cfg)
+	err = d.inner.PingContext(ctx)
+	if err != nil {
+		d.inner.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	// the migrator fresh flag also grants the schema to a role of its
+	// name, the schema is dropped here instead
+	s := `CREATE SCHEMA IF NOT EXISTS ` + schema
+	if fresh {
+		s = `DROP SCHEMA IF EXISTS ` + schema + ` CASCADE; ` +
+			`CREATE SCHEMA ` + schema
+		migratorFlag &^= migrator.FlagMigrateFresh
+	}
+	_, err = d.inner.ExecContext(ctx, s)
 	if err != nil {
+		d.inner.Close()
 		return nil, stackerr.Wrap(err)
 	}
-	return db, nil
+	count, err := migrator.NewPostgres(d, m, schema, migratorFlag).
+		Migrate(ctx)
+	if err != nil {
+		d.inner.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	if count != 0 {
+		log.Infof("%d migrations executed", count)
+	}
+	return d, nil
+}
+
+// DB is the sqlite or Postgres database. With sqlite the pragmas of DBOpts
+// are applied to every connection of the pool.
+type DB struct {
+	inner       *sqlp.DB
+	opts        DBOpts
+	initialSync atomic.Bool
+	postgres    bool
+}
+
+// SetInitialSync relaxes durability while the index catches up with the
+// node and restores it at the tip. A process crash while on is safe, a
+// power loss may corrupt the database. It is a no-op unless
+// DBOpts.InitialSync is set. The connections in use switch when they are
+// next taken from the pool.
+func (d *DB) SetInitialSync(on bool) {
+	if !d.opts.InitialSync {
+		return
+	}
+	d.initialSync.Store(on)
+}
+
+// synchronous returns the synchronous pragma of the connections, empty
+// keeps the sqlite default
+func (d *DB) synchronous() string {
+	switch {
+	case d.initialSync.Load():
+		return "OFF"
+	case d.opts.Synchronous != "":
+		return d.opts.Synchronous
+	case d.opts.InitialSync:
+		// the sqlite default, set back after the initial sync
+		return "FULL"
+	}
+	return ""
+}
+
+func (d *DB) dsn(synchronous string) string {
+	q := url.Values{}
+	q.Add("_pragma", "foreign_keys(1)")
+	if d.opts.BusyTimeout > 0 {
+		q.Add("_pragma", fmt.Sprintf(
+			"busy_timeout(%d)", d.opts.BusyTimeout/time.Millisecond,
+		))
+	}
+	if d.opts.JournalMode != "" {
+		q.Add("_pragma", fmt.Sprintf("journal_mode(%s)", d.opts.JournalMode))
+	}
+	if d.opts.CacheSize > 0 {
+		// negative values are KiB
+		q.Add("_pragma", fmt.Sprintf("cache_size(-%d)", d.opts.CacheSize))
+	}
+	if synchronous != "" {
+		q.Add("_pragma", fmt.Sprintf("synchronous(%s)", synchronous))
+	}
+	return "file:" + d.opts.Path + "?" + q.Encode()
+}
+
+// connector opens the connections with the pragmas of DBOpts
+type connector struct {
+	d *DB
+}
+
+func (c connector) Connect(ctx context.Context) (driver.Conn, error) {
+	synchronous := c.d.synchronous()
+	dc, err := c.Driver().Open(c.d.dsn(synchronous))
+	if err != nil {
+		return nil, err
+	}
+	sc, ok := dc.(sqliteConn)
+	if !ok {
+		dc.Close()
+		return nil, fmt.Errorf("unexpected sqlite connection %T", dc)
+	}
+	return &conn{sqliteConn: sc, d: c.d, synchronous: synchronous}, nil
+}
+
+func (c connector) Driver() driver.Driver {
+	return &msqlite.Driver{}
+}
+
+// sqliteConn are the interfaces of the sqlite driver connections
+type sqliteConn interface {
+	driver.Conn
+	driver.ConnBeginTx
+	driver.ConnPrepareContext
+	driver.ExecerContext
+	driver.QueryerContext
+	driver.Pinger
+	driver.SessionResetter
+	driver.Validator
+}
+
+// conn follows the synchronous pragma of SetInitialSync, it is applied
+// when the connection is taken from the pool
+type conn struct {
+	sqliteConn
+	d           *DB
+	synchronous string
+}
+
+func (c *conn) ResetSession(ctx context.Context) error {
+	err := c.sqliteConn.ResetSession(ctx)
+	if err != nil {
+		return err
+	}
+	synchronous := c.d.synchronous()
+	if synchronous == c.synchronous {
+		return nil
+	}
+	_, err = c.ExecContext(ctx, "PRAGMA synchronous = "+synchronous, nil)
+	if err != nil {
+		return err
+	}
+	c.synchronous = synchronous
+	return nil
+}
+
+func (d *DB) Close(ctx context.Context) error {
+	_ = ctx
+	return d.inner.Close()
+}
+
+func (d *DB) QueryRow(
+	ctx context.Context, query string, args ...any,
+) sql.Row {
+	return sqliteRow{d.inner.QueryRowContext(ctx, query, args...)}
+}
+
+func (d *DB) Query(
+	ctx context.Context, query string, args ...any,
+) (sql.Rows, error) {
+	rows, err := d.inner.QueryContext(ctx, query, args...)
+	if err != nil && errors.Is(err, sqlp.ErrNoRows) {
+		return nil, sql.ErrNoRows
+	}
+	return rows, err
+}
+
+func (d *DB) Exec(
+	ctx context.Context, query string, args ...any,
+) (int64, error) {
+	r, err := d.inner.ExecContext(ctx, query, args...)
+	if err != nil && errors.Is(err, sqlp.ErrNoRows) {
+		return 0, sql.ErrNoRows
+	}
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// Commit is no-op outside a transaction
+func (d *DB) Commit(ctx context.Context) error {
+	return nil
+}
+
+func (d *DB) Begin(ctx context.Context) (sql.Transaction, error) {
+	tx, err := d.inner.BeginTx(ctx, &sqlp.TxOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return sqlite.SqliteTx{Tx: tx}, nil
+}
+
+type sqliteRow struct {
+	*sqlp.Row
+}
+
+func (s sqliteRow) Scan(dest ...any) error {
+	err := s.Row.Scan(dest...)
+	if err != nil && errors.Is(err, sqlp.ErrNoRows) {
+		return sql.ErrNoRows
+	}
+	return err
 }
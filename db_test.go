@@ -0,0 +1,235 @@
+package epsgo
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/database/sql/migrator"
+	"ncody.com/ncgo.git/database/sql/sqlite"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestMigrateDeduplicates(t *testing.T) {
+	ctx := t.Context()
+	path := filepath.Join(t.TempDir(), "db.sqlite3")
+	var m migrator.Migrations
+	err := m.LoadFromEmbedFS(migrations, "migrations")
+	assert.Must(t, err)
+	// database created before the index migration
+	_, err = migrator.NewSqlite(path, m[:2], 0).Migrate(ctx)
+	assert.Must(t, err)
+	db, err := sqlite.New(path)
+	assert.Must(t, err)
+	// the header 02 went stale in a reorg, 03 links to the tip 04
+	_, err = db.Exec(ctx, `
+	INSERT INTO blockheader
+	(hash, height, serialized)
+	VALUES
+	(x'01', 1, x'0000000000'),
+	(x'02', 2, x'0000000001'),
+	(x'03', 2, x'0000000001'),
+	(x'04', 3, x'0000000003');
+	--
+	INSERT INTO scriptpubkey_tx
+	(scriptpubkey_hash, txid)
+	VALUES
+	(x'aa', x'01'), (x'aa', x'01'), (x'aa', x'02');
+	--
+	INSERT INTO tx
+	(txid, blockhash, pos, serialized, merkle_proof)
+	VALUES
+	(x'01', x'01', 1, x'00', x''), (x'02', x'02', 1, x'00', x'');
+	--
+	INSERT INTO spent_output
+	(txid_vout, satoshi, scriptpubkey_hash, spent_height)
+	VALUES
+	(x'01', 1, x'aa', 2);
+	--
+	INSERT INTO wallet
+	(hash, height, next_receive_index, next_change_index)
+	VALUES
+	(x'ff', 3, 0, 0);
+	`)
+	assert.Must(t, err)
+	db.Close(ctx)
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	d, err := OpenDB(
+		ctx, l, DBOpts{Path: path}, migrator.FlagMigrateAllowUpgrade,
+	)
+	assert.Must(t, err)
+	defer d.Close(ctx)
+	count := func(q string) int {
+		var n int
+		err := d.QueryRow(ctx, q).Scan(&n)
+		assert.Must(t, err)
+		return n
+	}
+	var hash []byte
+	err = d.QueryRow(
+		ctx, `SELECT hash FROM blockheader WHERE height = 2`,
+	).Scan(&hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, []byte{3}, hash)
+	// the index from the first duplicated height is scanned again
+	assert.MustEqual(t, 1, count(`SELECT COUNT(*) FROM scriptpubkey_tx`))
+	assert.MustEqual(t, 1, count(`SELECT COUNT(*) FROM tx`))
+	assert.MustEqual(t, 1, count(`SELECT COUNT(*) FROM unspent_output`))
+	assert.MustEqual(t, 0, count(`SELECT COUNT(*) FROM spent_output`))
+	assert.MustEqual(t, 1, count(`SELECT height FROM wallet`))
+	// the new keys reject duplicates
+	_, err = d.Exec(
+		ctx,
+		`INSERT INTO scriptpubkey_tx (scriptpubkey_hash, txid)
+		VALUES (x'aa', x'01')`,
+	)
+	assert.MustEqual(t, true, err != nil)
+}
+
+func TestDBPragmas(t *testing.T) {
+	ctx := t.Context()
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	d, err := OpenDB(
+		ctx,
+		l,
+		DBOpts{
+			Path:        filepath.Join(t.TempDir(), "db.sqlite3"),
+			JournalMode: "WAL",
+			Synchronous: "NORMAL",
+			CacheSize:   1024,
+			BusyTimeout: time.Second,
+			InitialSync: true,
+		},
+		migrator.FlagMigrateFresh,
+	)
+	assert.Must(t, err)
+	defer d.Close(ctx)
+	tAssertPragma(t, d, "journal_mode", "wal")
+	tAssertPragma(t, d, "synchronous", "1")
+	tAssertPragma(t, d, "cache_size", "-1024")
+	tAssertPragma(t, d, "busy_timeout", "1000")
+	d.SetInitialSync(true)
+	tAssertPragma(t, d, "synchronous", "0")
+	d.SetInitialSync(false)
+	tAssertPragma(t, d, "synchronous", "1")
+	// a connection in use at the switch follows on its next use
+	d.SetInitialSync(true)
+	d.inner.SetMaxOpenConns(1)
+	tx, err := d.Begin(ctx)
+	assert.Must(t, err)
+	d.SetInitialSync(false)
+	var v string
+	assert.Must(t, tx.QueryRow(ctx, "PRAGMA synchronous").Scan(&v))
+	assert.MustEqual(t, "0", v)
+	assert.Must(t, tx.Commit(ctx))
+	tAssertPragma(t, d, "synchronous", "1")
+}
+
+func tAssertPragma(t *testing.T, d *DB, pragma, expect string) {
+	var v string
+	err := d.QueryRow(t.Context(), "PRAGMA "+pragma).Scan(&v)
+	assert.Must(t, err)
+	assert.MustEqual(t, expect, v)
+}
+
+func TestPostgresSchema(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	// both are refused before connecting
+	dsn := "postgres://eps@127.0.0.1:1/eps"
+	_, err := OpenPostgresDB(
+		t.Context(), l, dsn, "public", migrator.FlagMigrateFresh,
+	)
+	assert.MustEqual(t, true, err != nil)
+	assert.MustEqual(t, true, strings.Contains(err.Error(), "public"))
+	_, err = OpenPostgresDB(t.Context(), l, dsn, "eps; DROP", 0)
+	assert.MustEqual(t, true, err != nil)
+	assert.MustEqual(t, true, strings.Contains(err.Error(), "schema name"))
+}
+
+func TestBackupRestore(t *testing.T) {
+	ctx := t.Context()
+	dir := t.TempDir()
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	opts := DBOpts{Path: filepath.Join(dir, "db.sqlite3"), JournalMode: "WAL"}
+	d, err := OpenDB(ctx, l, opts, migrator.FlagMigrateFresh)
+	assert.Must(t, err)
+	_, err = d.Exec(ctx, `
+	INSERT INTO blockheader
+	(hash, height, serialized)
+	VALUES
+	(x'01', 1, x'00');
+	`)
+	assert.Must(t, err)
+	backup := filepath.Join(dir, "backup.sqlite3")
+	assert.Must(t, d.Backup(ctx, backup))
+	assert.MustEqual(t, true, d.Backup(ctx, backup) != nil)
+	_, err = d.Exec(ctx, `DELETE FROM blockheader`)
+	assert.Must(t, err)
+	d.Close(ctx)
+	// the lock of a running server blocks the restore
+	lock, err := LockDB(opts)
+	assert.Must(t, err)
+	err = RestoreDB(ctx, opts, backup, func(sql.Database) error {
+		return nil
+	}, tNoReconcile)
+	assert.MustEqual(t, true, errors.Is(err, ErrDBInUse))
+	assert.Must(t, lock.Unlock())
+	// a rejected backup leaves the database in place
+	errCheck := errors.New("other network")
+	err = RestoreDB(ctx, opts, backup, func(sql.Database) error {
+		return errCheck
+	}, tNoReconcile)
+	assert.MustEqual(t, true, errors.Is(err, errCheck))
+	assert.MustEqual(t, 0, tCountHeaders(t, opts))
+	var reconciled bool
+	err = RestoreDB(
+		ctx,
+		opts,
+		backup,
+		func(sql.Database) error { return nil },
+		func() error {
+			// the lock is still held
+			_, err := LockDB(opts)
+			assert.MustEqual(t, true, errors.Is(err, ErrDBInUse))
+			reconciled = true
+			return nil
+		},
+	)
+	assert.Must(t, err)
+	assert.MustEqual(t, true, reconciled)
+	assert.MustEqual(t, 1, tCountHeaders(t, opts))
+	_, err = os.Stat(opts.Path + ".old")
+	assert.Must(t, err)
+	// a backup from a newer build is rejected
+	db, err := sqlite.New(backup)
+	assert.Must(t, err)
+	_, err = db.Exec(
+		ctx, `INSERT INTO migration (version, hash) VALUES (99, x'00')`,
+	)
+	assert.Must(t, err)
+	db.Close(ctx)
+	err = RestoreDB(ctx, opts, backup, func(sql.Database) error {
+		return nil
+	}, tNoReconcile)
+	assert.MustEqual(t, true, err != nil)
+}
+
+func tNoReconcile() error {
+	return nil
+}
+
+func tCountHeaders(t *testing.T, opts DBOpts) int {
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	d, err := OpenDB(t.Context(), l, opts, 0)
+	assert.Must(t, err)
+	defer d.Close(t.Context())
+	var n int
+	err = d.QueryRow(t.Context(), `SELECT COUNT(*) FROM blockheader`).Scan(&n)
+	assert.Must(t, err)
+	return n
+}
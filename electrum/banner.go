@@ -0,0 +1,102 @@
+package electrum
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+const defaultBanner = "eps-go $VERSION"
+
+// banner fills the banner template with the server figures
+func (m *mux) banner(ctx context.Context) string {
+	st := m.w.GetStats()
+	var mempoolTxs string
+	if strings.Contains(m.opts.Banner, "$MEMPOOL_TXS") {
+		mempoolTxs = m.mempoolTxs(ctx)
+	}
+	r := strings.NewReplacer(
+		"$VERSION", version(),
+		"$NETWORK", networkName(m.w.Network()),
+		"$TIP_HEIGHT", strconv.Itoa(st.TipHeight),
+		"$SYNC_PROGRESS", fmt.Sprintf("%.2f%%", st.Progress()),
+		"$WALLETS", strconv.Itoa(st.Wallets),
+		"$MEMPOOL_TXS", mempoolTxs,
+		"$UPTIME", time.Since(m.started).Truncate(time.Second).String(),
+		"$DONATION_ADDRESS", m.opts.DonationAddress,
+	)
+	return r.Replace(m.opts.Banner)
+}
+
+const (
+	// the mempool size is asked to the node at most once per
+	// mempoolCacheTime, a banner request waits at most mempoolTimeout
+	mempoolCacheTime = 10 * time.Second
+	mempoolTimeout   = 2 * time.Second
+)
+
+// mempoolCache keeps the last mempool size read for the banner
+type mempoolCache struct {
+	mu  sync.Mutex
+	at  time.Time
+	txs string
+}
+
+// mempoolTxs returns the mempool size, empty without the node rpc or when
+// the last read failed
+func (m *mux) mempoolTxs(ctx context.Context) string {
+	c := &m.mempool
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.at.IsZero() && time.Since(c.at) < mempoolCacheTime {
+		return c.txs
+	}
+	ctx, cancel := context.WithTimeout(ctx, mempoolTimeout)
+	defer cancel()
+	c.txs = ""
+	c.at = time.Now()
+	n, err := m.w.MempoolSize(ctx)
+	if err != nil {
+		m.log.Warnf("banner mempool size: %v", stackerr.Wrap(err))
+		return c.txs
+	}
+	if n >= 0 {
+		c.txs = strconv.Itoa(n)
+	}
+	return c.txs
+}
+
+// version returns the module version of the binary, the vcs revision for
+// builds from a checkout
+func version() string {
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	if bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+		return bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+			return s.Value[:12]
+		}
+	}
+	return "devel"
+}
+
+func networkName(net bitcoin.Network) string {
+	switch net {
+	case bitcoin.Mainnet:
+		return "mainnet"
+	case bitcoin.Testnet:
+		return "testnet"
+	}
+	return "regtest"
+}
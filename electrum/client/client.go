@@ -0,0 +1,457 @@
+// Package client is a Go client of the Electrum protocol served by eps-go.
+// The subscriptions are delivered on channels and survive the reconnections.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ncodysoftware/eps-go/jsonrpc"
+	"ncody.com/ncgo.git/log"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+const (
+	// the protocol range asked to the server, the outpoint subscriptions
+	// need 1.6
+	protocolMin           = "1.4"
+	protocolMax           = "1.6"
+	defaultReconnectDelay = time.Second * 5
+)
+
+// ErrNotConnected is returned by the requests while the connection is
+// down, the client reconnects in the background
+var ErrNotConnected = errors.New("electrum client not connected")
+
+// Error is an error answered by the server
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("electrum error %d: %s", e.Code, e.Message)
+}
+
+type Opts struct {
+	// TLS connects over TLS
+	TLS bool
+	// TLSConfig is the TLS configuration, nil verifies the server against
+	// the system roots
+	TLSConfig *tls.Config
+	// Name is the client name sent with server.version
+	Name string
+	// ReconnectDelay is the wait between the reconnection attempts, zero
+	// waits 5 seconds
+	ReconnectDelay time.Duration
+}
+
+// statusSub is a scripthash or address subscription, name is the param
+type statusSub struct {
+	method string
+	name   string
+}
+
+type Client struct {
+	log    *log.Logger
+	addr   string
+	opts   Opts
+	cancel func()
+	done   chan struct{}
+	// the server answers in order, mu serializes the requests
+	mu      sync.Mutex
+	conn    *jsonrpc.Client
+	id      uint64
+	version ServerVersion
+	// subMu guards the subscriptions and is held while notifying
+	subMu      sync.Mutex
+	closed     bool
+	hSubs      []chan HeaderTip
+	statusSubs map[statusSub]chan string
+	opSubs     map[Outpoint]chan OutpointStatus
+}
+
+// New connects to the server at addr and negotiates the protocol version
+func New(
+	ctx context.Context, log *log.Logger, addr string, opts Opts,
+) (*Client, error) {
+	if opts.Name == "" {
+		opts.Name = "eps-go client"
+	}
+	if opts.ReconnectDelay == 0 {
+		opts.ReconnectDelay = defaultReconnectDelay
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	c := &Client{
+		log:        log,
+		addr:       addr,
+		opts:       opts,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+		statusSubs: make(map[statusSub]chan string),
+		opSubs:     make(map[Outpoint]chan OutpointStatus),
+	}
+	err := c.connect(ctx)
+	if err != nil {
+		cancel()
+		return nil, stackerr.Wrap(err)
+	}
+	go func() {
+		defer close(c.done)
+		c.run(ctx)
+	}()
+	return c, nil
+}
+
+// Close disconnects and closes the subscription channels
+func (c *Client) Close(ctx context.Context) error {
+	c.cancel()
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		return fmt.Errorf("electrum client stop timeout reached")
+	}
+	c.mu.Lock()
+	conn := c.conn
+	c.conn = nil
+	c.mu.Unlock()
+	if conn != nil {
+		err := conn.Close(ctx)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	c.closed = true
+	for _, s := range c.hSubs {
+		close(s)
+	}
+	for _, s := range c.statusSubs {
+		close(s)
+	}
+	for _, s := range c.opSubs {
+		close(s)
+	}
+	c.hSubs = nil
+	clear(c.statusSubs)
+	clear(c.opSubs)
+	return nil
+}
+
+// ServerVersion returns the server software and protocol version of the
+// last connection
+func (c *Client) ServerVersion() ServerVersion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+// run reconnects when the connection is lost
+func (c *Client) run(ctx context.Context) {
+	for {
+		c.mu.Lock()
+		lost := c.conn.Done()
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-lost:
+		}
+		c.log.Warnf("electrum connection to %s lost, reconnecting", c.addr)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.opts.ReconnectDelay):
+			}
+			c.mu.Lock()
+			err := c.connect(ctx)
+			c.mu.Unlock()
+			if err == nil {
+				break
+			}
+			c.log.Err(stackerr.Wrap(err))
+		}
+	}
+}
+
+// connect dials the server, negotiates the protocol version and subscribes
+// again to the subscriptions of a lost connection. c.mu must be held once
+// the client runs.
+func (c *Client) connect(ctx context.Context) error {
+	opts := jsonrpc.ClientOpts{
+		NHandler:  c.onNotification,
+		TLSConfig: c.opts.TLSConfig,
+	}
+	if c.opts.TLS {
+		opts.Flags = jsonrpc.TLS
+	}
+	conn, err := jsonrpc.NewClient(ctx, c.log, c.addr, opts)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	c.conn = conn
+	err = c.handshake(ctx)
+	if err != nil {
+		c.conn = nil
+		conn.Close(ctx)
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (c *Client) handshake(ctx context.Context) error {
+	var version [2]string
+	err := c.send(
+		ctx,
+		"server.version",
+		[]any{c.opts.Name, []string{protocolMin, protocolMax}},
+		&version,
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	c.version = ServerVersion{Software: version[0], Protocol: version[1]}
+	return c.resubscribe(ctx)
+}
+
+// resubscribe subscribes the new connection and sends the current states on
+// the channels. The subscriptions the server refuses are dropped from the
+// connection but keep their channels.
+func (c *Client) resubscribe(ctx context.Context) error {
+	c.subMu.Lock()
+	headers := len(c.hSubs) > 0
+	statusSubs := make([]statusSub, 0, len(c.statusSubs))
+	for s := range c.statusSubs {
+		statusSubs = append(statusSubs, s)
+	}
+	outpoints := make([]Outpoint, 0, len(c.opSubs))
+	for op := range c.opSubs {
+		outpoints = append(outpoints, op)
+	}
+	c.subMu.Unlock()
+	// the notifications of the new connection wait for subMu, it is not
+	// held across the requests
+	refused := func(err error) bool {
+		var rpcErr *Error
+		if !errors.As(err, &rpcErr) {
+			return false
+		}
+		c.log.Err(stackerr.Wrap(err))
+		return true
+	}
+	if headers {
+		var r headerTipResult
+		err := c.send(ctx, "blockchain.headers.subscribe", nil, &r)
+		if err != nil && !refused(err) {
+			return stackerr.Wrap(err)
+		}
+		if err == nil {
+			tip, err := r.decode()
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			c.subMu.Lock()
+			for _, s := range c.hSubs {
+				sendLatest(s, tip)
+			}
+			c.subMu.Unlock()
+		}
+	}
+	for _, s := range statusSubs {
+		var status *string
+		err := c.send(ctx, s.method, []any{s.name}, &status)
+		if err != nil && refused(err) {
+			continue
+		}
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		c.subMu.Lock()
+		if ch, ok := c.statusSubs[s]; ok {
+			sendLatest(ch, derefStatus(status))
+		}
+		c.subMu.Unlock()
+	}
+	for _, op := range outpoints {
+		var r outpointStatusResult
+		err := c.send(
+			ctx,
+			"blockchain.outpoint.subscribe",
+			[]any{op.Txid, op.Vout},
+			&r,
+		)
+		if err != nil && refused(err) {
+			continue
+		}
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		c.subMu.Lock()
+		if ch, ok := c.opSubs[op]; ok {
+			sendLatest(ch, r.decode())
+		}
+		c.subMu.Unlock()
+	}
+	return nil
+}
+
+// call sends a request and decodes its result into result
+func (c *Client) call(
+	ctx context.Context, method string, params []any, result any,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	err := c.send(ctx, method, params, result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// send is call with c.mu held
+func (c *Client) send(
+	ctx context.Context, method string, params []any, result any,
+) error {
+	conn := c.conn
+	if conn == nil {
+		return ErrNotConnected
+	}
+	select {
+	case <-conn.Done():
+		return ErrNotConnected
+	default:
+	}
+	if params == nil {
+		params = []any{}
+	}
+	rawParams, err := json.Marshal(params)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	rawMethod, err := json.Marshal(method)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	c.id++
+	// the answer of an abandoned request would be read as the answer of
+	// the next one, the connection is dropped instead
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close(context.Background())
+	})
+	res, err := conn.Send(jsonrpc.Request{
+		JsonRPC: []byte(`"2.0"`),
+		Id:      strconv.AppendUint(nil, c.id, 10),
+		Method:  rawMethod,
+		Params:  rawParams,
+	})
+	stop()
+	if err != nil && ctx.Err() != nil {
+		return stackerr.Wrap(ctx.Err())
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrNotConnected, err)
+	}
+	if len(res.Error) > 0 && !bytes.Equal(res.Error, []byte(`null`)) {
+		var rpcErr Error
+		err = json.Unmarshal(res.Error, &rpcErr)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		return &rpcErr
+	}
+	if result == nil {
+		return nil
+	}
+	err = json.Unmarshal(res.Result, result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (c *Client) onNotification(n *jsonrpc.Notification) {
+	var method string
+	err := json.Unmarshal(n.Method, &method)
+	if err != nil {
+		c.log.Err(stackerr.Wrap(err))
+		return
+	}
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if c.closed {
+		return
+	}
+	switch method {
+	case "blockchain.headers.subscribe":
+		var params [1]headerTipResult
+		err = json.Unmarshal(n.Params, &params)
+		if err != nil {
+			break
+		}
+		var tip HeaderTip
+		tip, err = params[0].decode()
+		if err != nil {
+			break
+		}
+		for _, s := range c.hSubs {
+			sendLatest(s, tip)
+		}
+	case "blockchain.scripthash.subscribe", "blockchain.address.subscribe":
+		var (
+			name   string
+			status *string
+		)
+		params := []any{&name, &status}
+		err = json.Unmarshal(n.Params, &params)
+		if err != nil {
+			break
+		}
+		if s, ok := c.statusSubs[statusSub{method, name}]; ok {
+			sendLatest(s, derefStatus(status))
+		}
+	case "blockchain.outpoint.subscribe":
+		var (
+			op Outpoint
+			r  outpointStatusResult
+		)
+		params := []any{&[]any{&op.Txid, &op.Vout}, &r}
+		err = json.Unmarshal(n.Params, &params)
+		if err != nil {
+			break
+		}
+		if s, ok := c.opSubs[op]; ok {
+			sendLatest(s, r.decode())
+		}
+	default:
+		c.log.Debugf("unexpected notification: %s", n)
+	}
+	if err != nil {
+		c.log.Err(fmt.Errorf("bad %s notification: %w", method, err))
+	}
+}
+
+// sendLatest replaces the unread value of s, the subscriptions only keep the
+// latest state. The senders hold subMu.
+func sendLatest[T any](s chan T, v T) {
+	select {
+	case <-s:
+	default:
+	}
+	s <- v
+}
+
+func derefStatus(status *string) string {
+	if status == nil {
+		return ""
+	}
+	return *status
+}
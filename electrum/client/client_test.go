@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ncodysoftware/eps-go/headerstore"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/log"
+)
+
+// fakeServer answers each method with a fixed result, the methods missing
+// from results get an error
+type fakeServer struct {
+	l       net.Listener
+	mu      sync.Mutex
+	results map[string]string
+	conns   map[net.Conn]*sync.Mutex
+}
+
+func newFakeServer(t *testing.T, results map[string]string) *fakeServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Must(t, err)
+	s := &fakeServer{
+		l:       l,
+		results: results,
+		conns:   make(map[net.Conn]*sync.Mutex),
+	}
+	t.Cleanup(func() {
+		l.Close()
+		s.drop()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = &sync.Mutex{}
+			s.mu.Unlock()
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn) {
+	dec := json.NewDecoder(conn)
+	for {
+		var req struct {
+			Id     json.RawMessage `json:"id"`
+			Method string          `json:"method"`
+		}
+		if dec.Decode(&req) != nil {
+			return
+		}
+		s.mu.Lock()
+		result, ok := s.results[req.Method]
+		s.mu.Unlock()
+		res := fmt.Sprintf(
+			`{"jsonrpc":"2.0","id":%s,"result":%s}`, req.Id, result,
+		)
+		if !ok {
+			res = fmt.Sprintf(
+				`{"jsonrpc":"2.0","id":%s,"error":`+
+					`{"code":1,"message":"%s"}}`,
+				req.Id, req.Method,
+			)
+		}
+		s.write(conn, res)
+	}
+}
+
+func (s *fakeServer) write(conn net.Conn, msg string) {
+	s.mu.Lock()
+	wmu := s.conns[conn]
+	s.mu.Unlock()
+	wmu.Lock()
+	defer wmu.Unlock()
+	conn.Write([]byte(msg + "\n"))
+}
+
+func (s *fakeServer) setResult(method, result string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.results[method] = result
+}
+
+func (s *fakeServer) notify(method, params string) {
+	s.mu.Lock()
+	conns := make([]net.Conn, 0, len(s.conns))
+	for conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		s.write(conn, fmt.Sprintf(
+			`{"jsonrpc":"2.0","method":"%s","params":%s}`, method, params,
+		))
+	}
+}
+
+// drop closes the connections
+func (s *fakeServer) drop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	clear(s.conns)
+}
+
+func testClient(t *testing.T, s *fakeServer) *Client {
+	c, err := New(
+		t.Context(),
+		log.New(log.LevelFromString("error"), "eps-go"),
+		s.l.Addr().String(),
+		Opts{ReconnectDelay: time.Millisecond * 10},
+	)
+	assert.Must(t, err)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(
+			context.Background(), time.Second,
+		)
+		defer cancel()
+		assert.Must(t, c.Close(ctx))
+	})
+	return c
+}
+
+func TestClient(t *testing.T) {
+	ctx := t.Context()
+	header := [80]byte{1, 2, 3}
+	txid := Hash{0xaa}
+	s := newFakeServer(t, map[string]string{
+		"server.version":          `["eps-go", "1.4"]`,
+		"blockchain.block.header": fmt.Sprintf(`"%x"`, header),
+		"blockchain.scripthash.get_balance": `{"confirmed":5,` +
+			`"unconfirmed":-2}`,
+		"blockchain.scripthash.listunspent": fmt.Sprintf(
+			`[{"tx_hash":"%s","tx_pos":1,"height":10,"value":7}]`, txid,
+		),
+		"blockchain.outpoint.get_status": fmt.Sprintf(
+			`{"height":10,"spender_txhash":"%s","spender_height":11}`, txid,
+		),
+	})
+	c := testClient(t, s)
+	assert.MustEqual(t, ServerVersion{"eps-go", "1.4"}, c.ServerVersion())
+	got, err := c.BlockHeader(ctx, 1)
+	assert.Must(t, err)
+	assert.MustEqual(t, header, got)
+	sh := ScriptHash([]byte{0x51})
+	b, err := c.ScriptHashGetBalance(ctx, sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, Balance{5, -2}, b)
+	utxos, err := c.ScriptHashListUnspent(ctx, sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, []Unspent{{txid, 1, 10, 7}}, utxos)
+	status, err := c.OutpointGetStatus(ctx, Outpoint{txid, 1})
+	assert.Must(t, err)
+	assert.MustEqual(t, OutpointStatus{true, 10, true, txid, 11}, status)
+	_, err = c.TransactionBroadcast(ctx, []byte{1})
+	var rpcErr *Error
+	assert.MustEqual(t, true, errors.As(err, &rpcErr))
+	assert.MustEqual(t, "blockchain.transaction.broadcast", rpcErr.Message)
+}
+
+func TestClientSubscriptions(t *testing.T) {
+	ctx := t.Context()
+	sh := ScriptHash([]byte{0x51})
+	header := [80]byte{1}
+	s := newFakeServer(t, map[string]string{
+		"server.version":                  `["eps-go", "1.4"]`,
+		"blockchain.scripthash.subscribe": `null`,
+		"blockchain.headers.subscribe": fmt.Sprintf(
+			`{"height":1,"hex":"%x"}`, header,
+		),
+	})
+	c := testClient(t, s)
+	status, statusC, err := c.SubscribeScriptHash(ctx, sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, "", status)
+	tip, tipC, err := c.SubscribeHeaders(ctx)
+	assert.Must(t, err)
+	assert.MustEqual(t, HeaderTip{1, header}, tip)
+	s.notify(
+		"blockchain.scripthash.subscribe", fmt.Sprintf(`["%s","aa"]`, sh),
+	)
+	assert.MustEqual(t, "aa", <-statusC)
+	header[0] = 2
+	s.notify(
+		"blockchain.headers.subscribe",
+		fmt.Sprintf(`[{"height":2,"hex":"%x"}]`, header),
+	)
+	assert.MustEqual(t, HeaderTip{2, header}, <-tipC)
+	// the subscriptions are sent again on the new connection
+	s.setResult("blockchain.scripthash.subscribe", `"bb"`)
+	s.drop()
+	assert.MustEqual(t, "bb", <-statusC)
+	assert.MustEqual(t, HeaderTip{1, [80]byte{1}}, <-tipC)
+	s.setResult("blockchain.scripthash.unsubscribe", `true`)
+	found, err := c.UnsubscribeScriptHash(ctx, sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, true, found)
+	_, ok := <-statusC
+	assert.MustEqual(t, false, ok)
+}
+
+func TestMerkleProofs(t *testing.T) {
+	genesis := [80]byte{}
+	headers, err := headerstore.Open("", &genesis)
+	assert.Must(t, err)
+	var header [80]byte
+	for i := range 6 {
+		hash, _ := headers.Hash(headers.Tip())
+		copy(header[4:], hash[:])
+		header[76] = byte(i)
+		assert.Must(t, headers.Append(header[:]))
+	}
+	const cpHeight = 6
+	for height := range cpHeight + 1 {
+		branch, root, err := headers.Branch(height, cpHeight)
+		assert.Must(t, err)
+		hashes := make([]Hash, len(branch))
+		for i := range branch {
+			hashes[i] = branch[i]
+		}
+		var h [80]byte
+		headers.Header(height, &h)
+		ok := VerifyHeaderProof(&h, height, hashes, root)
+		assert.MustEqual(t, true, ok)
+		h[0] ^= 1
+		ok = VerifyHeaderProof(&h, height, hashes, root)
+		assert.MustEqual(t, false, ok)
+		// the headers hashes as the txids of a block
+		hash, _ := headers.Hash(height)
+		var block [80]byte
+		copy(block[36:], root[:])
+		ok = VerifyMerkle(&block, hash, height, hashes)
+		assert.MustEqual(t, true, ok)
+	}
+	h, err := ParseHash(Hash{1}.String())
+	assert.Must(t, err)
+	assert.MustEqual(t, Hash{1}, h)
+	assert.MustEqual(t, "01", hex.EncodeToString(h[:1]))
+}
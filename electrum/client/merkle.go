@@ -0,0 +1,71 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+var ErrBadProof = errors.New("bad merkle proof")
+
+// MerkleRoot returns the root of the tree whose leaf at pos is leaf, given
+// its merkle branch
+func MerkleRoot(leaf Hash, pos int, branch []Hash) Hash {
+	var buf [64]byte
+	h := leaf
+	for i := range branch {
+		if pos&1 == 0 {
+			copy(buf[:32], h[:])
+			copy(buf[32:], branch[i][:])
+		} else {
+			copy(buf[:32], branch[i][:])
+			copy(buf[32:], h[:])
+		}
+		h = doubleSha256(buf[:])
+		pos >>= 1
+	}
+	return h
+}
+
+// VerifyMerkle reports whether the tx at pos with the branch of
+// blockchain.transaction.get_merkle is in the block of header
+func VerifyMerkle(header *[80]byte, txid Hash, pos int, branch []Hash) bool {
+	root := MerkleRoot(txid, pos, branch)
+	return [32]byte(header[36:68]) == root
+}
+
+// VerifyHeaderProof reports whether the header at height belongs to the
+// headers whose root is root, the checkpoint proof of blockchain.block.header
+func VerifyHeaderProof(
+	header *[80]byte, height int, branch []Hash, root Hash,
+) bool {
+	return MerkleRoot(doubleSha256(header[:]), height, branch) == root
+}
+
+// VerifyTransaction checks the tx confirmed at height is in the block the
+// server has at that height. The header itself is trusted, VerifyMerkle
+// checks against the headers validated by the caller.
+func (c *Client) VerifyTransaction(
+	ctx context.Context, txid Hash, height int,
+) error {
+	m, err := c.TransactionGetMerkle(ctx, txid, height)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	header, err := c.BlockHeader(ctx, height)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if !VerifyMerkle(&header, txid, m.Pos, m.Branch) {
+		return fmt.Errorf("%w: tx %s at height %d", ErrBadProof, txid, height)
+	}
+	return nil
+}
+
+func doubleSha256(data []byte) [32]byte {
+	hash := sha256.Sum256(data)
+	return sha256.Sum256(hash[:])
+}
@@ -0,0 +1,471 @@
+package client
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+func (c *Client) Banner(ctx context.Context) (string, error) {
+	var banner string
+	err := c.call(ctx, "server.banner", nil, &banner)
+	return banner, err
+}
+
+func (c *Client) DonationAddress(ctx context.Context) (string, error) {
+	var addr string
+	err := c.call(ctx, "server.donation_address", nil, &addr)
+	return addr, err
+}
+
+func (c *Client) Peers(ctx context.Context) ([]Peer, error) {
+	var peers []Peer
+	err := c.call(ctx, "server.peers.subscribe", nil, &peers)
+	return peers, err
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	return c.call(ctx, "server.ping", nil, nil)
+}
+
+// EstimateFee returns the fee rate in BTC/kvB to confirm within blocks
+func (c *Client) EstimateFee(ctx context.Context, blocks int) (float64, error) {
+	var fee float64
+	err := c.call(ctx, "blockchain.estimatefee", []any{blocks}, &fee)
+	return fee, err
+}
+
+// RelayFee returns the minimum fee rate in BTC/kvB
+func (c *Client) RelayFee(ctx context.Context) (float64, error) {
+	var fee float64
+	err := c.call(ctx, "blockchain.relayfee", nil, &fee)
+	return fee, err
+}
+
+// FeeHistogram returns the mempool fee rates in sat/vB with the vsize of
+// the txs paying them
+func (c *Client) FeeHistogram(ctx context.Context) ([][2]float64, error) {
+	var histogram [][2]float64
+	err := c.call(ctx, "mempool.get_fee_histogram", nil, &histogram)
+	return histogram, err
+}
+
+func (c *Client) MempoolInfo(ctx context.Context) (MempoolInfo, error) {
+	var info MempoolInfo
+	err := c.call(ctx, "mempool.get_info", nil, &info)
+	return info, err
+}
+
+func (c *Client) BlockHeader(
+	ctx context.Context, height int,
+) ([80]byte, error) {
+	var (
+		header [80]byte
+		hexStr string
+	)
+	err := c.call(ctx, "blockchain.block.header", []any{height}, &hexStr)
+	if err != nil {
+		return header, stackerr.Wrap(err)
+	}
+	err = decodeHeader(hexStr, &header)
+	if err != nil {
+		return header, stackerr.Wrap(err)
+	}
+	return header, nil
+}
+
+// BlockHeaderProof returns the header at height with its proof against the
+// headers up to cpHeight
+func (c *Client) BlockHeaderProof(
+	ctx context.Context, height, cpHeight int,
+) (HeaderProof, error) {
+	var (
+		proof HeaderProof
+		r     struct {
+			Header string `json:"header"`
+			Branch []Hash `json:"branch"`
+			Root   Hash   `json:"root"`
+		}
+	)
+	err := c.call(
+		ctx, "blockchain.block.header", []any{height, cpHeight}, &r,
+	)
+	if err != nil {
+		return proof, stackerr.Wrap(err)
+	}
+	err = decodeHeader(r.Header, &proof.Header)
+	if err != nil {
+		return proof, stackerr.Wrap(err)
+	}
+	proof.Branch, proof.Root = r.Branch, r.Root
+	return proof, nil
+}
+
+// BlockHeaders returns up to count headers from startHeight, the proof of
+// the last one is requested when cpHeight is above zero
+func (c *Client) BlockHeaders(
+	ctx context.Context, startHeight, count, cpHeight int,
+) (HeaderChunk, error) {
+	var (
+		chunk HeaderChunk
+		r     struct {
+			Hex    string `json:"hex"`
+			Count  int    `json:"count"`
+			Max    int    `json:"max"`
+			Branch []Hash `json:"branch"`
+			Root   Hash   `json:"root"`
+		}
+	)
+	params := []any{startHeight, count}
+	if cpHeight > 0 {
+		params = append(params, cpHeight)
+	}
+	err := c.call(ctx, "blockchain.block.headers", params, &r)
+	if err != nil {
+		return chunk, stackerr.Wrap(err)
+	}
+	raw, err := hex.DecodeString(r.Hex)
+	if err != nil {
+		return chunk, stackerr.Wrap(err)
+	}
+	if len(raw) != r.Count*80 {
+		return chunk, fmt.Errorf(
+			"bad headers length %d for %d headers", len(raw), r.Count,
+		)
+	}
+	chunk.Headers = make([][80]byte, r.Count)
+	for i := range chunk.Headers {
+		copy(chunk.Headers[i][:], raw[i*80:])
+	}
+	chunk.Max, chunk.Branch, chunk.Root = r.Max, r.Branch, r.Root
+	return chunk, nil
+}
+
+// SubscribeHeaders returns the tip and a channel receiving the new tips, it
+// only keeps the latest unread one
+func (c *Client) SubscribeHeaders(
+	ctx context.Context,
+) (HeaderTip, <-chan HeaderTip, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var r headerTipResult
+	err := c.send(ctx, "blockchain.headers.subscribe", nil, &r)
+	if err != nil {
+		return HeaderTip{}, nil, stackerr.Wrap(err)
+	}
+	tip, err := r.decode()
+	if err != nil {
+		return tip, nil, stackerr.Wrap(err)
+	}
+	s := make(chan HeaderTip, 1)
+	c.subMu.Lock()
+	defer c.subMu.Unlock()
+	if c.closed {
+		return tip, nil, ErrNotConnected
+	}
+	c.hSubs = append(c.hSubs, s)
+	return tip, s, nil
+}
+
+func (c *Client) ScriptHashGetBalance(
+	ctx context.Context, sh Hash,
+) (Balance, error) {
+	var b Balance
+	err := c.call(ctx, "blockchain.scripthash.get_balance", []any{sh}, &b)
+	return b, err
+}
+
+// ScriptHashGetHistory returns the txs of sh from fromHeight to toHeight,
+// a negative toHeight has no bound. Servers limiting the history size
+// answer large histories with an error asking for height ranges.
+func (c *Client) ScriptHashGetHistory(
+	ctx context.Context, sh Hash, fromHeight, toHeight int,
+) ([]HistoryTx, error) {
+	return c.getHistory(
+		ctx, "blockchain.scripthash.get_history", sh, fromHeight, toHeight,
+	)
+}
+
+func (c *Client) ScriptHashGetMempool(
+	ctx context.Context, sh Hash,
+) ([]HistoryTx, error) {
+	var txs []HistoryTx
+	err := c.call(ctx, "blockchain.scripthash.get_mempool", []any{sh}, &txs)
+	return txs, err
+}
+
+func (c *Client) ScriptHashListUnspent(
+	ctx context.Context, sh Hash,
+) ([]Unspent, error) {
+	var utxos []Unspent
+	err := c.call(ctx, "blockchain.scripthash.listunspent", []any{sh}, &utxos)
+	return utxos, err
+}
+
+// SubscribeScriptHash returns the status of sh and a channel receiving its
+// new statuses, it only keeps the latest unread one. The status is empty
+// for a scripthash without history. Subscribing again returns the same
+// channel.
+func (c *Client) SubscribeScriptHash(
+	ctx context.Context, sh Hash,
+) (string, <-chan string, error) {
+	return c.subscribeStatus(
+		ctx, "blockchain.scripthash.subscribe", sh.String(),
+	)
+}
+
+// UnsubscribeScriptHash closes the channel of the subscription to sh and
+// returns whether the server had it
+func (c *Client) UnsubscribeScriptHash(
+	ctx context.Context, sh Hash,
+) (bool, error) {
+	key := statusSub{"blockchain.scripthash.subscribe", sh.String()}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subMu.Lock()
+	if s, ok := c.statusSubs[key]; ok {
+		delete(c.statusSubs, key)
+		close(s)
+	}
+	c.subMu.Unlock()
+	var found bool
+	err := c.send(
+		ctx, "blockchain.scripthash.unsubscribe", []any{key.name}, &found,
+	)
+	if err != nil {
+		return false, stackerr.Wrap(err)
+	}
+	return found, nil
+}
+
+func (c *Client) AddressGetBalance(
+	ctx context.Context, addr string,
+) (Balance, error) {
+	var b Balance
+	err := c.call(ctx, "blockchain.address.get_balance", []any{addr}, &b)
+	return b, err
+}
+
+// AddressGetHistory is ScriptHashGetHistory for the scripthash of addr
+func (c *Client) AddressGetHistory(
+	ctx context.Context, addr string, fromHeight, toHeight int,
+) ([]HistoryTx, error) {
+	return c.getHistory(
+		ctx, "blockchain.address.get_history", addr, fromHeight, toHeight,
+	)
+}
+
+func (c *Client) AddressListUnspent(
+	ctx context.Context, addr string,
+) ([]Unspent, error) {
+	var utxos []Unspent
+	err := c.call(ctx, "blockchain.address.listunspent", []any{addr}, &utxos)
+	return utxos, err
+}
+
+// SubscribeAddress is SubscribeScriptHash for the scripthash of addr, the
+// protocol has no method to unsubscribe
+func (c *Client) SubscribeAddress(
+	ctx context.Context, addr string,
+) (string, <-chan string, error) {
+	return c.subscribeStatus(ctx, "blockchain.address.subscribe", addr)
+}
+
+func (c *Client) getHistory(
+	ctx context.Context, method string, param any, fromHeight, toHeight int,
+) ([]HistoryTx, error) {
+	// the height range is only sent when set, for the servers of older
+	// protocol versions
+	params := []any{param}
+	if fromHeight > 0 || toHeight >= 0 {
+		params = append(params, fromHeight, toHeight)
+	}
+	var txs []HistoryTx
+	err := c.call(ctx, method, params, &txs)
+	return txs, err
+}
+
+// subscribeStatus registers the channel before the request to receive the
+// notifications sent ahead of the answer
+func (c *Client) subscribeStatus(
+	ctx context.Context, method, name string,
+) (string, <-chan string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := statusSub{method, name}
+	c.subMu.Lock()
+	if c.closed {
+		c.subMu.Unlock()
+		return "", nil, ErrNotConnected
+	}
+	s, ok := c.statusSubs[key]
+	if !ok {
+		s = make(chan string, 1)
+		c.statusSubs[key] = s
+	}
+	c.subMu.Unlock()
+	var status *string
+	err := c.send(ctx, method, []any{name}, &status)
+	if err != nil && !ok {
+		c.subMu.Lock()
+		delete(c.statusSubs, key)
+		c.subMu.Unlock()
+	}
+	if err != nil {
+		return "", nil, stackerr.Wrap(err)
+	}
+	return derefStatus(status), s, nil
+}
+
+func (c *Client) OutpointGetStatus(
+	ctx context.Context, op Outpoint,
+) (OutpointStatus, error) {
+	var r outpointStatusResult
+	err := c.call(
+		ctx, "blockchain.outpoint.get_status", []any{op.Txid, op.Vout}, &r,
+	)
+	if err != nil {
+		return OutpointStatus{}, stackerr.Wrap(err)
+	}
+	return r.decode(), nil
+}
+
+// SubscribeOutpoint returns the status of op and a channel receiving its
+// new statuses, it only keeps the latest unread one. Subscribing again
+// returns the same channel.
+func (c *Client) SubscribeOutpoint(
+	ctx context.Context, op Outpoint,
+) (OutpointStatus, <-chan OutpointStatus, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subMu.Lock()
+	if c.closed {
+		c.subMu.Unlock()
+		return OutpointStatus{}, nil, ErrNotConnected
+	}
+	s, ok := c.opSubs[op]
+	if !ok {
+		s = make(chan OutpointStatus, 1)
+		c.opSubs[op] = s
+	}
+	c.subMu.Unlock()
+	var r outpointStatusResult
+	err := c.send(
+		ctx, "blockchain.outpoint.subscribe", []any{op.Txid, op.Vout}, &r,
+	)
+	if err != nil && !ok {
+		c.subMu.Lock()
+		delete(c.opSubs, op)
+		c.subMu.Unlock()
+	}
+	if err != nil {
+		return OutpointStatus{}, nil, stackerr.Wrap(err)
+	}
+	return r.decode(), s, nil
+}
+
+// UnsubscribeOutpoint closes the channel of the subscription to op and
+// returns whether the server had it
+func (c *Client) UnsubscribeOutpoint(
+	ctx context.Context, op Outpoint,
+) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.subMu.Lock()
+	if s, ok := c.opSubs[op]; ok {
+		delete(c.opSubs, op)
+		close(s)
+	}
+	c.subMu.Unlock()
+	var found bool
+	err := c.send(
+		ctx, "blockchain.outpoint.unsubscribe", []any{op.Txid, op.Vout}, &found,
+	)
+	if err != nil {
+		return false, stackerr.Wrap(err)
+	}
+	return found, nil
+}
+
+// TransactionBroadcast relays rawTx and returns its txid
+func (c *Client) TransactionBroadcast(
+	ctx context.Context, rawTx []byte,
+) (Hash, error) {
+	var txid Hash
+	err := c.call(
+		ctx,
+		"blockchain.transaction.broadcast",
+		[]any{hex.EncodeToString(rawTx)},
+		&txid,
+	)
+	return txid, err
+}
+
+// TransactionBroadcastPackage relays a child with its parents, sorted
+// parents first
+func (c *Client) TransactionBroadcastPackage(
+	ctx context.Context, rawTxs [][]byte,
+) (PackageResult, error) {
+	var res PackageResult
+	hexTxs := make([]string, len(rawTxs))
+	for i := range rawTxs {
+		hexTxs[i] = hex.EncodeToString(rawTxs[i])
+	}
+	err := c.call(
+		ctx, "blockchain.transaction.broadcast_package", []any{hexTxs}, &res,
+	)
+	return res, err
+}
+
+// TransactionGet returns the serialized tx
+func (c *Client) TransactionGet(
+	ctx context.Context, txid Hash,
+) ([]byte, error) {
+	var hexTx string
+	err := c.call(ctx, "blockchain.transaction.get", []any{txid}, &hexTx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	raw, err := hex.DecodeString(hexTx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return raw, nil
+}
+
+// TransactionGetVerbose decodes the getrawtransaction object of the node
+// into result
+func (c *Client) TransactionGetVerbose(
+	ctx context.Context, txid Hash, result any,
+) error {
+	return c.call(ctx, "blockchain.transaction.get", []any{txid, true}, result)
+}
+
+// TransactionGetMerkle returns the merkle branch of the tx confirmed at
+// height
+func (c *Client) TransactionGetMerkle(
+	ctx context.Context, txid Hash, height int,
+) (Merkle, error) {
+	var m Merkle
+	err := c.call(
+		ctx, "blockchain.transaction.get_merkle", []any{txid, height}, &m,
+	)
+	return m, err
+}
+
+// TransactionIdFromPos returns the txid at pos in the block at height with
+// its merkle branch
+func (c *Client) TransactionIdFromPos(
+	ctx context.Context, height, pos int,
+) (Hash, []Hash, error) {
+	var r struct {
+		Txid   Hash   `json:"tx_hash"`
+		Merkle []Hash `json:"merkle"`
+	}
+	err := c.call(
+		ctx, "blockchain.transaction.id_from_pos", []any{height, pos, true}, &r,
+	)
+	return r.Txid, r.Merkle, err
+}
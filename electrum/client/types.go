@@ -0,0 +1,192 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Hash is a tx or block hash in internal byte order, its text form is the
+// reversed hex of the protocol
+type Hash [32]byte
+
+// ScriptHash returns the hash the protocol indexes scriptPubkey by
+func ScriptHash(scriptPubkey []byte) Hash {
+	return sha256.Sum256(scriptPubkey)
+}
+
+func ParseHash(s string) (Hash, error) {
+	var h Hash
+	err := h.UnmarshalText([]byte(s))
+	return h, err
+}
+
+func (h Hash) String() string {
+	r := h
+	slices.Reverse(r[:])
+	return hex.EncodeToString(r[:])
+}
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (h *Hash) UnmarshalText(text []byte) error {
+	if hex.DecodedLen(len(text)) != len(h) {
+		return fmt.Errorf("bad hash length: %d", len(text))
+	}
+	_, err := hex.Decode(h[:], text)
+	if err != nil {
+		return fmt.Errorf("bad hash: %w", err)
+	}
+	slices.Reverse(h[:])
+	return nil
+}
+
+type ServerVersion struct {
+	Software string
+	Protocol string
+}
+
+// HeaderTip is the chain tip of blockchain.headers.subscribe
+type HeaderTip struct {
+	Height int
+	Header [80]byte
+}
+
+type headerTipResult struct {
+	Height int    `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+func (r *headerTipResult) decode() (HeaderTip, error) {
+	tip := HeaderTip{Height: r.Height}
+	err := decodeHeader(r.Hex, &tip.Header)
+	return tip, err
+}
+
+func decodeHeader(s string, out *[80]byte) error {
+	if hex.DecodedLen(len(s)) != len(out) {
+		return fmt.Errorf("bad header length: %d", len(s))
+	}
+	_, err := hex.Decode(out[:], []byte(s))
+	if err != nil {
+		return fmt.Errorf("bad header: %w", err)
+	}
+	return nil
+}
+
+// HeaderProof is a header with its merkle branch to the root of the
+// headers up to a checkpoint height, see VerifyHeaderProof
+type HeaderProof struct {
+	Header [80]byte
+	Branch []Hash
+	Root   Hash
+}
+
+// HeaderChunk is the result of blockchain.block.headers, the proof is for
+// its last header when a checkpoint height was requested
+type HeaderChunk struct {
+	Headers [][80]byte
+	Max     int
+	Branch  []Hash
+	Root    Hash
+}
+
+type Balance struct {
+	Confirmed   int64 `json:"confirmed"`
+	Unconfirmed int64 `json:"unconfirmed"`
+}
+
+// HistoryTx is a tx of a scripthash history, Height is 0 or -1 for the
+// mempool txs
+type HistoryTx struct {
+	Txid   Hash   `json:"tx_hash"`
+	Height int    `json:"height"`
+	Fee    uint64 `json:"fee,omitempty"`
+}
+
+type Unspent struct {
+	Txid   Hash   `json:"tx_hash"`
+	Vout   uint32 `json:"tx_pos"`
+	Height int    `json:"height"`
+	Value  uint64 `json:"value"`
+}
+
+type Outpoint struct {
+	Txid Hash
+	Vout uint32
+}
+
+// OutpointStatus is the state of an output, Known is false when the server
+// does not track it
+type OutpointStatus struct {
+	Known         bool
+	Height        int
+	Spent         bool
+	SpenderTxid   Hash
+	SpenderHeight int
+}
+
+type outpointStatusResult struct {
+	Height        *int  `json:"height"`
+	SpenderTxHash *Hash `json:"spender_txhash"`
+	SpenderHeight *int  `json:"spender_height"`
+}
+
+func (r *outpointStatusResult) decode() OutpointStatus {
+	var s OutpointStatus
+	if r.Height == nil {
+		return s
+	}
+	s.Known = true
+	s.Height = *r.Height
+	if r.SpenderTxHash != nil {
+		s.Spent = true
+		s.SpenderTxid = *r.SpenderTxHash
+	}
+	if r.SpenderHeight != nil {
+		s.SpenderHeight = *r.SpenderHeight
+	}
+	return s
+}
+
+// Merkle is the merkle branch of a confirmed tx, see VerifyMerkle
+type Merkle struct {
+	BlockHeight int    `json:"block_height"`
+	Pos         int    `json:"pos"`
+	Branch      []Hash `json:"merkle"`
+}
+
+// PackageResult is the result of blockchain.transaction.broadcast_package,
+// Errors lists the rejected txs
+type PackageResult struct {
+	Success bool             `json:"success"`
+	Errors  []PackageTxError `json:"errors"`
+}
+
+type PackageTxError struct {
+	Txid  Hash   `json:"txid"`
+	Error string `json:"error"`
+}
+
+// MempoolInfo are the fee rates of mempool.get_info, in BTC/kvB
+type MempoolInfo struct {
+	MinFee              float64 `json:"mempoolminfee"`
+	MinRelayTxFee       float64 `json:"minrelaytxfee"`
+	IncrementalRelayFee float64 `json:"incrementalrelayfee"`
+}
+
+// Peer is a server of server.peers.subscribe
+type Peer struct {
+	IP       string
+	Host     string
+	Features []string
+}
+
+func (p *Peer) UnmarshalJSON(data []byte) error {
+	params := []any{&p.IP, &p.Host, &p.Features}
+	return json.Unmarshal(data, &params)
+}
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/ncodysoftware/eps-go/jsonrpc"
 	"github.com/ncodysoftware/eps-go/walletmanager"
@@ -18,15 +19,27 @@ var (
 	errBadParams = errors.New("bad params")
 )
 
+type Opts struct {
+	// Banner is the server.banner template, $VERSION, $NETWORK,
+	// $TIP_HEIGHT, $SYNC_PROGRESS, $WALLETS, $MEMPOOL_TXS, $UPTIME and
+	// $DONATION_ADDRESS are replaced with their values. $MEMPOOL_TXS is
+	// asked to the node rpc and is removed without it. Empty names the
+	// server and its version.
+	Banner string
+	// DonationAddress is returned by server.donation_address
+	DonationAddress string
+}
+
 func ListenAndServe(
 	ctx context.Context,
 	addr string,
 	log *log.Logger,
 	wm *walletmanager.W,
+	opts Opts,
 	onStart func(),
 ) error {
 	log.Infof("to listen on %s", addr)
-	mux := newMux(ctx, log, wm)
+	mux := newMux(log, wm, opts)
 	srv, err := jsonrpc.NewServer(ctx, log, addr, mux)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -37,22 +50,28 @@ func ListenAndServe(
 }
 
 type mux struct {
-	ctx      context.Context
 	log      *log.Logger
 	handlers map[string]func(ctx *jsonrpc.Ctx) error
 	w        *walletmanager.W
 	bufPool  sync.Pool
+	opts     Opts
+	started  time.Time
+	mempool  mempoolCache
 }
 
 func newMux(
-	ctx context.Context,
 	log *log.Logger,
 	w *walletmanager.W,
+	opts Opts,
 ) *mux {
+	if opts.Banner == "" {
+		opts.Banner = defaultBanner
+	}
 	m := &mux{
-		ctx: ctx,
-		log: log,
-		w:   w,
+		log:     log,
+		w:       w,
+		opts:    opts,
+		started: time.Now(),
 	}
 	m.bufPool.New = func() any {
 		return []byte{}
@@ -76,6 +95,10 @@ func (h *mux) OnRequest(ctx *jsonrpc.Ctx) error {
 		return fmt.Errorf("unknown method: %s", m)
 	}
 	err = handler(ctx)
+	var errSyncing *walletmanager.SyncingError
+	if err != nil && errors.As(err, &errSyncing) {
+		return rpcError(ctx, errCodeBadRequest, errSyncing.Error())
+	}
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
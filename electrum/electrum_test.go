@@ -13,6 +13,7 @@ import (
 	"sync"
 	"testing"
 
+	"github.com/ncodysoftware/eps-go/address"
 	"github.com/ncodysoftware/eps-go/internal/testdata"
 	"github.com/ncodysoftware/eps-go/jsonrpc"
 	"github.com/ncodysoftware/eps-go/testutil"
@@ -23,6 +24,37 @@ import (
 	"ncody.com/ncgo.git/bitcoin/scriptpubkey"
 )
 
+func TestIntegrationAddressGetBalance(t *testing.T) {
+	c, cls := setup(t)
+	defer cls()
+	var res struct {
+		Conf   uint64 `json:"confirmed"`
+		Unconf uint64 `json:"unconfirmed"`
+	}
+	spkh := deriveScriptHash(1, 0)
+	err := c.m.GetScriptHashBalance(c.t.C, &spkh, &res.Conf, &res.Unconf)
+	assert.Must(t, err)
+	addr, ok := address.FromScriptPubkey(
+		deriveScriptPubkey(1, 0), bitcoin.Regtest,
+	)
+	assert.MustEqual(t, true, ok)
+	r := jsonrpc.Request{
+		Method: toJson("blockchain.address.get_balance"),
+		Params: toJson([]string{addr}),
+	}
+	var exp jsonrpc.Response
+	exp.Result = toJson(res)
+	jrpcT(t, c.c, &r, &exp)
+	// a mainnet address
+	r.Params = toJson([]string{"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4"})
+	exp.Result = nil
+	exp.Error = toJson(map[string]any{
+		"code":    1,
+		"message": "invalid address: bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4",
+	})
+	jrpcT(t, c.c, &r, &exp)
+}
+
 func TestIntegrationBlockHeader(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
@@ -40,6 +72,39 @@ func TestIntegrationBlockHeader(t *testing.T) {
 	jrpcT(t, c.c2, &r, &exp)
 }
 
+func TestIntegrationBlockHeaderCheckpoint(t *testing.T) {
+	c, cls := setup(t)
+	defer cls()
+	var h [80]byte
+	err := c.m.GetBlockHeader(c.t.C, 1, &h)
+	assert.Must(t, err)
+	branch, root, err := c.m.GetHeaderBranch(c.t.C, 1, 5)
+	assert.Must(t, err)
+	var result struct {
+		Branch []string `json:"branch"`
+		Header string   `json:"header"`
+		Root   string   `json:"root"`
+	}
+	for i := range branch {
+		slices.Reverse(branch[i][:])
+		result.Branch = append(
+			result.Branch, hex.EncodeToString(branch[i][:]),
+		)
+	}
+	slices.Reverse(root[:])
+	result.Root = hex.EncodeToString(root[:])
+	result.Header = hex.EncodeToString(h[:])
+	r := jsonrpc.Request{
+		Method: toJson("blockchain.block.header"),
+		Params: toJson([]int{1, 5}),
+	}
+	exp := jsonrpc.Response{
+		Result: toJson(result),
+	}
+	jrpcT(t, c.c, &r, &exp)
+	jrpcT(t, c.c2, &r, &exp)
+}
+
 func TestIntegrationBlockHeaders(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
@@ -47,12 +112,8 @@ func TestIntegrationBlockHeaders(t *testing.T) {
 		Method: toJson("blockchain.block.headers"),
 		Params: toJson([]int{6, 5}),
 	}
-	headers, err := c.m.GetBlockHeaders(c.t.C, 6, 5)
+	sHeaders, err := c.m.GetBlockHeaders(c.t.C, 6, 5, nil)
 	assert.Must(t, err)
-	sHeaders := make([]byte, 0, 80*5)
-	for i := range headers {
-		sHeaders = append(sHeaders, headers[i][:]...)
-	}
 	var result = struct {
 		Headers string `json:"hex"`
 		Count   int    `json:"count"`
@@ -105,6 +166,31 @@ func TestIntegrationHeadersSubscribe(t *testing.T) {
 	jrpcT(t, c.c2, &r, &exp)
 }
 
+func TestIntegrationOutpointGetStatus(t *testing.T) {
+	c, cls := setup(t)
+	defer cls()
+	txD := tSelectSomeTxData(c.t)
+	status, err := c.m.GetOutpointStatus(c.t.C, &txD.Txid, 0)
+	assert.Must(t, err)
+	txid := txD.Txid
+	slices.Reverse(txid[:])
+	req := jsonrpc.Request{
+		Method: toJson("blockchain.outpoint.get_status"),
+		Params: toJson([]any{hex.EncodeToString(txid[:]), 0}),
+	}
+	exp := jsonrpc.Response{
+		Result: toJson(makeOutpointStatusResult(&status)),
+	}
+	jrpcT(t, c.c, &req, &exp)
+	// unknown outpoint
+	req.Params = toJson([]any{hex.EncodeToString(txid[:]), 1 << 30})
+	exp.Result = []byte(`{}`)
+	jrpcT(t, c.c, &req, &exp)
+	req.Method = toJson("blockchain.outpoint.unsubscribe")
+	exp.Result = []byte(`false`)
+	jrpcT(t, c.c, &req, &exp)
+}
+
 func TestIntegrationScriptHashGetBalance(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
@@ -130,7 +216,7 @@ func TestIntegrationScriptHashGetHistory(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
 	spkh := deriveScriptHash(1, 0)
-	hist, err := c.m.GetScriptHashHistory(c.t.C, &spkh)
+	hist, err := c.m.GetScriptHashHistory(c.t.C, &spkh, 0, -1)
 	assert.Must(t, err)
 	slices.Reverse(spkh[:])
 	req := jsonrpc.Request{
@@ -251,7 +337,20 @@ func TestIntegrationScriptHashUnsubscribe(t *testing.T) {
 		Result: []byte(`false`),
 	}
 	jrpcT(t, c.c, &req, &exp)
-	//jrpcT(t, c.c2, &req, &exp)
+	sub := jsonrpc.Request{
+		Id:      toJson(0),
+		JsonRPC: toJson("2.0"),
+		Method:  toJson("blockchain.scripthash.subscribe"),
+		Params:  req.Params,
+	}
+	_, err := c.c.Send(sub)
+	assert.Must(t, err)
+	// the subscription of the other connection is not affected
+	jrpcT(t, c.c2, &req, &exp)
+	exp.Result = []byte(`true`)
+	jrpcT(t, c.c, &req, &exp)
+	exp.Result = []byte(`false`)
+	jrpcT(t, c.c, &req, &exp)
 }
 
 func TestIntegrationTransactionBroadcast(t *testing.T) {
@@ -295,6 +394,64 @@ func TestIntegrationTransactionGet(t *testing.T) {
 	jrpcT(t, c.c2, &req, &exp)
 }
 
+func TestIntegrationTransactionGetVerbose(t *testing.T) {
+	c, cls := setup(t)
+	defer cls()
+	txD := tSelectSomeTxData(c.t)
+	var tx bitcoin.Transaction
+	err := tx.Deserialize(bytes.NewReader(txD.Raw))
+	assert.Must(t, err)
+	var height int
+	var header [80]byte
+	err = c.m.GetTipHeader(c.t.C, &height, &header)
+	assert.Must(t, err)
+	slices.Reverse(txD.Txid[:])
+	slices.Reverse(txD.BlockHash[:])
+	req := jsonrpc.Request{
+		Id:      toJson(0),
+		JsonRPC: toJson("2.0"),
+		Method:  toJson("blockchain.transaction.get"),
+		Params:  toJson([]any{hex.EncodeToString(txD.Txid[:]), true}),
+	}
+	res, err := c.c.Send(req)
+	assert.Must(t, err)
+	var result struct {
+		Txid          string `json:"txid"`
+		Hex           string `json:"hex"`
+		Size          int    `json:"size"`
+		Blockhash     string `json:"blockhash"`
+		Confirmations int    `json:"confirmations"`
+		Vin           []any  `json:"vin"`
+		Vout          []struct {
+			Value        json.Number `json:"value"`
+			ScriptPubkey struct {
+				Hex     string `json:"hex"`
+				Address string `json:"address"`
+			} `json:"scriptPubKey"`
+		} `json:"vout"`
+	}
+	assert.Must(t, json.Unmarshal(res.Result, &result))
+	assert.MustEqual(t, hex.EncodeToString(txD.Txid[:]), result.Txid)
+	assert.MustEqual(t, hex.EncodeToString(txD.Raw), result.Hex)
+	assert.MustEqual(t, len(txD.Raw), result.Size)
+	assert.MustEqual(
+		t, hex.EncodeToString(txD.BlockHash[:]), result.Blockhash,
+	)
+	assert.MustEqual(t, height-txD.Height+1, result.Confirmations)
+	assert.MustEqual(t, len(tx.Inputs), len(result.Vin))
+	assert.MustEqual(t, len(tx.Outputs), len(result.Vout))
+	for i, out := range tx.Outputs {
+		v := result.Vout[i]
+		assert.MustEqual(
+			t, fmt.Sprintf("%d.%08d", out.Amount/1e8, out.Amount%1e8),
+			string(v.Value),
+		)
+		assert.MustEqual(
+			t, hex.EncodeToString(out.ScriptPubkey), v.ScriptPubkey.Hex,
+		)
+	}
+}
+
 func TestIntegrationTransactionGetMerkle(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
@@ -453,6 +610,30 @@ func TestIntegrationMempoolGetInfo(t *testing.T) {
 	//jrpcT(t, c.c2, &req, &exp)
 }
 
+const tDonationAddress = "bcrt1qw508d6qejxtdg4y5r3zarvary0c5xw7kygt080"
+
+func TestIntegrationServerBanner(t *testing.T) {
+	c, cls := setup(t)
+	defer cls()
+	var (
+		height int
+		h      [80]byte
+	)
+	assert.Must(t, c.m.GetTipHeader(c.t.C, &height, &h))
+	r := jsonrpc.Request{
+		Method: toJson("server.banner"),
+		Params: []byte("[]"),
+	}
+	// jrpcT drops the spaces of the result
+	exp := jsonrpc.Response{
+		Result: toJson(fmt.Sprintf("regtest%d100.00%%", height)),
+	}
+	jrpcT(t, c.c, &r, &exp)
+	r.Method = toJson("server.donation_address")
+	exp.Result = toJson(tDonationAddress)
+	jrpcT(t, c.c, &r, &exp)
+}
+
 func TestIntegrationPing(t *testing.T) {
 	c, cls := setup(t)
 	defer cls()
@@ -540,7 +721,13 @@ func setup(t *testing.T) (Ctx, func()) {
 		},
 	}
 	wm, err := walletmanager.New(
-		tc.C, tc.D, tc.L, bcli, wallets, bitcoin.Regtest,
+		tc.C,
+		tc.D,
+		tc.L,
+		bcli,
+		wallets,
+		bitcoin.Regtest,
+		walletmanager.Opts{NodeAddr: tc.Cfg.BTCNodeAddr},
 	)
 	assert.Must(t, err)
 	wm.WaitInit(tc.C)
@@ -553,6 +740,10 @@ func setup(t *testing.T) (Ctx, func()) {
 			tc.Cfg.ListenAddress,
 			tc.L,
 			wm,
+			Opts{
+				Banner:          "$NETWORK $TIP_HEIGHT $SYNC_PROGRESS",
+				DonationAddress: tDonationAddress,
+			},
 			func() {
 				close(srvStarted)
 			},
@@ -637,6 +828,10 @@ func jrpcT(
 }
 
 func deriveScriptHash(account, index uint32) [32]byte {
+	return sha256.Sum256(deriveScriptPubkey(account, index))
+}
+
+func deriveScriptPubkey(account, index uint32) []byte {
 	firstRecv, err := bip32.DeriveXpub(
 		&testdata.DefaultKeySet.RootAccount,
 		[]uint32{account, index},
@@ -652,7 +847,7 @@ func deriveScriptHash(account, index uint32) [32]byte {
 	if err != nil {
 		panic(err)
 	}
-	return sha256.Sum256(spk)
+	return spk
 }
 
 func tSelectSomeTx(tc *testutil.TCtx) []byte {
@@ -683,14 +878,12 @@ func tSelectSomeTxData(tc *testutil.TCtx) tTxData {
 	s := `
 	SELECT 
 		tx.txid,
-		bh.height,
+		tx.height,
 		tx.blockhash,
 		tx.pos,
 		tx.serialized,
 		tx.merkle_proof
 	FROM tx
-	JOIN blockheader AS bh
-	ON bh.hash = tx.blockhash
 	LIMIT 1
 	;
 	`
@@ -725,3 +918,25 @@ func (self *bufWrapper) Scan(src any) error {
 	copy(*self, data)
 	return nil
 }
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		params string
+		want   string
+	}{
+		{``, "1.4"},
+		{`"1.4"`, "1.4"},
+		{`"1.4.0"`, "1.4"},
+		{`"1.6"`, "1.6"},
+		{`["1.4", "1.6"]`, "1.6"},
+		{`["1.4", "1.5"]`, "1.4.2"},
+		{`["1.4", "2.0"]`, "1.6"},
+		{`"1.3"`, ""},
+		{`["1.7", "2.0"]`, ""},
+		{`"x"`, ""},
+	} {
+		got, err := negotiateVersion(json.RawMessage(tc.params))
+		assert.MustEqual(t, tc.want == "", err != nil)
+		assert.MustEqual(t, tc.want, got)
+	}
+}
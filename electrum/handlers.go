@@ -1,35 +1,56 @@
 package electrum
 
 import (
+	"context"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"slices"
+	"strconv"
+	"strings"
 
+	"github.com/ncodysoftware/eps-go/address"
 	"github.com/ncodysoftware/eps-go/jsonrpc"
+	"github.com/ncodysoftware/eps-go/noderpc"
+	"github.com/ncodysoftware/eps-go/walletmanager"
 	"ncody.com/ncgo.git/stackerr"
 )
 
 func (m *mux) defaultHandlers() map[string]func(ctx *jsonrpc.Ctx) error {
 	return map[string]func(ctx *jsonrpc.Ctx) error{
-		"blockchain.block.header":           m.blockHeaderHandler,
-		"blockchain.block.headers":          m.blockHeadersHandler,
-		"blockchain.estimatefee":            m.estimateFeeHandler,
-		"blockchain.headers.subscribe":      m.headersSubscribeHandler,
-		"blockchain.scripthash.get_balance": m.scriptHashGetBalanceHandler,
-		"blockchain.scripthash.get_history": m.scriptHashGetHistoryHandler,
-		"blockchain.scripthash.get_mempool": m.scriptHashGetMempoolHandler,
-		"blockchain.scripthash.listunspent": m.scriptHashListUnspentHandler,
-		"blockchain.scripthash.subscribe":   m.scriptHashSubscribeHandler,
-		"blockchain.scripthash.unsubscribe": m.scriptHashUnsubscribeHandler,
-		"blockchain.transaction.broadcast":  m.transactionBroadcastHandler,
-		//"blockchain.transaction.broadcast_package": nil,
-		"blockchain.transaction.get":         m.transactionGetHandler,
-		"blockchain.transaction.get_merkle":  m.transactionGetMerkleHandler,
-		"blockchain.transaction.id_from_pos": m.transactionIdFromPosHandler,
-		"blockchain.relayfee":                m.blockchainRelayFeeHandler,
-		"mempool.get_fee_histogram":          m.mempoolGetFeeHistogramHandler,
-		"mempool.get_info":                   m.mempoolGetInfo,
+		"blockchain.address.get_balance": m.addressHandler(
+			m.scriptHashGetBalanceHandler,
+		),
+		"blockchain.address.get_history": m.addressHandler(
+			m.scriptHashGetHistoryHandler,
+		),
+		"blockchain.address.listunspent": m.addressHandler(
+			m.scriptHashListUnspentHandler,
+		),
+		"blockchain.address.subscribe":             m.addressSubscribeHandler,
+		"blockchain.block.header":                  m.blockHeaderHandler,
+		"blockchain.block.headers":                 m.blockHeadersHandler,
+		"blockchain.estimatefee":                   m.estimateFeeHandler,
+		"blockchain.headers.subscribe":             m.headersSubscribeHandler,
+		"blockchain.outpoint.get_status":           m.outpointGetStatusHandler,
+		"blockchain.outpoint.subscribe":            m.outpointSubscribeHandler,
+		"blockchain.outpoint.unsubscribe":          m.outpointUnsubscribeHandler,
+		"blockchain.scripthash.get_balance":        m.scriptHashGetBalanceHandler,
+		"blockchain.scripthash.get_history":        m.scriptHashGetHistoryHandler,
+		"blockchain.scripthash.get_mempool":        m.scriptHashGetMempoolHandler,
+		"blockchain.scripthash.listunspent":        m.scriptHashListUnspentHandler,
+		"blockchain.scripthash.subscribe":          m.scriptHashSubscribeHandler,
+		"blockchain.scripthash.unsubscribe":        m.scriptHashUnsubscribeHandler,
+		"blockchain.transaction.broadcast":         m.transactionBroadcastHandler,
+		"blockchain.transaction.broadcast_package": m.transactionBroadcastPackageHandler,
+		"blockchain.transaction.get":               m.transactionGetHandler,
+		"blockchain.transaction.get_merkle":        m.transactionGetMerkleHandler,
+		"blockchain.transaction.id_from_pos":       m.transactionIdFromPosHandler,
+		"blockchain.relayfee":                      m.blockchainRelayFeeHandler,
+		"mempool.get_fee_histogram":                m.mempoolGetFeeHistogramHandler,
+		"mempool.get_info":                         m.mempoolGetInfo,
 		//"server.add_peer": nil,
 		"server.banner":           m.serverBannerHandler,
 		"server.donation_address": m.serverDonationAddressHandler,
@@ -54,21 +75,60 @@ func (m *mux) blockHeaderHandler(ctx *jsonrpc.Ctx) error {
 	}
 	height = params[0]
 	var header [80]byte
-	err = m.w.GetBlockHeader(m.ctx, height, &header)
+	err = m.w.GetBlockHeader(ctx.Context, height, &header)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	ctx.Response.Result = fmt.Appendf(
-		nil, `"%s"`, hex.EncodeToString(header[:]),
+	if len(params) < 2 || params[1] == 0 {
+		ctx.Response.Result = fmt.Appendf(
+			nil, `"%s"`, hex.EncodeToString(header[:]),
+		)
+		return nil
+	}
+	var result struct {
+		Branch []string `json:"branch"`
+		Header string   `json:"header"`
+		Root   string   `json:"root"`
+	}
+	result.Branch, result.Root, err = m.headerProof(
+		ctx.Context, height, params[1],
 	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	result.Header = hex.EncodeToString(header[:])
+	ctx.Response.Result, err = json.Marshal(result)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	return nil
 }
 
+// headerProof returns the branch and root proving the header at height
+// against the checkpoint at cpHeight, hex encoded like the txids
+func (m *mux) headerProof(
+	ctx context.Context, height, cpHeight int,
+) ([]string, string, error) {
+	branch, root, err := m.w.GetHeaderBranch(ctx, height, cpHeight)
+	if err != nil {
+		return nil, "", stackerr.Wrap(err)
+	}
+	hexBranch := make([]string, 0, len(branch))
+	for i := range branch {
+		slices.Reverse(branch[i][:])
+		hexBranch = append(hexBranch, hex.EncodeToString(branch[i][:]))
+	}
+	slices.Reverse(root[:])
+	return hexBranch, hex.EncodeToString(root[:]), nil
+}
+
 func (m *mux) blockHeadersHandler(ctx *jsonrpc.Ctx) error {
 	var result = struct {
-		Hex   string `json:"hex"`
-		Count int    `json:"count"`
-		Max   int    `json:"max"`
+		Hex    string   `json:"hex"`
+		Count  int      `json:"count"`
+		Max    int      `json:"max"`
+		Branch []string `json:"branch,omitempty"`
+		Root   string   `json:"root,omitempty"`
 	}{}
 	const max = 2016
 	var (
@@ -80,19 +140,27 @@ func (m *mux) blockHeadersHandler(ctx *jsonrpc.Ctx) error {
 		return fmt.Errorf("protocol violation")
 	}
 	startHeight, count = params[0], params[1]
-	headers, err := m.w.GetBlockHeaders(m.ctx, startHeight, min(count, max))
-	if err != nil {
-		return stackerr.Wrap(err)
-	}
 	serializedHeaders := m.bGet()
 	defer m.bPut(serializedHeaders)
 	bClear(&serializedHeaders)
-	for i := range headers {
-		serializedHeaders = append(serializedHeaders, headers[i][:]...)
+	serializedHeaders, err = m.w.GetBlockHeaders(
+		ctx.Context, startHeight, min(count, max), serializedHeaders,
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
 	}
-	result.Count = len(headers)
+	result.Count = len(serializedHeaders) / 80
 	result.Max = max
 	result.Hex = hex.EncodeToString(serializedHeaders)
+	// the proof is for the last header returned
+	if len(params) > 2 && params[2] != 0 && result.Count > 0 {
+		result.Branch, result.Root, err = m.headerProof(
+			ctx.Context, startHeight+result.Count-1, params[2],
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
 	ctx.Response.Result, err = json.Marshal(result)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -111,12 +179,12 @@ func (m *mux) headersSubscribeHandler(ctx *jsonrpc.Ctx) error {
 		Height int    `json:"height"`
 	}
 	var h [80]byte
-	err := m.w.GetTipHeader(m.ctx, &r.Height, &h)
+	err := m.w.GetTipHeader(ctx.Context, &r.Height, &h)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 	connId := ctx.ConnId
-	m.w.HeadersSubscribe(connId, func(height int, header [80]byte) {
+	notify := func(height int, header [80]byte) {
 		err := ctx.Notifier.Notify(connId, &jsonrpc.Notification{
 			Method: []byte(`"blockchain.headers.subscribe"`),
 			Params: fmt.Appendf(
@@ -125,11 +193,17 @@ func (m *mux) headersSubscribeHandler(ctx *jsonrpc.Ctx) error {
 				height,
 				hex.EncodeToString(header[:]),
 			),
+			// only the tip is sent to a client behind
+			Key: "blockchain.headers.subscribe",
 		})
 		if err != nil {
 			m.log.Err(stackerr.Wrap(err))
 		}
-	})
+	}
+	err = m.w.HeadersSubscribe(ctx.Context, connId, notify)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	r.Hex = hex.EncodeToString(h[:])
 	ctx.Response.Result, err = json.Marshal(r)
 	if err != nil {
@@ -138,6 +212,200 @@ func (m *mux) headersSubscribeHandler(ctx *jsonrpc.Ctx) error {
 	return nil
 }
 
+// parseOutpoint reads the [tx_hash, txout_idx] params, a trailing
+// spk_hint is ignored
+func parseOutpoint(ctx *jsonrpc.Ctx) ([32]byte, uint32, error) {
+	var (
+		params  []json.RawMessage
+		txid    [32]byte
+		txidStr string
+		vout    uint32
+	)
+	err := json.Unmarshal(ctx.Request.Params, &params)
+	if err != nil {
+		return txid, vout, stackerr.Wrap(err)
+	}
+	if len(params) < 2 {
+		return txid, vout, fmt.Errorf("bad param len")
+	}
+	err = json.Unmarshal(params[0], &txidStr)
+	if err != nil {
+		return txid, vout, stackerr.Wrap(err)
+	}
+	txidS, err := hex.DecodeString(txidStr)
+	if err != nil {
+		return txid, vout, stackerr.Wrap(err)
+	}
+	if len(txidS) != 32 {
+		return txid, vout, fmt.Errorf("bad tx_hash")
+	}
+	slices.Reverse(txidS)
+	copy(txid[:], txidS)
+	err = json.Unmarshal(params[1], &vout)
+	if err != nil {
+		return txid, vout, stackerr.Wrap(err)
+	}
+	return txid, vout, nil
+}
+
+type outpointStatusResult struct {
+	Height        *int   `json:"height,omitempty"`
+	SpenderTxHash string `json:"spender_txhash,omitempty"`
+	SpenderHeight *int   `json:"spender_height,omitempty"`
+}
+
+// makeOutpointStatusResult returns {} for an outpoint the index does not
+// know about
+func makeOutpointStatusResult(
+	s *walletmanager.OutpointStatus,
+) outpointStatusResult {
+	var r outpointStatusResult
+	if !s.Known {
+		return r
+	}
+	r.Height = &s.Height
+	if s.Spent {
+		r.SpenderTxHash = hexHash(s.SpenderTxid)
+		r.SpenderHeight = &s.SpenderHeight
+	}
+	return r
+}
+
+func (m *mux) outpointGetStatusHandler(ctx *jsonrpc.Ctx) error {
+	txid, vout, err := parseOutpoint(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	status, err := m.w.GetOutpointStatus(ctx.Context, &txid, vout)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	ctx.Response.Result, err = json.Marshal(
+		makeOutpointStatusResult(&status),
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (m *mux) outpointSubscribeHandler(ctx *jsonrpc.Ctx) error {
+	txid, vout, err := parseOutpoint(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	status, err := m.w.GetOutpointStatus(ctx.Context, &txid, vout)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	ctx.Response.Result, err = json.Marshal(
+		makeOutpointStatusResult(&status),
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	txHash := hexHash(txid)
+	connId := ctx.ConnId
+	notify := func(status walletmanager.OutpointStatus) {
+		res := makeOutpointStatusResult(&status)
+		params, err := json.Marshal([]any{[]any{txHash, vout}, res})
+		if err != nil {
+			m.log.Err(stackerr.Wrap(err))
+			return
+		}
+		err = ctx.Notifier.Notify(connId, &jsonrpc.Notification{
+			Method: []byte(`"blockchain.outpoint.subscribe"`),
+			Params: params,
+			// the latest status of the outpoint wins
+			Key: fmt.Sprintf(
+				"blockchain.outpoint.subscribe %s:%d", txHash, vout,
+			),
+		})
+		if err != nil {
+			m.log.Err(stackerr.Wrap(err))
+		}
+	}
+	err = m.w.OutpointSubscribe(ctx.Context, connId, txid, vout, notify)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (m *mux) outpointUnsubscribeHandler(ctx *jsonrpc.Ctx) error {
+	txid, vout, err := parseOutpoint(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	ctx.Response.Result = []byte("false")
+	if m.w.OutpointUnsubscribe(ctx.ConnId, txid, vout) {
+		ctx.Response.Result = []byte("true")
+	}
+	return nil
+}
+
+// addressHandler runs the scripthash handler h on the scripthash of the
+// address param, for the methods older clients call with addresses
+func (m *mux) addressHandler(
+	h func(ctx *jsonrpc.Ctx) error,
+) func(ctx *jsonrpc.Ctx) error {
+	return func(ctx *jsonrpc.Ctx) error {
+		var params []json.RawMessage
+		err := json.Unmarshal(ctx.Request.Params, &params)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		if len(params) < 1 {
+			return fmt.Errorf("protocol violation")
+		}
+		_, sh, err := m.parseAddress(params[0])
+		if err != nil {
+			return rpcError(ctx, errCodeBadRequest, err.Error())
+		}
+		params[0], err = json.Marshal(hexHash(sh))
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		ctx.Request.Params, err = json.Marshal(params)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		return h(ctx)
+	}
+}
+
+func (m *mux) addressSubscribeHandler(ctx *jsonrpc.Ctx) error {
+	var params []json.RawMessage
+	err := json.Unmarshal(ctx.Request.Params, &params)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if len(params) < 1 {
+		return fmt.Errorf("protocol violation")
+	}
+	addr, sh, err := m.parseAddress(params[0])
+	if err != nil {
+		return rpcError(ctx, errCodeBadRequest, err.Error())
+	}
+	return m.subscribeScriptHash(
+		ctx, sh, "blockchain.address.subscribe", addr,
+	)
+}
+
+// parseAddress returns the address in param and its scripthash
+func (m *mux) parseAddress(param json.RawMessage) (string, [32]byte, error) {
+	var addr string
+	err := json.Unmarshal(param, &addr)
+	if err != nil {
+		return "", [32]byte{}, fmt.Errorf("invalid address")
+	}
+	spk, err := address.ToScriptPubkey(addr, m.w.Network())
+	if err != nil {
+		return "", [32]byte{}, fmt.Errorf("invalid address: %s", addr)
+	}
+	return addr, sha256.Sum256(spk), nil
+}
+
 func (m *mux) scriptHashGetBalanceHandler(ctx *jsonrpc.Ctx) error {
 	sh, err := parseScriptHash(ctx)
 	if err != nil {
@@ -147,7 +415,7 @@ func (m *mux) scriptHashGetBalanceHandler(ctx *jsonrpc.Ctx) error {
 		Conf   uint64 `json:"confirmed"`
 		Unconf uint64 `json:"unconfirmed"`
 	}
-	err = m.w.GetScriptHashBalance(m.ctx, &sh, &res.Conf, &res.Unconf)
+	err = m.w.GetScriptHashBalance(ctx.Context, &sh, &res.Conf, &res.Unconf)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -167,8 +435,35 @@ func (m *mux) scriptHashGetHistoryHandler(ctx *jsonrpc.Ctx) error {
 		TxHash string `json:"tx_hash"`
 		Height int    `json:"height"`
 	}
+	// the optional from_height and to_height params of newer protocol
+	// versions page through the history
+	var params []json.RawMessage
+	err = json.Unmarshal(ctx.Request.Params, &params)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	fromHeight, toHeight := 0, -1
+	if len(params) > 1 {
+		err = json.Unmarshal(params[1], &fromHeight)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	if len(params) > 2 {
+		err = json.Unmarshal(params[2], &toHeight)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
 	var res []txData
-	hist, err := m.w.GetScriptHashHistory(m.ctx, &sh)
+	hist, err := m.w.GetScriptHashHistory(ctx.Context, &sh, fromHeight, toHeight)
+	if errors.Is(err, walletmanager.ErrHistoryTooLarge) {
+		return rpcError(
+			ctx,
+			errCodeBadRequest,
+			"history too large, request it by height ranges",
+		)
+	}
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -199,7 +494,10 @@ func (m *mux) scriptHashListUnspentHandler(ctx *jsonrpc.Ctx) error {
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	unspentD, err := m.w.GetScriptHashUnspent(m.ctx, &sh)
+	unspentD, err := m.w.GetScriptHashUnspent(ctx.Context, &sh)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	type utxo struct {
 		Height int    `json:"height"`
 		TxPos  int    `json:"tx_pos"`
@@ -217,6 +515,9 @@ func (m *mux) scriptHashListUnspentHandler(ctx *jsonrpc.Ctx) error {
 		})
 	}
 	ctx.Response.Result, err = json.Marshal(res)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	return nil
 }
 
@@ -225,10 +526,20 @@ func (m *mux) scriptHashSubscribeHandler(ctx *jsonrpc.Ctx) error {
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	return m.subscribeScriptHash(
+		ctx, sh, "blockchain.scripthash.subscribe", hexHash(sh),
+	)
+}
+
+// subscribeScriptHash answers with the status of sh and notifies method
+// with name, the scripthash or address the client subscribed to
+func (m *mux) subscribeScriptHash(
+	ctx *jsonrpc.Ctx, sh [32]byte, method, name string,
+) error {
 	buf := m.bGet()
 	defer m.bPut(buf)
 	bClear(&buf)
-	status, err := m.w.GetScriptHashStatus(m.ctx, &sh, &buf)
+	status, err := m.w.GetScriptHashStatus(ctx.Context, &sh, &buf)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -240,26 +551,36 @@ func (m *mux) scriptHashSubscribeHandler(ctx *jsonrpc.Ctx) error {
 		)
 	}
 	connId := ctx.ConnId
-	m.w.ScriptHashSubscribe(connId, sh, func(status2 [32]byte) {
-		sh1 := sh
-		slices.Reverse(sh1[:])
-		shHex := hex.EncodeToString(sh1[:])
+	notify := func(status2 [32]byte) {
 		statusHex := hex.EncodeToString(status2[:])
 		err := ctx.Notifier.Notify(connId, &jsonrpc.Notification{
-			Method: []byte(`"blockchain.scripthash.subscribe"`),
+			Method: fmt.Appendf(nil, `"%s"`, method),
 			Params: fmt.Appendf(
-				nil, `["%s","%s"]`, shHex, statusHex,
+				nil, `["%s","%s"]`, name, statusHex,
 			),
+			// the latest status of the scripthash wins
+			Key: method + " " + name,
 		})
 		if err != nil {
 			m.log.Err(stackerr.Wrap(err))
 		}
-	})
+	}
+	err = m.w.ScriptHashSubscribe(ctx.Context, connId, sh, notify)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	return nil
 }
 
 func (m *mux) scriptHashUnsubscribeHandler(ctx *jsonrpc.Ctx) error {
+	sh, err := parseScriptHash(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	ctx.Response.Result = []byte("false")
+	if m.w.ScriptHashUnsubscribe(ctx.ConnId, sh) {
+		ctx.Response.Result = []byte("true")
+	}
 	return nil
 }
 
@@ -279,7 +600,7 @@ func (m *mux) transactionBroadcastHandler(ctx *jsonrpc.Ctx) error {
 	buf := m.bGet()
 	defer m.bPut(buf)
 	bClear(&buf)
-	txid, err := m.w.BroadcastTX(m.ctx, rawTx, &buf)
+	txid, err := m.w.BroadcastTX(ctx.Context, rawTx, &buf)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -291,6 +612,76 @@ func (m *mux) transactionBroadcastHandler(ctx *jsonrpc.Ctx) error {
 	return nil
 }
 
+func (m *mux) transactionBroadcastPackageHandler(ctx *jsonrpc.Ctx) error {
+	var (
+		params  []json.RawMessage
+		hexTxs  []string
+		verbose bool
+	)
+	err := json.Unmarshal(ctx.Request.Params, &params)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if len(params) < 1 {
+		return fmt.Errorf("bad param len")
+	}
+	err = json.Unmarshal(params[0], &hexTxs)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if len(params) > 1 {
+		err = json.Unmarshal(params[1], &verbose)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	rawTxs := make([][]byte, len(hexTxs))
+	for i := range hexTxs {
+		rawTxs[i], err = hex.DecodeString(hexTxs[i])
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	res, err := m.w.BroadcastPackage(ctx.Context, rawTxs)
+	var rpcErr *noderpc.Error
+	switch {
+	case errors.Is(err, walletmanager.ErrInvalidPackage),
+		errors.Is(err, walletmanager.ErrNoNodeRPC):
+		return rpcError(ctx, errCodeBadRequest, err.Error())
+	case errors.As(err, &rpcErr):
+		return rpcError(ctx, errCodeBadRequest, rpcErr.Message)
+	case err != nil:
+		return stackerr.Wrap(err)
+	}
+	// verbose asks for the node result as is
+	if verbose && res.Node != nil {
+		ctx.Response.Result = res.Node
+		return nil
+	}
+	type txError struct {
+		Txid  string `json:"txid"`
+		Error string `json:"error"`
+	}
+	r := struct {
+		Success bool      `json:"success"`
+		Errors  []txError `json:"errors,omitempty"`
+	}{Success: res.Success()}
+	for i := range res.Txs {
+		if res.Txs[i].Err == "" {
+			continue
+		}
+		r.Errors = append(r.Errors, txError{
+			Txid:  hexHash(res.Txs[i].Txid),
+			Error: res.Txs[i].Err,
+		})
+	}
+	ctx.Response.Result, err = json.Marshal(r)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
 func (m *mux) transactionGetHandler(ctx *jsonrpc.Ctx) error {
 	var params []json.RawMessage
 	var txidStr string
@@ -312,11 +703,33 @@ func (m *mux) transactionGetHandler(ctx *jsonrpc.Ctx) error {
 	slices.Reverse(txidS)
 	var txid [32]byte
 	copy(txid[:], txidS)
-	raw, err := m.w.GetRawTx(m.ctx, &txid)
+	var verbose bool
+	if len(params) > 1 {
+		err = json.Unmarshal(params[1], &verbose)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	if !verbose {
+		raw, err := m.w.GetRawTx(ctx.Context, &txid)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		ctx.Response.Result, err = json.Marshal(hex.EncodeToString(raw))
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		return nil
+	}
+	info, err := m.w.GetTransaction(ctx.Context, &txid)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	ctx.Response.Result, err = json.Marshal(hex.EncodeToString(raw))
+	res, err := m.verboseTransaction(ctx.Context, &info)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	ctx.Response.Result, err = json.Marshal(res)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -354,7 +767,7 @@ func (m *mux) transactionGetMerkleHandler(ctx *jsonrpc.Ctx) error {
 	buf := m.bGet()
 	defer m.bPut(buf)
 	bClear(&buf)
-	merkle, err := m.w.GetTransactionMerkle(m.ctx, &txid)
+	merkle, err := m.w.GetTransactionMerkle(ctx.Context, &txid)
 	var mRes struct {
 		BlockHeight int      `json:"block_height"`
 		Pos         int      `json:"pos"`
@@ -390,7 +803,7 @@ func (m *mux) transactionIdFromPosHandler(ctx *jsonrpc.Ctx) error {
 	defer m.bPut(buf)
 	bClear(&buf)
 	mrk, err := m.w.GetTransactionMerkleFromPos(
-		m.ctx, height, txpos,
+		ctx.Context, height, txpos,
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -455,12 +868,20 @@ func (m *mux) mempoolGetInfo(ctx *jsonrpc.Ctx) error {
 }
 
 func (m *mux) serverBannerHandler(ctx *jsonrpc.Ctx) error {
-	ctx.Response.Result = []byte(`"eps-go"`)
+	var err error
+	ctx.Response.Result, err = json.Marshal(m.banner(ctx.Context))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	return nil
 }
 
 func (m *mux) serverDonationAddressHandler(ctx *jsonrpc.Ctx) error {
-	ctx.Response.Result = []byte(`"none"`)
+	var err error
+	ctx.Response.Result, err = json.Marshal(m.opts.DonationAddress)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	return nil
 }
 
@@ -475,32 +896,121 @@ func (m *mux) pingHandler(ctx *jsonrpc.Ctx) error {
 }
 
 func (m *mux) serverVersionHandler(ctx *jsonrpc.Ctx) error {
-	var clientName, protoVersion string
+	var (
+		clientName   string
+		protoVersion json.RawMessage
+	)
 	params := []any{&clientName, &protoVersion}
 	err := json.Unmarshal(ctx.Request.Params, &params)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	if protoVersion != "1.4" {
-		return fmt.Errorf("bad client version: %s", protoVersion)
+	version, err := negotiateVersion(protoVersion)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	ctx.Response.Result, err = json.Marshal([]string{"eps-go", version})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// protocolVersions are the protocol versions served, in ascending order,
+// blockchain.outpoint.* needs 1.6
+var protocolVersions = []string{"1.4", "1.4.1", "1.4.2", "1.6"}
+
+// negotiateVersion returns the highest version served in the client range,
+// raw is a version, a [min, max] pair or empty for 1.4
+func negotiateVersion(raw json.RawMessage) (string, error) {
+	minVersion, maxVersion := "1.4", "1.4"
+	if len(raw) > 0 && raw[0] == '[' {
+		var r []string
+		err := json.Unmarshal(raw, &r)
+		if err != nil {
+			return "", stackerr.Wrap(err)
+		}
+		if len(r) != 2 {
+			return "", fmt.Errorf("bad client version range: %s", raw)
+		}
+		minVersion, maxVersion = r[0], r[1]
+	} else if len(raw) > 0 && string(raw) != "null" {
+		err := json.Unmarshal(raw, &minVersion)
+		if err != nil {
+			return "", stackerr.Wrap(err)
+		}
+		maxVersion = minVersion
+	}
+	lo, err := parseVersion(minVersion)
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	hi, err := parseVersion(maxVersion)
+	if err != nil {
+		return "", stackerr.Wrap(err)
+	}
+	for _, v := range slices.Backward(protocolVersions) {
+		pv, _ := parseVersion(v)
+		if slices.Compare(pv, lo) >= 0 && slices.Compare(pv, hi) <= 0 {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("bad client version: %s", raw)
+}
+
+// parseVersion splits a dotted protocol version, trailing zeros are dropped
+// so 1.4.0 equals 1.4
+func parseVersion(s string) ([]int, error) {
+	var v []int
+	for f := range strings.SplitSeq(s, ".") {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad version: %q", s)
+		}
+		v = append(v, n)
+	}
+	for len(v) > 1 && v[len(v)-1] == 0 {
+		v = v[:len(v)-1]
+	}
+	return v, nil
+}
+
+// errCodeBadRequest is the error code electrum servers use for requests
+// they refuse
+const errCodeBadRequest = 1
+
+// rpcError answers the request with an error, returning one from a handler
+// closes the connection instead
+func rpcError(ctx *jsonrpc.Ctx, code int, message string) error {
+	var err error
+	ctx.Response.Error, err = json.Marshal(struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}{code, message})
+	if err != nil {
+		return stackerr.Wrap(err)
 	}
-	ctx.Response.Result = []byte(`["eps-go", "1.4"]`)
 	return nil
 }
 
 func parseScriptHash(ctx *jsonrpc.Ctx) ([32]byte, error) {
 	var (
-		params []string
+		params []json.RawMessage
+		shStr  string
 		sh     [32]byte
 	)
 	err := json.Unmarshal(ctx.Request.Params, &params)
 	if err != nil {
 		return sh, stackerr.Wrap(err)
 	}
-	if len(params) < 1 || len(params[0]) != 64 {
+	if len(params) < 1 {
+		return sh, fmt.Errorf("protocol violation")
+	}
+	err = json.Unmarshal(params[0], &shStr)
+	if err != nil || len(shStr) != 64 {
 		return sh, fmt.Errorf("protocol violation")
 	}
-	shs, err := hex.DecodeString(params[0])
+	shs, err := hex.DecodeString(shStr)
 	if err != nil {
 		return sh, stackerr.Wrap(err)
 	}
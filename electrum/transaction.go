@@ -0,0 +1,190 @@
+package electrum
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/ncodysoftware/eps-go/address"
+	"github.com/ncodysoftware/eps-go/walletmanager"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// amount is a value in satoshis marshalled in BTC like bitcoind does
+type amount uint64
+
+func (a amount) MarshalJSON() ([]byte, error) {
+	return fmt.Appendf(nil, "%d.%08d", a/1e8, a%1e8), nil
+}
+
+type scriptPubkeyResult struct {
+	Hex     string `json:"hex"`
+	Address string `json:"address,omitempty"`
+	Type    string `json:"type"`
+}
+
+type prevoutResult struct {
+	Value        amount             `json:"value"`
+	ScriptPubkey scriptPubkeyResult `json:"scriptPubKey"`
+}
+
+type vinResult struct {
+	Coinbase  string `json:"coinbase,omitempty"`
+	Txid      string `json:"txid,omitempty"`
+	Vout      uint32 `json:"vout"`
+	ScriptSig *struct {
+		Hex string `json:"hex"`
+	} `json:"scriptSig,omitempty"`
+	Witness  []string       `json:"txinwitness,omitempty"`
+	Prevout  *prevoutResult `json:"prevout,omitempty"`
+	Sequence uint32         `json:"sequence"`
+}
+
+type voutResult struct {
+	Value        amount             `json:"value"`
+	N            int                `json:"n"`
+	ScriptPubkey scriptPubkeyResult `json:"scriptPubKey"`
+}
+
+// verboseTx is the verbose form of blockchain.transaction.get, the one of
+// bitcoind getrawtransaction
+type verboseTx struct {
+	Txid          string       `json:"txid"`
+	Hash          string       `json:"hash"`
+	Version       uint32       `json:"version"`
+	Size          int          `json:"size"`
+	Vsize         int          `json:"vsize"`
+	Weight        int          `json:"weight"`
+	Locktime      uint32       `json:"locktime"`
+	Vin           []vinResult  `json:"vin"`
+	Vout          []voutResult `json:"vout"`
+	Hex           string       `json:"hex"`
+	Blockhash     string       `json:"blockhash"`
+	Confirmations int          `json:"confirmations"`
+	Time          uint32       `json:"time"`
+	Blocktime     uint32       `json:"blocktime"`
+}
+
+func (m *mux) verboseTransaction(
+	ctx context.Context, info *walletmanager.TransactionInfo,
+) (verboseTx, error) {
+	var (
+		res verboseTx
+		tx  bitcoin.Transaction
+		buf []byte
+	)
+	err := tx.Deserialize(bytes.NewReader(info.Raw))
+	if err != nil {
+		return res, stackerr.Wrap(err)
+	}
+	net := m.w.Network()
+	txid := tx.Txid(&buf)
+	// Txid leaves the serialization without witness in buf
+	baseSize := len(buf)
+	res.Txid = hexHash(txid)
+	res.Hash = hexHash(doubleSha256(info.Raw))
+	res.Version = tx.Version
+	res.Size = len(info.Raw)
+	res.Weight = 3*baseSize + len(info.Raw)
+	res.Vsize = (res.Weight + 3) / 4
+	res.Locktime = tx.Locktime
+	res.Hex = hex.EncodeToString(info.Raw)
+	res.Blockhash = hexHash(info.BlockHash)
+	res.Confirmations = info.Confirmations
+	res.Time = info.BlockTime
+	res.Blocktime = info.BlockTime
+	res.Vin = make([]vinResult, 0, len(tx.Inputs))
+	for i := range tx.Inputs {
+		in := &tx.Inputs[i]
+		var vin vinResult
+		if i < len(tx.Witness) {
+			items := tx.Witness[i].StackItems
+			for j := range items {
+				item := hex.EncodeToString(items[j].Item)
+				vin.Witness = append(vin.Witness, item)
+			}
+		}
+		vin.Sequence = in.Sequence
+		if in.Txid == [32]byte{} && in.Vout == 0xffffffff {
+			vin.Coinbase = hex.EncodeToString(in.ScriptSig)
+			res.Vin = append(res.Vin, vin)
+			continue
+		}
+		vin.Txid = hexHash(in.Txid)
+		vin.Vout = in.Vout
+		vin.ScriptSig = &struct {
+			Hex string `json:"hex"`
+		}{hex.EncodeToString(in.ScriptSig)}
+		vin.Prevout, err = m.prevout(ctx, &in.Txid, in.Vout, net)
+		if err != nil {
+			return res, stackerr.Wrap(err)
+		}
+		res.Vin = append(res.Vin, vin)
+	}
+	res.Vout = make([]voutResult, 0, len(tx.Outputs))
+	for i := range tx.Outputs {
+		out := &tx.Outputs[i]
+		spk := makeScriptPubkeyResult(out.ScriptPubkey, net)
+		res.Vout = append(res.Vout, voutResult{
+			Value:        amount(out.Amount),
+			N:            i,
+			ScriptPubkey: spk,
+		})
+	}
+	return res, nil
+}
+
+// prevout returns the output spent by an input, nil when the funding
+// transaction is not stored, the verbose tx does not fetch the parents
+func (m *mux) prevout(
+	ctx context.Context, txid *[32]byte, vout uint32, net bitcoin.Network,
+) (*prevoutResult, error) {
+	raw, err := m.w.GetStoredRawTx(ctx, txid)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	var tx bitcoin.Transaction
+	err = tx.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if int(vout) >= len(tx.Outputs) {
+		return nil, fmt.Errorf("bad prevout %d", vout)
+	}
+	out := &tx.Outputs[vout]
+	return &prevoutResult{
+		Value:        amount(out.Amount),
+		ScriptPubkey: makeScriptPubkeyResult(out.ScriptPubkey, net),
+	}, nil
+}
+
+func makeScriptPubkeyResult(
+	spk []byte, net bitcoin.Network,
+) scriptPubkeyResult {
+	addr, _ := address.FromScriptPubkey(spk, net)
+	return scriptPubkeyResult{
+		Hex:     hex.EncodeToString(spk),
+		Address: addr,
+		Type:    address.Type(spk),
+	}
+}
+
+// hexHash encodes h in the reversed byte order of the protocol
+func hexHash(h [32]byte) string {
+	slices.Reverse(h[:])
+	return hex.EncodeToString(h[:])
+}
+
+func doubleSha256(data []byte) [32]byte {
+	h := sha256.Sum256(data)
+	return sha256.Sum256(h[:])
+}
@@ -0,0 +1,175 @@
+package gcs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+// BIP158 basic filter parameters
+const (
+	P = 19
+	M = 784931
+)
+
+// MatchAny reports whether any of the items may be in the BIP158 basic
+// filter of the block with the given hash
+func MatchAny(
+	filter []byte, blockHash *[32]byte, items [][]byte, buf *[]uint64,
+) (bool, error) {
+	var buf2 []uint64
+	if buf == nil {
+		buf = &buf2
+	}
+	n, off := readCompactSize(filter)
+	if off == 0 {
+		return false, fmt.Errorf("bad filter size")
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+	var (
+		f  = n * M
+		k0 = binary.LittleEndian.Uint64(blockHash[0:8])
+		k1 = binary.LittleEndian.Uint64(blockHash[8:16])
+	)
+	*buf = (*buf)[:0]
+	for i := range items {
+		*buf = append(*buf, hashToRange(items[i], f, k0, k1))
+	}
+	slices.Sort(*buf)
+	query := *buf
+	r := bitReader{data: filter[off:]}
+	var value uint64
+	for range n {
+		delta, err := r.readGolombRice()
+		if err != nil {
+			return false, err
+		}
+		value += delta
+		for len(query) > 0 && query[0] < value {
+			query = query[1:]
+		}
+		if len(query) == 0 {
+			return false, nil
+		}
+		if query[0] == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func hashToRange(item []byte, f, k0, k1 uint64) uint64 {
+	hi, _ := bits.Mul64(sipHash24(k0, k1, item), f)
+	return hi
+}
+
+type bitReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *bitReader) readBit() (uint64, error) {
+	idx := r.pos / 8
+	if idx >= len(r.data) {
+		return 0, fmt.Errorf("filter truncated")
+	}
+	bit := (r.data[idx] >> (7 - r.pos%8)) & 1
+	r.pos++
+	return uint64(bit), nil
+}
+
+func (r *bitReader) readGolombRice() (uint64, error) {
+	var q uint64
+	for {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		if bit == 0 {
+			break
+		}
+		q++
+	}
+	var rem uint64
+	for range P {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		rem = rem<<1 | bit
+	}
+	return q<<P | rem, nil
+}
+
+func sipHash24(k0, k1 uint64, msg []byte) uint64 {
+	v0 := k0 ^ 0x736f6d6570736575
+	v1 := k1 ^ 0x646f72616e646f6d
+	v2 := k0 ^ 0x6c7967656e657261
+	v3 := k1 ^ 0x7465646279746573
+	round := func() {
+		v0 += v1
+		v1 = bits.RotateLeft64(v1, 13)
+		v1 ^= v0
+		v0 = bits.RotateLeft64(v0, 32)
+		v2 += v3
+		v3 = bits.RotateLeft64(v3, 16)
+		v3 ^= v2
+		v0 += v3
+		v3 = bits.RotateLeft64(v3, 21)
+		v3 ^= v0
+		v2 += v1
+		v1 = bits.RotateLeft64(v1, 17)
+		v1 ^= v2
+		v2 = bits.RotateLeft64(v2, 32)
+	}
+	b := uint64(len(msg)) << 56
+	for len(msg) >= 8 {
+		m := binary.LittleEndian.Uint64(msg)
+		v3 ^= m
+		round()
+		round()
+		v0 ^= m
+		msg = msg[8:]
+	}
+	for i := range msg {
+		b |= uint64(msg[i]) << (8 * i)
+	}
+	v3 ^= b
+	round()
+	round()
+	v0 ^= b
+	v2 ^= 0xff
+	round()
+	round()
+	round()
+	round()
+	return v0 ^ v1 ^ v2 ^ v3
+}
+
+func readCompactSize(b []byte) (uint64, int) {
+	if len(b) < 1 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfd:
+		if len(b) < 3 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+	case 0xfe:
+		if len(b) < 5 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint32(b[1:])), 5
+	case 0xff:
+		if len(b) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9
+	default:
+		return uint64(b[0]), 1
+	}
+}
@@ -0,0 +1,140 @@
+package gcs
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestSipHash24(t *testing.T) {
+	// vectors from the siphash reference implementation
+	key := make([]byte, 16)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	k0 := binary.LittleEndian.Uint64(key[:8])
+	k1 := binary.LittleEndian.Uint64(key[8:])
+	msg := make([]byte, 15)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	assert.MustEqual(t, uint64(0x726fdb47dd0e0e31), sipHash24(k0, k1, nil))
+	assert.MustEqual(
+		t, uint64(0x74f839c593dc67fd), sipHash24(k0, k1, msg[:1]),
+	)
+	assert.MustEqual(t, uint64(0xa129ca6149be45e5), sipHash24(k0, k1, msg))
+}
+
+func TestMatchAnyTestnetGenesis(t *testing.T) {
+	// BIP158 test vector, testnet block 0
+	blockHash := tHash(
+		"000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	)
+	filter := tHexDecode("019dfca8")
+	script := tHexDecode(
+		"4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f" +
+			"61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c70" +
+			"2b6bf11d5fac",
+	)
+	var buf []uint64
+	ok, err := MatchAny(filter, &blockHash, [][]byte{script}, &buf)
+	assert.Must(t, err)
+	assert.MustEqual(t, true, ok)
+	ok, err = MatchAny(filter, &blockHash, [][]byte{script[1:]}, &buf)
+	assert.Must(t, err)
+	assert.MustEqual(t, false, ok)
+}
+
+func TestMatchAny(t *testing.T) {
+	var blockHash [32]byte
+	blockHash[0] = 0xaa
+	var items, others [][]byte
+	for i := range 500 {
+		items = append(items, fmt.Appendf(nil, "script %d", i))
+		others = append(others, fmt.Appendf(nil, "other %d", i))
+	}
+	filter := tBuildFilter(&blockHash, items)
+	var buf []uint64
+	for i := range items {
+		ok, err := MatchAny(
+			filter, &blockHash, [][]byte{others[i], items[i]}, &buf,
+		)
+		assert.Must(t, err)
+		assert.MustEqual(t, true, ok)
+	}
+	ok, err := MatchAny(filter, &blockHash, others, &buf)
+	assert.Must(t, err)
+	assert.MustEqual(t, false, ok)
+	ok, err = MatchAny(filter[:len(filter)/2], &blockHash, others, &buf)
+	assert.MustEqual(t, false, ok)
+	if err == nil {
+		t.Fatal("expected truncated filter error")
+	}
+}
+
+// tBuildFilter encodes a BIP158 filter with the given items
+func tBuildFilter(blockHash *[32]byte, items [][]byte) []byte {
+	var (
+		n      = uint64(len(items))
+		k0     = binary.LittleEndian.Uint64(blockHash[0:8])
+		k1     = binary.LittleEndian.Uint64(blockHash[8:16])
+		values []uint64
+	)
+	for i := range items {
+		values = append(values, hashToRange(items[i], n*M, k0, k1))
+	}
+	slices.Sort(values)
+	values = slices.Compact(values)
+	var (
+		out   = []byte{byte(len(values))}
+		acc   byte
+		nbits int
+		last  uint64
+	)
+	if len(values) >= 0xfd {
+		out = binary.LittleEndian.AppendUint16(
+			[]byte{0xfd}, uint16(len(values)),
+		)
+	}
+	writeBit := func(bit uint64) {
+		acc = acc<<1 | byte(bit)
+		nbits++
+		if nbits == 8 {
+			out = append(out, acc)
+			acc, nbits = 0, 0
+		}
+	}
+	for _, v := range values {
+		delta := v - last
+		last = v
+		for range delta >> P {
+			writeBit(1)
+		}
+		writeBit(0)
+		for i := P - 1; i >= 0; i-- {
+			writeBit((delta >> i) & 1)
+		}
+	}
+	if nbits > 0 {
+		out = append(out, acc<<(8-nbits))
+	}
+	return out
+}
+
+func tHash(s string) [32]byte {
+	h := [32]byte(tHexDecode(s))
+	slices.Reverse(h[:])
+	return h
+}
+
+func tHexDecode(s string) []byte {
+	d, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
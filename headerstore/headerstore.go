@@ -0,0 +1,276 @@
+package headerstore
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/ncodysoftware/eps-go/internal/filelock"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+const HeaderSize = 80
+
+var (
+	ErrNotLinked = errors.New("header does not link to the tip")
+	ErrInUse     = errors.New("headers file opened by another process")
+)
+
+// Store keeps the block headers in an append only file of 80 byte records,
+// the record n is the header at height n and the first one is the genesis
+// header. The whole chain is held in memory, reads never touch the file.
+type Store struct {
+	// nil when the store is kept in memory only
+	f    *os.File
+	lock *filelock.Lock
+	data []byte
+	// keyed by the first 8 bytes of the header hash, heights are checked
+	// against the full hash. The rare colliding hashes go to collisions.
+	index      map[uint64]int32
+	collisions map[[32]byte]int32
+	recovered  int
+	// roots of the complete merkle spans and hashes of the last one, see
+	// Branch
+	nodes   [][32]byte
+	pending [][32]byte
+}
+
+// Open loads the headers file at path, creating it with genesis when it
+// does not exist. A torn record or a header not linking to the previous
+// one, left by a crash while appending, is truncated away. The file is
+// locked until Close, Open fails with ErrInUse while another process has it
+// open. With an empty path the store is kept in memory.
+func Open(path string, genesis *[HeaderSize]byte) (*Store, error) {
+	s := &Store{
+		index:      make(map[uint64]int32),
+		collisions: make(map[[32]byte]int32),
+	}
+	if path == "" {
+		s.add(genesis[:])
+		return s, nil
+	}
+	lock, err := filelock.Acquire(path + ".lock")
+	if errors.Is(err, filelock.ErrLocked) {
+		return nil, fmt.Errorf("%s: %w", path, ErrInUse)
+	}
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	s.lock = lock
+	err = s.open(path, genesis)
+	if err != nil {
+		s.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	return s, nil
+}
+
+func (s *Store) open(path string, genesis *[HeaderSize]byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	s.f = f
+	data, err := readAll(f)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if len(data) >= HeaderSize &&
+		[HeaderSize]byte(data[:HeaderSize]) != *genesis {
+		return fmt.Errorf(
+			"headers file %s belongs to another network", path,
+		)
+	}
+	valid := 0
+	for off := 0; off+HeaderSize <= len(data); off += HeaderSize {
+		if off > 0 && !s.links(data[off:off+HeaderSize]) {
+			break
+		}
+		s.add(data[off : off+HeaderSize])
+		valid = off + HeaderSize
+	}
+	if valid == len(data) && valid > 0 {
+		return nil
+	}
+	s.recovered = (len(data) - valid + HeaderSize - 1) / HeaderSize
+	if valid == 0 {
+		s.add(genesis[:])
+		_, err = f.WriteAt(genesis[:], 0)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	err = s.truncateFile()
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func readAll(f *os.File) ([]byte, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	data := make([]byte, st.Size())
+	_, err = f.ReadAt(data, 0)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return data, nil
+}
+
+// Recovered returns the number of records dropped by Open
+func (s *Store) Recovered() int {
+	return s.recovered
+}
+
+// Tip returns the height of the last header
+func (s *Store) Tip() int {
+	return len(s.data)/HeaderSize - 1
+}
+
+// Header copies the header at height to out
+func (s *Store) Header(height int, out *[HeaderSize]byte) bool {
+	if height < 0 || height > s.Tip() {
+		return false
+	}
+	copy(out[:], s.data[height*HeaderSize:])
+	return true
+}
+
+// Headers returns up to limit serialized headers starting at height. The
+// slice is shared with the store, it must not be modified or kept across
+// Append and Truncate.
+func (s *Store) Headers(height, limit int) []byte {
+	if height < 0 || height > s.Tip() || limit <= 0 {
+		return nil
+	}
+	end := min(s.Tip()+1, height+limit)
+	return s.data[height*HeaderSize : end*HeaderSize]
+}
+
+// Hash returns the hash of the header at height
+func (s *Store) Hash(height int) ([32]byte, bool) {
+	if height < 0 || height > s.Tip() {
+		return [32]byte{}, false
+	}
+	off := height * HeaderSize
+	return doubleSha256(s.data[off : off+HeaderSize]), true
+}
+
+// Height returns the height of the header with hash
+func (s *Store) Height(hash *[32]byte) (int, bool) {
+	if height, ok := s.collisions[*hash]; ok {
+		return int(height), true
+	}
+	height, ok := s.index[binary.LittleEndian.Uint64(hash[:])]
+	if !ok {
+		return 0, false
+	}
+	h, _ := s.Hash(int(height))
+	if h != *hash {
+		return 0, false
+	}
+	return int(height), true
+}
+
+// Append adds serialized headers on top of the tip and syncs the file.
+// Every header must link to the previous one.
+func (s *Store) Append(headers []byte) error {
+	if len(headers)%HeaderSize != 0 {
+		return fmt.Errorf("bad headers size: %d", len(headers))
+	}
+	tip := s.Tip()
+	for off := 0; off < len(headers); off += HeaderSize {
+		if !s.links(headers[off : off+HeaderSize]) {
+			s.truncate(tip)
+			return ErrNotLinked
+		}
+		s.add(headers[off : off+HeaderSize])
+	}
+	if s.f == nil {
+		return nil
+	}
+	_, err := s.f.WriteAt(headers, int64((tip+1)*HeaderSize))
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		s.truncate(tip)
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// Truncate removes the headers above height, the genesis header is kept
+func (s *Store) Truncate(height int) error {
+	if height < 0 || height >= s.Tip() {
+		return nil
+	}
+	s.truncate(height)
+	if s.f == nil {
+		return nil
+	}
+	return s.truncateFile()
+}
+
+func (s *Store) Close() error {
+	var err error
+	if s.f != nil {
+		err = s.f.Close()
+	}
+	if s.lock != nil {
+		s.lock.Unlock()
+	}
+	return err
+}
+
+func (s *Store) truncateFile() error {
+	err := s.f.Truncate(int64(len(s.data)))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return s.f.Sync()
+}
+
+// links reports whether header links to the tip
+func (s *Store) links(header []byte) bool {
+	tip, _ := s.Hash(s.Tip())
+	return [32]byte(header[4:36]) == tip
+}
+
+func (s *Store) add(header []byte) {
+	height := int32(len(s.data) / HeaderSize)
+	s.data = append(s.data, header...)
+	hash := doubleSha256(header)
+	key := binary.LittleEndian.Uint64(hash[:])
+	s.addMerkle(hash)
+	if _, ok := s.index[key]; ok {
+		s.collisions[hash] = height
+		return
+	}
+	s.index[key] = height
+}
+
+// truncate drops the headers above height from memory
+func (s *Store) truncate(height int) {
+	for h := s.Tip(); h > height; h-- {
+		hash, _ := s.Hash(h)
+		key := binary.LittleEndian.Uint64(hash[:])
+		if _, ok := s.collisions[hash]; ok {
+			delete(s.collisions, hash)
+			continue
+		}
+		delete(s.index, key)
+	}
+	s.data = s.data[:(height+1)*HeaderSize]
+	s.truncateMerkle(height)
+}
+
+func doubleSha256(data []byte) [32]byte {
+	hash := sha256.Sum256(data)
+	return sha256.Sum256(hash[:])
+}
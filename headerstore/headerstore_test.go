@@ -0,0 +1,189 @@
+package headerstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+// tChain returns n serialized headers linking to genesis
+func tChain(genesis *[HeaderSize]byte, n int, nonce byte) []byte {
+	prev := doubleSha256(genesis[:])
+	var chain []byte
+	for i := range n {
+		var raw [HeaderSize]byte
+		copy(raw[4:36], prev[:])
+		raw[78] = nonce
+		raw[79] = byte(i)
+		chain = append(chain, raw[:]...)
+		prev = doubleSha256(raw[:])
+	}
+	return chain
+}
+
+func TestStore(t *testing.T) {
+	genesis := [HeaderSize]byte{1}
+	path := filepath.Join(t.TempDir(), "headers.dat")
+	s, err := Open(path, &genesis)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, s.Tip())
+	chain := tChain(&genesis, 10, 0)
+	assert.Must(t, s.Append(chain[:5*HeaderSize]))
+	assert.Must(t, s.Append(chain[5*HeaderSize:]))
+	assert.MustEqual(t, 10, s.Tip())
+	assert.MustEqual(t, chain[2*HeaderSize:5*HeaderSize], s.Headers(3, 3))
+	assert.MustEqual(t, 2*HeaderSize, len(s.Headers(9, 5)))
+	assert.MustEqual(t, 0, len(s.Headers(11, 5)))
+	var h [HeaderSize]byte
+	assert.MustEqual(t, true, s.Header(0, &h))
+	assert.MustEqual(t, genesis, h)
+	assert.MustEqual(t, false, s.Header(11, &h))
+	hash, ok := s.Hash(7)
+	assert.MustEqual(t, true, ok)
+	height, ok := s.Height(&hash)
+	assert.MustEqual(t, true, ok)
+	assert.MustEqual(t, 7, height)
+	// a header not linking to the tip is rejected
+	err = s.Append(chain[:HeaderSize])
+	assert.MustEqual(t, true, errors.Is(err, ErrNotLinked))
+	assert.MustEqual(t, 10, s.Tip())
+	// a reorg replaces the headers above 6
+	assert.Must(t, s.Truncate(6))
+	_, ok = s.Height(&hash)
+	assert.MustEqual(t, false, ok)
+	fork := tChain(&genesis, 9, 1)
+	err = s.Append(fork[6*HeaderSize:])
+	assert.MustEqual(t, true, errors.Is(err, ErrNotLinked))
+	assert.Must(t, s.Truncate(0))
+	assert.Must(t, s.Append(fork))
+	assert.Must(t, s.Close())
+	s, err = Open(path, &genesis)
+	assert.Must(t, err)
+	assert.MustEqual(t, 9, s.Tip())
+	assert.MustEqual(t, 0, s.Recovered())
+	assert.MustEqual(t, fork, s.Headers(1, 9))
+	// a second opener could truncate the file under the first one
+	_, err = Open(path, &genesis)
+	assert.MustEqual(t, true, errors.Is(err, ErrInUse))
+	assert.Must(t, s.Close())
+	// another network
+	_, err = Open(path, &[HeaderSize]byte{2})
+	assert.MustEqual(t, true, err != nil)
+	s, err = Open(path, &genesis)
+	assert.Must(t, err)
+	assert.Must(t, s.Close())
+}
+
+func TestStoreRecovery(t *testing.T) {
+	genesis := [HeaderSize]byte{1}
+	path := filepath.Join(t.TempDir(), "headers.dat")
+	chain := tChain(&genesis, 4, 0)
+	// a torn record at the end
+	data := append(genesis[:], chain...)
+	data = append(data, make([]byte, 30)...)
+	assert.Must(t, os.WriteFile(path, data, 0o644))
+	s, err := Open(path, &genesis)
+	assert.Must(t, err)
+	assert.MustEqual(t, 4, s.Tip())
+	assert.MustEqual(t, 1, s.Recovered())
+	assert.Must(t, s.Close())
+	st, err := os.Stat(path)
+	assert.Must(t, err)
+	assert.MustEqual(t, int64(5*HeaderSize), st.Size())
+	// a record not linking to the previous one
+	data = append(genesis[:], chain[:2*HeaderSize]...)
+	data = append(data, chain[3*HeaderSize:]...)
+	assert.Must(t, os.WriteFile(path, data, 0o644))
+	s, err = Open(path, &genesis)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, s.Tip())
+	assert.MustEqual(t, 1, s.Recovered())
+	assert.Must(t, s.Append(chain[2*HeaderSize:]))
+	assert.Must(t, s.Close())
+	// an empty file gets the genesis header
+	assert.Must(t, os.WriteFile(path, nil, 0o644))
+	s, err = Open(path, &genesis)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, s.Tip())
+	assert.Must(t, s.Close())
+	st, err = os.Stat(path)
+	assert.Must(t, err)
+	assert.MustEqual(t, int64(HeaderSize), st.Size())
+}
+
+// tMerkleRoot is the bitcoin merkle root of hashes
+func tMerkleRoot(hashes [][32]byte) [32]byte {
+	lvl := append([][32]byte{}, hashes...)
+	for len(lvl) > 1 {
+		if len(lvl)%2 != 0 {
+			lvl = append(lvl, lvl[len(lvl)-1])
+		}
+		var next [][32]byte
+		for i := 0; i < len(lvl); i += 2 {
+			next = append(next, hashPair(&lvl[i], &lvl[i+1]))
+		}
+		lvl = next
+	}
+	return lvl[0]
+}
+
+func TestBranch(t *testing.T) {
+	genesis := [HeaderSize]byte{1}
+	s, err := Open("", &genesis)
+	assert.Must(t, err)
+	chain := tChain(&genesis, 3*merkleSpan, 0)
+	assert.Must(t, s.Append(chain))
+	hashes := make([][32]byte, s.Tip()+1)
+	for h := range hashes {
+		hashes[h], _ = s.Hash(h)
+	}
+	check := func(height, cpHeight int) {
+		t.Helper()
+		branch, root, err := s.Branch(height, cpHeight)
+		assert.Must(t, err)
+		assert.MustEqual(t, tMerkleRoot(hashes[:cpHeight+1]), root)
+		current, pos := hashes[height], height
+		for _, v := range branch {
+			if pos%2 == 0 {
+				current = hashPair(&current, &v)
+			} else {
+				current = hashPair(&v, &current)
+			}
+			pos /= 2
+		}
+		assert.MustEqual(t, root, current)
+	}
+	for _, c := range [][2]int{
+		{0, 1},
+		{5, 5},
+		{7, 100},
+		{100, merkleSpan - 1},
+		{3, merkleSpan},
+		{merkleSpan, merkleSpan},
+		{10, 2*merkleSpan - 1},
+		{merkleSpan + 7, 2*merkleSpan + 33},
+		{2*merkleSpan + 30, 2*merkleSpan + 33},
+		{3 * merkleSpan, 3 * merkleSpan},
+	} {
+		check(c[0], c[1])
+	}
+	_, _, err = s.Branch(10, 9)
+	assert.MustEqual(t, true, err != nil)
+	_, _, err = s.Branch(10, s.Tip()+1)
+	assert.MustEqual(t, true, err != nil)
+	// the cached nodes above a reorg are dropped
+	assert.Must(t, s.Truncate(merkleSpan+5))
+	check(merkleSpan, merkleSpan+5)
+	fork := tChain(&genesis, 2*merkleSpan, 1)
+	assert.Must(t, s.Truncate(0))
+	assert.Must(t, s.Append(fork))
+	hashes = hashes[:s.Tip()+1]
+	for h := range hashes {
+		hashes[h], _ = s.Hash(h)
+	}
+	check(merkleSpan+3, 2*merkleSpan)
+	check(3, 2*merkleSpan-1)
+}
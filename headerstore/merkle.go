@@ -0,0 +1,119 @@
+package headerstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+)
+
+// merkleLevel is the level of the header hashes merkle tree cached by the
+// store, every cached node is the root of merkleSpan headers
+const (
+	merkleLevel = 10
+	merkleSpan  = 1 << merkleLevel
+)
+
+// Branch returns the merkle branch of the header at height and the root of
+// the tree of the header hashes 0..cpHeight, the checkpoint proof of the
+// electrum protocol. The hashes are in internal byte order.
+func (s *Store) Branch(height, cpHeight int) ([][32]byte, [32]byte, error) {
+	if height < 0 || height > cpHeight || cpHeight > s.Tip() {
+		return nil, [32]byte{}, fmt.Errorf(
+			"require height %d <= cp_height %d <= tip %d",
+			height,
+			cpHeight,
+			s.Tip(),
+		)
+	}
+	n := cpHeight + 1
+	span := height / merkleSpan
+	leaves := s.spanHashes(span, n)
+	if n <= merkleSpan {
+		branch, root := merkleBranch(leaves, height, -1)
+		return branch, root, nil
+	}
+	branch, spanRoot := merkleBranch(
+		leaves, height-span*merkleSpan, merkleLevel,
+	)
+	// the cached nodes cover the complete spans, the last one may end
+	// before cpHeight
+	last := cpHeight / merkleSpan
+	nodes := make([][32]byte, 0, last+1)
+	nodes = append(nodes, s.nodes[:last]...)
+	switch {
+	case span == last:
+		nodes = append(nodes, spanRoot)
+	case n%merkleSpan == 0:
+		nodes = append(nodes, s.nodes[last])
+	default:
+		_, root := merkleBranch(s.spanHashes(last, n), 0, merkleLevel)
+		nodes = append(nodes, root)
+	}
+	upper, root := merkleBranch(nodes, span, -1)
+	return append(branch, upper...), root, nil
+}
+
+// spanHashes returns the hashes of the headers of span below height end
+func (s *Store) spanHashes(span, end int) [][32]byte {
+	start := span * merkleSpan
+	end = min(end, start+merkleSpan)
+	hashes := make([][32]byte, 0, end-start)
+	for h := start; h < end; h++ {
+		hash, _ := s.Hash(h)
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+// addMerkle caches the root of the span completed by the header hash
+func (s *Store) addMerkle(hash [32]byte) {
+	s.pending = append(s.pending, hash)
+	if len(s.pending) < merkleSpan {
+		return
+	}
+	_, root := merkleBranch(s.pending, 0, merkleLevel)
+	s.nodes = append(s.nodes, root)
+	s.pending = s.pending[:0]
+}
+
+// truncateMerkle drops the cached nodes above height
+func (s *Store) truncateMerkle(height int) {
+	span := (height + 1) / merkleSpan
+	s.nodes = s.nodes[:span]
+	s.pending = append(s.pending[:0], s.spanHashes(span, height+1)...)
+}
+
+// merkleBranch returns the branch of leaves[pos] and the node levels above
+// the leaves, the root when levels is negative. The last node of an odd
+// level is paired with itself.
+func merkleBranch(
+	leaves [][32]byte, pos, levels int,
+) ([][32]byte, [32]byte) {
+	lvl := slices.Clone(leaves)
+	var branch [][32]byte
+	for i := 0; levels >= 0 && i < levels || levels < 0 && len(lvl) > 1; i++ {
+		sibling := pos ^ 1
+		if sibling >= len(lvl) {
+			sibling = pos
+		}
+		branch = append(branch, lvl[sibling])
+		for j := 0; j < len(lvl); j += 2 {
+			right := lvl[j]
+			if j+1 < len(lvl) {
+				right = lvl[j+1]
+			}
+			lvl[j/2] = hashPair(&lvl[j], &right)
+		}
+		lvl = lvl[:(len(lvl)+1)/2]
+		pos /= 2
+	}
+	return branch, lvl[0]
+}
+
+func hashPair(left, right *[32]byte) [32]byte {
+	var buf [64]byte
+	copy(buf[:32], left[:])
+	copy(buf[32:], right[:])
+	hash := sha256.Sum256(buf[:])
+	return sha256.Sum256(hash[:])
+}
@@ -0,0 +1,45 @@
+// Package filelock takes exclusive advisory locks on files, the lock of a
+// process is released when it exits.
+package filelock
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// ErrLocked is returned by Acquire when another process holds the lock
+var ErrLocked = errors.New("file locked by another process")
+
+type Lock struct {
+	f *os.File
+}
+
+// Acquire locks path, creating it if needed, without waiting
+func Acquire(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	err = lock(f)
+	if err != nil {
+		f.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return nil, stackerr.Wrap(err)
+	}
+	return &Lock{f: f}, nil
+}
+
+// Unlock releases the lock, the file is kept
+func (l *Lock) Unlock() error {
+	err := unlock(l.f)
+	if err != nil {
+		l.f.Close()
+		return stackerr.Wrap(err)
+	}
+	return l.f.Close()
+}
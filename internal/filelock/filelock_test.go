@@ -0,0 +1,23 @@
+package filelock
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db.lock")
+	l, err := Acquire(path)
+	assert.Must(t, err)
+	// flock locks belong to the open file, a second open conflicts also
+	// within the process
+	_, err = Acquire(path)
+	assert.MustEqual(t, true, errors.Is(err, ErrLocked))
+	assert.Must(t, l.Unlock())
+	l, err = Acquire(path)
+	assert.Must(t, err)
+	assert.Must(t, l.Unlock())
+}
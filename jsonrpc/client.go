@@ -25,6 +25,9 @@ const (
 type ClientOpts struct {
 	NHandler NotificationHandlerFunc
 	Flags    clientFlags
+	// TLSConfig is used with the TLS flag, nil verifies the server against
+	// the system roots
+	TLSConfig *tls.Config
 }
 
 type Client struct {
@@ -48,12 +51,18 @@ func NewClient(
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
-	if opts.Flags&(TLS|TLSNoVerify) == (TLS | TLSNoVerify) {
-		conn = tls.Client(conn, &tls.Config{
-			InsecureSkipVerify: true,
-		})
-	} else if opts.Flags&TLS != 0 {
-		conn = tls.Client(conn, &tls.Config{})
+	if opts.Flags&TLS != 0 {
+		cfg := &tls.Config{}
+		if opts.TLSConfig != nil {
+			cfg = opts.TLSConfig.Clone()
+		}
+		if opts.Flags&TLSNoVerify != 0 {
+			cfg.InsecureSkipVerify = true
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		conn = tls.Client(conn, cfg)
 	}
 	ctx, cancel := context.WithCancel(ctx)
 	c := &Client{
@@ -80,6 +89,11 @@ func (c *Client) Close(ctx context.Context) error {
 	}
 }
 
+// Done is closed when the connection is lost or the client closed
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 func (c *Client) Send(req Request) (Response, error) {
 	select {
 	case c.reqC <- req:
@@ -0,0 +1,119 @@
+package jsonrpc
+
+import (
+	"errors"
+	"sync"
+)
+
+// maxQueuedNotifications bounds the notifications waiting to be written to
+// a connection, a client this far behind is disconnected
+const maxQueuedNotifications = 10000
+
+// maxQueuedRequestBytes bounds the size of the requests read ahead of the
+// one being handled, a client pipelining more is disconnected. Wallets
+// send their scripthash subscriptions at once, a few hundred bytes each.
+const maxQueuedRequestBytes = 1 << 20
+
+var (
+	errQueueFull        = errors.New("notification queue full")
+	errRequestQueueFull = errors.New("request queue full")
+)
+
+// notifyQueue holds the notifications of a connection until the writer
+// sends them. A notification replaces the queued one with the same Key.
+type notifyQueue struct {
+	mu    sync.Mutex
+	items []Notification
+	// position in items of the queued keys
+	keys  map[string]int
+	ready chan struct{}
+}
+
+func newNotifyQueue() *notifyQueue {
+	return &notifyQueue{
+		keys:  make(map[string]int),
+		ready: make(chan struct{}, 1),
+	}
+}
+
+func (q *notifyQueue) push(n *Notification) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if i, ok := q.keys[n.Key]; ok && n.Key != "" {
+		q.items[i] = *n
+		return nil
+	}
+	if len(q.items) >= maxQueuedNotifications {
+		return errQueueFull
+	}
+	if n.Key != "" {
+		q.keys[n.Key] = len(q.items)
+	}
+	q.items = append(q.items, *n)
+	trySend(q.ready, struct{}{})
+	return nil
+}
+
+// pop appends the queued notifications to out and empties the queue
+func (q *notifyQueue) pop(out []Notification) []Notification {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	out = append(out, q.items...)
+	clear(q.items)
+	q.items = q.items[:0]
+	clear(q.keys)
+	return out
+}
+
+// requestQueue holds the requests of a connection until the handler takes
+// them. The reader never waits on it, so it sees the client disconnect
+// while a request is handled.
+type requestQueue struct {
+	mu    sync.Mutex
+	items []queuedRequest
+	// sum of the sizes of items
+	size  int
+	ready chan struct{}
+}
+
+type queuedRequest struct {
+	r    Request
+	size int
+}
+
+func newRequestQueue() *requestQueue {
+	return &requestQueue{ready: make(chan struct{}, 1)}
+}
+
+// push queues r, size is the length of its encoding
+func (q *requestQueue) push(r *Request, size int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.size+size > maxQueuedRequestBytes {
+		return errRequestQueueFull
+	}
+	q.size += size
+	q.items = append(q.items, queuedRequest{r: *r, size: size})
+	trySend(q.ready, struct{}{})
+	return nil
+}
+
+// pop returns the oldest request, false when the queue is empty. ready is
+// signaled again while requests are left.
+func (q *requestQueue) pop() (Request, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return Request{}, false
+	}
+	r := q.items[0]
+	q.items[0] = queuedRequest{}
+	q.items = q.items[1:]
+	q.size -= r.size
+	if len(q.items) == 0 {
+		q.items = nil
+	} else {
+		trySend(q.ready, struct{}{})
+	}
+	return r.r, true
+}
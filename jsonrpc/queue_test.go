@@ -0,0 +1,75 @@
+package jsonrpc
+
+import (
+	"errors"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestNotifyQueue(t *testing.T) {
+	q := newNotifyQueue()
+	for _, n := range []Notification{
+		{Params: []byte(`["h",1]`), Key: "h"},
+		{Params: []byte(`["a",1]`), Key: "a"},
+		{Params: []byte(`["x"]`)},
+		{Params: []byte(`["h",2]`), Key: "h"},
+		{Params: []byte(`["x"]`)},
+		{Params: []byte(`["a",2]`), Key: "a"},
+	} {
+		assert.Must(t, q.push(&n))
+	}
+	<-q.ready
+	var params []string
+	for _, n := range q.pop(nil) {
+		params = append(params, string(n.Params))
+	}
+	// the latest of each key in the position of the first one
+	assert.MustEqual(
+		t, []string{`["h",2]`, `["a",2]`, `["x"]`, `["x"]`}, params,
+	)
+	assert.MustEqual(t, 0, len(q.pop(nil)))
+	// a key popped is queued again
+	assert.Must(t, q.push(&Notification{Key: "h"}))
+	assert.MustEqual(t, 1, len(q.pop(nil)))
+	assert.Must(t, q.push(&Notification{Key: "h"}))
+	for range maxQueuedNotifications - 1 {
+		assert.Must(t, q.push(&Notification{}))
+	}
+	err := q.push(&Notification{})
+	assert.MustEqual(t, true, errors.Is(err, errQueueFull))
+	// a queued key is still replaced on a full queue
+	assert.Must(t, q.push(&Notification{Key: "h"}))
+	err = q.push(&Notification{Key: "a"})
+	assert.MustEqual(t, true, errors.Is(err, errQueueFull))
+	q.pop(nil)
+	assert.Must(t, q.push(&Notification{Key: "a"}))
+}
+
+func TestRequestQueue(t *testing.T) {
+	q := newRequestQueue()
+	_, ok := q.pop()
+	assert.MustEqual(t, false, ok)
+	for _, id := range []string{"1", "2"} {
+		assert.Must(t, q.push(&Request{Id: []byte(id)}, 10))
+	}
+	// ready stays signaled while requests are left
+	for _, id := range []string{"1", "2"} {
+		<-q.ready
+		r, ok := q.pop()
+		assert.MustEqual(t, true, ok)
+		assert.MustEqual(t, id, string(r.Id))
+	}
+	select {
+	case <-q.ready:
+		t.Fatal("ready on an empty queue")
+	default:
+	}
+	assert.Must(t, q.push(&Request{}, maxQueuedRequestBytes-1))
+	err := q.push(&Request{}, 2)
+	assert.MustEqual(t, true, errors.Is(err, errRequestQueueFull))
+	// the size of a popped request is freed
+	_, ok = q.pop()
+	assert.MustEqual(t, true, ok)
+	assert.Must(t, q.push(&Request{}, 2))
+}
@@ -26,6 +26,8 @@ type Notifier interface {
 }
 
 type Ctx struct {
+	// Context is cancelled when the connection closes
+	Context  context.Context
 	ConnId   uint32
 	Request  Request
 	Response Response
@@ -33,7 +35,8 @@ type Ctx struct {
 }
 
 type connState struct {
-	notChan chan<- Notification
+	queue *notifyQueue
+	errC  chan<- error
 }
 
 type Server struct {
@@ -108,11 +111,13 @@ func (s *Server) Notify(connId uint32, n *Notification) error {
 		n.JsonRPC = []byte(`"2.0"`)
 	}
 	s.log.Debugf("%d <== %s", connId, n)
-	ok = trySend(st.notChan, *n)
-	if ok {
-		return nil
+	err := st.queue.push(n)
+	if err != nil {
+		// the client does not read, drop the connection
+		trySend(st.errC, stackerr.Wrap(err))
+		return stackerr.Wrap(err)
 	}
-	return fmt.Errorf("sending notification would block")
+	return nil
 }
 
 type connAccepter interface {
@@ -137,8 +142,9 @@ func (s *Server) run(
 			s.log.Err(stackerr.Wrap(err))
 			continue
 		}
+		id := connId
 		wg.Go(func() {
-			err := s.connHandler(ctx, conn, connId, h)
+			err := s.connHandler(ctx, conn, id, h)
 			if err != nil {
 				s.log.Err(stackerr.Wrap(err))
 			}
@@ -160,13 +166,13 @@ func (s *Server) connHandler(
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 	errC := make(chan error, 1)
-	reqC := make(chan Request, 1)
+	reqs := newRequestQueue()
 	resC := make(chan Response, 1)
-	notC := make(chan Notification, 1)
+	queue := newNotifyQueue()
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	s.mu.Lock()
-	s.connections[connId] = connState{notC}
+	s.connections[connId] = connState{queue: queue, errC: errC}
 	s.mu.Unlock()
 	defer func() {
 		s.mu.Lock()
@@ -174,13 +180,13 @@ func (s *Server) connHandler(
 		s.mu.Unlock()
 	}()
 	wg.Go(func() {
-		s.read(ctx, errC, reqC, conn)
+		s.read(ctx, errC, reqs, conn)
 	})
 	wg.Go(func() {
-		s.write(ctx, errC, resC, notC, conn)
+		s.write(ctx, errC, resC, queue, conn)
 	})
 	wg.Go(func() {
-		s.rpcLoop(ctx, errC, reqC, resC, connId, h)
+		s.rpcLoop(ctx, errC, reqs, resC, connId, h)
 	})
 	select {
 	case err := <-errC:
@@ -214,18 +220,24 @@ func (s *Server) connHandler(
 func (s *Server) read(
 	ctx context.Context,
 	errC chan<- error,
-	reqC chan<- Request,
+	reqs *requestQueue,
 	conn net.Conn,
 ) {
 	dec := json.NewDecoder(conn)
 	for ctx.Err() == nil {
 		var r Request
+		offset := dec.InputOffset()
 		err := dec.Decode(&r)
 		if err != nil {
 			trySend(errC, stackerr.Wrap(err))
 			return
 		}
-		reqC <- r
+		err = reqs.push(&r, int(dec.InputOffset()-offset))
+		if err != nil {
+			// the client sends more than it waits for, drop it
+			trySend(errC, stackerr.Wrap(err))
+			return
+		}
 	}
 }
 
@@ -233,10 +245,11 @@ func (s *Server) write(
 	ctx context.Context,
 	errC chan<- error,
 	resC <-chan Response,
-	notC <-chan Notification,
+	queue *notifyQueue,
 	conn net.Conn,
 ) {
 	enc := json.NewEncoder(conn)
+	var notifications []Notification
 	for ctx.Err() == nil {
 		select {
 		case r := <-resC:
@@ -245,12 +258,16 @@ func (s *Server) write(
 				trySend(errC, stackerr.Wrap(err))
 				return
 			}
-		case n := <-notC:
-			err := enc.Encode(n)
-			if err != nil {
-				trySend(errC, stackerr.Wrap(err))
-				return
+		case <-queue.ready:
+			notifications = queue.pop(notifications[:0])
+			for i := range notifications {
+				err := enc.Encode(&notifications[i])
+				if err != nil {
+					trySend(errC, stackerr.Wrap(err))
+					return
+				}
 			}
+			clear(notifications)
 		case <-ctx.Done():
 			return
 		}
@@ -260,7 +277,7 @@ func (s *Server) write(
 func (s *Server) rpcLoop(
 	ctx context.Context,
 	errC chan<- error,
-	reqC <-chan Request,
+	reqs *requestQueue,
 	resC chan<- Response,
 	connId uint32,
 	h ServerHandler,
@@ -271,11 +288,17 @@ func (s *Server) rpcLoop(
 loop:
 	for ctx.Err() == nil {
 		var c Ctx
+		c.Context = ctx
 		c.ConnId = connId
 		select {
 		case <-ctx.Done():
 			break loop
-		case c.Request = <-reqC:
+		case <-reqs.ready:
+			var ok bool
+			c.Request, ok = reqs.pop()
+			if !ok {
+				continue
+			}
 			s.log.Debugf("%d ==> %s", c.ConnId, &c.Request)
 			c.Notifier = s
 			err = h.OnRequest(&c)
@@ -285,7 +308,11 @@ loop:
 			c.Response.Id = c.Request.Id
 			c.Response.JsonRPC = []byte(`"2.0"`)
 			s.log.Debugf("%d <== %s", c.ConnId, &c.Response)
-			resC <- c.Response
+			select {
+			case resC <- c.Response:
+			case <-ctx.Done():
+				break loop
+			}
 		}
 	}
 	h.OnDisconnect(connId)
@@ -0,0 +1,65 @@
+package jsonrpc
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/log"
+)
+
+// blockingHandler waits in OnRequest until the connection is cancelled
+type blockingHandler struct {
+	started   chan struct{}
+	cancelled chan struct{}
+}
+
+func (h *blockingHandler) OnConnect(uint32)    {}
+func (h *blockingHandler) OnDisconnect(uint32) {}
+
+func (h *blockingHandler) OnRequest(ctx *Ctx) error {
+	trySend(h.started, struct{}{})
+	<-ctx.Context.Done()
+	trySend(h.cancelled, struct{}{})
+	return ctx.Context.Err()
+}
+
+func TestDisconnectWhileHandling(t *testing.T) {
+	s := &Server{
+		log:         log.New(log.LevelFromString("error"), "eps-go"),
+		connections: make(map[uint32]connState),
+	}
+	h := &blockingHandler{
+		started:   make(chan struct{}, 1),
+		cancelled: make(chan struct{}, 1),
+	}
+	srvConn, cliConn := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- s.connHandler(t.Context(), srvConn, 0, h)
+	}()
+	// pipelined requests queue up behind the blocked one
+	for i := range 3 {
+		_, err := cliConn.Write(
+			[]byte(`{"jsonrpc":"2.0","id":` + string('0'+byte(i)) +
+				`,"method":"m","params":[]}` + "\n"),
+		)
+		assert.Must(t, err)
+	}
+	<-h.started
+	assert.Must(t, cliConn.Close())
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second*5)
+	defer cancel()
+	select {
+	case <-h.cancelled:
+	case <-ctx.Done():
+		t.Fatal("the handler is not cancelled on disconnect")
+	}
+	select {
+	case <-done:
+	case <-ctx.Done():
+		t.Fatal("the connection is not closed")
+	}
+}
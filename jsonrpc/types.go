@@ -23,6 +23,9 @@ type Notification struct {
 	JsonRPC json.RawMessage `json:"jsonrpc"`
 	Method  json.RawMessage `json:"method"`
 	Params  json.RawMessage `json:"params"`
+	// Key coalesces queued notifications, a notification replaces the
+	// unsent one with the same non-empty Key
+	Key string `json:"-"`
 }
 
 func (j *Notification) String() string {
@@ -0,0 +1,138 @@
+---
+BEGIN;
+---
+-- scriptpubkey_tx had no key, duplicated rows are dropped while copying
+CREATE TABLE scriptpubkey_tx_new (
+	scriptpubkey_hash BLOB NOT NULL,
+	txid BLOB NOT NULL,
+	PRIMARY KEY (scriptpubkey_hash, txid)
+) WITHOUT ROWID;
+---
+INSERT OR IGNORE INTO scriptpubkey_tx_new
+(scriptpubkey_hash, txid)
+SELECT scriptpubkey_hash, txid
+FROM scriptpubkey_tx;
+---
+DROP TABLE scriptpubkey_tx;
+---
+ALTER TABLE scriptpubkey_tx_new RENAME TO scriptpubkey_tx;
+---
+CREATE INDEX scriptpubkey_tx_txid_idx
+ON scriptpubkey_tx (txid);
+---
+-- one header per height. The headers chaining to the newest tip are kept,
+-- the newest one where the chain is broken. The index is rolled back below
+-- the first duplicated height, the wallets scan it again.
+CREATE TABLE blockheader_keep (
+	hash BLOB PRIMARY KEY
+) WITHOUT ROWID;
+---
+WITH RECURSIVE chain(hash, prev) AS (
+	SELECT hash, SUBSTR(serialized, 5, 32)
+	FROM blockheader
+	WHERE rowid = (
+		SELECT MAX(rowid)
+		FROM blockheader
+		WHERE height = (SELECT MAX(height) FROM blockheader)
+	)
+	UNION
+	SELECT bh.hash, SUBSTR(bh.serialized, 5, 32)
+	FROM blockheader AS bh
+	JOIN chain
+	ON bh.hash = chain.prev
+)
+INSERT INTO blockheader_keep
+(hash)
+SELECT hash
+FROM chain;
+---
+INSERT OR IGNORE INTO blockheader_keep
+(hash)
+SELECT hash
+FROM blockheader
+WHERE rowid IN (
+	SELECT MAX(rowid)
+	FROM blockheader
+	GROUP BY height
+)
+AND height NOT IN (
+	SELECT bh.height
+	FROM blockheader AS bh
+	JOIN blockheader_keep AS k
+	ON k.hash = bh.hash
+);
+---
+CREATE TABLE blockheader_rollback AS
+SELECT MIN(height) AS height
+FROM (
+	SELECT height
+	FROM blockheader
+	GROUP BY height
+	HAVING COUNT(*) > 1
+);
+---
+DELETE FROM scriptpubkey_tx
+WHERE txid IN (
+	SELECT tx.txid
+	FROM tx
+	JOIN blockheader AS bh
+	ON bh.hash = tx.blockhash
+	WHERE bh.height >= (SELECT height FROM blockheader_rollback)
+);
+---
+INSERT OR IGNORE INTO unspent_output
+(txid_vout, satoshi, scriptpubkey_hash)
+SELECT txid_vout, satoshi, scriptpubkey_hash
+FROM spent_output
+WHERE spent_height >= (SELECT height FROM blockheader_rollback);
+---
+DELETE FROM spent_output
+WHERE spent_height >= (SELECT height FROM blockheader_rollback);
+---
+DELETE FROM unspent_output
+WHERE SUBSTR(txid_vout, 1, 32) IN (
+	SELECT tx.txid
+	FROM tx
+	JOIN blockheader AS bh
+	ON bh.hash = tx.blockhash
+	WHERE bh.height >= (SELECT height FROM blockheader_rollback)
+);
+---
+DELETE FROM tx
+WHERE blockhash IN (
+	SELECT hash
+	FROM blockheader
+	WHERE height >= (SELECT height FROM blockheader_rollback)
+);
+---
+UPDATE wallet
+SET height = (SELECT height - 1 FROM blockheader_rollback)
+WHERE height >= (SELECT height FROM blockheader_rollback);
+---
+DELETE FROM blockheader
+WHERE hash NOT IN (
+	SELECT hash
+	FROM blockheader_keep
+);
+---
+DROP TABLE blockheader_keep;
+---
+DROP TABLE blockheader_rollback;
+---
+CREATE UNIQUE INDEX blockheader_height_idx
+ON blockheader (height);
+---
+CREATE INDEX tx_blockhash_pos_idx
+ON tx (blockhash, pos);
+---
+CREATE INDEX unspent_output_scriptpubkey_hash_idx
+ON unspent_output (scriptpubkey_hash);
+---
+CREATE INDEX unspent_output_txid_idx
+ON unspent_output (SUBSTR(txid_vout, 1, 32));
+---
+CREATE INDEX spent_output_spent_height_idx
+ON spent_output (spent_height);
+---
+COMMIT;
+---
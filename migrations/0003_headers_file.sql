@@ -0,0 +1,37 @@
+---
+BEGIN;
+---
+-- the headers moved to the headers file, the txs keep the height of their
+-- block. blockheader is only read once to import the headers.
+ALTER TABLE tx ADD COLUMN height INTEGER NOT NULL DEFAULT -1;
+---
+UPDATE tx
+SET height = (
+	SELECT bh.height
+	FROM blockheader AS bh
+	WHERE bh.hash = tx.blockhash
+)
+WHERE EXISTS (
+	SELECT 1
+	FROM blockheader AS bh
+	WHERE bh.hash = tx.blockhash
+);
+---
+DROP INDEX tx_blockhash_pos_idx;
+---
+CREATE INDEX tx_height_pos_idx
+ON tx (height, pos);
+---
+-- the genesis hash of the network the index was built for
+CREATE TABLE IF NOT EXISTS network (
+	genesis BLOB PRIMARY KEY
+);
+---
+INSERT INTO network
+(genesis)
+SELECT SUBSTR(serialized, 5, 32)
+FROM blockheader
+WHERE height = 1;
+---
+COMMIT;
+---
@@ -0,0 +1,11 @@
+---
+BEGIN;
+---
+-- the spenders of the outputs spent before spent_output.spender_txid, see
+-- runBackfills
+INSERT INTO backfill
+(name)
+VALUES ('spender_txid');
+---
+COMMIT;
+---
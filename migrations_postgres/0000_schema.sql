@@ -0,0 +1,63 @@
+---
+BEGIN;
+---
+CREATE TABLE IF NOT EXISTS wallet (
+	hash BYTEA PRIMARY KEY,
+	height INTEGER NOT NULL,
+	next_receive_index BIGINT NOT NULL,
+	next_change_index BIGINT NOT NULL
+);
+---
+CREATE TABLE IF NOT EXISTS blockheader (
+	hash BYTEA PRIMARY KEY,
+	height INTEGER NOT NULL,
+	serialized BYTEA NOT NULL
+);
+---
+CREATE UNIQUE INDEX IF NOT EXISTS blockheader_height_idx
+ON blockheader (height);
+---
+CREATE TABLE IF NOT EXISTS unspent_output (
+	txid_vout BYTEA PRIMARY KEY,
+	satoshi BIGINT NOT NULL,
+	scriptpubkey_hash BYTEA NOT NULL
+);
+---
+CREATE INDEX IF NOT EXISTS unspent_output_scriptpubkey_hash_idx
+ON unspent_output (scriptpubkey_hash);
+---
+CREATE INDEX IF NOT EXISTS unspent_output_txid_idx
+ON unspent_output ((SUBSTR(txid_vout, 1, 32)));
+---
+CREATE TABLE IF NOT EXISTS tx (
+	txid BYTEA PRIMARY KEY,
+	blockhash BYTEA NOT NULL,
+	pos INTEGER NOT NULL,
+	serialized BYTEA NOT NULL,
+	merkle_proof BYTEA NOT NULL
+);
+---
+CREATE INDEX IF NOT EXISTS tx_blockhash_pos_idx
+ON tx (blockhash, pos);
+---
+CREATE TABLE IF NOT EXISTS scriptpubkey_tx (
+	scriptpubkey_hash BYTEA NOT NULL,
+	txid BYTEA NOT NULL,
+	PRIMARY KEY (scriptpubkey_hash, txid)
+);
+---
+CREATE INDEX IF NOT EXISTS scriptpubkey_tx_txid_idx
+ON scriptpubkey_tx (txid);
+---
+CREATE TABLE IF NOT EXISTS spent_output (
+	txid_vout BYTEA PRIMARY KEY,
+	satoshi BIGINT NOT NULL,
+	scriptpubkey_hash BYTEA NOT NULL,
+	spent_height INTEGER NOT NULL
+);
+---
+CREATE INDEX IF NOT EXISTS spent_output_spent_height_idx
+ON spent_output (spent_height);
+---
+COMMIT;
+---
@@ -0,0 +1,31 @@
+---
+BEGIN;
+---
+-- the headers moved to the headers file, the txs keep the height of their
+-- block. blockheader is only read once to import the headers.
+ALTER TABLE tx ADD COLUMN IF NOT EXISTS height INTEGER NOT NULL DEFAULT -1;
+---
+UPDATE tx
+SET height = bh.height
+FROM blockheader AS bh
+WHERE bh.hash = tx.blockhash;
+---
+DROP INDEX IF EXISTS tx_blockhash_pos_idx;
+---
+CREATE INDEX IF NOT EXISTS tx_height_pos_idx
+ON tx (height, pos);
+---
+-- the genesis hash of the network the index was built for
+CREATE TABLE IF NOT EXISTS network (
+	genesis BYTEA PRIMARY KEY
+);
+---
+INSERT INTO network
+(genesis)
+SELECT SUBSTRING(serialized FROM 5 FOR 32)
+FROM blockheader
+WHERE height = 1
+ON CONFLICT DO NOTHING;
+---
+COMMIT;
+---
@@ -0,0 +1,8 @@
+---
+BEGIN;
+---
+-- the tx spending the output, NULL for outputs spent before this column
+ALTER TABLE spent_output ADD COLUMN IF NOT EXISTS spender_txid BYTEA;
+---
+COMMIT;
+---
@@ -0,0 +1,26 @@
+---
+BEGIN;
+---
+-- the txs spent by the inputs of the wallet txs, a parent fetched on demand
+-- is searched below its children
+CREATE TABLE IF NOT EXISTS tx_input (
+	parent_txid BYTEA NOT NULL,
+	child_txid BYTEA NOT NULL,
+	PRIMARY KEY (parent_txid, child_txid)
+);
+---
+CREATE INDEX IF NOT EXISTS tx_input_child_txid_idx
+ON tx_input (child_txid);
+---
+-- the data eps-go fills at startup for the rows stored before the table or
+-- column holding it, a row is deleted once its backfill is done
+CREATE TABLE IF NOT EXISTS backfill (
+	name TEXT PRIMARY KEY
+);
+---
+INSERT INTO backfill
+(name)
+VALUES ('tx_input');
+---
+COMMIT;
+---
@@ -0,0 +1,102 @@
+package noderpc
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestSubmitPackage(t *testing.T) {
+	var req struct {
+		Method string          `json:"method"`
+		Params [][]string      `json:"params"`
+		Id     json.RawMessage `json:"id"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			user, pass, ok := r.BasicAuth()
+			assert.MustEqual(t, true, ok)
+			assert.MustEqual(t, "u:p", user+":"+pass)
+			assert.Must(t, json.NewDecoder(r.Body).Decode(&req))
+			if len(req.Params[0]) == 1 {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"result":null,"error":{"code":-25,` +
+					`"message":"package topology disallowed"},"id":0}`))
+				return
+			}
+			w.Write([]byte(`{"result":{"package_msg":"success",` +
+				`"tx-results":{"bb":{"txid":"aa"}}},"error":null,"id":0}`))
+		},
+	))
+	defer srv.Close()
+	c, err := New("http://u:p@" + srv.Listener.Addr().String())
+	assert.Must(t, err)
+	raw, res, err := c.SubmitPackage(t.Context(), [][]byte{{1}, {2}})
+	assert.Must(t, err)
+	assert.MustEqual(t, "submitpackage", req.Method)
+	assert.MustEqual(t, [][]string{{"01", "02"}}, req.Params)
+	assert.MustEqual(t, "success", res.PackageMsg)
+	assert.MustEqual(t, "aa", res.TxResults["bb"].Txid)
+	assert.MustEqual(t, true, len(raw) > 0)
+	_, _, err = c.SubmitPackage(t.Context(), [][]byte{{1}})
+	var rpcErr *Error
+	assert.MustEqual(t, true, errors.As(err, &rpcErr))
+	assert.MustEqual(t, -25, rpcErr.Code)
+}
+
+func TestGetMempoolSize(t *testing.T) {
+	var req struct {
+		Method string `json:"method"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Must(t, json.NewDecoder(r.Body).Decode(&req))
+			w.Write([]byte(`{"result":{"loaded":true,"size":42,` +
+				`"bytes":9000},"error":null,"id":0}`))
+		},
+	))
+	defer srv.Close()
+	c, err := New("http://" + srv.Listener.Addr().String())
+	assert.Must(t, err)
+	n, err := c.GetMempoolSize(t.Context())
+	assert.Must(t, err)
+	assert.MustEqual(t, "getmempoolinfo", req.Method)
+	assert.MustEqual(t, 42, n)
+}
+
+func TestGetRawTransaction(t *testing.T) {
+	var req struct {
+		Method string `json:"method"`
+		Params []any  `json:"params"`
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			assert.Must(t, json.NewDecoder(r.Body).Decode(&req))
+			if req.Params[0] != "aa" {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"result":null,"error":{"code":-5,` +
+					`"message":"No such mempool transaction"},"id":0}`))
+				return
+			}
+			w.Write([]byte(`{"result":{"txid":"aa","hex":"0200",` +
+				`"blockhash":"bb","confirmations":1},"error":null,"id":0}`))
+		},
+	))
+	defer srv.Close()
+	c, err := New("http://" + srv.Listener.Addr().String())
+	assert.Must(t, err)
+	res, err := c.GetRawTransaction(t.Context(), "aa")
+	assert.Must(t, err)
+	assert.MustEqual(t, "getrawtransaction", req.Method)
+	assert.MustEqual(t, []any{"aa", true}, req.Params)
+	assert.MustEqual(t, "0200", res.Hex)
+	assert.MustEqual(t, "bb", res.BlockHash)
+	_, err = c.GetRawTransaction(t.Context(), "cc")
+	var rpcErr *Error
+	assert.MustEqual(t, true, errors.As(err, &rpcErr))
+	assert.MustEqual(t, -5, rpcErr.Code)
+}
@@ -0,0 +1,135 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// BIP157 limits for a single request
+const (
+	MaxCFiltersPerRequest  = 1000
+	MaxCFHeadersPerRequest = 2000
+)
+
+const filterTypeBasic = 0
+
+type CFilter struct {
+	BlockHash [32]byte
+	Filter    []byte
+}
+
+type CFHeaders struct {
+	StopHash     [32]byte
+	PrevHeader   [32]byte
+	FilterHashes [][32]byte
+}
+
+// GetCFilters returns the basic filters of count blocks starting at
+// startHeight and ending at the block stopHash. The peer is closed when the
+// request is abandoned, the filters still in flight would stall it.
+func (p *Peer) GetCFilters(
+	ctx context.Context, startHeight, count int, stopHash [32]byte,
+) ([]CFilter, error) {
+	if count > MaxCFiltersPerRequest {
+		return nil, fmt.Errorf("too many filters requested: %d", count)
+	}
+	err := p.write(
+		cmdGetCFilters, makeFilterRequest(startHeight, stopHash),
+	)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	filters := make([]CFilter, 0, count)
+	for range count {
+		timer := time.NewTimer(blockTimeout)
+		select {
+		case f := <-p.cfilterC:
+			filters = append(filters, f)
+		case <-p.done:
+			timer.Stop()
+			return nil, stackerr.Wrap(p.closedErr())
+		case <-timer.C:
+			p.cancel()
+			return nil, fmt.Errorf("timed out waiting for cfilter")
+		case <-ctx.Done():
+			timer.Stop()
+			p.cancel()
+			return nil, stackerr.Wrap(ctx.Err())
+		}
+		timer.Stop()
+	}
+	return filters, nil
+}
+
+// GetCFHeaders returns the basic filter hashes of the blocks from
+// startHeight to the block stopHash and the filter header preceding them,
+// the peer is closed when the request is abandoned
+func (p *Peer) GetCFHeaders(
+	ctx context.Context, startHeight int, stopHash [32]byte,
+) (CFHeaders, error) {
+	err := p.write(
+		cmdGetCFHeaders, makeFilterRequest(startHeight, stopHash),
+	)
+	if err != nil {
+		return CFHeaders{}, stackerr.Wrap(err)
+	}
+	timer := time.NewTimer(blockTimeout)
+	defer timer.Stop()
+	select {
+	case h := <-p.cfheadersC:
+		return h, nil
+	case <-p.done:
+		return CFHeaders{}, stackerr.Wrap(p.closedErr())
+	case <-timer.C:
+		p.cancel()
+		return CFHeaders{}, fmt.Errorf("timed out waiting for cfheaders")
+	case <-ctx.Done():
+		p.cancel()
+		return CFHeaders{}, stackerr.Wrap(ctx.Err())
+	}
+}
+
+func makeFilterRequest(startHeight int, stopHash [32]byte) []byte {
+	buf := make([]byte, 0, 1+4+32)
+	buf = append(buf, filterTypeBasic)
+	buf = binary.LittleEndian.AppendUint32(buf, uint32(startHeight))
+	buf = append(buf, stopHash[:]...)
+	return buf
+}
+
+func parseCFilter(payload []byte, out *CFilter) error {
+	if len(payload) < 1+32 || payload[0] != filterTypeBasic {
+		return fmt.Errorf("bad cfilter payload")
+	}
+	copy(out.BlockHash[:], payload[1:33])
+	size, n := readCompactSize(payload[33:])
+	if n == 0 || uint64(len(payload)-33-n) != size {
+		return fmt.Errorf("bad cfilter size")
+	}
+	// the serialized filter, starting with its element count
+	out.Filter = bytes.Clone(payload[33+n:])
+	return nil
+}
+
+func parseCFHeaders(payload []byte, out *CFHeaders) error {
+	if len(payload) < 1+32+32 || payload[0] != filterTypeBasic {
+		return fmt.Errorf("bad cfheaders payload")
+	}
+	copy(out.StopHash[:], payload[1:33])
+	copy(out.PrevHeader[:], payload[33:65])
+	count, n := readCompactSize(payload[65:])
+	rest := payload[65+n:]
+	if n == 0 || uint64(len(rest)) != count*32 {
+		return fmt.Errorf("bad cfheaders size")
+	}
+	out.FilterHashes = make([][32]byte, count)
+	for i := range out.FilterHashes {
+		copy(out.FilterHashes[i][:], rest[i*32:])
+	}
+	return nil
+}
@@ -0,0 +1,482 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/log"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+const (
+	ServiceNetwork        uint64 = 1 << 0
+	ServiceWitness        uint64 = 1 << 3
+	ServiceCompactFilters uint64 = 1 << 6
+	ServiceNetworkLimited uint64 = 1 << 10
+)
+
+// NetworkLimitedBlocks is the depth from the tip served by nodes announcing
+// only ServiceNetworkLimited (BIP159)
+const NetworkLimitedBlocks = 288
+
+const (
+	protoVersion     = 70016
+	maxPayload       = 32 << 20
+	handshakeTimeout = time.Second * 30
+	blockTimeout     = time.Minute * 2
+	invBlock         = 2
+	invWitnessFlag   = 0x40000000
+	invWitnessBlock  = invBlock | invWitnessFlag
+	maxInvPerMessage = 50000
+)
+
+var magicBytes = [...][4]byte{
+	bitcoin.Mainnet: {0xf9, 0xbe, 0xb4, 0xd9},
+	bitcoin.Testnet: {0x0b, 0x11, 0x09, 0x07},
+	bitcoin.Regtest: {0xfa, 0xbf, 0xb5, 0xda},
+}
+
+// MagicBytes returns the message start of the network, also used as the
+// record marker of the node block files
+func MagicBytes(network bitcoin.Network) [4]byte {
+	return magicBytes[network]
+}
+
+var (
+	ErrBlockTimeout  = errors.New("timed out waiting for block")
+	ErrBlockNotFound = errors.New("block not found by the node")
+)
+
+type command [12]byte
+
+var (
+	cmdVersion  = makeCommand("version")
+	cmdVerack   = makeCommand("verack")
+	cmdPing     = makeCommand("ping")
+	cmdPong     = makeCommand("pong")
+	cmdGetdata  = makeCommand("getdata")
+	cmdBlock    = makeCommand("block")
+	cmdNotFound = makeCommand("notfound")
+	//
+	cmdGetCFilters  = makeCommand("getcfilters")
+	cmdCFilter      = makeCommand("cfilter")
+	cmdGetCFHeaders = makeCommand("getcfheaders")
+	cmdCFHeaders    = makeCommand("cfheaders")
+)
+
+func makeCommand(s string) command {
+	var c command
+	copy(c[:], s)
+	return c
+}
+
+// Peer is a bare bitcoin p2p connection used for bulk block download.
+// Unlike bitcoin.Client it allows many getdata requests in flight, blocks
+// are handed back as raw payloads in the order the node sends them.
+type Peer struct {
+	log      *log.Logger
+	conn     net.Conn
+	magic    [4]byte
+	services uint64
+	height   int
+	//
+	cancel func()
+	done   chan struct{}
+	err    error
+	wmu    sync.Mutex
+	blockC chan []byte
+	// hashes of requested blocks the node does not have
+	notFoundC chan [32]byte
+	//
+	cfilterC   chan CFilter
+	cfheadersC chan CFHeaders
+}
+
+func Dial(
+	ctx context.Context,
+	log *log.Logger,
+	addr string,
+	network bitcoin.Network,
+) (*Peer, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	p, err := newPeer(ctx, log, conn, network)
+	if err != nil {
+		conn.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	return p, nil
+}
+
+func newPeer(
+	ctx context.Context,
+	log *log.Logger,
+	conn net.Conn,
+	network bitcoin.Network,
+) (*Peer, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	p := &Peer{
+		log:    log,
+		conn:   conn,
+		magic:  magicBytes[network],
+		cancel: cancel,
+		done:   make(chan struct{}),
+		blockC: make(chan []byte),
+		//
+		notFoundC: make(chan [32]byte),
+		//
+		cfilterC:   make(chan CFilter),
+		cfheadersC: make(chan CFHeaders),
+	}
+	err := p.handshake()
+	if err != nil {
+		cancel()
+		return nil, stackerr.Wrap(err)
+	}
+	go func() {
+		defer close(p.done)
+		p.err = p.read(ctx)
+	}()
+	go func() {
+		<-ctx.Done()
+		p.conn.Close()
+	}()
+	return p, nil
+}
+
+func (p *Peer) Close() error {
+	p.cancel()
+	<-p.done
+	return nil
+}
+
+// Services returns the service bits announced by the node
+func (p *Peer) Services() uint64 {
+	return p.services
+}
+
+// StartHeight returns the best height announced by the node
+func (p *Peer) StartHeight() int {
+	return p.height
+}
+
+// GetBlocks requests the blocks, they are delivered by ReadBlock in the
+// same order
+func (p *Peer) GetBlocks(hashes [][32]byte) error {
+	var payload []byte
+	for len(hashes) > 0 {
+		n := min(len(hashes), maxInvPerMessage)
+		payload = appendCompactSize(payload[:0], uint64(n))
+		for i := range n {
+			payload = binary.LittleEndian.AppendUint32(
+				payload, invWitnessBlock,
+			)
+			payload = append(payload, hashes[i][:]...)
+		}
+		err := p.write(cmdGetdata, payload)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		hashes = hashes[n:]
+	}
+	return nil
+}
+
+// ReadBlock returns the next serialized block sent by the node. When the
+// node answers with notfound, e.g. a pruned block, the error wraps
+// ErrBlockNotFound.
+func (p *Peer) ReadBlock(ctx context.Context) ([]byte, error) {
+	timer := time.NewTimer(blockTimeout)
+	defer timer.Stop()
+	select {
+	case b := <-p.blockC:
+		return b, nil
+	case hash := <-p.notFoundC:
+		return nil, fmt.Errorf("%w: %x", ErrBlockNotFound, hash)
+	case <-p.done:
+		return nil, stackerr.Wrap(p.closedErr())
+	case <-timer.C:
+		return nil, stackerr.Wrap(ErrBlockTimeout)
+	case <-ctx.Done():
+		return nil, stackerr.Wrap(ctx.Err())
+	}
+}
+
+func (p *Peer) closedErr() error {
+	if p.err != nil {
+		return p.err
+	}
+	return fmt.Errorf("p2p connection closed")
+}
+
+func (p *Peer) handshake() error {
+	err := p.conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	err = p.write(cmdVersion, makeVersionPayload())
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	var gotVersion, gotVerack bool
+	var buf []byte
+	for !gotVersion || !gotVerack {
+		cmd, payload, err := p.readMessage(&buf)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		switch cmd {
+		case cmdVersion:
+			err := parseVersionPayload(
+				payload, &p.services, &p.height,
+			)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			err = p.write(cmdVerack, nil)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			gotVersion = true
+		case cmdVerack:
+			gotVerack = true
+		}
+	}
+	err = p.conn.SetDeadline(time.Time{})
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (p *Peer) read(ctx context.Context) error {
+	var buf []byte
+	for ctx.Err() == nil {
+		cmd, payload, err := p.readMessage(&buf)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		switch cmd {
+		case cmdPing:
+			err := p.write(cmdPong, payload)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+		case cmdBlock:
+			block := bytes.Clone(payload)
+			select {
+			case p.blockC <- block:
+			case <-ctx.Done():
+				return nil
+			}
+		case cmdNotFound:
+			hashes, err := parseNotFoundBlocks(payload)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			for _, h := range hashes {
+				select {
+				case p.notFoundC <- h:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+		case cmdCFilter:
+			var f CFilter
+			err := parseCFilter(payload, &f)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			select {
+			case p.cfilterC <- f:
+			case <-ctx.Done():
+				return nil
+			}
+		case cmdCFHeaders:
+			var h CFHeaders
+			err := parseCFHeaders(payload, &h)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			select {
+			case p.cfheadersC <- h:
+			case <-ctx.Done():
+				return nil
+			}
+		default:
+			p.log.Tracef(
+				"p2p: ignoring message %s",
+				bytes.TrimRight(cmd[:], "\x00"),
+			)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) readMessage(buf *[]byte) (command, []byte, error) {
+	var (
+		header [24]byte
+		cmd    command
+	)
+	_, err := io.ReadFull(p.conn, header[:])
+	if err != nil {
+		return cmd, nil, stackerr.Wrap(err)
+	}
+	if !bytes.Equal(header[:4], p.magic[:]) {
+		return cmd, nil, fmt.Errorf("bad magic bytes: %x", header[:4])
+	}
+	copy(cmd[:], header[4:16])
+	size := binary.LittleEndian.Uint32(header[16:20])
+	if size > maxPayload {
+		return cmd, nil, fmt.Errorf("payload too big: %d", size)
+	}
+	if cap(*buf) < int(size) {
+		*buf = make([]byte, size)
+	}
+	payload := (*buf)[:size]
+	_, err = io.ReadFull(p.conn, payload)
+	if err != nil {
+		return cmd, nil, stackerr.Wrap(err)
+	}
+	sum := checksum(payload)
+	if !bytes.Equal(sum[:], header[20:24]) {
+		return cmd, nil, fmt.Errorf("bad payload checksum")
+	}
+	return cmd, payload, nil
+}
+
+func (p *Peer) write(cmd command, payload []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	msg := make([]byte, 0, 24+len(payload))
+	msg = append(msg, p.magic[:]...)
+	msg = append(msg, cmd[:]...)
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(len(payload)))
+	sum := checksum(payload)
+	msg = append(msg, sum[:]...)
+	msg = append(msg, payload...)
+	_, err := p.conn.Write(msg)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// parseNotFoundBlocks returns the block hashes of a notfound payload
+func parseNotFoundBlocks(payload []byte) ([][32]byte, error) {
+	count, n := readCompactSize(payload)
+	if n == 0 || uint64(len(payload)-n) != count*36 {
+		return nil, fmt.Errorf("bad notfound payload")
+	}
+	var hashes [][32]byte
+	for i := n; i < len(payload); i += 36 {
+		kind := binary.LittleEndian.Uint32(payload[i:])
+		if kind&^invWitnessFlag != invBlock {
+			continue
+		}
+		hashes = append(hashes, [32]byte(payload[i+4:i+36]))
+	}
+	return hashes, nil
+}
+
+func makeVersionPayload() []byte {
+	var (
+		buf   []byte
+		addr  [26]byte
+		nonce [8]byte
+	)
+	rand.Read(nonce[:])
+	buf = binary.LittleEndian.AppendUint32(buf, protoVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, 0)
+	buf = binary.LittleEndian.AppendUint64(
+		buf, uint64(time.Now().Unix()),
+	)
+	buf = append(buf, addr[:]...)
+	buf = append(buf, addr[:]...)
+	buf = append(buf, nonce[:]...)
+	ua := "/eps-go/"
+	buf = appendCompactSize(buf, uint64(len(ua)))
+	buf = append(buf, ua...)
+	buf = binary.LittleEndian.AppendUint32(buf, 0)
+	// no transaction relay
+	buf = append(buf, 0)
+	return buf
+}
+
+func parseVersionPayload(payload []byte, services *uint64, height *int) error {
+	// version, services, time, addr_recv, addr_from, nonce
+	const uaOffset = 4 + 8 + 8 + 26 + 26 + 8
+	if len(payload) < uaOffset+1 {
+		return fmt.Errorf("version payload too short")
+	}
+	*services = binary.LittleEndian.Uint64(payload[4:12])
+	uaLen, n := readCompactSize(payload[uaOffset:])
+	off := uaOffset + n + int(uaLen)
+	if n == 0 || off+4 > len(payload) {
+		return fmt.Errorf("version payload too short")
+	}
+	*height = int(int32(binary.LittleEndian.Uint32(payload[off:])))
+	return nil
+}
+
+func checksum(payload []byte) [4]byte {
+	h := sha256.Sum256(payload)
+	h = sha256.Sum256(h[:])
+	return [4]byte(h[:4])
+}
+
+func appendCompactSize(buf []byte, v uint64) []byte {
+	switch {
+	case v < 0xfd:
+		return append(buf, byte(v))
+	case v <= 0xffff:
+		buf = append(buf, 0xfd)
+		return binary.LittleEndian.AppendUint16(buf, uint16(v))
+	case v <= 0xffffffff:
+		buf = append(buf, 0xfe)
+		return binary.LittleEndian.AppendUint32(buf, uint32(v))
+	default:
+		buf = append(buf, 0xff)
+		return binary.LittleEndian.AppendUint64(buf, v)
+	}
+}
+
+// readCompactSize returns the value and the number of bytes read, zero
+// bytes read means the input is too short
+func readCompactSize(b []byte) (uint64, int) {
+	if len(b) < 1 {
+		return 0, 0
+	}
+	switch b[0] {
+	case 0xfd:
+		if len(b) < 3 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint16(b[1:])), 3
+	case 0xfe:
+		if len(b) < 5 {
+			return 0, 0
+		}
+		return uint64(binary.LittleEndian.Uint32(b[1:])), 5
+	case 0xff:
+		if len(b) < 9 {
+			return 0, 0
+		}
+		return binary.LittleEndian.Uint64(b[1:]), 9
+	default:
+		return uint64(b[0]), 1
+	}
+}
@@ -0,0 +1,290 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestPeerPipelinedBlocks(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "p2p")
+	conn, nodeConn := net.Pipe()
+	defer nodeConn.Close()
+	node := &Peer{conn: nodeConn, magic: magicBytes[bitcoin.Regtest]}
+	hashes := make([][32]byte, 5)
+	for i := range hashes {
+		hashes[i][0] = byte(i)
+	}
+	nodeErr := make(chan error, 1)
+	go func() {
+		nodeErr <- fakeNode(node, len(hashes))
+	}()
+	p, err := newPeer(t.Context(), l, conn, bitcoin.Regtest)
+	assert.Must(t, err)
+	defer p.Close()
+	assert.MustEqual(t, ServiceNetworkLimited|ServiceWitness, p.Services())
+	assert.MustEqual(t, 123, p.StartHeight())
+	err = p.GetBlocks(hashes)
+	assert.Must(t, err)
+	for i := range hashes {
+		block, err := p.ReadBlock(t.Context())
+		assert.Must(t, err)
+		assert.MustEqual(t, fmt.Sprintf("block %d", i), string(block))
+	}
+	assert.Must(t, <-nodeErr)
+}
+
+func TestPeerBlockNotFound(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "p2p")
+	conn, nodeConn := net.Pipe()
+	defer nodeConn.Close()
+	node := &Peer{conn: nodeConn, magic: magicBytes[bitcoin.Regtest]}
+	hashes := [][32]byte{{1}, {2}, {3}}
+	nodeErr := make(chan error, 1)
+	go func() {
+		nodeErr <- fakePrunedNode(node, hashes[1])
+	}()
+	p, err := newPeer(t.Context(), l, conn, bitcoin.Regtest)
+	assert.Must(t, err)
+	defer p.Close()
+	err = p.GetBlocks(hashes)
+	assert.Must(t, err)
+	block, err := p.ReadBlock(t.Context())
+	assert.Must(t, err)
+	assert.MustEqual(t, "block 0", string(block))
+	_, err = p.ReadBlock(t.Context())
+	assert.MustEqual(t, true, errors.Is(err, ErrBlockNotFound))
+	block, err = p.ReadBlock(t.Context())
+	assert.Must(t, err)
+	assert.MustEqual(t, "block 2", string(block))
+	assert.Must(t, <-nodeErr)
+}
+
+// fakePrunedNode answers a getdata of three blocks, the second one is
+// reported as not found
+func fakePrunedNode(node *Peer, missing [32]byte) error {
+	var buf []byte
+	err := fakeHandshake(node, &buf)
+	if err != nil {
+		return err
+	}
+	cmd, _, err := node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdGetdata {
+		return fmt.Errorf("expected getdata, got %s", cmd[:])
+	}
+	err = node.write(cmdBlock, []byte("block 0"))
+	if err != nil {
+		return err
+	}
+	res := appendCompactSize(nil, 1)
+	res = binary.LittleEndian.AppendUint32(res, invWitnessBlock)
+	res = append(res, missing[:]...)
+	err = node.write(cmdNotFound, res)
+	if err != nil {
+		return err
+	}
+	return node.write(cmdBlock, []byte("block 2"))
+}
+
+func TestPeerFilters(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "p2p")
+	conn, nodeConn := net.Pipe()
+	defer nodeConn.Close()
+	node := &Peer{conn: nodeConn, magic: magicBytes[bitcoin.Regtest]}
+	stopHash := [32]byte{7}
+	nodeErr := make(chan error, 1)
+	go func() {
+		nodeErr <- fakeFilterNode(node, stopHash)
+	}()
+	p, err := newPeer(t.Context(), l, conn, bitcoin.Regtest)
+	assert.Must(t, err)
+	defer p.Close()
+	headers, err := p.GetCFHeaders(t.Context(), 10, stopHash)
+	assert.Must(t, err)
+	assert.MustEqual(t, stopHash, headers.StopHash)
+	assert.MustEqual(t, [32]byte{1}, headers.PrevHeader)
+	assert.MustEqual(t, [][32]byte{{2}, {3}}, headers.FilterHashes)
+	filters, err := p.GetCFilters(t.Context(), 10, 2, stopHash)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, len(filters))
+	assert.MustEqual(t, [32]byte{10}, filters[0].BlockHash)
+	assert.MustEqual(t, []byte{1, 0xaa}, filters[0].Filter)
+	assert.MustEqual(t, [32]byte{11}, filters[1].BlockHash)
+	assert.MustEqual(t, []byte{0}, filters[1].Filter)
+	assert.Must(t, <-nodeErr)
+}
+
+func TestPeerSlowFilters(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "p2p")
+	conn, nodeConn := net.Pipe()
+	defer nodeConn.Close()
+	node := &Peer{conn: nodeConn, magic: magicBytes[bitcoin.Regtest]}
+	stopHash := [32]byte{7}
+	late := make(chan struct{})
+	go fakeSlowFilterNode(node, late)
+	p, err := newPeer(t.Context(), l, conn, bitcoin.Regtest)
+	assert.Must(t, err)
+	defer p.Close()
+	ctx, cancel := context.WithTimeout(t.Context(), time.Millisecond*50)
+	defer cancel()
+	_, err = p.GetCFilters(ctx, 10, 2, stopHash)
+	assert.MustEqual(t, true, errors.Is(err, context.DeadlineExceeded))
+	// the late filter does not stall the next request
+	close(late)
+	_, err = p.GetCFHeaders(t.Context(), 10, stopHash)
+	assert.MustEqual(t, true, err != nil)
+}
+
+// fakeSlowFilterNode sends the second of two filters once late is closed
+func fakeSlowFilterNode(node *Peer, late <-chan struct{}) error {
+	var buf []byte
+	err := fakeHandshake(node, &buf)
+	if err != nil {
+		return err
+	}
+	_, _, err = node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	for i := range 2 {
+		if i == 1 {
+			<-late
+		}
+		res := []byte{filterTypeBasic}
+		res = append(res, tHash(byte(10+i))...)
+		res = append(res, 1, 0)
+		err = node.write(cmdCFilter, res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fakeFilterNode(node *Peer, stopHash [32]byte) error {
+	var buf []byte
+	err := fakeHandshake(node, &buf)
+	if err != nil {
+		return err
+	}
+	cmd, payload, err := node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdGetCFHeaders ||
+		!bytes.Equal(payload, makeFilterRequest(10, stopHash)) {
+		return fmt.Errorf("bad getcfheaders: %s %x", cmd[:], payload)
+	}
+	res := []byte{filterTypeBasic}
+	res = append(res, stopHash[:]...)
+	res = append(res, tHash(1)...)
+	res = append(res, 2)
+	res = append(res, tHash(2)...)
+	res = append(res, tHash(3)...)
+	err = node.write(cmdCFHeaders, res)
+	if err != nil {
+		return err
+	}
+	cmd, payload, err = node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdGetCFilters ||
+		!bytes.Equal(payload, makeFilterRequest(10, stopHash)) {
+		return fmt.Errorf("bad getcfilters: %s %x", cmd[:], payload)
+	}
+	for i, f := range [][]byte{{1, 0xaa}, {0}} {
+		res := []byte{filterTypeBasic}
+		res = append(res, tHash(byte(10+i))...)
+		res = append(res, byte(len(f)))
+		res = append(res, f...)
+		err = node.write(cmdCFilter, res)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tHash(b byte) []byte {
+	var h [32]byte
+	h[0] = b
+	return h[:]
+}
+
+func fakeHandshake(node *Peer, buf *[]byte) error {
+	cmd, _, err := node.readMessage(buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdVersion {
+		return fmt.Errorf("expected version, got %s", cmd[:])
+	}
+	version := makeVersionPayload()
+	binary.LittleEndian.PutUint64(
+		version[4:], ServiceNetworkLimited|ServiceWitness,
+	)
+	binary.LittleEndian.PutUint32(version[len(version)-5:], 123)
+	err = node.write(cmdVersion, version)
+	if err != nil {
+		return err
+	}
+	cmd, _, err = node.readMessage(buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdVerack {
+		return fmt.Errorf("expected verack, got %s", cmd[:])
+	}
+	return node.write(cmdVerack, nil)
+}
+
+func fakeNode(node *Peer, nblocks int) error {
+	var buf []byte
+	err := fakeHandshake(node, &buf)
+	if err != nil {
+		return err
+	}
+	cmd, payload, err := node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdGetdata {
+		return fmt.Errorf("expected getdata, got %s", cmd[:])
+	}
+	count, _ := readCompactSize(payload)
+	if int(count) != nblocks {
+		return fmt.Errorf("expected %d inventories, got %d", nblocks, count)
+	}
+	// the node pings while blocks are in flight
+	err = node.write(cmdPing, []byte("12345678"))
+	if err != nil {
+		return err
+	}
+	cmd, payload, err = node.readMessage(&buf)
+	if err != nil {
+		return err
+	}
+	if cmd != cmdPong || !bytes.Equal(payload, []byte("12345678")) {
+		return fmt.Errorf("bad pong: %s %x", cmd[:], payload)
+	}
+	for i := range nblocks {
+		err = node.write(cmdBlock, fmt.Appendf(nil, "block %d", i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -53,10 +53,10 @@ func setup(t *testing.T) {
 		return
 	}
 	tCtx.L = log.New(log.LevelFromString(tCtx.Cfg.LogLevel), "eps-go")
-	tCtx.D, tCtx.err = epsgo.OpenDB(
+	tCtx.D, tCtx.err = epsgo.OpenConfigDB(
 		tCtx.C,
 		tCtx.L,
-		tCtx.Cfg.SqliteDBPath,
+		tCtx.Cfg,
 		migrator.FlagMigrateFresh,
 	)
 }
@@ -0,0 +1,103 @@
+package walletmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// runBackfills fills the data a migration added for the rows stored before
+// it, each backfill runs once in its own sql transaction
+func (w *W) runBackfills(ctx context.Context) error {
+	names, err := w.repo.selectBackfills(ctx, w.db)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	for _, name := range names {
+		err := w.repo.execute(
+			ctx,
+			w.db,
+			func(db sql.Database) error {
+				var err error
+				switch name {
+				case "tx_input":
+					err = w.backfillTxInputs(ctx, db)
+				case "spender_txid":
+					err = w.backfillSpenders(ctx, db)
+				default:
+					err = fmt.Errorf("unknown backfill %q", name)
+				}
+				if err != nil {
+					return stackerr.Wrap(err)
+				}
+				return w.repo.deleteBackfill(ctx, db, name)
+			},
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		w.log.Infof("BACKFILL DONE; name: %s", name)
+	}
+	return nil
+}
+
+// backfillTxInputs records the parents of the txs stored before tx_input.
+// The txs are read first, the rows are not inserted while iterating them.
+func (w *W) backfillTxInputs(ctx context.Context, db sql.Database) error {
+	parents := make(map[[32]byte][][32]byte)
+	err := w.repo.forEachTransaction(
+		ctx,
+		db,
+		func(t *transactionData) error {
+			var tx bitcoin.Transaction
+			err := tx.Deserialize(bytes.NewReader(t.Raw))
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			parents[t.Txid] = txParents(&tx)
+			return nil
+		},
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	for txid, p := range parents {
+		err := w.repo.insertTransactionInputs(ctx, db, &txid, p)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+// backfillSpenders records the spenders of the outputs spent before
+// spent_output kept them
+func (w *W) backfillSpenders(ctx context.Context, db sql.Database) error {
+	spent, err := w.repo.selectAllSpentOutputs(ctx, db)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	for i := range spent {
+		if spent[i].Spender != ([32]byte{}) {
+			continue
+		}
+		spender, err := w.findSpender(ctx, db, &spent[i])
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		if spender == ([32]byte{}) {
+			continue
+		}
+		err = w.repo.updateSpentOutputSpender(
+			ctx, db, &spent[i].TxidVout, &spender,
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
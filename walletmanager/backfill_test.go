@@ -0,0 +1,42 @@
+package walletmanager
+
+import (
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestBackfillSpenders(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	// an output spent at height 3 before the spenders were stored
+	var spent txidVout
+	makeTxidVout(&[32]byte{0xf1}, 1, &spent)
+	child := bitcoin.Transaction{
+		Version: 2,
+		Inputs: []bitcoin.Input{
+			{Txid: [32]byte{0xf0}},
+			{Txid: [32]byte{0xf1}, Vout: 1},
+		},
+		Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: []byte{0x51}}},
+	}
+	childTxid := child.Txid(nil)
+	err := repo.insertTransaction(
+		ctx, nil, &childTxid, &[32]byte{3}, 3, 1, child.Serialize(nil), nil,
+	)
+	assert.Must(t, err)
+	err = repo.insertUnspentOutput(ctx, nil, &spent, 1000, &[32]byte{0xaa})
+	assert.Must(t, err)
+	err = repo.deleteUnspentOutput(ctx, nil, &spent, 3, &[32]byte{})
+	assert.Must(t, err)
+	w := &W{
+		log:  log.New(log.LevelFromString("error"), "eps-go"),
+		repo: repo,
+	}
+	assert.Must(t, w.backfillSpenders(ctx, nil))
+	var so spentOutputData
+	assert.Must(t, repo.selectSpentOutput(ctx, nil, &spent, &so))
+	assert.MustEqual(t, childTxid, so.Spender)
+}
@@ -0,0 +1,107 @@
+package walletmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/ncodysoftware/eps-go/gcs"
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// loadFilters downloads the BIP158 basic filters of the chunk and checks
+// them against the filter header chain served by the node
+func (w *W) loadFilters(
+	ctx context.Context, peer *p2p.Peer, c *syncChunk,
+) error {
+	c.filters = make([]p2p.CFilter, 0, len(c.hashes))
+	for start := 0; start < len(c.hashes); {
+		end := min(start+p2p.MaxCFiltersPerRequest, len(c.hashes))
+		height := c.height + start
+		stopHash := c.hashes[end-1]
+		headers, err := peer.GetCFHeaders(ctx, height, stopHash)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		filters, err := peer.GetCFilters(ctx, height, end-start, stopHash)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		err = w.verifyFilters(
+			height, c.hashes[start:end], &headers, filters,
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		c.filters = append(c.filters, filters...)
+		start = end
+	}
+	return nil
+}
+
+func (w *W) verifyFilters(
+	height int,
+	hashes [][32]byte,
+	headers *p2p.CFHeaders,
+	filters []p2p.CFilter,
+) error {
+	if headers.StopHash != hashes[len(hashes)-1] ||
+		len(headers.FilterHashes) != len(hashes) ||
+		len(filters) != len(hashes) {
+		return fmt.Errorf("unexpected cfheaders at height %d", height)
+	}
+	// the first header fetched is trusted, from there on the chain must
+	// link with the headers already verified
+	if w.cfHeaderHeight == height-1 && headers.PrevHeader != w.cfHeader {
+		return fmt.Errorf("filter header chain broken at height %d", height)
+	}
+	prev := headers.PrevHeader
+	for i := range filters {
+		if filters[i].BlockHash != hashes[i] {
+			return fmt.Errorf("unexpected cfilter at height %d", height+i)
+		}
+		filterHash := doubleSha256(filters[i].Filter)
+		if filterHash != headers.FilterHashes[i] {
+			return fmt.Errorf("bad cfilter hash at height %d", height+i)
+		}
+		prev = catDoubleSha256(filterHash, prev)
+	}
+	w.cfHeader = prev
+	w.cfHeaderHeight = height + len(hashes) - 1
+	return nil
+}
+
+// matchFilters matches the skipped blocks of the chunk from index from
+// against the scriptpubkeys derived since the last call, matching blocks
+// are selected and returned in height order
+func (w *W) matchFilters(c *syncChunk, from int) ([]blockRef, error) {
+	scripts := w.scripts[c.tested:]
+	c.tested = len(w.scripts)
+	var matched []blockRef
+	for i := from; i < len(c.hashes); i++ {
+		if c.selected[i] {
+			continue
+		}
+		ok, err := gcs.MatchAny(
+			c.filters[i].Filter, &c.hashes[i], scripts, &c.hashBuf,
+		)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		if !ok {
+			continue
+		}
+		c.selected[i] = true
+		matched = append(matched, blockRef{
+			height: c.height + i,
+			hash:   c.hashes[i],
+		})
+	}
+	return matched, nil
+}
+
+func doubleSha256(data []byte) [32]byte {
+	hash := sha256.Sum256(data)
+	return sha256.Sum256(hash[:])
+}
@@ -0,0 +1,91 @@
+package walletmanager
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/ncodysoftware/eps-go/p2p"
+	"github.com/ncodysoftware/eps-go/testutil"
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestVerifyFilters(t *testing.T) {
+	w := &W{cfHeaderHeight: -1}
+	hashes := [][32]byte{{1}, {2}, {3}}
+	filters := []p2p.CFilter{
+		{BlockHash: hashes[0], Filter: []byte{0}},
+		{BlockHash: hashes[1], Filter: []byte{1, 0xaa}},
+		{BlockHash: hashes[2], Filter: []byte{0}},
+	}
+	headers := p2p.CFHeaders{
+		StopHash:   hashes[2],
+		PrevHeader: [32]byte{9},
+	}
+	for i := range filters {
+		headers.FilterHashes = append(
+			headers.FilterHashes, doubleSha256(filters[i].Filter),
+		)
+	}
+	err := w.verifyFilters(10, hashes, &headers, filters)
+	assert.Must(t, err)
+	assert.MustEqual(t, 12, w.cfHeaderHeight)
+	// the next range must link with the last verified header
+	next := p2p.CFHeaders{
+		StopHash:     hashes[0],
+		PrevHeader:   [32]byte{9},
+		FilterHashes: headers.FilterHashes[:1],
+	}
+	err = w.verifyFilters(13, hashes[:1], &next, filters[:1])
+	if err == nil {
+		t.Fatal("expected broken chain error")
+	}
+	next.PrevHeader = w.cfHeader
+	err = w.verifyFilters(13, hashes[:1], &next, filters[:1])
+	assert.Must(t, err)
+	// filter not matching its hash
+	bad := slices.Clone(filters)
+	bad[1].Filter = []byte{1, 0xbb}
+	w.cfHeaderHeight = -1
+	err = w.verifyFilters(10, hashes, &headers, bad)
+	if err == nil {
+		t.Fatal("expected bad filter hash error")
+	}
+}
+
+func TestMatchFilters(t *testing.T) {
+	// BIP158 test vector, testnet block 0
+	blockHash := [32]byte(testutil.MustHexDecode(
+		"000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+	))
+	slices.Reverse(blockHash[:])
+	filter := testutil.MustHexDecode("019dfca8")
+	script := testutil.MustHexDecode(
+		"4104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f" +
+			"61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c70" +
+			"2b6bf11d5fac",
+	)
+	c := syncChunk{
+		height: 100,
+		hashes: [][32]byte{blockHash, blockHash, blockHash},
+		filters: []p2p.CFilter{
+			{BlockHash: blockHash, Filter: filter},
+			{BlockHash: blockHash, Filter: filter},
+			{BlockHash: blockHash, Filter: filter},
+		},
+		selected: []bool{false, false, true},
+	}
+	w := &W{scripts: [][]byte{script[1:]}}
+	matched, err := w.matchFilters(&c, 0)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(matched))
+	// a refill derived the script while processing block 100
+	w.scripts = append(w.scripts, script)
+	matched, err = w.matchFilters(&c, 1)
+	assert.Must(t, err)
+	assert.MustEqual(t, []blockRef{{height: 101, hash: blockHash}}, matched)
+	assert.MustEqual(t, []bool{false, true, true}, c.selected)
+	// nothing new to match
+	matched, err = w.matchFilters(&c, 0)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(matched))
+}
@@ -0,0 +1,63 @@
+package walletmanager
+
+import (
+	"context"
+
+	"github.com/ncodysoftware/eps-go/headerstore"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// OpenHeaders opens the headers file of net, see headerstore.Open
+func OpenHeaders(
+	path string, net bitcoin.Network,
+) (*headerstore.Store, error) {
+	data, err := genesisData(net)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	genesis := [80]byte(data.Serialized[:80])
+	s, err := headerstore.Open(path, &genesis)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return s, nil
+}
+
+// headerImporter is implemented by repositories that stored the headers
+// before the headers file
+type headerImporter interface {
+	importBlockHeaders(
+		ctx context.Context,
+		db sql.Database,
+		headers *headerstore.Store,
+	) (int, error)
+}
+
+func (w *W) setupHeaders(ctx context.Context) error {
+	im, ok := w.repo.(headerImporter)
+	if !ok {
+		return nil
+	}
+	n, err := im.importBlockHeaders(ctx, w.db, w.headers)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if n > 0 {
+		w.log.Infof("%d headers imported from the database", n)
+	}
+	return nil
+}
+
+// blockHashes appends to out the hashes of up to limit headers starting at
+// height
+func (w *W) blockHashes(height, limit int, out *[][32]byte) {
+	for h := height; h < height+limit; h++ {
+		hash, ok := w.headers.Hash(h)
+		if !ok {
+			return
+		}
+		*out = append(*out, hash)
+	}
+}
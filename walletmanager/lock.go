@@ -0,0 +1,95 @@
+package walletmanager
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// SyncingError is returned by the wallet queries until the initial sync
+// completes
+type SyncingError struct {
+	Progress float64
+	Height   int
+}
+
+func (e *SyncingError) Error() string {
+	return fmt.Sprintf("syncing, %.2f%% at height %d", e.Progress, e.Height)
+}
+
+// ctxMutex is a mutex whose LockCtx gives up when the context is done, the
+// zero value is unlocked
+type ctxMutex struct {
+	once sync.Once
+	c    chan struct{}
+}
+
+func (m *ctxMutex) ch() chan struct{} {
+	m.once.Do(func() {
+		m.c = make(chan struct{}, 1)
+	})
+	return m.c
+}
+
+func (m *ctxMutex) Lock() {
+	m.ch() <- struct{}{}
+}
+
+func (m *ctxMutex) LockCtx(ctx context.Context) error {
+	select {
+	case m.ch() <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return stackerr.Wrap(ctx.Err())
+	}
+}
+
+// Unlock panics when m is not locked, as sync.Mutex does
+func (m *ctxMutex) Unlock() {
+	select {
+	case <-m.ch():
+	default:
+		panic("unlock of unlocked ctxMutex")
+	}
+}
+
+// lock takes w.mu for the wallet queries, it returns a SyncingError while
+// the initial sync runs
+func (w *W) lock(ctx context.Context) error {
+	select {
+	case <-w.initCompleted:
+	default:
+		st := w.GetStats()
+		return &SyncingError{Progress: st.Progress(), Height: st.SyncHeight}
+	}
+	err := w.mu.LockCtx(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+// rlockHeaders waits for the headers to be synced and read locks them, the
+// header queries are answered during the initial sync of the wallets
+func (w *W) rlockHeaders(ctx context.Context) error {
+	select {
+	case <-w.headersSynced:
+	case <-ctx.Done():
+		return stackerr.Wrap(ctx.Err())
+	}
+	w.hmu.RLock()
+	return nil
+}
+
+// storeSyncHeight records the height of the least synchronized wallet for
+// the progress read without w.mu
+func (w *W) storeSyncHeight() {
+	height := math.MaxInt
+	for i := range w.wallets {
+		height = min(height, w.wallets[i].height)
+	}
+	w.syncHeight.Store(int64(height))
+}
@@ -0,0 +1,65 @@
+package walletmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+)
+
+func TestQueriesWhileSyncing(t *testing.T) {
+	ctx := t.Context()
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	var header [80]byte
+	for range 4 {
+		hash, _ := headers.Hash(headers.Tip())
+		copy(header[4:], hash[:])
+		assert.Must(t, headers.Append(header[:]))
+	}
+	w := &W{
+		initCompleted: make(chan struct{}),
+		headersSynced: make(chan struct{}),
+		headers:       headers,
+		wallets:       []wallet{{height: 1}, {height: 3}},
+		scriptPubkeys: make(map[[32]byte]scriptPubkeyInfo),
+	}
+	w.storeSyncHeight()
+	// the header queries wait for the headers until the request is gone
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	var height int
+	err = w.GetTipHeader(cctx, &height, &header)
+	assert.MustEqual(t, true, errors.Is(err, context.Canceled))
+	close(w.headersSynced)
+	assert.Must(t, w.GetTipHeader(ctx, &height, &header))
+	assert.MustEqual(t, 4, height)
+	// the wallet queries tell the progress
+	var conf, unconf uint64
+	err = w.GetScriptHashBalance(ctx, &[32]byte{}, &conf, &unconf)
+	var errSyncing *SyncingError
+	assert.MustEqual(t, true, errors.As(err, &errSyncing))
+	assert.MustEqual(t, SyncingError{Progress: 25, Height: 1}, *errSyncing)
+	assert.MustEqual(t, "syncing, 25.00% at height 1", errSyncing.Error())
+	close(w.initCompleted)
+	assert.Must(t, w.GetScriptHashBalance(ctx, &[32]byte{}, &conf, &unconf))
+	// a query waiting for the lock gives up with its request
+	w.mu.Lock()
+	cctx, cancel = context.WithCancel(ctx)
+	cancel()
+	err = w.GetScriptHashBalance(cctx, &[32]byte{}, &conf, &unconf)
+	assert.MustEqual(t, true, errors.Is(err, context.Canceled))
+	w.mu.Unlock()
+}
+
+func TestCtxMutexUnlockUnlocked(t *testing.T) {
+	var m ctxMutex
+	m.Lock()
+	m.Unlock()
+	defer func() {
+		assert.MustEqual(t, "unlock of unlocked ctxMutex", recover())
+	}()
+	m.Unlock()
+}
@@ -0,0 +1,633 @@
+package walletmanager
+
+import (
+	"context"
+	"slices"
+
+	"ncody.com/ncgo.git/database/sql"
+)
+
+type memTx struct {
+	blockHash   [32]byte
+	height      int
+	pos         int
+	raw         []byte
+	merkleProof []byte
+}
+
+type memSpent struct {
+	utxoData2
+	height  int
+	spender [32]byte
+}
+
+// memRepository is a repository kept in memory. Like the sql one it is not
+// safe for concurrent use, W serializes the calls. execute rolls back a
+// failed fn by replaying the undo log of the changes it made.
+type memRepository struct {
+	wallets map[[32]byte]walletData
+	txs     map[[32]byte]memTx
+	// txids of each height, in insertion order
+	blockTxs  map[int][][32]byte
+	shTxs     map[[32]byte]map[[32]byte]struct{}
+	utxoIndex map[txidVout]utxoData2
+	spent     map[txidVout]memSpent
+	// children of each parent txid
+	txInputs map[[32]byte]map[[32]byte]struct{}
+	// the changes are logged while execute runs fn
+	executing bool
+	undo      []func()
+}
+
+// NewMemRepository returns an empty repository kept in memory
+func NewMemRepository() Repository {
+	return &memRepository{
+		wallets:   make(map[[32]byte]walletData),
+		txs:       make(map[[32]byte]memTx),
+		blockTxs:  make(map[int][][32]byte),
+		shTxs:     make(map[[32]byte]map[[32]byte]struct{}),
+		utxoIndex: make(map[txidVout]utxoData2),
+		spent:     make(map[txidVout]memSpent),
+		txInputs:  make(map[[32]byte]map[[32]byte]struct{}),
+	}
+}
+
+func (r *memRepository) execute(
+	ctx context.Context,
+	db sql.Database,
+	fn func(db sql.Database) error,
+) error {
+	_ = ctx
+	r.executing = true
+	defer func() {
+		r.executing = false
+		clear(r.undo)
+		r.undo = r.undo[:0]
+	}()
+	err := fn(db)
+	if err != nil {
+		for i := len(r.undo) - 1; i >= 0; i-- {
+			r.undo[i]()
+		}
+		return err
+	}
+	return nil
+}
+
+// logChange logs the undo of a change of k in m, to call before changing it
+func logChange[K comparable, V any](r *memRepository, m map[K]V, k K) {
+	if !r.executing {
+		return
+	}
+	v, ok := m[k]
+	r.undo = append(r.undo, func() {
+		if ok {
+			m[k] = v
+		} else {
+			delete(m, k)
+		}
+	})
+}
+
+func (r *memRepository) reloadCaches(
+	ctx context.Context,
+	db sql.Database,
+) error {
+	_, _ = ctx, db
+	return nil
+}
+
+func (r *memRepository) selectWalletData(
+	ctx context.Context,
+	db sql.Database,
+	hash *[32]byte,
+) (walletData, error) {
+	_, _ = ctx, db
+	wd, ok := r.wallets[*hash]
+	if !ok {
+		return wd, sql.ErrNoRows
+	}
+	return wd, nil
+}
+
+func (r *memRepository) insertWalletData(
+	ctx context.Context,
+	db sql.Database,
+	wd *walletData,
+) error {
+	_, _ = ctx, db
+	logChange(r, r.wallets, wd.Hash)
+	r.wallets[wd.Hash] = *wd
+	return nil
+}
+
+func (r *memRepository) updateWalletIndexes(
+	ctx context.Context,
+	db sql.Database,
+	whash *[32]byte,
+	nextReceiveIndex uint32,
+	nextChangeIndex uint32,
+) error {
+	_, _ = ctx, db
+	wd, ok := r.wallets[*whash]
+	if !ok {
+		return nil
+	}
+	wd.NextReceiveIndex = nextReceiveIndex
+	wd.NextChangeIndex = nextChangeIndex
+	logChange(r, r.wallets, *whash)
+	r.wallets[*whash] = wd
+	return nil
+}
+
+func (r *memRepository) updateWalletHeight(
+	ctx context.Context,
+	db sql.Database,
+	whash *[32]byte,
+	height int,
+) error {
+	_, _ = ctx, db
+	wd, ok := r.wallets[*whash]
+	if !ok {
+		return nil
+	}
+	wd.Height = height
+	logChange(r, r.wallets, *whash)
+	r.wallets[*whash] = wd
+	return nil
+}
+
+func (r *memRepository) selectScriptHashBalance(
+	ctx context.Context,
+	db sql.Database,
+	sh *[32]byte,
+	out *uint64,
+) error {
+	_, _ = ctx, db
+	*out = 0
+	for _, v := range r.utxoIndex {
+		if v.ScriptPubkeyHash != *sh {
+			continue
+		}
+		*out += v.Satoshi
+	}
+	return nil
+}
+
+func (r *memRepository) selectScriptHashHistory(
+	ctx context.Context,
+	db sql.Database,
+	sh *[32]byte,
+	fromHeight int,
+	toHeight int,
+	limit int,
+) ([]TxData, error) {
+	_, _ = ctx, db
+	type entry struct {
+		TxData
+		pos int
+	}
+	var entries []entry
+	for txid := range r.shTxs[*sh] {
+		tx, ok := r.txs[txid]
+		if !ok || tx.height < fromHeight ||
+			toHeight >= 0 && tx.height >= toHeight {
+			continue
+		}
+		entries = append(entries, entry{TxData{tx.height, txid}, tx.pos})
+	}
+	slices.SortFunc(entries, func(a, b entry) int {
+		return cmpHeightPos(a.Height, a.pos, b.Height, b.pos)
+	})
+	if limit >= 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	var h []TxData
+	for _, e := range entries {
+		h = append(h, e.TxData)
+	}
+	return h, nil
+}
+
+func (r *memRepository) selectScriptHashUnspent(
+	ctx context.Context,
+	db sql.Database,
+	sh *[32]byte,
+) ([]UtxoData, error) {
+	_, _ = ctx, db
+	var u []UtxoData
+	for txVout, v := range r.utxoIndex {
+		if v.ScriptPubkeyHash != *sh {
+			continue
+		}
+		txid := [32]byte(txVout[:32])
+		tx, ok := r.txs[txid]
+		if !ok {
+			continue
+		}
+		u = append(u, UtxoData{
+			Height:  tx.height,
+			TxPos:   tx.pos,
+			Txid:    txid,
+			Satoshi: v.Satoshi,
+		})
+	}
+	slices.SortFunc(u, func(a, b UtxoData) int {
+		return cmpHeightPos(a.Height, a.TxPos, b.Height, b.TxPos)
+	})
+	return u, nil
+}
+
+// cmpHeightPos orders like the ORDER BY height, pos of the sql queries
+func cmpHeightPos(aHeight, aPos, bHeight, bPos int) int {
+	if aHeight != bHeight {
+		return aHeight - bHeight
+	}
+	return aPos - bPos
+}
+
+func (r *memRepository) insertTransaction(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+	blockHash *[32]byte,
+	height int,
+	pos int,
+	serialized []byte,
+	merkleProof []byte,
+) error {
+	_, _ = ctx, db
+	if _, ok := r.txs[*txid]; ok {
+		return nil
+	}
+	logChange(r, r.txs, *txid)
+	r.txs[*txid] = memTx{
+		blockHash:   *blockHash,
+		height:      height,
+		pos:         pos,
+		raw:         slices.Clone(serialized),
+		merkleProof: slices.Clone(merkleProof),
+	}
+	logChange(r, r.blockTxs, height)
+	r.blockTxs[height] = append(r.blockTxs[height], *txid)
+	return nil
+}
+
+func (r *memRepository) selectRawTransaction(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+) ([]byte, error) {
+	_, _ = ctx, db
+	tx, ok := r.txs[*txid]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return slices.Clone(tx.raw), nil
+}
+
+func (r *memRepository) selectTransactionFromTxid(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+) (transactionData, error) {
+	_, _ = ctx, db
+	tx, ok := r.txs[*txid]
+	if !ok {
+		return transactionData{}, sql.ErrNoRows
+	}
+	return tx.data(txid), nil
+}
+
+func (r *memRepository) selectTransactionFromHeightPos(
+	ctx context.Context,
+	db sql.Database,
+	height, pos int,
+) (transactionData, error) {
+	_, _ = ctx, db
+	for _, txid := range r.blockTxs[height] {
+		tx := r.txs[txid]
+		if tx.pos == pos {
+			return tx.data(&txid), nil
+		}
+	}
+	return transactionData{}, sql.ErrNoRows
+}
+
+func (r *memRepository) selectBlockTransactions(
+	ctx context.Context,
+	db sql.Database,
+	height int,
+) ([]transactionData, error) {
+	_, _ = ctx, db
+	var txs []transactionData
+	for _, txid := range r.blockTxs[height] {
+		tx := r.txs[txid]
+		txs = append(txs, tx.data(&txid))
+	}
+	slices.SortFunc(txs, func(a, b transactionData) int {
+		return a.Pos - b.Pos
+	})
+	return txs, nil
+}
+
+func (t *memTx) data(txid *[32]byte) transactionData {
+	return transactionData{
+		Txid:        *txid,
+		BlockHash:   t.blockHash,
+		Height:      t.height,
+		Pos:         t.pos,
+		Raw:         slices.Clone(t.raw),
+		MerkleProof: slices.Clone(t.merkleProof),
+	}
+}
+
+func (r *memRepository) insertScriptPubkeyTransaction(
+	ctx context.Context,
+	db sql.Database,
+	scriptPubkeyHash *[32]byte,
+	txid *[32]byte,
+) error {
+	_, _ = ctx, db
+	txids, ok := r.shTxs[*scriptPubkeyHash]
+	if !ok {
+		txids = make(map[[32]byte]struct{})
+		logChange(r, r.shTxs, *scriptPubkeyHash)
+		r.shTxs[*scriptPubkeyHash] = txids
+	}
+	logChange(r, txids, *txid)
+	txids[*txid] = struct{}{}
+	return nil
+}
+
+func (r *memRepository) insertUnspentOutput(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	satoshi uint64,
+	scriptPubkeyHash *[32]byte,
+) error {
+	_, _ = ctx, db
+	if _, ok := r.utxoIndex[*txVout]; ok {
+		return nil
+	}
+	logChange(r, r.utxoIndex, *txVout)
+	r.utxoIndex[*txVout] = utxoData2{
+		Satoshi:          satoshi,
+		ScriptPubkeyHash: *scriptPubkeyHash,
+	}
+	return nil
+}
+
+func (r *memRepository) selectUnspentOutput(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	out *utxoData,
+) error {
+	_, _ = ctx, db
+	u, ok := r.utxoIndex[*txVout]
+	if !ok {
+		return errNotFound
+	}
+	out.TxidVout = *txVout
+	out.Satoshi = u.Satoshi
+	out.ScriptPubkeyHash = u.ScriptPubkeyHash
+	return nil
+}
+
+func (r *memRepository) deleteUnspentOutput(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	height int,
+	spender *[32]byte,
+) error {
+	_, _ = ctx, db
+	u, ok := r.utxoIndex[*txVout]
+	if !ok {
+		return nil
+	}
+	if _, ok := r.spent[*txVout]; !ok {
+		logChange(r, r.spent, *txVout)
+		r.spent[*txVout] = memSpent{
+			utxoData2: u, height: height, spender: *spender,
+		}
+	}
+	logChange(r, r.utxoIndex, *txVout)
+	delete(r.utxoIndex, *txVout)
+	return nil
+}
+
+func (r *memRepository) selectSpentOutput(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	out *spentOutputData,
+) error {
+	_, _ = ctx, db
+	s, ok := r.spent[*txVout]
+	if !ok {
+		return errNotFound
+	}
+	*out = spentOutputData{
+		TxidVout: *txVout, SpentHeight: s.height, Spender: s.spender,
+	}
+	return nil
+}
+
+func (r *memRepository) updateSpentOutputSpender(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	spender *[32]byte,
+) error {
+	_, _ = ctx, db
+	s, ok := r.spent[*txVout]
+	if !ok {
+		return nil
+	}
+	s.spender = *spender
+	logChange(r, r.spent, *txVout)
+	r.spent[*txVout] = s
+	return nil
+}
+
+func (r *memRepository) insertTransactionInputs(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+	parents [][32]byte,
+) error {
+	_, _ = ctx, db
+	for _, parent := range parents {
+		children, ok := r.txInputs[parent]
+		if !ok {
+			children = make(map[[32]byte]struct{})
+			logChange(r, r.txInputs, parent)
+			r.txInputs[parent] = children
+		}
+		logChange(r, children, *txid)
+		children[*txid] = struct{}{}
+	}
+	return nil
+}
+
+func (r *memRepository) selectChildHeight(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+) (int, error) {
+	_, _ = ctx, db
+	height := -1
+	for child := range r.txInputs[*txid] {
+		tx, ok := r.txs[child]
+		if ok && (height < 0 || tx.height < height) {
+			height = tx.height
+		}
+	}
+	return height, nil
+}
+
+func (r *memRepository) deleteAllSinceBlock(
+	ctx context.Context,
+	db sql.Database,
+	height int,
+) error {
+	_, _ = ctx, db
+	removed := make(map[[32]byte]struct{})
+	for h, txids := range r.blockTxs {
+		if h <= height {
+			continue
+		}
+		for _, txid := range txids {
+			removed[txid] = struct{}{}
+			logChange(r, r.txs, txid)
+			delete(r.txs, txid)
+		}
+		logChange(r, r.blockTxs, h)
+		delete(r.blockTxs, h)
+	}
+	for sh, txids := range r.shTxs {
+		for txid := range txids {
+			if _, ok := removed[txid]; ok {
+				logChange(r, txids, txid)
+				delete(txids, txid)
+			}
+		}
+		if len(txids) == 0 {
+			logChange(r, r.shTxs, sh)
+			delete(r.shTxs, sh)
+		}
+	}
+	for txVout, s := range r.spent {
+		if s.height <= height {
+			continue
+		}
+		logChange(r, r.utxoIndex, txVout)
+		r.utxoIndex[txVout] = s.utxoData2
+		logChange(r, r.spent, txVout)
+		delete(r.spent, txVout)
+	}
+	for txVout := range r.utxoIndex {
+		if _, ok := removed[[32]byte(txVout[:32])]; ok {
+			logChange(r, r.utxoIndex, txVout)
+			delete(r.utxoIndex, txVout)
+		}
+	}
+	for parent, children := range r.txInputs {
+		for child := range children {
+			if _, ok := removed[child]; ok {
+				logChange(r, children, child)
+				delete(children, child)
+			}
+		}
+		if len(children) == 0 {
+			logChange(r, r.txInputs, parent)
+			delete(r.txInputs, parent)
+		}
+	}
+	for hash, wd := range r.wallets {
+		if wd.Height > height {
+			wd.Height = height
+			logChange(r, r.wallets, hash)
+			r.wallets[hash] = wd
+		}
+	}
+	return nil
+}
+
+func (r *memRepository) selectBackfills(
+	ctx context.Context,
+	db sql.Database,
+) ([]string, error) {
+	_, _ = ctx, db
+	return nil, nil
+}
+
+func (r *memRepository) deleteBackfill(
+	ctx context.Context,
+	db sql.Database,
+	name string,
+) error {
+	_, _, _ = ctx, db, name
+	return nil
+}
+
+func (r *memRepository) selectAllWalletData(
+	ctx context.Context,
+	db sql.Database,
+) ([]walletData, error) {
+	_, _ = ctx, db
+	var wds []walletData
+	for _, wd := range r.wallets {
+		wds = append(wds, wd)
+	}
+	return wds, nil
+}
+
+func (r *memRepository) selectAllUtxos(
+	ctx context.Context,
+	db sql.Database,
+) ([]utxoData, error) {
+	_, _ = ctx, db
+	var u []utxoData
+	for txVout, v := range r.utxoIndex {
+		u = append(u, utxoData{
+			TxidVout:         txVout,
+			Satoshi:          v.Satoshi,
+			ScriptPubkeyHash: v.ScriptPubkeyHash,
+		})
+	}
+	return u, nil
+}
+
+func (r *memRepository) selectAllSpentOutputs(
+	ctx context.Context,
+	db sql.Database,
+) ([]spentOutputData, error) {
+	_, _ = ctx, db
+	var so []spentOutputData
+	for txVout, s := range r.spent {
+		so = append(so, spentOutputData{
+			TxidVout: txVout, SpentHeight: s.height, Spender: s.spender,
+		})
+	}
+	return so, nil
+}
+
+func (r *memRepository) forEachTransaction(
+	ctx context.Context,
+	db sql.Database,
+	fn func(t *transactionData) error,
+) error {
+	_, _ = ctx, db
+	for txid, tx := range r.txs {
+		t := tx.data(&txid)
+		err := fn(&t)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
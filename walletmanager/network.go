@@ -0,0 +1,80 @@
+package walletmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// CheckNetwork returns an error when the index stored in db was built for
+// another network than net. An empty index matches every network.
+func CheckNetwork(
+	ctx context.Context, db sql.Database, net bitcoin.Network,
+) error {
+	data, err := genesisData(net)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	var genesis [32]byte
+	h := bufWrapper(genesis[:])
+	err = db.QueryRow(ctx, `SELECT genesis FROM network LIMIT 1;`).Scan(&h)
+	switch {
+	case err == nil && genesis != data.Hash:
+		return fmt.Errorf("index was built for another network")
+	case err == nil || errors.Is(err, sql.ErrNoRows):
+		return nil
+	}
+	// databases older than the network table, the header at height 1
+	// links to the genesis block
+	var raw [80]byte
+	bw := bufWrapper(raw[:])
+	err = db.QueryRow(
+		ctx, `SELECT serialized FROM blockheader WHERE height = 1;`,
+	).Scan(&bw)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if [32]byte(raw[4:36]) != data.Hash {
+		return fmt.Errorf("index was built for another network")
+	}
+	return nil
+}
+
+// genesisData returns the genesis block of net
+func genesisData(net bitcoin.Network) (*blockHeaderData, error) {
+	if int(net) >= len(genesisBlockData) ||
+		len(genesisBlockData[net].Serialized) < 80 {
+		return nil, fmt.Errorf("no genesis block for network %d", net)
+	}
+	return &genesisBlockData[net], nil
+}
+
+// recordNetwork stores the network of an empty index in db and checks the
+// one of an existing index
+func recordNetwork(
+	ctx context.Context, db sql.Database, net bitcoin.Network,
+) error {
+	err := CheckNetwork(ctx, db, net)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	s := `
+	INSERT INTO network
+	(genesis)
+	VALUES ($1)
+	ON CONFLICT DO NOTHING
+	;
+	`
+	_, err = db.Exec(ctx, s, genesisBlockData[net].Hash[:])
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
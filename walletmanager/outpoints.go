@@ -0,0 +1,228 @@
+package walletmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// OutpointStatus is the state of a wallet output. Known is false for
+// outpoints the index does not track.
+type OutpointStatus struct {
+	Known         bool
+	Height        int
+	Spent         bool
+	SpenderTxid   [32]byte
+	SpenderHeight int
+}
+
+// GetOutpointStatus returns whether the output vout of txid is funded and
+// spent
+func (w *W) GetOutpointStatus(
+	ctx context.Context, txid *[32]byte, vout uint32,
+) (OutpointStatus, error) {
+	err := w.lock(ctx)
+	if err != nil {
+		return OutpointStatus{}, stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	var txVout txidVout
+	makeTxidVout(txid, vout, &txVout)
+	status, err := w.getOutpointStatus(ctx, w.db, &txVout)
+	if err != nil {
+		return status, stackerr.Wrap(err)
+	}
+	return status, nil
+}
+
+func (w *W) getOutpointStatus(
+	ctx context.Context, db sql.Database, txVout *txidVout,
+) (OutpointStatus, error) {
+	var (
+		status OutpointStatus
+		utxoD  utxoData
+		spentD spentOutputData
+	)
+	err := w.repo.selectUnspentOutput(ctx, db, txVout, &utxoD)
+	if err != nil && !errors.Is(err, errNotFound) {
+		return status, stackerr.Wrap(err)
+	}
+	if err != nil {
+		err = w.repo.selectSpentOutput(ctx, db, txVout, &spentD)
+		if err != nil && errors.Is(err, errNotFound) {
+			return status, nil
+		}
+		if err != nil {
+			return status, stackerr.Wrap(err)
+		}
+		status.Spent = true
+		status.SpenderHeight = spentD.SpentHeight
+		status.SpenderTxid = spentD.Spender
+		if spentD.Spender == [32]byte{} {
+			status.SpenderTxid, err = w.findSpender(ctx, db, &spentD)
+			if err != nil {
+				return status, stackerr.Wrap(err)
+			}
+		}
+	}
+	txid := [32]byte(txVout[:32])
+	txData, err := w.repo.selectTransactionFromTxid(ctx, db, &txid)
+	if err != nil {
+		return status, stackerr.Wrap(err)
+	}
+	status.Known = true
+	status.Height = txData.Height
+	return status, nil
+}
+
+// findSpender looks for the tx spending an output stored before the
+// spender was, among the txs of its spent height. It returns a zero txid
+// when none spends it.
+func (w *W) findSpender(
+	ctx context.Context, db sql.Database, spentD *spentOutputData,
+) ([32]byte, error) {
+	txid := [32]byte(spentD.TxidVout[:32])
+	vout := binary.LittleEndian.Uint32(spentD.TxidVout[32:])
+	txs, err := w.repo.selectBlockTransactions(ctx, db, spentD.SpentHeight)
+	if err != nil {
+		return [32]byte{}, stackerr.Wrap(err)
+	}
+	for i := range txs {
+		var tx bitcoin.Transaction
+		err := tx.Deserialize(bytes.NewReader(txs[i].Raw))
+		if err != nil {
+			return [32]byte{}, stackerr.Wrap(err)
+		}
+		for j := range tx.Inputs {
+			if tx.Inputs[j].Txid == txid && tx.Inputs[j].Vout == vout {
+				return txs[i].Txid, nil
+			}
+		}
+	}
+	return [32]byte{}, nil
+}
+
+// OutpointSubscribe registers cb to be called with the new status of the
+// output vout of txid
+func (w *W) OutpointSubscribe(
+	ctx context.Context,
+	id uint32,
+	txid [32]byte,
+	vout uint32,
+	cb func(OutpointStatus),
+) error {
+	err := w.lock(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	var txVout txidVout
+	makeTxidVout(&txid, vout, &txVout)
+	m := w.opSubs[txVout]
+	if m == nil {
+		m = make(map[uint32]func(OutpointStatus))
+	}
+	m[id] = cb
+	w.opSubs[txVout] = m
+	c := w.connOpSubs[id]
+	if c == nil {
+		c = make(map[txidVout]struct{})
+	}
+	c[txVout] = struct{}{}
+	w.connOpSubs[id] = c
+	return nil
+}
+
+// OutpointUnsubscribe removes the subscription of the connection to the
+// outpoint and reports whether there was one
+func (w *W) OutpointUnsubscribe(id uint32, txid [32]byte, vout uint32) bool {
+	select {
+	case <-w.initCompleted:
+	default:
+		// nothing is subscribed before
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var txVout txidVout
+	makeTxidVout(&txid, vout, &txVout)
+	c := w.connOpSubs[id]
+	if _, ok := c[txVout]; !ok {
+		return false
+	}
+	delete(c, txVout)
+	if len(c) == 0 {
+		delete(w.connOpSubs, id)
+	}
+	w.deleteOutpointSub(id, &txVout)
+	return true
+}
+
+func (w *W) deleteOutpointSub(id uint32, txVout *txidVout) {
+	m := w.opSubs[*txVout]
+	delete(m, id)
+	if len(m) == 0 {
+		delete(w.opSubs, *txVout)
+	}
+}
+
+// queueOutpointStatus records the status of a wallet output funded or
+// spent by the block being processed, it is sent once the batch commits
+func (w *W) queueOutpointStatus(
+	ctx context.Context, db sql.Database, txVout *txidVout,
+) error {
+	if len(w.opSubs[*txVout]) == 0 {
+		return nil
+	}
+	status, err := w.getOutpointStatus(ctx, db, txVout)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	w.pendingOps[*txVout] = status
+	return nil
+}
+
+// outpointStatuses returns the status of every subscribed outpoint
+func (w *W) outpointStatuses(
+	ctx context.Context,
+) (map[txidVout]OutpointStatus, error) {
+	statuses := make(map[txidVout]OutpointStatus, len(w.opSubs))
+	for txVout := range w.opSubs {
+		status, err := w.getOutpointStatus(ctx, w.db, &txVout)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		statuses[txVout] = status
+	}
+	return statuses, nil
+}
+
+// notifyChangedOutpoints notifies the subscribers of the outpoints whose
+// status changed since outpointStatuses returned prev
+func (w *W) notifyChangedOutpoints(
+	ctx context.Context, prev map[txidVout]OutpointStatus,
+) error {
+	for txVout, old := range prev {
+		status, err := w.getOutpointStatus(ctx, w.db, &txVout)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		if status != old {
+			w.notifyOutpointSubscribers(&txVout, status)
+		}
+	}
+	return nil
+}
+
+func (w *W) notifyOutpointSubscribers(
+	txVout *txidVout, status OutpointStatus,
+) {
+	for _, cb := range w.opSubs[*txVout] {
+		cb(status)
+	}
+}
@@ -0,0 +1,108 @@
+package walletmanager
+
+import (
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+)
+
+func TestOutpointStatus(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	w := &W{
+		initCompleted: make(chan struct{}),
+		headersSynced: make(chan struct{}),
+		repo:          repo,
+		opSubs:        make(map[txidVout]map[uint32]func(OutpointStatus)),
+		connOpSubs:    make(map[uint32]map[txidVout]struct{}),
+		pendingOps:    make(map[txidVout]OutpointStatus),
+	}
+	close(w.initCompleted)
+	close(w.headersSynced)
+	parent := bitcoin.Transaction{
+		Version: 2,
+		Inputs:  []bitcoin.Input{{Txid: [32]byte{1}}},
+		Outputs: []bitcoin.Output{
+			{Amount: 1, ScriptPubkey: []byte{0x51}},
+			{Amount: 2, ScriptPubkey: []byte{0x51}},
+		},
+	}
+	parentTxid := parent.Txid(nil)
+	child := bitcoin.Transaction{
+		Version: 2,
+		Inputs: []bitcoin.Input{
+			{Txid: parentTxid, Vout: 0},
+			{Txid: parentTxid, Vout: 1},
+		},
+		Outputs: []bitcoin.Output{{Amount: 3, ScriptPubkey: []byte{0x51}}},
+	}
+	childTxid := child.Txid(nil)
+	var got []OutpointStatus
+	notify := func(txVout *txidVout) {
+		err := w.executeBatch(ctx, func(db sql.Database) error {
+			return w.queueOutpointStatus(ctx, db, txVout)
+		})
+		assert.Must(t, err)
+	}
+	onStatus := func(s OutpointStatus) { got = append(got, s) }
+	err := w.OutpointSubscribe(ctx, 1, parentTxid, 0, onStatus)
+	assert.Must(t, err)
+	status, err := w.GetOutpointStatus(ctx, &parentTxid, 0)
+	assert.Must(t, err)
+	assert.MustEqual(t, OutpointStatus{}, status)
+	// funded at 10
+	err = repo.insertTransaction(
+		ctx, nil, &parentTxid, &[32]byte{}, 10, 1, parent.Serialize(nil), nil,
+	)
+	assert.Must(t, err)
+	var txVout0, txVout1 txidVout
+	makeTxidVout(&parentTxid, 0, &txVout0)
+	makeTxidVout(&parentTxid, 1, &txVout1)
+	for _, txVout := range []*txidVout{&txVout0, &txVout1} {
+		err = repo.insertUnspentOutput(ctx, nil, txVout, 1, &[32]byte{})
+		assert.Must(t, err)
+		notify(txVout)
+	}
+	funded := OutpointStatus{Known: true, Height: 10}
+	assert.MustEqual(t, []OutpointStatus{funded}, got)
+	// spent at 11
+	err = repo.insertTransaction(
+		ctx, nil, &childTxid, &[32]byte{}, 11, 1, child.Serialize(nil), nil,
+	)
+	assert.Must(t, err)
+	err = repo.deleteUnspentOutput(ctx, nil, &txVout0, 11, &childTxid)
+	assert.Must(t, err)
+	notify(&txVout0)
+	spent := OutpointStatus{
+		Known:         true,
+		Height:        10,
+		Spent:         true,
+		SpenderTxid:   childTxid,
+		SpenderHeight: 11,
+	}
+	assert.MustEqual(t, []OutpointStatus{funded, spent}, got)
+	// spent before the spender was stored
+	err = repo.deleteUnspentOutput(ctx, nil, &txVout1, 11, &[32]byte{})
+	assert.Must(t, err)
+	status, err = w.GetOutpointStatus(ctx, &parentTxid, 1)
+	assert.Must(t, err)
+	assert.MustEqual(t, spent, status)
+	// a reorg rolling back height 11 notifies the output as unspent
+	prev, err := w.outpointStatuses(ctx)
+	assert.Must(t, err)
+	assert.Must(t, repo.deleteAllSinceBlock(ctx, nil, 10))
+	assert.Must(t, w.notifyChangedOutpoints(ctx, prev))
+	assert.MustEqual(t, []OutpointStatus{funded, spent, funded}, got)
+	assert.MustEqual(t, false, w.OutpointUnsubscribe(2, parentTxid, 0))
+	assert.MustEqual(t, true, w.OutpointUnsubscribe(1, parentTxid, 0))
+	assert.MustEqual(t, 0, len(w.opSubs))
+	assert.MustEqual(t, 0, len(w.connOpSubs))
+	// a disconnect drops the subscriptions
+	err = w.OutpointSubscribe(ctx, 1, parentTxid, 1, func(OutpointStatus) {})
+	assert.Must(t, err)
+	w.UnsubscribeAll(1)
+	assert.MustEqual(t, 0, len(w.opSubs))
+	assert.MustEqual(t, 0, len(w.connOpSubs))
+}
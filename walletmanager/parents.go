@@ -0,0 +1,293 @@
+package walletmanager
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// parentSearchBlocks bounds the blocks read looking for the parent of a
+// stored transaction, starting at the block of the child, the node has no
+// txindex over P2P
+const parentSearchBlocks = 1008
+
+// parentSearchRequestBlocks bounds the blocks read by one request, the next
+// request for the same parent resumes below them
+const parentSearchRequestBlocks = 144
+
+// fetchParent finds txid, an input of a stored transaction, in the blocks
+// below its child and stores it with its merkle branch. The node rpc is
+// asked for the block of txid first, it knows it with txindex. It is called
+// without w.mu, the blocks are read unlocked. The returned error wraps
+// sql.ErrNoRows when txid is not a parent or is not in the blocks searched.
+func (w *W) fetchParent(
+	ctx context.Context, txid *[32]byte,
+) ([]byte, error) {
+	refs, next, err := w.parentSearchRefs(ctx, txid)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if ref, ok := w.rpcParentRef(ctx, txid); ok {
+		refs = append([]blockRef{ref}, refs...)
+	}
+	pb, pos, err := w.searchParent(ctx, txid, refs)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	if pb != nil {
+		raw := pb.block.Transactions[pos].Serialize(nil)
+		err = w.storeParent(ctx, txid, pb, pos, raw)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		return raw, nil
+	}
+	err = w.mu.LockCtx(ctx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	if next > 0 {
+		w.parentSearches[*txid] = next
+		return nil, fmt.Errorf(
+			"tx %x not found above height %d yet: %w",
+			*txid,
+			next,
+			sql.ErrNoRows,
+		)
+	}
+	delete(w.parentSearches, *txid)
+	w.missingParents[*txid] = struct{}{}
+	return nil, fmt.Errorf(
+		"tx %x not in the %d blocks below its child: %w",
+		*txid,
+		parentSearchBlocks,
+		sql.ErrNoRows,
+	)
+}
+
+// parentSearchRefs returns the blocks to search for the parent txid by this
+// request, from the block of its lowest child down or from where the last
+// request stopped. The blocks the node no longer serves and the blocks dir
+// does not have are left out. next is the height the next request resumes
+// at, 0 when the search ends with this request.
+func (w *W) parentSearchRefs(
+	ctx context.Context, txid *[32]byte,
+) ([]blockRef, int, error) {
+	err := w.mu.LockCtx(ctx)
+	if err != nil {
+		return nil, 0, stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	if _, ok := w.missingParents[*txid]; ok {
+		return nil, 0, fmt.Errorf(
+			"tx %x not found: %w", *txid, sql.ErrNoRows,
+		)
+	}
+	height, err := w.repo.selectChildHeight(ctx, w.db, txid)
+	if err != nil {
+		return nil, 0, stackerr.Wrap(err)
+	}
+	if height < 0 {
+		return nil, 0, fmt.Errorf(
+			"tx %x not found: %w", *txid, sql.ErrNoRows,
+		)
+	}
+	bottom := height - parentSearchBlocks
+	h, ok := w.parentSearches[*txid]
+	if !ok {
+		h = height
+	}
+	w.hmu.RLock()
+	defer w.hmu.RUnlock()
+	var refs []blockRef
+	// the genesis coinbase can not be spent
+	for end := max(h-parentSearchRequestBlocks, bottom, 0); h > end; h-- {
+		hash, ok := w.headers.Hash(h)
+		if !ok {
+			continue
+		}
+		ref := blockRef{height: h, hash: hash}
+		ref.local = w.blocks != nil && w.blocks.Has(&hash)
+		if !ref.local && h < w.firstBlock {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	if h <= bottom {
+		h = 0
+	}
+	return refs, h, nil
+}
+
+// rpcParentRef returns the block of txid reported by the node rpc, false
+// without the node rpc or txindex
+func (w *W) rpcParentRef(
+	ctx context.Context, txid *[32]byte,
+) (blockRef, bool) {
+	if w.rpc == nil {
+		return blockRef{}, false
+	}
+	id := *txid
+	slices.Reverse(id[:])
+	res, err := w.rpc.GetRawTransaction(ctx, hex.EncodeToString(id[:]))
+	if err != nil {
+		w.log.Debugf("parent tx %x from the node rpc: %v", *txid, err)
+		return blockRef{}, false
+	}
+	hash, err := hex.DecodeString(res.BlockHash)
+	if err != nil || len(hash) != 32 {
+		return blockRef{}, false
+	}
+	slices.Reverse(hash)
+	ref := blockRef{hash: [32]byte(hash)}
+	var ok bool
+	w.hmu.RLock()
+	ref.height, ok = w.headers.Height(&ref.hash)
+	w.hmu.RUnlock()
+	if !ok {
+		return blockRef{}, false
+	}
+	ref.local = w.blocks != nil && w.blocks.Has(&ref.hash)
+	return ref, true
+}
+
+// searchParent reads the blocks of refs in order until one has txid and
+// returns it with the position of txid, a nil block when none has it. The
+// blocks are requested from w.peer with up to syncInflightBlocks in flight
+// like the sync does, w.pmu is released between them so the sync is not
+// held up.
+func (w *W) searchParent(
+	ctx context.Context, txid *[32]byte, refs []blockRef,
+) (*preparedBlock, int, error) {
+	for chunk := range slices.Chunk(refs, syncInflightBlocks) {
+		pb, pos, err := w.searchParentBlocks(ctx, txid, chunk)
+		if err != nil || pb != nil {
+			return pb, pos, err
+		}
+	}
+	return nil, -1, nil
+}
+
+// searchParentBlocks is searchParent for up to syncInflightBlocks refs,
+// holding w.pmu
+func (w *W) searchParentBlocks(
+	ctx context.Context, txid *[32]byte, refs []blockRef,
+) (*preparedBlock, int, error) {
+	err := w.pmu.LockCtx(ctx)
+	if err != nil {
+		return nil, -1, stackerr.Wrap(err)
+	}
+	defer w.pmu.Unlock()
+	var peer *p2p.Peer
+	if slices.ContainsFunc(refs, func(r blockRef) bool { return !r.local }) {
+		peer, err = w.getPeer(ctx)
+		if err != nil {
+			return nil, -1, stackerr.Wrap(err)
+		}
+	}
+	// blocks still requested when the search stops would reach the next
+	// reader of the peer
+	var stopped bool
+	defer func() {
+		if stopped && peer != nil {
+			w.closePeer()
+		}
+	}()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		errC  = make(chan error, 1)
+		slots = make(chan struct{}, syncInflightBlocks)
+		rawC  = make(chan rawBlock, syncInflightBlocks)
+		buf   []byte
+	)
+	wg.Go(func() {
+		fetchBlocks(ctx, w.log, peer, w.blocks, refs, slots, rawC, errC)
+	})
+	for rb := range rawC {
+		<-slots
+		pb := &preparedBlock{}
+		err := prepareBlock(rb.height, rb.raw, pb, &buf)
+		if err != nil {
+			stopped = true
+			return nil, -1, stackerr.Wrap(err)
+		}
+		pos := slices.Index(pb.txids, *txid)
+		if pos >= 0 {
+			stopped = true
+			return pb, pos, nil
+		}
+	}
+	select {
+	case err := <-errC:
+		stopped = true
+		return nil, -1, stackerr.Wrap(err)
+	default:
+	}
+	if ctx.Err() != nil {
+		stopped = true
+		return nil, -1, stackerr.Wrap(ctx.Err())
+	}
+	return nil, -1, nil
+}
+
+// storeParent stores the parent txid found at pos in pb unless a reorg
+// replaced the block while it was read
+func (w *W) storeParent(
+	ctx context.Context,
+	txid *[32]byte,
+	pb *preparedBlock,
+	pos int,
+	raw []byte,
+) error {
+	err := w.mu.LockCtx(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	w.hmu.RLock()
+	hash, ok := w.headers.Hash(pb.height)
+	w.hmu.RUnlock()
+	if !ok || hash != pb.hash {
+		return fmt.Errorf(
+			"block %d replaced while searching tx %x: %w",
+			pb.height,
+			*txid,
+			sql.ErrNoRows,
+		)
+	}
+	merkle := pb.merkleBranch(pos, nil)
+	err = w.repo.insertTransaction(
+		ctx, w.db, txid, &pb.hash, pb.height, pos, raw, merkle,
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	w.log.Infof("PARENT TX FETCHED; height: %d; txid: %x", pb.height, *txid)
+	return nil
+}
+
+// txParents returns the txids spent by tx, none for a coinbase
+func txParents(tx *bitcoin.Transaction) [][32]byte {
+	var parents [][32]byte
+	for i := range tx.Inputs {
+		in := &tx.Inputs[i]
+		if in.Txid == ([32]byte{}) && in.Vout == 0xffffffff {
+			continue
+		}
+		if !slices.Contains(parents, in.Txid) {
+			parents = append(parents, in.Txid)
+		}
+	}
+	return parents
+}
@@ -0,0 +1,169 @@
+package walletmanager
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/ncodysoftware/eps-go/blockdir"
+	"github.com/ncodysoftware/eps-go/noderpc"
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestFetchParent(t *testing.T) {
+	ctx := t.Context()
+	// the test block on top of the regtest genesis, read from a blocks dir
+	block := testBlock()
+	block.PreviousBlock = genesisBlockData[bitcoin.Regtest].Hash
+	raw := block.Serialize(nil)
+	magic := p2p.MagicBytes(bitcoin.Regtest)
+	data := append(magic[:], binary.LittleEndian.AppendUint32(
+		nil, uint32(len(raw)),
+	)...)
+	dir := t.TempDir()
+	err := os.WriteFile(
+		filepath.Join(dir, "blk00000.dat"), append(data, raw...), 0o644,
+	)
+	assert.Must(t, err)
+	blocks, err := blockdir.Open(dir, bitcoin.Regtest)
+	assert.Must(t, err)
+	assert.Must(t, blocks.Scan())
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	assert.Must(t, headers.Append(raw[:80]))
+	var buf []byte
+	pb := preparedBlock{block: block}
+	indexBlock(&pb, &buf)
+	// a wallet tx in the same block spending the tx at pos 3 and an
+	// unknown one
+	child := bitcoin.Transaction{
+		Version: 2,
+		Inputs: []bitcoin.Input{
+			{Txid: pb.txids[3]},
+			{Txid: [32]byte{1}},
+		},
+		Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: []byte{0x51}}},
+	}
+	childTxid := child.Txid(nil)
+	repo := NewMemRepository()
+	err = repo.insertTransaction(
+		ctx, nil, &childTxid, &pb.hash, 1, 100, child.Serialize(nil), nil,
+	)
+	assert.Must(t, err)
+	err = repo.insertTransactionInputs(ctx, nil, &childTxid, txParents(&child))
+	assert.Must(t, err)
+	// the node rpc knows the block of the tx at pos 3 only
+	var rpcTxids []string
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(rw http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Params []any `json:"params"`
+			}
+			assert.Must(t, json.NewDecoder(r.Body).Decode(&req))
+			txid := req.Params[0].(string)
+			rpcTxids = append(rpcTxids, txid)
+			if txid != tHexHash(pb.txids[3]) {
+				rw.WriteHeader(http.StatusInternalServerError)
+				rw.Write([]byte(`{"result":null,"error":{"code":-5,` +
+					`"message":"No such mempool transaction"},"id":0}`))
+				return
+			}
+			rw.Write([]byte(`{"result":{"blockhash":"` +
+				tHexHash(pb.hash) + `"},"error":null,"id":0}`))
+		},
+	))
+	defer srv.Close()
+	rpc, err := noderpc.New(srv.URL)
+	assert.Must(t, err)
+	w := &W{
+		log:            log.New(log.LevelFromString("error"), "eps-go"),
+		repo:           repo,
+		headers:        headers,
+		blocks:         blocks,
+		rpc:            rpc,
+		missingParents: make(map[[32]byte]struct{}),
+		parentSearches: make(map[[32]byte]int),
+	}
+	got, err := w.fetchParent(ctx, &pb.txids[3])
+	assert.Must(t, err)
+	assert.MustEqual(t, block.Transactions[3].Serialize(nil), got)
+	td, err := repo.selectTransactionFromTxid(ctx, nil, &pb.txids[3])
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, td.Height)
+	assert.MustEqual(t, 3, td.Pos)
+	assert.MustEqual(t, pb.hash, td.BlockHash)
+	assert.MustEqual(t, pb.merkleBranch(3, nil), td.MerkleProof)
+	assert.MustEqual(t, []string{tHexHash(pb.txids[3])}, rpcTxids)
+	// a parent missing from the blocks is remembered
+	_, err = w.fetchParent(ctx, &[32]byte{1})
+	assert.MustEqual(t, true, errors.Is(err, sql.ErrNoRows))
+	assert.MustEqual(t, 1, len(w.missingParents))
+	assert.MustEqual(t, 2, len(rpcTxids))
+	// not a parent
+	_, err = w.fetchParent(ctx, &pb.txids[4])
+	assert.MustEqual(t, true, errors.Is(err, sql.ErrNoRows))
+	assert.MustEqual(t, 1, len(w.missingParents))
+}
+
+// tHexHash returns h in the byte order of the node rpc
+func tHexHash(h [32]byte) string {
+	slices.Reverse(h[:])
+	return hex.EncodeToString(h[:])
+}
+
+// TestParentSearchRefs splits the search of a parent 200 blocks deep in two
+// requests
+func TestParentSearchRefs(t *testing.T) {
+	ctx := t.Context()
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	prev := genesisBlockData[bitcoin.Regtest].Hash
+	for height := 1; height <= 200; height++ {
+		var raw [80]byte
+		copy(raw[4:36], prev[:])
+		binary.LittleEndian.PutUint32(raw[76:], uint32(height))
+		assert.Must(t, headers.Append(raw[:]))
+		prev = doubleSha256(raw[:])
+	}
+	repo := NewMemRepository()
+	child := bitcoin.Transaction{
+		Version: 2,
+		Inputs:  []bitcoin.Input{{Txid: [32]byte{1}}},
+		Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: []byte{0x51}}},
+	}
+	childTxid := child.Txid(nil)
+	err = repo.insertTransaction(
+		ctx, nil, &childTxid, &prev, 200, 1, child.Serialize(nil), nil,
+	)
+	assert.Must(t, err)
+	err = repo.insertTransactionInputs(ctx, nil, &childTxid, txParents(&child))
+	assert.Must(t, err)
+	w := &W{
+		repo:           repo,
+		headers:        headers,
+		missingParents: make(map[[32]byte]struct{}),
+		parentSearches: make(map[[32]byte]int),
+	}
+	refs, next, err := w.parentSearchRefs(ctx, &[32]byte{1})
+	assert.Must(t, err)
+	assert.MustEqual(t, parentSearchRequestBlocks, len(refs))
+	assert.MustEqual(t, 200, refs[0].height)
+	assert.MustEqual(t, 200-parentSearchRequestBlocks, next)
+	w.parentSearches[[32]byte{1}] = next
+	refs, next, err = w.parentSearchRefs(ctx, &[32]byte{1})
+	assert.Must(t, err)
+	assert.MustEqual(t, 200-parentSearchRequestBlocks, len(refs))
+	assert.MustEqual(t, 1, refs[len(refs)-1].height)
+	assert.MustEqual(t, 0, next)
+}
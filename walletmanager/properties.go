@@ -4,6 +4,19 @@ import "ncody.com/ncgo.git/bitcoin"
 
 const gap = 2000
 
+const (
+	// blocks synced per round, also the compact filters kept in memory
+	syncChunkBlocks = 1000
+	// blocks requested from the node and not yet committed
+	syncInflightBlocks = 16
+	// a batch is committed in one sql transaction when either limit is hit
+	syncBatchBlocks = 500
+	syncBatchBytes  = 16 << 20
+	// blocks this close to the tip are fetched over p2p even when the
+	// node blocks dir is configured
+	blockDirTipBlocks = 6
+)
+
 type accountKind uint32
 
 const (
@@ -59,7 +72,53 @@ var genesisBlockData = [3]blockHeaderData{
 			0xac, 0x00, 0x00, 0x00, 0x00,
 		},
 	},
-	bitcoin.Testnet: {},
+	bitcoin.Testnet: {
+		Hash: [32]byte{
+			0x43, 0x49, 0x7f, 0xd7, 0xf8, 0x26, 0x95, 0x71,
+			0x08, 0xf4, 0xa3, 0x0f, 0xd9, 0xce, 0xc3, 0xae,
+			0xba, 0x79, 0x97, 0x20, 0x84, 0xe9, 0x0e, 0xad,
+			0x01, 0xea, 0x33, 0x09, 0x00, 0x00, 0x00, 0x00,
+		},
+		Height: 0,
+		Serialized: []byte{
+			0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x3b, 0xa3, 0xed, 0xfd,
+			0x7a, 0x7b, 0x12, 0xb2, 0x7a, 0xc7, 0x2c, 0x3e,
+			0x67, 0x76, 0x8f, 0x61, 0x7f, 0xc8, 0x1b, 0xc3,
+			0x88, 0x8a, 0x51, 0x32, 0x3a, 0x9f, 0xb8, 0xaa,
+			0x4b, 0x1e, 0x5e, 0x4a, 0xda, 0xe5, 0x49, 0x4d,
+			0xff, 0xff, 0x00, 0x1d, 0x1a, 0xa4, 0xae, 0x18,
+			0x01, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0xff,
+			0xff, 0xff, 0x4d, 0x04, 0xff, 0xff, 0x00, 0x1d,
+			0x01, 0x04, 0x45, 0x54, 0x68, 0x65, 0x20, 0x54,
+			0x69, 0x6d, 0x65, 0x73, 0x20, 0x30, 0x33, 0x2f,
+			0x4a, 0x61, 0x6e, 0x2f, 0x32, 0x30, 0x30, 0x39,
+			0x20, 0x43, 0x68, 0x61, 0x6e, 0x63, 0x65, 0x6c,
+			0x6c, 0x6f, 0x72, 0x20, 0x6f, 0x6e, 0x20, 0x62,
+			0x72, 0x69, 0x6e, 0x6b, 0x20, 0x6f, 0x66, 0x20,
+			0x73, 0x65, 0x63, 0x6f, 0x6e, 0x64, 0x20, 0x62,
+			0x61, 0x69, 0x6c, 0x6f, 0x75, 0x74, 0x20, 0x66,
+			0x6f, 0x72, 0x20, 0x62, 0x61, 0x6e, 0x6b, 0x73,
+			0xff, 0xff, 0xff, 0xff, 0x01, 0x00, 0xf2, 0x05,
+			0x2a, 0x01, 0x00, 0x00, 0x00, 0x43, 0x41, 0x04,
+			0x67, 0x8a, 0xfd, 0xb0, 0xfe, 0x55, 0x48, 0x27,
+			0x19, 0x67, 0xf1, 0xa6, 0x71, 0x30, 0xb7, 0x10,
+			0x5c, 0xd6, 0xa8, 0x28, 0xe0, 0x39, 0x09, 0xa6,
+			0x79, 0x62, 0xe0, 0xea, 0x1f, 0x61, 0xde, 0xb6,
+			0x49, 0xf6, 0xbc, 0x3f, 0x4c, 0xef, 0x38, 0xc4,
+			0xf3, 0x55, 0x04, 0xe5, 0x1e, 0xc1, 0x12, 0xde,
+			0x5c, 0x38, 0x4d, 0xf7, 0xba, 0x0b, 0x8d, 0x57,
+			0x8a, 0x4c, 0x70, 0x2b, 0x6b, 0xf1, 0x1d, 0x5f,
+			0xac, 0x00, 0x00, 0x00, 0x00,
+		},
+	},
 	bitcoin.Regtest: {
 		Hash: [32]byte{
 			0x06, 0x22, 0x6e, 0x46, 0x11, 0x1a, 0x0b, 0x59,
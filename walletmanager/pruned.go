@@ -0,0 +1,127 @@
+package walletmanager
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// missingBlockError is returned by the sync when the node can not serve a
+// block it announced a header for
+type missingBlockError struct {
+	height int
+	hash   [32]byte
+}
+
+func (m missingBlockError) Error() string {
+	return fmt.Sprintf("block %x at height %d not available", m.hash, m.height)
+}
+
+// checkPruned sets w.firstBlock to the lowest height whose block can be
+// fetched. A node announcing NODE_NETWORK_LIMITED without NODE_NETWORK
+// only serves the last p2p.NetworkLimitedBlocks blocks, older blocks may
+// still be read from the blocks dir.
+func (w *W) checkPruned(ctx context.Context) error {
+	peer, err := w.getPeer(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	if peer.Services()&p2p.ServiceNetwork != 0 {
+		return nil
+	}
+	first := max(1, w.bestHeader-p2p.NetworkLimitedBlocks+1)
+	if w.blocks != nil {
+		first, err = lowestAvailable(
+			max(1, w.firstBlock),
+			first,
+			func(height int) (bool, error) {
+				hash, ok := w.headers.Hash(height)
+				return ok && w.blocks.Has(&hash), nil
+			},
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	if first > w.firstBlock {
+		w.log.Warnf(
+			"PRUNED NODE; blocks available from height %d", first,
+		)
+	}
+	w.firstBlock = max(w.firstBlock, first)
+	return nil
+}
+
+// lowestAvailable returns the lowest height in [lo, hi] for which has
+// holds, assuming every height above it holds too. hi is returned when
+// no lower height holds.
+func lowestAvailable(
+	lo, hi int, has func(height int) (bool, error),
+) (int, error) {
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		ok, err := has(mid)
+		if err != nil {
+			return 0, stackerr.Wrap(err)
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+	return hi, nil
+}
+
+// markStalled flags the wallets that need blocks below w.firstBlock. With
+// opts.ScanFromFirstBlock they are moved to the first available block
+// instead, their history below it is left out.
+func (w *W) markStalled(ctx context.Context) error {
+	for i := range w.wallets {
+		wl := &w.wallets[i]
+		wasStalled := wl.stalled
+		wl.stalled = false
+		if wl.height+1 >= w.firstBlock {
+			continue
+		}
+		if !w.scanFromFirstBlock {
+			wl.stalled = true
+			if wasStalled {
+				continue
+			}
+			w.log.Errf(
+				"WALLET %x CAN NOT BE SCANNED; height: %d; node "+
+					"blocks available from height %d",
+				wl.hash,
+				wl.height,
+				w.firstBlock,
+			)
+			continue
+		}
+		w.log.Warnf(
+			"WALLET %x SCANNED FROM HEIGHT %d; history from height "+
+				"%d is missing",
+			wl.hash,
+			w.firstBlock,
+			wl.height+1,
+		)
+		err := w.repo.execute(
+			ctx,
+			w.db,
+			func(db sql.Database) error {
+				return w.repo.updateWalletHeight(
+					ctx, db, &wl.hash, w.firstBlock-1,
+				)
+			},
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		wl.height = w.firstBlock - 1
+	}
+	w.storeSyncHeight()
+	return nil
+}
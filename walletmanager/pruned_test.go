@@ -0,0 +1,52 @@
+package walletmanager
+
+import (
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestLowestAvailable(t *testing.T) {
+	for _, first := range []int{1, 2, 50, 99, 100} {
+		var calls int
+		got, err := lowestAvailable(
+			1,
+			100,
+			func(height int) (bool, error) {
+				calls++
+				return height >= first, nil
+			},
+		)
+		assert.Must(t, err)
+		assert.MustEqual(t, first, got)
+		assert.MustEqual(t, true, calls <= 7)
+	}
+}
+
+func TestMarkStalled(t *testing.T) {
+	repo := NewMemRepository()
+	w := &W{
+		log:        log.New(log.LevelFromString("error"), "eps-go"),
+		repo:       repo,
+		firstBlock: 100,
+		wallets: []wallet{
+			{hash: [32]byte{1}, height: 10},
+			{hash: [32]byte{2}, height: 99},
+		},
+	}
+	for _, wl := range w.wallets {
+		wd := walletData{Hash: wl.hash, Height: wl.height}
+		assert.Must(t, repo.insertWalletData(t.Context(), nil, &wd))
+	}
+	assert.Must(t, w.markStalled(t.Context()))
+	assert.MustEqual(t, true, w.wallets[0].stalled)
+	assert.MustEqual(t, false, w.wallets[1].stalled)
+	w.scanFromFirstBlock = true
+	assert.Must(t, w.markStalled(t.Context()))
+	assert.MustEqual(t, false, w.wallets[0].stalled)
+	assert.MustEqual(t, 99, w.wallets[0].height)
+	wd, err := repo.selectWalletData(t.Context(), nil, &w.wallets[0].hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, 99, wd.Height)
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math"
 
+	"github.com/ncodysoftware/eps-go/headerstore"
 	"ncody.com/ncgo.git/database/sql"
 	"ncody.com/ncgo.git/stackerr"
 )
@@ -16,13 +18,157 @@ type utxoData2 struct {
 	ScriptPubkeyHash [32]byte
 }
 
-type repository struct {
+// Repository stores the index. The db argument of the methods is the
+// database or the transaction started by execute, implementations not
+// backed by sql.Database ignore it. The methods are unexported, the
+// implementations are the sql one New builds and NewMemRepository.
+type Repository interface {
+	// execute runs fn in a transaction, a failed fn leaves the repository
+	// as it was
+	execute(
+		ctx context.Context,
+		db sql.Database,
+		fn func(db sql.Database) error,
+	) error
+	reloadCaches(ctx context.Context, db sql.Database) error
+	selectWalletData(
+		ctx context.Context, db sql.Database, hash *[32]byte,
+	) (walletData, error)
+	insertWalletData(ctx context.Context, db sql.Database, wd *walletData) error
+	updateWalletIndexes(
+		ctx context.Context,
+		db sql.Database,
+		whash *[32]byte,
+		nextReceiveIndex uint32,
+		nextChangeIndex uint32,
+	) error
+	updateWalletHeight(
+		ctx context.Context, db sql.Database, whash *[32]byte, height int,
+	) error
+	selectScriptHashBalance(
+		ctx context.Context, db sql.Database, sh *[32]byte, out *uint64,
+	) error
+	// selectScriptHashHistory returns at most limit txs of sh from
+	// fromHeight up to toHeight excluded, a negative toHeight or limit has
+	// no bound
+	selectScriptHashHistory(
+		ctx context.Context,
+		db sql.Database,
+		sh *[32]byte,
+		fromHeight int,
+		toHeight int,
+		limit int,
+	) ([]TxData, error)
+	selectScriptHashUnspent(
+		ctx context.Context, db sql.Database, sh *[32]byte,
+	) ([]UtxoData, error)
+	insertTransaction(
+		ctx context.Context,
+		db sql.Database,
+		txid *[32]byte,
+		blockHash *[32]byte,
+		height int,
+		pos int,
+		serialized []byte,
+		merkleProof []byte,
+	) error
+	selectRawTransaction(
+		ctx context.Context, db sql.Database, txid *[32]byte,
+	) ([]byte, error)
+	selectTransactionFromTxid(
+		ctx context.Context, db sql.Database, txid *[32]byte,
+	) (transactionData, error)
+	selectTransactionFromHeightPos(
+		ctx context.Context, db sql.Database, height, pos int,
+	) (transactionData, error)
+	// selectBlockTransactions returns the stored txs of the block at
+	// height by position
+	selectBlockTransactions(
+		ctx context.Context, db sql.Database, height int,
+	) ([]transactionData, error)
+	insertScriptPubkeyTransaction(
+		ctx context.Context,
+		db sql.Database,
+		scriptPubkeyHash *[32]byte,
+		txid *[32]byte,
+	) error
+	insertUnspentOutput(
+		ctx context.Context,
+		db sql.Database,
+		txVout *txidVout,
+		satoshi uint64,
+		scriptPubkeyHash *[32]byte,
+	) error
+	selectUnspentOutput(
+		ctx context.Context, db sql.Database, txVout *txidVout, out *utxoData,
+	) error
+	// deleteUnspentOutput moves the output to the spent ones
+	deleteUnspentOutput(
+		ctx context.Context,
+		db sql.Database,
+		txVout *txidVout,
+		height int,
+		spender *[32]byte,
+	) error
+	// selectSpentOutput returns errNotFound when txVout is not a spent
+	// wallet output
+	selectSpentOutput(
+		ctx context.Context,
+		db sql.Database,
+		txVout *txidVout,
+		out *spentOutputData,
+	) error
+	// updateSpentOutputSpender sets the spender of an output spent before
+	// the spenders were stored
+	updateSpentOutputSpender(
+		ctx context.Context,
+		db sql.Database,
+		txVout *txidVout,
+		spender *[32]byte,
+	) error
+	// insertTransactionInputs records the txs spent by the stored tx txid
+	insertTransactionInputs(
+		ctx context.Context,
+		db sql.Database,
+		txid *[32]byte,
+		parents [][32]byte,
+	) error
+	// selectChildHeight returns the lowest height of the stored txs
+	// spending an output of txid, -1 when there is none
+	selectChildHeight(
+		ctx context.Context, db sql.Database, txid *[32]byte,
+	) (int, error)
+	// deleteAllSinceBlock removes the blocks above height and restores the
+	// outputs they spent
+	deleteAllSinceBlock(ctx context.Context, db sql.Database, height int) error
+	// selectBackfills returns the pending backfills, see runBackfills
+	selectBackfills(ctx context.Context, db sql.Database) ([]string, error)
+	deleteBackfill(ctx context.Context, db sql.Database, name string) error
+	// the methods below read the whole index, they are used by the verifier
+	selectAllWalletData(
+		ctx context.Context, db sql.Database,
+	) ([]walletData, error)
+	selectAllUtxos(ctx context.Context, db sql.Database) ([]utxoData, error)
+	selectAllSpentOutputs(
+		ctx context.Context, db sql.Database,
+	) ([]spentOutputData, error)
+	forEachTransaction(
+		ctx context.Context,
+		db sql.Database,
+		fn func(t *transactionData) error,
+	) error
+}
+
+// sqlRepository is the Repository stored in sqlite or Postgres
+type sqlRepository struct {
 	db        sql.Database
 	utxoIndex map[txidVout]utxoData2
 }
 
-func newRepository(ctx context.Context, db sql.Database) (*repository, error) {
-	r := &repository{
+func newSQLRepository(
+	ctx context.Context, db sql.Database,
+) (*sqlRepository, error) {
+	r := &sqlRepository{
 		db: db,
 	}
 	err := r.loadUtxoIndex(ctx, db)
@@ -32,7 +178,7 @@ func newRepository(ctx context.Context, db sql.Database) (*repository, error) {
 	return r, nil
 }
 
-func (r *repository) loadUtxoIndex(ctx context.Context, db sql.Database) error {
+func (r *sqlRepository) loadUtxoIndex(ctx context.Context, db sql.Database) error {
 	utxos, err := r.selectAllUtxos(ctx, db)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -49,7 +195,24 @@ func (r *repository) loadUtxoIndex(ctx context.Context, db sql.Database) error {
 	return nil
 }
 
-func (r *repository) reloadCaches(
+func (r *sqlRepository) execute(
+	ctx context.Context,
+	db sql.Database,
+	fn func(db sql.Database) error,
+) error {
+	err := sql.Execute(ctx, db, fn)
+	if err != nil {
+		// the utxo cache may hold the changes of the rolled back tx
+		rerr := r.reloadCaches(ctx, db)
+		if rerr != nil {
+			return fmt.Errorf("%w, reloading the caches: %v", err, rerr)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *sqlRepository) reloadCaches(
 	ctx context.Context,
 	db sql.Database,
 ) error {
@@ -70,7 +233,7 @@ type walletData struct {
 	NextChangeIndex  uint32
 }
 
-func (r *repository) selectWalletData(
+func (r *sqlRepository) selectWalletData(
 	ctx context.Context,
 	db sql.Database,
 	hash *[32]byte,
@@ -92,7 +255,7 @@ func (r *repository) selectWalletData(
 	return w, nil
 }
 
-func (r *repository) insertWalletData(
+func (r *sqlRepository) insertWalletData(
 	ctx context.Context,
 	db sql.Database,
 	wd *walletData,
@@ -124,137 +287,63 @@ type blockHeaderData struct {
 	Serialized []byte
 }
 
-func (r *repository) selectLastBlockHeaderData(
+// importBlockHeaders moves the headers stored in the blockheader table by
+// the versions before the headers file to headers. The headers not linking
+// to it are dropped, the sync downloads them again.
+func (r *sqlRepository) importBlockHeaders(
 	ctx context.Context,
 	db sql.Database,
-	hd *blockHeaderData,
-) error {
+	headers *headerstore.Store,
+) (int, error) {
 	s := `
-	SELECT hash, height, serialized
+	SELECT height, serialized
 	FROM blockheader
-	ORDER BY height DESC
-	LIMIT 1
-	;
-	`
-	h := bufWrapper(hd.Hash[:])
-	err := db.QueryRow(ctx, s).Scan(&h, &hd.Height, &hd.Serialized)
-	if err != nil {
-		return stackerr.Wrap(err)
-	}
-	return nil
-}
-
-func (r *repository) selectBlockHashesAtHeight(
-	ctx context.Context,
-	db sql.Database,
-	height int,
-	limit int,
-	out *[][32]byte,
-) error {
-	s := `
-	SELECT hash FROM blockheader
-	WHERE
-		EXISTS (
-			SELECT 1 FROM blockheader
-			WHERE height = $1
-		)
-		AND
-		height >= $1
+	WHERE height > $1
 	ORDER BY height ASC
-	LIMIT $2
 	;
 	`
-	rows, err := db.Query(ctx, s, height, limit)
+	rows, err := db.Query(ctx, s, headers.Tip())
 	if err != nil {
-		return stackerr.Wrap(err)
+		return 0, stackerr.Wrap(err)
 	}
-	defer rows.Close()
-	for i := 0; rows.Next(); i++ {
-		var buf [32]byte
-		h := bufWrapper(buf[:])
-		err := rows.Scan(&h)
+	var (
+		batch []byte
+		raw   [80]byte
+	)
+	for next := headers.Tip() + 1; rows.Next(); next++ {
+		var height int
+		bw := bufWrapper(raw[:])
+		err := rows.Scan(&height, &bw)
 		if err != nil {
-			return stackerr.Wrap(err)
+			rows.Close()
+			return 0, stackerr.Wrap(err)
 		}
-		*out = append(*out, buf)
-	}
-	return nil
-}
-
-func (r *repository) selectRawBlockHeaderByHeight(
-	ctx context.Context,
-	db sql.Database,
-	height int,
-	out *[80]byte,
-) error {
-	s := `
-	SELECT (serialized)
-	FROM blockheader
-	WHERE height = $1
-	LIMIT 1;
-	`
-	bw := bufWrapper(out[:])
-	err := db.QueryRow(ctx, s, height).Scan(&bw)
-	if err != nil {
-		return stackerr.Wrap(err)
-	}
-	return nil
-}
-
-func (r *repository) selectRawBlockHeadersByHeight(
-	ctx context.Context,
-	db sql.Database,
-	height,
-	limit int,
-) ([][80]byte, error) {
-	s := `
-	SELECT (serialized)
-	FROM blockheader
-	WHERE height >= $1
-	ORDER BY height ASC
-	LIMIT $2
-	;
-	`
-	rows, err := db.Query(ctx, s, height, limit)
-	if err != nil {
-		return nil, stackerr.Wrap(err)
+		if height != next {
+			break
+		}
+		batch = append(batch, raw[:]...)
 	}
-	defer rows.Close()
-	var h [][80]byte
-	for rows.Next() {
-		var b [80]byte
-		bw := bufWrapper(b[:])
-		err := rows.Scan(&bw)
-		if err != nil {
-			return nil, stackerr.Wrap(err)
+	rows.Close()
+	n := 0
+	for len(batch) > 0 {
+		chunk := batch[:min(len(batch), 2000*80)]
+		err = headers.Append(chunk)
+		if err != nil && errors.Is(err, headerstore.ErrNotLinked) {
+			break
+		} else if err != nil {
+			return n, stackerr.Wrap(err)
 		}
-		h = append(h, b)
+		n += len(chunk) / 80
+		batch = batch[len(chunk):]
 	}
-	return h, nil
-}
-
-func (r *repository) selectLastBlockHeaderHeightAndRaw(
-	ctx context.Context,
-	db sql.Database,
-	outHeight *int,
-	outHeader *[80]byte,
-) error {
-	s := `
-	SELECT height, serialized
-	FROM blockheader
-	ORDER BY height DESC
-	LIMIT 1
-	;
-	`
-	h := bufWrapper(outHeader[:])
-	err := db.QueryRow(ctx, s).Scan(outHeight, &h)
+	_, err = db.Exec(ctx, `DELETE FROM blockheader;`)
 	if err != nil {
-		return stackerr.Wrap(err)
+		return n, stackerr.Wrap(err)
 	}
-	return nil
+	return n, nil
 }
 
-func (r *repository) selectScriptHashBalance(
+func (r *sqlRepository) selectScriptHashBalance(
 	ctx context.Context,
 	db sql.Database,
 	sh *[32]byte,
@@ -276,24 +365,36 @@ type TxData struct {
 	Txid   [32]byte
 }
 
-func (r *repository) selectScriptHashHistory(
+const sqlSelectScriptHashHistory = `
+SELECT tx.height, stx.txid
+FROM scriptpubkey_tx AS stx
+JOIN tx 
+ON tx.txid = stx.txid
+WHERE stx.scriptpubkey_hash = $1
+AND tx.height >= CAST($2 AS BIGINT)
+AND tx.height < CAST($3 AS BIGINT)
+ORDER BY tx.height, tx.pos ASC
+LIMIT CAST($4 AS BIGINT)
+;
+`
+
+func (r *sqlRepository) selectScriptHashHistory(
 	ctx context.Context,
 	db sql.Database,
 	sh *[32]byte,
+	fromHeight int,
+	toHeight int,
+	limit int,
 ) ([]TxData, error) {
-	s := `
-	SELECT bh.height, stx.txid
-	FROM scriptpubkey_tx AS stx
-	JOIN tx 
-	ON tx.txid = stx.txid
-	JOIN blockheader AS bh 
-	ON bh.hash = tx.blockhash
-	WHERE stx.scriptpubkey_hash = $1
-	ORDER BY bh.height, tx.pos ASC
-	;
-	`
+	s := sqlSelectScriptHashHistory
+	if toHeight < 0 {
+		toHeight = math.MaxInt64
+	}
+	if limit < 0 {
+		limit = math.MaxInt64
+	}
 	var h []TxData
-	rows, err := db.Query(ctx, s, sh[:])
+	rows, err := db.Query(ctx, s, sh[:], fromHeight, toHeight, limit)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
@@ -317,22 +418,22 @@ type UtxoData struct {
 	Satoshi uint64
 }
 
-func (r *repository) selectScriptHashUnspent(
+const sqlSelectScriptHashUnspent = `
+SELECT tx.height, tx.pos, SUBSTR(uo.txid_vout, 1, 32), uo.satoshi
+FROM unspent_output AS uo
+JOIN tx
+ON tx.txid = SUBSTR(uo.txid_vout, 1, 32)
+WHERE uo.scriptpubkey_hash = $1
+ORDER BY tx.height, tx.pos ASC
+;
+`
+
+func (r *sqlRepository) selectScriptHashUnspent(
 	ctx context.Context,
 	db sql.Database,
 	sh *[32]byte,
 ) ([]UtxoData, error) {
-	s := `
-	SELECT bh.height, tx.pos, SUBSTR(uo.txid_vout, 1, 32), uo.satoshi
-	FROM unspent_output AS uo
-	JOIN tx
-	ON tx.txid = SUBSTR(uo.txid_vout, 1, 32)
-	JOIN blockheader as bh
-	ON bh.hash = tx.blockhash
-	WHERE uo.scriptpubkey_hash = $1
-	ORDER BY bh.height, tx.pos ASC
-	;
-	`
+	s := sqlSelectScriptHashUnspent
 	var u []UtxoData
 	rows, err := db.Query(ctx, s, sh[:])
 	if err != nil {
@@ -351,43 +452,21 @@ func (r *repository) selectScriptHashUnspent(
 	return u, nil
 }
 
-func (r *repository) insertBlockHeader(
-	ctx context.Context,
-	db sql.Database,
-	hash *[32]byte,
-	height int,
-	serialized []byte,
-) error {
-	s := `
-	INSERT INTO blockheader
-	(hash, height, serialized)
-	VALUES ($1, $2, $3)
-	;
-	`
-	_, err := db.Exec(ctx, s, hash[:], height, serialized[:80])
-	if err != nil {
-		return stackerr.Wrap(err)
-	}
-	return nil
-}
-
-func (r *repository) insertTransaction(
+func (r *sqlRepository) insertTransaction(
 	ctx context.Context,
 	db sql.Database,
 	txid *[32]byte,
 	blockHash *[32]byte,
+	height int,
 	pos int,
 	serialized []byte,
 	merkleProof []byte,
 ) error {
 	s := `
 	INSERT INTO tx
-	(txid, blockhash, pos, serialized, merkle_proof)
-	SELECT $1, $2, $3, $4, $5
-	WHERE NOT EXISTS (
-		SELECT 1 FROM tx
-		WHERE txid = $1
-	)
+	(txid, blockhash, height, pos, serialized, merkle_proof)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT DO NOTHING
 	;
 	`
 	_, err := db.Exec(
@@ -395,6 +474,7 @@ func (r *repository) insertTransaction(
 		s,
 		txid[:],
 		blockHash[:],
+		height,
 		pos,
 		serialized,
 		merkleProof,
@@ -405,7 +485,7 @@ func (r *repository) insertTransaction(
 	return nil
 }
 
-func (r *repository) selectRawTransaction(
+func (r *sqlRepository) selectRawTransaction(
 	ctx context.Context,
 	db sql.Database,
 	txid *[32]byte,
@@ -427,27 +507,27 @@ func (r *repository) selectRawTransaction(
 type transactionData struct {
 	Txid        [32]byte
 	BlockHash   [32]byte
+	Height      int
 	Pos         int
 	Raw         []byte
 	MerkleProof []byte
 }
 
-func (r *repository) selectTransactionFromTxid(
+func (r *sqlRepository) selectTransactionFromTxid(
 	ctx context.Context,
 	db sql.Database,
 	txid *[32]byte,
 ) (transactionData, error) {
 	s := `
-	SELECT tx.blockhash, tx.pos, tx.serialized, tx.merkle_proof
+	SELECT tx.blockhash, tx.height, tx.pos, tx.serialized, tx.merkle_proof
 	FROM tx
 	WHERE txid = $1
 	LIMIT 1;
-	;
 	`
 	var t transactionData
 	bh := bufWrapper(t.BlockHash[:])
 	err := db.QueryRow(ctx, s, txid[:]).Scan(
-		&bh, &t.Pos, &t.Raw, &t.MerkleProof,
+		&bh, &t.Height, &t.Pos, &t.Raw, &t.MerkleProof,
 	)
 	if err != nil {
 		return t, stackerr.Wrap(err)
@@ -456,28 +536,28 @@ func (r *repository) selectTransactionFromTxid(
 	return t, nil
 }
 
-func (r *repository) selectTransactionFromHeightPos(
+const sqlSelectTransactionFromHeightPos = `
+SELECT tx.txid, tx.blockhash, tx.height, tx.pos, tx.serialized,
+	tx.merkle_proof
+FROM tx
+WHERE
+	tx.height = $1
+	AND
+	tx.pos = $2
+LIMIT 1;
+`
+
+func (r *sqlRepository) selectTransactionFromHeightPos(
 	ctx context.Context,
 	db sql.Database,
 	height, pos int,
 ) (transactionData, error) {
-	s := `
-	SELECT tx.txid, tx.blockhash, tx.pos, tx.serialized, tx.merkle_proof
-	FROM tx
-	JOIN blockheader AS bh
-	ON bh.hash = tx.blockhash
-	WHERE
-		bh.height = $1
-		AND
-		tx.pos = $2
-	LIMIT 1;
-	;
-	`
+	s := sqlSelectTransactionFromHeightPos
 	var t transactionData
 	txid := bufWrapper(t.Txid[:])
 	bh := bufWrapper(t.BlockHash[:])
 	err := db.QueryRow(ctx, s, height, pos).Scan(
-		&txid, &bh, &t.Pos, &t.Raw, &t.MerkleProof,
+		&txid, &bh, &t.Height, &t.Pos, &t.Raw, &t.MerkleProof,
 	)
 	if err != nil {
 		return t, stackerr.Wrap(err)
@@ -485,7 +565,42 @@ func (r *repository) selectTransactionFromHeightPos(
 	return t, nil
 }
 
-func (r *repository) insertScriptPubkeyTransaction(
+const sqlSelectBlockTransactions = `
+SELECT tx.txid, tx.blockhash, tx.height, tx.pos, tx.serialized,
+	tx.merkle_proof
+FROM tx
+WHERE tx.height = $1
+ORDER BY tx.pos
+;
+`
+
+func (r *sqlRepository) selectBlockTransactions(
+	ctx context.Context,
+	db sql.Database,
+	height int,
+) ([]transactionData, error) {
+	rows, err := db.Query(ctx, sqlSelectBlockTransactions, height)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer rows.Close()
+	var txs []transactionData
+	for rows.Next() {
+		var t transactionData
+		txid := bufWrapper(t.Txid[:])
+		bh := bufWrapper(t.BlockHash[:])
+		err := rows.Scan(
+			&txid, &bh, &t.Height, &t.Pos, &t.Raw, &t.MerkleProof,
+		)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		txs = append(txs, t)
+	}
+	return txs, nil
+}
+
+func (r *sqlRepository) insertScriptPubkeyTransaction(
 	ctx context.Context,
 	db sql.Database,
 	scriptPubkeyHash *[32]byte,
@@ -494,14 +609,8 @@ func (r *repository) insertScriptPubkeyTransaction(
 	s := `
 	INSERT INTO scriptpubkey_tx
 	(scriptpubkey_hash, txid)
-	SELECT $1, $2
-	WHERE NOT EXISTS (
-		SELECT 1 FROM scriptpubkey_tx
-		WHERE 
-			scriptpubkey_hash = $1
-		AND 
-			txid = $2
-	)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING
 	;
 	`
 	_, err := db.Exec(ctx, s, scriptPubkeyHash[:], txid[:])
@@ -511,7 +620,69 @@ func (r *repository) insertScriptPubkeyTransaction(
 	return nil
 }
 
-func (r *repository) insertUnspentOutput(
+func (r *sqlRepository) updateSpentOutputSpender(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	spender *[32]byte,
+) error {
+	s := `
+	UPDATE spent_output
+	SET spender_txid = $2
+	WHERE txid_vout = $1
+	;
+	`
+	_, err := db.Exec(ctx, s, txVout[:], spender[:])
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) insertTransactionInputs(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+	parents [][32]byte,
+) error {
+	s := `
+	INSERT INTO tx_input
+	(parent_txid, child_txid)
+	VALUES ($1, $2)
+	ON CONFLICT DO NOTHING
+	;
+	`
+	for i := range parents {
+		_, err := db.Exec(ctx, s, parents[i][:], txid[:])
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
+const sqlSelectChildHeight = `
+SELECT COALESCE(MIN(tx.height), -1)
+FROM tx_input AS ti
+JOIN tx ON tx.txid = ti.child_txid
+WHERE ti.parent_txid = $1
+;
+`
+
+func (r *sqlRepository) selectChildHeight(
+	ctx context.Context,
+	db sql.Database,
+	txid *[32]byte,
+) (int, error) {
+	var height int
+	err := db.QueryRow(ctx, sqlSelectChildHeight, txid[:]).Scan(&height)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	return height, nil
+}
+
+func (r *sqlRepository) insertUnspentOutput(
 	ctx context.Context,
 	db sql.Database,
 	txVout *txidVout,
@@ -521,12 +692,8 @@ func (r *repository) insertUnspentOutput(
 	s := `
 	INSERT INTO unspent_output
 	(txid_vout, satoshi, scriptpubkey_hash)
-	SELECT $1, $2, $3
-	WHERE NOT EXISTS (
-		SELECT 1 FROM unspent_output
-		WHERE txid_vout = $1
-		LIMIT 1
-	)
+	VALUES ($1, $2, $3)
+	ON CONFLICT DO NOTHING
 	;
 	`
 	_, err := db.Exec(ctx, s, txVout[:], satoshi, scriptPubkeyHash[:])
@@ -540,7 +707,7 @@ func (r *repository) insertUnspentOutput(
 	return nil
 }
 
-func (r *repository) selectAllUtxos(
+func (r *sqlRepository) selectAllUtxos(
 	ctx context.Context,
 	db sql.Database,
 ) ([]utxoData, error) {
@@ -573,7 +740,7 @@ type utxoData struct {
 	ScriptPubkeyHash [32]byte
 }
 
-func (r *repository) selectUnspentOutput(
+func (r *sqlRepository) selectUnspentOutput(
 	ctx context.Context,
 	db sql.Database,
 	txVout *txidVout,
@@ -590,32 +757,32 @@ func (r *repository) selectUnspentOutput(
 	return nil
 }
 
-func (r *repository) deleteUnspentOutput(
+func (r *sqlRepository) deleteUnspentOutput(
 	ctx context.Context,
 	db sql.Database,
 	txVout *txidVout,
 	height int,
+	spender *[32]byte,
 ) error {
 	s := `
 	INSERT INTO spent_output
-	(txid_vout, satoshi, scriptpubkey_hash, spent_height)
-	SELECT txid_vout, satoshi, scriptpubkey_hash, $2
+	(txid_vout, satoshi, scriptpubkey_hash, spent_height, spender_txid)
+	SELECT txid_vout, satoshi, scriptpubkey_hash, CAST($2 AS BIGINT), $3
 	FROM unspent_output
-	WHERE 
-		txid_vout = $1 
-	AND
-		NOT EXISTS (
-			SELECT 1
-			FROM spent_output
-			WHERE txid_vout = $1
-		)
+	WHERE txid_vout = $1
+	ON CONFLICT DO NOTHING
 	;
-	--
+	`
+	_, err := db.Exec(ctx, s, txVout[:], height, spender[:])
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	s = `
 	DELETE FROM unspent_output
 	WHERE txid_vout = $1
 	;
 	`
-	_, err := db.Exec(ctx, s, txVout[:], height)
+	_, err = db.Exec(ctx, s, txVout[:])
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -623,7 +790,7 @@ func (r *repository) deleteUnspentOutput(
 	return nil
 }
 
-func (r *repository) updateWalletIndexes(
+func (r *sqlRepository) updateWalletIndexes(
 	ctx context.Context,
 	db sql.Database,
 	whash *[32]byte,
@@ -643,7 +810,7 @@ func (r *repository) updateWalletIndexes(
 	return nil
 }
 
-func (r *repository) updateWalletHeight(
+func (r *sqlRepository) updateWalletHeight(
 	ctx context.Context,
 	db sql.Database,
 	whash *[32]byte,
@@ -662,66 +829,251 @@ func (r *repository) updateWalletHeight(
 	return nil
 }
 
-func (r *repository) deleteAllSinceBlock(
-	ctx context.Context,
-	db sql.Database,
-	height int,
-) error {
-	s := `
-	BEGIN;
-	--
-	DELETE 
+// sqlDeleteAllSinceBlock rolls the index back, the statements run in one
+// transaction
+var sqlDeleteAllSinceBlock = [...]string{
+	`
+	DELETE
 	FROM scriptpubkey_tx AS stx
 	WHERE stx.txid IN (
 		SELECT txid FROM tx
-		JOIN blockheader AS bh
-		ON bh.hash = tx.blockhash
-		AND bh.height > $1
+		WHERE height > $1
 	);
-	--
+	`,
+	`
 	INSERT INTO unspent_output
 	(txid_vout, satoshi, scriptpubkey_hash)
 	SELECT txid_vout, satoshi, scriptpubkey_hash
 	FROM spent_output
-	WHERE spent_height > $1;
-	--
+	WHERE spent_height > $1
+	ON CONFLICT DO NOTHING;
+	`,
+	`
 	DELETE FROM spent_output
 	WHERE spent_height > $1;
-	--
+	`,
+	`
 	DELETE
 	FROM unspent_output
 	WHERE SUBSTR(txid_vout, 1, 32) IN (
-		SELECT tx.txid FROM tx
-		JOIN blockheader AS bh
-		ON bh.hash = tx.blockhash
-		WHERE bh.height > $1
+		SELECT txid FROM tx
+		WHERE height > $1
 	);
-	--
+	`,
+	`
 	DELETE
-	FROM tx
-	WHERE blockhash IN (
-		SELECT hash
-		FROM blockheader
+	FROM tx_input
+	WHERE child_txid IN (
+		SELECT txid FROM tx
 		WHERE height > $1
 	);
-	--
+	`,
+	`
 	DELETE
-	FROM blockheader
+	FROM tx
 	WHERE height > $1;
-	--
+	`,
+	`
 	UPDATE wallet
 	SET height = $1
 	WHERE height > $1;
-	--
-	COMMIT;
+	`,
+}
+
+func (r *sqlRepository) deleteAllSinceBlock(
+	ctx context.Context,
+	db sql.Database,
+	height int,
+) error {
+	err := sql.Execute(
+		ctx,
+		db,
+		func(db sql.Database) error {
+			for _, s := range sqlDeleteAllSinceBlock {
+				_, err := db.Exec(ctx, s, height)
+				if err != nil {
+					return stackerr.Wrap(err)
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (r *sqlRepository) selectBackfills(
+	ctx context.Context,
+	db sql.Database,
+) ([]string, error) {
+	s := `
+	SELECT name
+	FROM backfill
+	ORDER BY name
+	;
+	`
+	rows, err := db.Query(ctx, s)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *sqlRepository) deleteBackfill(
+	ctx context.Context,
+	db sql.Database,
+	name string,
+) error {
+	s := `
+	DELETE FROM backfill
+	WHERE name = $1
+	;
 	`
-	_, err := db.Exec(ctx, s, height)
+	_, err := db.Exec(ctx, s, name)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
 	return nil
 }
 
+func (r *sqlRepository) selectAllWalletData(
+	ctx context.Context,
+	db sql.Database,
+) ([]walletData, error) {
+	s := `
+	SELECT hash, height, next_receive_index, next_change_index
+	FROM wallet
+	;
+	`
+	rows, err := db.Query(ctx, s)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer rows.Close()
+	var wds []walletData
+	for rows.Next() {
+		var wd walletData
+		h := bufWrapper(wd.Hash[:])
+		err := rows.Scan(
+			&h, &wd.Height, &wd.NextReceiveIndex, &wd.NextChangeIndex,
+		)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		wds = append(wds, wd)
+	}
+	return wds, nil
+}
+
+type spentOutputData struct {
+	TxidVout    txidVout
+	SpentHeight int
+	// zero for outputs spent before the spender was stored
+	Spender [32]byte
+}
+
+func (r *sqlRepository) selectSpentOutput(
+	ctx context.Context,
+	db sql.Database,
+	txVout *txidVout,
+	out *spentOutputData,
+) error {
+	s := `
+	SELECT spent_height, spender_txid
+	FROM spent_output
+	WHERE txid_vout = $1
+	;
+	`
+	var spender []byte
+	err := db.QueryRow(ctx, s, txVout[:]).Scan(&out.SpentHeight, &spender)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		return errNotFound
+	}
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	out.TxidVout = *txVout
+	out.Spender = [32]byte{}
+	copy(out.Spender[:], spender)
+	return nil
+}
+
+func (r *sqlRepository) selectAllSpentOutputs(
+	ctx context.Context,
+	db sql.Database,
+) ([]spentOutputData, error) {
+	s := `
+	SELECT txid_vout, spent_height, spender_txid
+	FROM spent_output
+	;
+	`
+	rows, err := db.Query(ctx, s)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	defer rows.Close()
+	var so []spentOutputData
+	for rows.Next() {
+		var (
+			d       spentOutputData
+			spender []byte
+		)
+		tv := bufWrapper(d.TxidVout[:])
+		err := rows.Scan(&tv, &d.SpentHeight, &spender)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		copy(d.Spender[:], spender)
+		so = append(so, d)
+	}
+	return so, nil
+}
+
+func (r *sqlRepository) forEachTransaction(
+	ctx context.Context,
+	db sql.Database,
+	fn func(t *transactionData) error,
+) error {
+	s := `
+	SELECT txid, blockhash, height, pos, serialized, merkle_proof
+	FROM tx
+	;
+	`
+	rows, err := db.Query(ctx, s)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t transactionData
+		txid := bufWrapper(t.Txid[:])
+		bh := bufWrapper(t.BlockHash[:])
+		err := rows.Scan(
+			&txid, &bh, &t.Height, &t.Pos, &t.Raw, &t.MerkleProof,
+		)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		err = fn(&t)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	return nil
+}
+
 type bufWrapper []byte
 
 func (self *bufWrapper) Scan(src any) error {
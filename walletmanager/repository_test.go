@@ -0,0 +1,307 @@
+package walletmanager
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	epsgo "github.com/ncodysoftware/eps-go"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/database/sql/migrator"
+	"ncody.com/ncgo.git/log"
+)
+
+// TestRepository runs against the memory repository, sqlite and, when
+// POSTGRES_DSN is set, Postgres. The Postgres schema is dropped, use a
+// throwaway database.
+func TestRepository(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	t.Run("memory", func(t *testing.T) {
+		tRepository(t, NewMemRepository(), nil)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := epsgo.OpenDB(
+			t.Context(),
+			l,
+			epsgo.DBOpts{Path: filepath.Join(t.TempDir(), "db.sqlite3")},
+			migrator.FlagMigrateFresh,
+		)
+		assert.Must(t, err)
+		defer db.Close(t.Context())
+		r, err := newSQLRepository(t.Context(), db)
+		assert.Must(t, err)
+		tRepository(t, r, db)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv("POSTGRES_DSN")
+		if dsn == "" {
+			t.Skip("POSTGRES_DSN not set")
+		}
+		db, err := epsgo.OpenPostgresDB(
+			t.Context(),
+			l,
+			dsn,
+			os.Getenv("POSTGRES_SCHEMA"),
+			migrator.FlagMigrateFresh,
+		)
+		assert.Must(t, err)
+		defer db.Close(t.Context())
+		r, err := newSQLRepository(t.Context(), db)
+		assert.Must(t, err)
+		tRepository(t, r, db)
+	})
+}
+
+func tRepository(t *testing.T, r Repository, db sql.Database) {
+	ctx := t.Context()
+	wd := walletData{Hash: [32]byte{0xee}, Height: 2}
+	assert.Must(t, r.insertWalletData(ctx, db, &wd))
+	sh := [32]byte{0xaa}
+	for height := 1; height <= 3; height++ {
+		hash := [32]byte{byte(height)}
+		txid := [32]byte{0xf0 | byte(height)}
+		var txVout txidVout
+		copy(txVout[:], txid[:])
+		// inserts are idempotent, a block may be processed twice
+		for range 2 {
+			err := r.insertTransaction(
+				ctx, db, &txid, &hash, height, 1, []byte{1}, []byte{0},
+			)
+			assert.Must(t, err)
+			err = r.insertScriptPubkeyTransaction(ctx, db, &sh, &txid)
+			assert.Must(t, err)
+		}
+		err := r.insertUnspentOutput(ctx, db, &txVout, 1000, &sh)
+		assert.Must(t, err)
+	}
+	history, err := r.selectScriptHashHistory(ctx, db, &sh, 0, -1, -1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 3, len(history))
+	assert.MustEqual(t, [32]byte{0xf3}, history[2].Txid)
+	history, err = r.selectScriptHashHistory(ctx, db, &sh, 2, 3, -1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(history))
+	assert.MustEqual(t, [32]byte{0xf2}, history[0].Txid)
+	history, err = r.selectScriptHashHistory(ctx, db, &sh, 2, -1, 1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(history))
+	assert.MustEqual(t, 2, history[0].Height)
+	// the output of height 1 is spent at height 3
+	var spent txidVout
+	spent[0] = 0xf1
+	spender := [32]byte{0xf3}
+	assert.Must(t, r.deleteUnspentOutput(ctx, db, &spent, 3, &spender))
+	err = r.insertTransactionInputs(ctx, db, &spender, [][32]byte{{0xf1}})
+	assert.Must(t, err)
+	childHeight, err := r.selectChildHeight(ctx, db, &[32]byte{0xf1})
+	assert.Must(t, err)
+	assert.MustEqual(t, 3, childHeight)
+	var so spentOutputData
+	assert.Must(t, r.selectSpentOutput(ctx, db, &spent, &so))
+	assert.MustEqual(t, 3, so.SpentHeight)
+	assert.MustEqual(t, spender, so.Spender)
+	err = r.updateSpentOutputSpender(ctx, db, &spent, &[32]byte{0xf5})
+	assert.Must(t, err)
+	assert.Must(t, r.selectSpentOutput(ctx, db, &spent, &so))
+	assert.MustEqual(t, [32]byte{0xf5}, so.Spender)
+	assert.Must(t, r.updateSpentOutputSpender(ctx, db, &spent, &spender))
+	err = r.selectSpentOutput(ctx, db, &txidVout{0xf2}, &so)
+	assert.MustEqual(t, true, errors.Is(err, errNotFound))
+	unspent, err := r.selectScriptHashUnspent(ctx, db, &sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, len(unspent))
+	assert.MustEqual(t, 2, unspent[0].Height)
+	assert.MustEqual(t, uint64(1000), unspent[0].Satoshi)
+	tx, err := r.selectTransactionFromHeightPos(ctx, db, 3, 1)
+	assert.Must(t, err)
+	assert.MustEqual(t, [32]byte{0xf3}, tx.Txid)
+	txs, err := r.selectBlockTransactions(ctx, db, 3)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(txs))
+	assert.MustEqual(t, [32]byte{0xf3}, txs[0].Txid)
+	// rolling back to height 1 restores the output spent at height 3
+	assert.Must(t, r.deleteAllSinceBlock(ctx, db, 1))
+	unspent, err = r.selectScriptHashUnspent(ctx, db, &sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(unspent))
+	assert.MustEqual(t, [32]byte{0xf1}, unspent[0].Txid)
+	assert.Must(t, r.reloadCaches(ctx, db))
+	var balance uint64
+	assert.Must(t, r.selectScriptHashBalance(ctx, db, &sh, &balance))
+	assert.MustEqual(t, uint64(1000), balance)
+	history, err = r.selectScriptHashHistory(ctx, db, &sh, 0, -1, -1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(history))
+	wd, err = r.selectWalletData(ctx, db, &wd.Hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, wd.Height)
+	_, err = r.selectTransactionFromHeightPos(ctx, db, 3, 1)
+	assert.MustEqual(t, true, errors.Is(err, sql.ErrNoRows))
+	err = r.selectSpentOutput(ctx, db, &spent, &so)
+	assert.MustEqual(t, true, errors.Is(err, errNotFound))
+	childHeight, err = r.selectChildHeight(ctx, db, &[32]byte{0xf1})
+	assert.Must(t, err)
+	assert.MustEqual(t, -1, childHeight)
+	// a failed execute leaves nothing behind
+	errFn := errors.New("fn failed")
+	err = r.execute(ctx, db, func(db sql.Database) error {
+		txid := [32]byte{0xf4}
+		err := r.insertTransaction(
+			ctx, db, &txid, &[32]byte{4}, 2, 2, []byte{1}, []byte{0},
+		)
+		assert.Must(t, err)
+		assert.Must(t, r.deleteUnspentOutput(ctx, db, &spent, 2, &txid))
+		assert.Must(t, r.insertScriptPubkeyTransaction(ctx, db, &sh, &txid))
+		assert.Must(t, r.updateWalletHeight(ctx, db, &wd.Hash, 2))
+		return errFn
+	})
+	assert.MustEqual(t, true, errors.Is(err, errFn))
+	_, err = r.selectRawTransaction(ctx, db, &[32]byte{0xf4})
+	assert.MustEqual(t, true, errors.Is(err, sql.ErrNoRows))
+	unspent, err = r.selectScriptHashUnspent(ctx, db, &sh)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(unspent))
+	assert.Must(t, r.selectScriptHashBalance(ctx, db, &sh, &balance))
+	assert.MustEqual(t, uint64(1000), balance)
+	history, err = r.selectScriptHashHistory(ctx, db, &sh, 0, -1, -1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(history))
+	wd, err = r.selectWalletData(ctx, db, &wd.Hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, wd.Height)
+}
+
+func TestImportBlockHeaders(t *testing.T) {
+	ctx := t.Context()
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	db, err := epsgo.OpenDB(
+		ctx,
+		l,
+		epsgo.DBOpts{Path: filepath.Join(t.TempDir(), "db.sqlite3")},
+		migrator.FlagMigrateFresh,
+	)
+	assert.Must(t, err)
+	defer db.Close(ctx)
+	// heights 1 to 3 link to the genesis, height 5 is past a gap
+	prev := genesisBlockData[bitcoin.Regtest].Hash
+	for _, height := range []int{1, 2, 3, 5} {
+		var raw [80]byte
+		copy(raw[4:36], prev[:])
+		raw[79] = byte(height)
+		prev = doubleSha256(raw[:])
+		_, err := db.Exec(
+			ctx,
+			`INSERT INTO blockheader (hash, height, serialized)
+			VALUES ($1, $2, $3)`,
+			prev[:],
+			height,
+			raw[:],
+		)
+		assert.Must(t, err)
+	}
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	var r sqlRepository
+	n, err := r.importBlockHeaders(ctx, db, headers)
+	assert.Must(t, err)
+	assert.MustEqual(t, 3, n)
+	assert.MustEqual(t, 3, headers.Tip())
+	var count int
+	err = db.QueryRow(ctx, `SELECT COUNT(*) FROM blockheader`).Scan(&count)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, count)
+	// the network is recorded once
+	assert.Must(t, recordNetwork(ctx, db, bitcoin.Regtest))
+	assert.Must(t, recordNetwork(ctx, db, bitcoin.Regtest))
+	assert.MustEqual(t, true, CheckNetwork(ctx, db, bitcoin.Mainnet) != nil)
+}
+
+// TestOpenHeaders checks the genesis data of every network
+func TestOpenHeaders(t *testing.T) {
+	for _, net := range []bitcoin.Network{
+		bitcoin.Mainnet, bitcoin.Testnet, bitcoin.Regtest,
+	} {
+		headers, err := OpenHeaders("", net)
+		assert.Must(t, err)
+		data := genesisBlockData[net]
+		assert.MustEqual(t, data.Hash, doubleSha256(data.Serialized[:80]))
+		assert.MustEqual(t, 0, headers.Tip())
+	}
+	_, err := OpenHeaders("", bitcoin.Network(len(genesisBlockData)))
+	assert.MustEqual(t, true, err != nil)
+}
+
+func TestQueryPlans(t *testing.T) {
+	l := log.New(log.LevelFromString("error"), "eps-go")
+	db, err := epsgo.OpenDB(
+		t.Context(),
+		l,
+		epsgo.DBOpts{Path: filepath.Join(t.TempDir(), "db.sqlite3")},
+		migrator.FlagMigrateFresh,
+	)
+	assert.Must(t, err)
+	defer db.Close(t.Context())
+	queries := []string{
+		sqlSelectScriptHashHistory,
+		sqlSelectScriptHashUnspent,
+		sqlSelectTransactionFromHeightPos,
+		sqlSelectChildHeight,
+		sqlSelectBlockTransactions,
+	}
+	queries = append(queries, sqlDeleteAllSinceBlock[:]...)
+	for _, q := range queries {
+		for _, stmt := range tSplitStatements(q) {
+			args := []any{}
+			for strings.Contains(stmt, fmt.Sprintf("$%d", len(args)+1)) {
+				args = append(args, 1)
+			}
+			rows, err := db.Query(
+				t.Context(), "EXPLAIN QUERY PLAN "+stmt, args...,
+			)
+			assert.Must(t, err)
+			for rows.Next() {
+				var (
+					id, parent, notused int
+					detail              string
+				)
+				err := rows.Scan(&id, &parent, &notused, &detail)
+				assert.Must(t, err)
+				// every table must be reached through an index,
+				// except the wallet table that holds a few rows
+				if strings.HasPrefix(detail, "SCAN ") &&
+					!strings.Contains(detail, " USING ") &&
+					detail != "SCAN wallet" {
+					t.Fatalf("full scan: %s\n%s", detail, stmt)
+				}
+			}
+			rows.Close()
+		}
+	}
+}
+
+// tSplitStatements returns the statements of a multi statement query
+// without the transaction control ones
+func tSplitStatements(q string) []string {
+	var stmts []string
+	for _, stmt := range strings.Split(q, ";") {
+		var lines []string
+		for _, line := range strings.Split(stmt, "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "--") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+		stmt = strings.Join(lines, "\n")
+		if stmt == "" || stmt == "BEGIN" || stmt == "COMMIT" {
+			continue
+		}
+		stmts = append(stmts, stmt)
+	}
+	return stmts
+}
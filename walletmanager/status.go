@@ -0,0 +1,83 @@
+package walletmanager
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"slices"
+	"strconv"
+
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+var ErrHistoryTooLarge = errors.New("history too large")
+
+// shStatusState is the sha256 state of the status preimage of a scripthash
+// with its txs up to height, the status of newer txs continues from it
+type shStatusState struct {
+	state  []byte
+	height int
+	n      int
+}
+
+func (w *W) getScriptHashStatus(
+	ctx context.Context, db sql.Database, sh *[32]byte, buf *[]byte,
+) ([]byte, error) {
+	st, ok := w.shStatuses[*sh]
+	h := sha256.New()
+	from := 0
+	if ok {
+		err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(st.state)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		from = st.height + 1
+	}
+	hist, err := w.repo.selectScriptHashHistory(ctx, db, sh, from, -1, -1)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	writeStatusPreimage(h, hist)
+	if len(hist) > 0 {
+		st.height = hist[len(hist)-1].Height
+		st.n += len(hist)
+	}
+	// only the wallet scripthashes are cached, any can be requested
+	if _, tracked := w.scriptPubkeys[*sh]; tracked {
+		st.state, err = h.(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		w.shStatuses[*sh] = st
+	}
+	if st.n == 0 {
+		return nil, nil
+	}
+	var buf2 []byte
+	if buf == nil {
+		buf = &buf2
+	}
+	clearBuf(buf)
+	*buf = h.Sum(*buf)
+	return *buf, nil
+}
+
+// writeStatusPreimage writes the "txid:height:" of each tx
+func writeStatusPreimage(h hash.Hash, txs []TxData) {
+	var line []byte
+	for i := range txs {
+		var hx [64]byte
+		txid := txs[i].Txid
+		slices.Reverse(txid[:])
+		hex.Encode(hx[:], txid[:])
+		line = append(line[:0], hx[:]...)
+		line = append(line, ':')
+		line = strconv.AppendInt(line, int64(txs[i].Height), 10)
+		line = append(line, ':')
+		h.Write(line)
+	}
+}
@@ -0,0 +1,82 @@
+package walletmanager
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+)
+
+func TestScriptHashStatus(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	sh := [32]byte{0xaa}
+	w := &W{
+		initCompleted: make(chan struct{}),
+		repo:          repo,
+		maxHistory:    2,
+		scriptPubkeys: map[[32]byte]scriptPubkeyInfo{sh: {}},
+		shStatuses:    make(map[[32]byte]shStatusState),
+	}
+	close(w.initCompleted)
+	add := func(height, pos int) {
+		txid := [32]byte{byte(height), byte(pos)}
+		err := repo.insertTransaction(
+			ctx, nil, &txid, &[32]byte{}, height, pos, []byte{1}, nil,
+		)
+		assert.Must(t, err)
+		err = repo.insertScriptPubkeyTransaction(ctx, nil, &sh, &txid)
+		assert.Must(t, err)
+	}
+	// expected status of the txs in history order
+	expStatus := func(txs ...[2]int) []byte {
+		var preimage string
+		for _, tx := range txs {
+			txid := [32]byte{byte(tx[0]), byte(tx[1])}
+			slices.Reverse(txid[:])
+			preimage += fmt.Sprintf("%x:%d:", txid, tx[0])
+		}
+		hash := sha256.Sum256([]byte(preimage))
+		return hash[:]
+	}
+	status := func() []byte {
+		s, err := w.GetScriptHashStatus(ctx, &sh, nil)
+		assert.Must(t, err)
+		return s
+	}
+	assert.MustEqual(t, 0, len(status()))
+	add(5, 2)
+	add(5, 1)
+	assert.MustEqual(t, expStatus([2]int{5, 1}, [2]int{5, 2}), status())
+	// continued from the cached state
+	add(7, 1)
+	assert.MustEqual(
+		t, expStatus([2]int{5, 1}, [2]int{5, 2}, [2]int{7, 1}), status(),
+	)
+	assert.MustEqual(t, 7, w.shStatuses[sh].height)
+	// an older block needs the cache to be dropped, as processBlock does
+	add(6, 1)
+	delete(w.shStatuses, sh)
+	assert.MustEqual(
+		t,
+		expStatus([2]int{5, 1}, [2]int{5, 2}, [2]int{6, 1}, [2]int{7, 1}),
+		status(),
+	)
+	// untracked scripthashes are not cached
+	_, err := w.GetScriptHashStatus(ctx, &[32]byte{0xbb}, nil)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(w.shStatuses))
+	// history pages
+	_, err = w.GetScriptHashHistory(ctx, &sh, 0, -1)
+	assert.MustEqual(t, true, errors.Is(err, ErrHistoryTooLarge))
+	hist, err := w.GetScriptHashHistory(ctx, &sh, 6, -1)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, len(hist))
+	hist, err = w.GetScriptHashHistory(ctx, &sh, 0, 6)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, len(hist))
+	assert.MustEqual(t, [32]byte{5, 1}, hist[0].Txid)
+}
@@ -0,0 +1,126 @@
+package walletmanager
+
+import (
+	"context"
+
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// HeadersSubscribe registers cb to be called with the new tips, it waits
+// for the headers to be synced, not the wallets
+func (w *W) HeadersSubscribe(
+	ctx context.Context, id uint32, cb func(height int, header [80]byte),
+) error {
+	select {
+	case <-w.headersSynced:
+	case <-ctx.Done():
+		return stackerr.Wrap(ctx.Err())
+	}
+	// run holds no lock during the initial sync but does not notify the
+	// header subscribers until it completes
+	err := w.mu.LockCtx(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	w.hSubs[id] = cb
+	return nil
+}
+
+// notifyHeaderSubscribers sends the header at height, the tip, to the
+// subscribers
+func (w *W) notifyHeaderSubscribers(height int) {
+	var header [80]byte
+	if len(w.hSubs) == 0 || !w.headers.Header(height, &header) {
+		return
+	}
+	for _, cb := range w.hSubs {
+		cb(height, header)
+	}
+}
+
+// ScriptHashSubscribe registers cb to be called with the new status of sh,
+// a connection subscribing again replaces its callback
+func (w *W) ScriptHashSubscribe(
+	ctx context.Context, id uint32, sh [32]byte, cb func(status [32]byte),
+) error {
+	err := w.lock(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	m := w.shSubs[sh]
+	if m == nil {
+		m = make(map[uint32]func([32]byte))
+	}
+	m[id] = cb
+	w.shSubs[sh] = m
+	c := w.connSubs[id]
+	if c == nil {
+		c = make(map[[32]byte]struct{})
+	}
+	c[sh] = struct{}{}
+	w.connSubs[id] = c
+	return nil
+}
+
+// ScriptHashUnsubscribe removes the subscription of the connection to sh
+// and reports whether there was one
+func (w *W) ScriptHashUnsubscribe(id uint32, sh [32]byte) bool {
+	select {
+	case <-w.initCompleted:
+	default:
+		// nothing is subscribed before
+		return false
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c := w.connSubs[id]
+	if _, ok := c[sh]; !ok {
+		return false
+	}
+	delete(c, sh)
+	if len(c) == 0 {
+		delete(w.connSubs, id)
+	}
+	w.deleteScriptHashSub(id, sh)
+	return true
+}
+
+func (w *W) deleteScriptHashSub(id uint32, sh [32]byte) {
+	m := w.shSubs[sh]
+	delete(m, id)
+	if len(m) == 0 {
+		delete(w.shSubs, sh)
+	}
+}
+
+func (w *W) notifyScriptHashSubscribers(sh [32]byte, status [32]byte) {
+	if len(w.shSubs[sh]) == 0 {
+		return
+	}
+	for _, cb := range w.shSubs[sh] {
+		cb(status)
+	}
+}
+
+// UnsubscribeAll removes the subscriptions of a closed connection
+func (w *W) UnsubscribeAll(id uint32) {
+	select {
+	case <-w.headersSynced:
+	default:
+		// nothing is subscribed before
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.hSubs, id)
+	for sh := range w.connSubs[id] {
+		w.deleteScriptHashSub(id, sh)
+	}
+	delete(w.connSubs, id)
+	for txVout := range w.connOpSubs[id] {
+		w.deleteOutpointSub(id, &txVout)
+	}
+	delete(w.connOpSubs, id)
+}
@@ -0,0 +1,93 @@
+package walletmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+)
+
+func TestScriptHashSubscriptions(t *testing.T) {
+	w := &W{
+		initCompleted: make(chan struct{}),
+		headersSynced: make(chan struct{}),
+		shSubs:        make(map[[32]byte]map[uint32]func([32]byte)),
+		hSubs:         make(map[uint32]func(int, [80]byte)),
+		connSubs:      make(map[uint32]map[[32]byte]struct{}),
+	}
+	close(w.initCompleted)
+	close(w.headersSynced)
+	notified := make(map[uint32]int)
+	subscribe := func(id uint32, sh [32]byte) {
+		err := w.ScriptHashSubscribe(
+			t.Context(), id, sh, func([32]byte) { notified[id]++ },
+		)
+		assert.Must(t, err)
+	}
+	notify := func(sh [32]byte) map[uint32]int {
+		clear(notified)
+		w.notifyScriptHashSubscribers(sh, [32]byte{})
+		return notified
+	}
+	sh1, sh2 := [32]byte{1}, [32]byte{2}
+	assert.MustEqual(t, false, w.ScriptHashUnsubscribe(1, sh1))
+	subscribe(1, sh1)
+	subscribe(1, sh1)
+	subscribe(1, sh2)
+	subscribe(2, sh1)
+	assert.MustEqual(t, map[uint32]int{1: 1, 2: 1}, notify(sh1))
+	// only the subscription of the connection goes away
+	assert.MustEqual(t, true, w.ScriptHashUnsubscribe(1, sh1))
+	assert.MustEqual(t, false, w.ScriptHashUnsubscribe(1, sh1))
+	assert.MustEqual(t, map[uint32]int{2: 1}, notify(sh1))
+	assert.MustEqual(t, map[uint32]int{1: 1}, notify(sh2))
+	// a disconnect drops the remaining ones
+	w.UnsubscribeAll(1)
+	assert.MustEqual(t, 0, len(notify(sh2)))
+	assert.MustEqual(t, false, w.ScriptHashUnsubscribe(1, sh2))
+	subscribe(1, sh2)
+	assert.MustEqual(t, true, w.ScriptHashUnsubscribe(1, sh2))
+	assert.MustEqual(t, false, w.ScriptHashUnsubscribe(2, sh2))
+	w.UnsubscribeAll(2)
+	assert.MustEqual(t, 0, len(w.shSubs))
+	assert.MustEqual(t, 0, len(w.connSubs))
+	// unsubscribing after a disconnect
+	w.UnsubscribeAll(3)
+	assert.MustEqual(t, false, w.ScriptHashUnsubscribe(3, sh1))
+	// a disconnect cancels a subscription waiting for the lock
+	w.mu.Lock()
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	err := w.ScriptHashSubscribe(ctx, 4, sh1, func([32]byte) {})
+	assert.MustEqual(t, true, errors.Is(err, context.Canceled))
+	w.mu.Unlock()
+	assert.MustEqual(t, 0, len(w.shSubs))
+}
+
+func TestNotifyHeaderSubscribers(t *testing.T) {
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	w := &W{
+		initCompleted: make(chan struct{}),
+		headersSynced: make(chan struct{}),
+		headers:       headers,
+		hSubs:         make(map[uint32]func(int, [80]byte)),
+	}
+	close(w.initCompleted)
+	close(w.headersSynced)
+	var got []int
+	err = w.HeadersSubscribe(
+		t.Context(), 1, func(height int, header [80]byte) {
+			hash, _ := headers.Hash(height)
+			assert.MustEqual(t, hash, doubleSha256(header[:]))
+			got = append(got, height)
+		},
+	)
+	assert.Must(t, err)
+	w.notifyHeaderSubscribers(0)
+	// no header there yet
+	w.notifyHeaderSubscribers(1)
+	assert.MustEqual(t, []int{0}, got)
+}
@@ -0,0 +1,701 @@
+package walletmanager
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"runtime"
+	"slices"
+	"sync"
+
+	"github.com/ncodysoftware/eps-go/blockdir"
+	"github.com/ncodysoftware/eps-go/p2p"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/log"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// preparedBlock is a decoded block with everything that does not depend on
+// wallet state already computed by the sync workers
+type preparedBlock struct {
+	height int
+	size   int
+	hash   [32]byte
+	block  bitcoin.Block
+	txids  [][32]byte
+	// sha256 of every output scriptpubkey, indexed by tx and vout
+	outSH [][][32]byte
+	// built on the first wallet match
+	tree merkleTree
+}
+
+// merkleBranch appends the serialized merkle branch of the tx at pos
+func (pb *preparedBlock) merkleBranch(pos int, buf []byte) []byte {
+	if pb.tree == nil {
+		pb.tree = newMerkleTree(pb.txids)
+	}
+	var branch [32][32]byte
+	for _, h := range pb.tree.branch(pos, branch[:0]) {
+		buf = append(buf, h[:]...)
+	}
+	return buf
+}
+
+type blockRef struct {
+	height int
+	hash   [32]byte
+	// read from the node blocks dir instead of p2p
+	local bool
+}
+
+type rawBlock struct {
+	height int
+	raw    []byte
+}
+
+// syncChunk is a run of consecutive blocks synced together
+type syncChunk struct {
+	height int
+	hashes [][32]byte
+	// nil when the node does not serve compact filters
+	filters []p2p.CFilter
+	// blocks that must be downloaded
+	selected []bool
+	// number of w.scripts already matched against the filters
+	tested  int
+	hashBuf []uint64
+}
+
+// syncWallets processes the blocks after the lowest wallet height. Wallets
+// needing blocks the node no longer has are reported and left behind,
+// already indexed data keeps being served.
+func (w *W) syncWallets(ctx context.Context, buf *[]byte) error {
+	if len(w.wallets) == 0 {
+		return nil
+	}
+	err := w.pmu.LockCtx(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.pmu.Unlock()
+	if w.blocks != nil {
+		err := w.blocks.Scan()
+		if err != nil {
+			// the blocks indexed so far are still read, the others are
+			// downloaded
+			w.log.Err(stackerr.Wrap(err))
+		}
+	}
+	err = w.checkPruned(ctx)
+	if err != nil {
+		w.closePeer()
+		return stackerr.Wrap(err)
+	}
+	for {
+		err := w.syncAvailable(ctx, buf)
+		var missing missingBlockError
+		if !errors.As(err, &missing) {
+			return err
+		}
+		w.log.Errf("%s", missing)
+		w.firstBlock = max(w.firstBlock, missing.height+1)
+	}
+}
+
+func (w *W) syncAvailable(ctx context.Context, buf *[]byte) error {
+	err := w.markStalled(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	height := -1
+	for i := range w.wallets {
+		if w.wallets[i].stalled {
+			continue
+		}
+		if height < 0 || w.wallets[i].height < height {
+			height = w.wallets[i].height
+		}
+	}
+	if height < 0 || height >= w.bestHeader {
+		return nil
+	}
+	hbuf := make([][32]byte, 0, syncChunkBlocks)
+	var rem estimateTime
+	height++
+	for height <= w.bestHeader {
+		hbuf = hbuf[:0]
+		w.blockHashes(height, cap(hbuf), &hbuf)
+		if len(hbuf) == 0 {
+			return fmt.Errorf(
+				"missing block headers at height %d", height,
+			)
+		}
+		c := syncChunk{height: height, hashes: hbuf}
+		err := w.syncBlocks(ctx, &c, &rem, buf)
+		if err != nil {
+			w.closePeer()
+			return stackerr.Wrap(err)
+		}
+		height += len(hbuf)
+	}
+	return nil
+}
+
+// syncBlocks downloads and processes the blocks of the chunk. When the
+// node serves compact filters only blocks matching a wallet scriptpubkey
+// are downloaded. Blocks are requested with up to syncInflightBlocks in
+// flight, decoded and hashed by one worker per cpu and then committed in
+// height order, syncBatchBlocks per sql transaction.
+func (w *W) syncBlocks(
+	ctx context.Context,
+	c *syncChunk,
+	est *estimateTime,
+	buf *[]byte,
+) error {
+	peer, err := w.getPeer(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	c.selected = make([]bool, len(c.hashes))
+	var refs []blockRef
+	if peer.Services()&p2p.ServiceCompactFilters != 0 {
+		err := w.loadFilters(ctx, peer, c)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		refs, err = w.matchFilters(c, 0)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		w.log.Debugf(
+			"FILTERS; height: %d; %d of %d blocks match",
+			c.height,
+			len(refs),
+			len(c.hashes),
+		)
+	} else {
+		refs = make([]blockRef, len(c.hashes))
+		for i := range c.hashes {
+			c.selected[i] = true
+			refs[i] = blockRef{height: c.height + i, hash: c.hashes[i]}
+		}
+	}
+	if w.blocks != nil {
+		w.markLocal(refs)
+	}
+	for _, r := range refs {
+		if r.height < w.firstBlock && !r.local {
+			return missingBlockError{height: r.height, hash: r.hash}
+		}
+	}
+	if len(refs) > 0 {
+		err := w.fetchAndCommit(ctx, peer, c, refs, est, buf)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+	}
+	// blocks after the last match were skipped
+	end := c.height + len(c.hashes) - 1
+	err = w.executeBatch(
+		ctx,
+		func(db sql.Database) error {
+			return w.updateWalletsHeight(ctx, db, end)
+		},
+	)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	return nil
+}
+
+func (w *W) fetchAndCommit(
+	ctx context.Context,
+	peer *p2p.Peer,
+	c *syncChunk,
+	refs []blockRef,
+	est *estimateTime,
+	buf *[]byte,
+) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		errC  = make(chan error, 1)
+		slots = make(chan struct{}, syncInflightBlocks)
+		rawC  = make(chan rawBlock, syncInflightBlocks)
+		prepC = make(chan *preparedBlock, syncInflightBlocks)
+	)
+	wg.Go(func() {
+		fetchBlocks(ctx, w.log, peer, w.blocks, refs, slots, rawC, errC)
+	})
+	var workers sync.WaitGroup
+	for range runtime.NumCPU() {
+		workers.Go(func() {
+			prepareBlocks(ctx, rawC, prepC, errC)
+		})
+	}
+	wg.Go(func() {
+		workers.Wait()
+		close(prepC)
+	})
+	// the pipeline owns refs, later matches are queued on a copy
+	queue := slices.Clone(refs)
+	return w.commitBlocks(ctx, c, queue, slots, prepC, errC, est, buf)
+}
+
+// markLocal flags the refs that can be read from the node blocks dir.
+// Blocks near the tip always come from p2p.
+func (w *W) markLocal(refs []blockRef) {
+	var n int
+	for i := range refs {
+		if refs[i].height > w.bestHeader-blockDirTipBlocks {
+			break
+		}
+		refs[i].local = w.blocks.Has(&refs[i].hash)
+		if refs[i].local {
+			n++
+		}
+	}
+	if n > 0 {
+		w.log.Debugf(
+			"BLOCKDIR; %d of %d blocks read from disk", n, len(refs),
+		)
+	}
+}
+
+// fetchBlocks delivers the blocks of refs in order. Local blocks are read
+// from dir, the others are requested from the peer with up to
+// syncInflightBlocks in flight. The local blocks dir fails to read are
+// downloaded instead. peer is nil when every block is local, a local block
+// failing to read is then an error.
+func fetchBlocks(
+	ctx context.Context,
+	log *log.Logger,
+	peer *p2p.Peer,
+	dir *blockdir.Dir,
+	refs []blockRef,
+	slots chan<- struct{},
+	rawC chan<- rawBlock,
+	errC chan<- error,
+) {
+	defer close(rawC)
+	var (
+		requested int
+		hashes    [][32]byte
+		// blocks received while waiting for a downloaded local block, in
+		// request order
+		early [][]byte
+	)
+	for i := range refs {
+		prev := requested
+		if requested == i {
+			select {
+			case slots <- struct{}{}:
+				requested++
+			case <-ctx.Done():
+				return
+			}
+		}
+	fill:
+		for requested < len(refs) {
+			select {
+			case slots <- struct{}{}:
+				requested++
+			default:
+				break fill
+			}
+		}
+		if requested > prev {
+			hashes = hashes[:0]
+			for _, r := range refs[prev:requested] {
+				if !r.local {
+					hashes = append(hashes, r.hash)
+				}
+			}
+			if len(hashes) > 0 {
+				err := peer.GetBlocks(hashes)
+				if err != nil {
+					trySend(errC, stackerr.Wrap(err))
+					return
+				}
+			}
+		}
+		var (
+			raw []byte
+			err error
+		)
+		if refs[i].local {
+			raw, err = dir.ReadBlock(&refs[i].hash)
+			if err != nil {
+				if peer == nil {
+					trySend(errC, stackerr.Wrap(err))
+					return
+				}
+				log.Errf(
+					"BLOCKDIR; block %d not read, downloading it: %s",
+					refs[i].height,
+					err,
+				)
+				refs[i].local = false
+				raw, early, err = refetchBlock(
+					ctx, peer, &refs[i], refs[i+1:requested], early,
+				)
+			}
+		} else if len(early) > 0 {
+			raw, early = early[0], early[1:]
+		} else {
+			raw, err = readPeerBlock(ctx, peer, &refs[i])
+		}
+		if err != nil {
+			trySend(errC, stackerr.Wrap(err))
+			return
+		}
+		select {
+		case rawC <- rawBlock{height: refs[i].height, raw: raw}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// refetchBlock downloads the block of ref. The blocks of ahead already
+// requested arrive first, the ones not in early yet are appended to it.
+func refetchBlock(
+	ctx context.Context,
+	peer *p2p.Peer,
+	ref *blockRef,
+	ahead []blockRef,
+	early [][]byte,
+) ([]byte, [][]byte, error) {
+	err := peer.GetBlocks([][32]byte{ref.hash})
+	if err != nil {
+		return nil, early, stackerr.Wrap(err)
+	}
+	var n int
+	for i := range ahead {
+		if ahead[i].local {
+			continue
+		}
+		n++
+		if n <= len(early) {
+			continue
+		}
+		raw, err := readPeerBlock(ctx, peer, &ahead[i])
+		if err != nil {
+			return nil, early, stackerr.Wrap(err)
+		}
+		early = append(early, raw)
+	}
+	raw, err := readPeerBlock(ctx, peer, ref)
+	if err != nil {
+		return nil, early, stackerr.Wrap(err)
+	}
+	return raw, early, nil
+}
+
+func readPeerBlock(
+	ctx context.Context, peer *p2p.Peer, ref *blockRef,
+) ([]byte, error) {
+	raw, err := peer.ReadBlock(ctx)
+	if errors.Is(err, p2p.ErrBlockNotFound) {
+		return nil, missingBlockError{height: ref.height, hash: ref.hash}
+	}
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return raw, nil
+}
+
+func prepareBlocks(
+	ctx context.Context,
+	rawC <-chan rawBlock,
+	prepC chan<- *preparedBlock,
+	errC chan<- error,
+) {
+	var buf []byte
+	for rb := range rawC {
+		pb := &preparedBlock{}
+		err := prepareBlock(rb.height, rb.raw, pb, &buf)
+		if err != nil {
+			trySend(errC, stackerr.Wrap(err))
+			return
+		}
+		select {
+		case prepC <- pb:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func prepareBlock(
+	height int, raw []byte, out *preparedBlock, buf *[]byte,
+) error {
+	out.height = height
+	out.size = len(raw)
+	err := out.block.Deserialize(bytes.NewReader(raw))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	indexBlock(out, buf)
+	return nil
+}
+
+func indexBlock(out *preparedBlock, buf *[]byte) {
+	clearBuf(buf)
+	out.hash = out.block.Hash(buf)
+	out.txids = out.block.TXIDs(
+		make([][32]byte, 0, len(out.block.Transactions)), buf,
+	)
+	out.outSH = make([][][32]byte, len(out.block.Transactions))
+	for i := range out.block.Transactions {
+		tx := &out.block.Transactions[i]
+		out.outSH[i] = make([][32]byte, len(tx.Outputs))
+		for j := range tx.Outputs {
+			out.outSH[i][j] = sha256.Sum256(tx.Outputs[j].ScriptPubkey)
+		}
+	}
+}
+
+// commitBlocks processes the queued blocks in height order. Wallet
+// lookups happen here and not on the workers, so outputs to scriptpubkeys
+// derived by a refill earlier in the same batch are still found. Blocks
+// matched after a refill are not in the pipeline and are fetched one by
+// one with the bitcoin client.
+func (w *W) commitBlocks(
+	ctx context.Context,
+	c *syncChunk,
+	queue []blockRef,
+	slots <-chan struct{},
+	prepC <-chan *preparedBlock,
+	errC <-chan error,
+	est *estimateTime,
+	buf *[]byte,
+) error {
+	var (
+		next int
+		// blocks delivered by the pipeline out of order
+		pending = make(map[int]*preparedBlock)
+		// blocks put back after an early batch stop
+		held = make(map[int]*preparedBlock)
+		// blocks matched after a refill, not in the pipeline
+		late      = make(map[int]struct{})
+		batch     []*preparedBlock
+		batchSize int
+		buf2      []byte
+	)
+	for next < len(queue) {
+		ref := queue[next]
+		var pb *preparedBlock
+		if p, ok := held[ref.height]; ok {
+			delete(held, ref.height)
+			pb = p
+		} else if p, ok := pending[ref.height]; ok {
+			delete(pending, ref.height)
+			<-slots
+			pb = p
+		} else if _, ok := late[ref.height]; ok {
+			p, err := w.fetchLate(ctx, ref, &buf2)
+			if err != nil {
+				return stackerr.Wrap(err)
+			}
+			pb = p
+		} else {
+			select {
+			case pb, ok := <-prepC:
+				if !ok {
+					select {
+					case err := <-errC:
+						return stackerr.Wrap(err)
+					default:
+						return fmt.Errorf("sync pipeline stopped")
+					}
+				}
+				pending[pb.height] = pb
+			case err := <-errC:
+				return stackerr.Wrap(err)
+			case <-ctx.Done():
+				return stackerr.Wrap(ctx.Err())
+			}
+			continue
+		}
+		batch = append(batch, pb)
+		batchSize += pb.size
+		next++
+		if len(batch) < syncBatchBlocks &&
+			batchSize < syncBatchBytes &&
+			next < len(queue) {
+			continue
+		}
+		n, matched, err := w.commitBatch(ctx, c, batch, est, buf, &buf2)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		// blocks after a late match go back to the queue
+		for _, pb := range batch[n:] {
+			held[pb.height] = pb
+		}
+		next -= len(batch) - n
+		for _, r := range matched {
+			i, _ := slices.BinarySearchFunc(
+				queue[next:],
+				r.height,
+				func(a blockRef, h int) int { return a.height - h },
+			)
+			queue = slices.Insert(queue, next+i, r)
+			late[r.height] = struct{}{}
+		}
+		clear(batch)
+		batch = batch[:0]
+		batchSize = 0
+	}
+	return nil
+}
+
+// fetchLate reads a block matched after a refill from the blocks dir when
+// it is there, blocks below w.firstBlock can not be asked to the node
+func (w *W) fetchLate(
+	ctx context.Context, ref blockRef, buf *[]byte,
+) (*preparedBlock, error) {
+	pb := &preparedBlock{}
+	if w.blocks != nil && w.blocks.Has(&ref.hash) {
+		raw, err := w.blocks.ReadBlock(&ref.hash)
+		if err == nil {
+			err = prepareBlock(ref.height, raw, pb, buf)
+		}
+		if err == nil {
+			return pb, nil
+		}
+		w.log.Errf(
+			"BLOCKDIR; block %d not read, downloading it: %s",
+			ref.height,
+			err,
+		)
+		pb = &preparedBlock{}
+	}
+	if ref.height < w.firstBlock {
+		return nil, missingBlockError{height: ref.height, hash: ref.hash}
+	}
+	block, err := w.bcli.GetBlock(ctx, ref.hash)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	pb.height = ref.height
+	pb.block = block
+	indexBlock(pb, buf)
+	return pb, nil
+}
+
+// commitBatch processes the batch in one sql transaction and returns the
+// number of processed blocks plus the skipped blocks matching scriptpubkeys
+// derived while processing. Processing stops before a block that comes
+// after one of those matches.
+func (w *W) commitBatch(
+	ctx context.Context,
+	c *syncChunk,
+	batch []*preparedBlock,
+	est *estimateTime,
+	buf *[]byte,
+	buf2 *[]byte,
+) (int, []blockRef, error) {
+	var (
+		n       int
+		matched []blockRef
+	)
+	err := w.executeBatch(
+		ctx,
+		func(db sql.Database) error {
+			for i, pb := range batch {
+				err := w.processBlock(ctx, db, pb, est, buf, buf2)
+				if err != nil {
+					return stackerr.Wrap(err)
+				}
+				n = i + 1
+				if c.filters == nil || c.tested == len(w.scripts) {
+					continue
+				}
+				m, err := w.matchFilters(c, pb.height-c.height+1)
+				if err != nil {
+					return stackerr.Wrap(err)
+				}
+				matched = append(matched, m...)
+				if len(m) > 0 && n < len(batch) &&
+					m[0].height < batch[n].height {
+					return nil
+				}
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return 0, nil, stackerr.Wrap(err)
+	}
+	return n, matched, nil
+}
+
+// executeBatch runs fn in one sql transaction. The wallets, derived
+// scriptpubkeys and cached statuses changed by fn are restored when it
+// rolls back, the subscribers are notified only once it commits.
+func (w *W) executeBatch(
+	ctx context.Context, fn func(db sql.Database) error,
+) error {
+	wallets := slices.Clone(w.wallets)
+	nScripts := len(w.scripts)
+	err := w.repo.execute(ctx, w.db, fn)
+	if err != nil {
+		copy(w.wallets, wallets)
+		for _, s := range w.scripts[nScripts:] {
+			delete(w.scriptPubkeys, sha256.Sum256(s))
+		}
+		clear(w.scripts[nScripts:])
+		w.scripts = w.scripts[:nScripts]
+		// the cached statuses may include the rolled back blocks
+		clear(w.shStatuses)
+		clear(w.pendingSH)
+		clear(w.pendingOps)
+		return stackerr.Wrap(err)
+	}
+	w.storeSyncHeight()
+	for sh, status := range w.pendingSH {
+		w.notifyScriptHashSubscribers(sh, status)
+	}
+	for txVout, status := range w.pendingOps {
+		w.notifyOutpointSubscribers(&txVout, status)
+	}
+	clear(w.pendingSH)
+	clear(w.pendingOps)
+	return nil
+}
+
+// getPeer returns the peer blocks are requested from, dialing it when
+// needed. getPeer and closePeer are called holding w.pmu.
+func (w *W) getPeer(ctx context.Context) (*p2p.Peer, error) {
+	if w.peer != nil {
+		return w.peer, nil
+	}
+	peer, err := p2p.Dial(ctx, w.log, w.nodeAddr, w.net)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	w.peer = peer
+	return peer, nil
+}
+
+func (w *W) closePeer() {
+	if w.peer == nil {
+		return
+	}
+	w.peer.Close()
+	w.peer = nil
+}
+
+func trySend[T any](c chan<- T, v T) {
+	select {
+	case c <- v:
+	default:
+	}
+}
@@ -0,0 +1,207 @@
+package walletmanager
+
+import (
+	"crypto/sha256"
+	"errors"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/ncodysoftware/eps-go/internal/testdata"
+	"github.com/ncodysoftware/eps-go/testutil"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/bitcoin/bip32"
+	"ncody.com/ncgo.git/bitcoin/scriptpubkey"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestIntegrationSyncThroughput(t *testing.T) {
+	_, err := os.Stat("/tmp/eps-go/bitcoind-ok")
+	if err != nil {
+		t.Skip("bitcoind setup not executed")
+	}
+	tc, cls := testutil.GetTCtx(t)
+	defer cls()
+	bcli := bitcoin.NewClient(
+		tc.C, tc.Cfg.BTCNodeAddr, tc.L, bitcoin.Regtest,
+	)
+	err = bcli.Start()
+	assert.Must(t, err)
+	defer bcli.Stop()
+	wc := WalletConfig{
+		Kind:    scriptpubkey.SK_P2WPKH,
+		Reqsigs: 0,
+		MasterPubs: []bip32.ExtendedKey{
+			testdata.DefaultKeySet.RootAccount,
+		},
+		Height: 0,
+	}
+	w, err := New(
+		tc.C,
+		tc.D,
+		tc.L,
+		bcli,
+		[]WalletConfig{wc},
+		bitcoin.Regtest,
+		Opts{NodeAddr: tc.Cfg.BTCNodeAddr},
+	)
+	assert.Must(t, err)
+	err = w.WaitInit(tc.C)
+	assert.Must(t, err)
+	// stop the background loop, syncs are driven by hand from here
+	err = w.Close(tc.C)
+	assert.Must(t, err)
+	recv, err := deriveScriptPubkeys(&w.wallets[0], receiveAccount, 0, 1)
+	assert.Must(t, err)
+	recvSh := sha256.Sum256(recv[0])
+	var buf []byte
+	testutil.Bench(
+		t,
+		5,
+		testutil.BenchParams{
+			Name: "sequential sync",
+			Fn: func(t *testing.T) {
+				tResetWallets(t, tc, w)
+				tSyncSequential(t, tc, w)
+				b := tSelectScriptBalance(t, tc, &recvSh)
+				assert.MustEqual(t, 5000, b/100_000_000)
+			},
+		},
+		testutil.BenchParams{
+			Name: "pipelined sync",
+			Fn: func(t *testing.T) {
+				tResetWallets(t, tc, w)
+				err := w.syncWallets(tc.C, &buf)
+				assert.Must(t, err)
+				w.closePeer()
+				b := tSelectScriptBalance(t, tc, &recvSh)
+				assert.MustEqual(t, 5000, b/100_000_000)
+			},
+		},
+	)
+}
+
+func tResetWallets(t *testing.T, tc *testutil.TCtx, w *W) {
+	s := `
+	BEGIN;
+	DELETE FROM tx;
+	DELETE FROM scriptpubkey_tx;
+	DELETE FROM unspent_output;
+	DELETE FROM spent_output;
+	UPDATE wallet
+	SET height = 0, next_receive_index = 0, next_change_index = 0;
+	COMMIT;
+	`
+	_, err := tc.D.Exec(tc.C, s)
+	assert.Must(t, err)
+	err = w.repo.reloadCaches(tc.C, tc.D)
+	assert.Must(t, err)
+	for i := range w.wallets {
+		w.wallets[i].height = 0
+		w.wallets[i].nextReceiveIndex = 0
+		w.wallets[i].nextChangeIndex = 0
+	}
+}
+
+// tSyncSequential is the sync loop used before the pipeline: one GetBlock
+// round trip and one sql transaction per block
+func tSyncSequential(t *testing.T, tc *testutil.TCtx, w *W) {
+	var (
+		hashes    [][32]byte
+		rem       estimateTime
+		buf, buf2 []byte
+	)
+	w.blockHashes(1, w.bestHeader, &hashes)
+	for i, bh := range hashes {
+		block, err := w.bcli.GetBlock(tc.C, bh)
+		assert.Must(t, err)
+		pb := preparedBlock{height: i + 1, block: block}
+		indexBlock(&pb, &buf)
+		err = sql.Execute(
+			tc.C,
+			w.db,
+			func(db sql.Database) error {
+				return w.processBlock(tc.C, db, &pb, &rem, &buf, &buf2)
+			},
+		)
+		assert.Must(t, err)
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	w := &W{
+		log:           log.New(log.LevelFromString("error"), "eps-go"),
+		repo:          repo,
+		initCompleted: make(chan struct{}),
+		wallets: []wallet{{
+			kind: scriptpubkey.SK_P2WPKH,
+			masterPubs: []bip32.ExtendedKey{
+				testdata.DefaultKeySet.RootAccount,
+			},
+			height: 4,
+			hash:   [32]byte{1},
+		}},
+		scriptPubkeys: make(map[[32]byte]scriptPubkeyInfo),
+		shStatuses:    make(map[[32]byte]shStatusState),
+		pendingSH:     make(map[[32]byte][32]byte),
+		pendingOps:    make(map[txidVout]OutpointStatus),
+		shSubs:        make(map[[32]byte]map[uint32]func([32]byte)),
+		connSubs:      make(map[uint32]map[[32]byte]struct{}),
+	}
+	close(w.initCompleted)
+	wd := walletData{Hash: w.wallets[0].hash, Height: 4}
+	assert.Must(t, repo.insertWalletData(ctx, nil, &wd))
+	assert.Must(t, w.refillWallet(0))
+	w.storeSyncHeight()
+	recv, err := deriveScriptPubkeys(&w.wallets[0], receiveAccount, 0, 1)
+	assert.Must(t, err)
+	var notified int
+	err = w.ScriptHashSubscribe(
+		ctx, 1, sha256.Sum256(recv[0]), func([32]byte) { notified++ },
+	)
+	assert.Must(t, err)
+	pb := preparedBlock{
+		height: 5,
+		block: bitcoin.Block{Transactions: []bitcoin.Transaction{{
+			Version: 2,
+			Inputs:  []bitcoin.Input{{Txid: [32]byte{1}}},
+			Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: recv[0]}},
+		}}},
+	}
+	var (
+		buf, buf2 []byte
+		est       estimateTime
+	)
+	indexBlock(&pb, &buf)
+	errBatch := errors.New("batch failed")
+	process := func(fail bool) error {
+		return w.executeBatch(ctx, func(db sql.Database) error {
+			err := w.processBlock(ctx, db, &pb, &est, &buf, &buf2)
+			assert.Must(t, err)
+			if fail {
+				return errBatch
+			}
+			return nil
+		})
+	}
+	wallets := slices.Clone(w.wallets)
+	nScripts := len(w.scripts)
+	// a rolled back batch leaves the memory as it was and notifies nobody
+	err = process(true)
+	assert.MustEqual(t, true, errors.Is(err, errBatch))
+	assert.MustEqual(t, 0, notified)
+	assert.MustEqual(t, wallets, w.wallets)
+	assert.MustEqual(t, nScripts, len(w.scripts))
+	assert.MustEqual(t, nScripts, len(w.scriptPubkeys))
+	assert.MustEqual(t, 4, int(w.syncHeight.Load()))
+	assert.Must(t, process(false))
+	assert.MustEqual(t, 1, notified)
+	assert.MustEqual(t, 5, w.wallets[0].height)
+	assert.MustEqual(t, uint32(1), w.wallets[0].nextReceiveIndex)
+	assert.MustEqual(t, nScripts+1, len(w.scripts))
+	assert.MustEqual(t, 5, int(w.syncHeight.Load()))
+}
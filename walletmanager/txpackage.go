@@ -0,0 +1,229 @@
+package walletmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// package limits of the node mempool policy
+const (
+	maxPackageCount  = 25
+	maxPackageWeight = 404000
+	// TRUC (v3) txs, BIP431
+	trucVersion       = 3
+	maxTrucVsize      = 10000
+	maxTrucChildVsize = 1000
+)
+
+var ErrInvalidPackage = errors.New("invalid package")
+
+// ErrNoNodeRPC is returned by BroadcastPackage for a package of more than
+// one parent without the node rpc, p2p package relay takes a single parent
+var ErrNoNodeRPC = errors.New(
+	"packages of more than one parent need the node rpc, set BTC_RPC_URL",
+)
+
+// PackageTxResult is the relay outcome of a package tx, Err is empty when
+// it was accepted
+type PackageTxResult struct {
+	Txid [32]byte
+	Err  string
+}
+
+type PackageResult struct {
+	Txs []PackageTxResult
+	// the submitpackage result of the node, nil when relayed by p2p
+	Node json.RawMessage
+}
+
+// Success reports whether every tx of the package was accepted
+func (r *PackageResult) Success() bool {
+	for i := range r.Txs {
+		if r.Txs[i].Err != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// BroadcastPackage relays a child and its parents, sorted parents first.
+// The package goes through submitpackage when the node rpc is configured,
+// without taking w.mu. Otherwise a single parent and its child are relayed
+// over p2p parents first, which nodes with 1-parent-1-child package relay
+// accept as a package, and larger packages return ErrNoNodeRPC. An invalid
+// package topology returns ErrInvalidPackage.
+func (w *W) BroadcastPackage(
+	ctx context.Context, rawTxs [][]byte,
+) (PackageResult, error) {
+	var res PackageResult
+	txs := make([]bitcoin.Transaction, len(rawTxs))
+	for i := range rawTxs {
+		err := txs[i].Deserialize(bytes.NewReader(rawTxs[i]))
+		if err != nil {
+			return res, fmt.Errorf(
+				"%w: tx %d: %v", ErrInvalidPackage, i, err,
+			)
+		}
+	}
+	err := checkPackage(txs, rawTxs)
+	if err != nil {
+		return res, stackerr.Wrap(err)
+	}
+	res.Txs = make([]PackageTxResult, len(txs))
+	for i := range txs {
+		res.Txs[i].Txid = txs[i].Txid(nil)
+	}
+	if w.rpc == nil {
+		err = w.relayPackage(ctx, rawTxs, &res)
+		if err != nil {
+			return res, stackerr.Wrap(err)
+		}
+		return res, nil
+	}
+	raw, nodeRes, err := w.rpc.SubmitPackage(ctx, rawTxs)
+	if err != nil {
+		return res, stackerr.Wrap(err)
+	}
+	res.Node = raw
+	for i := range rawTxs {
+		wtxid := doubleSha256(rawTxs[i])
+		slices.Reverse(wtxid[:])
+		txRes, ok := nodeRes.TxResults[hex.EncodeToString(wtxid[:])]
+		switch {
+		case ok:
+			res.Txs[i].Err = txRes.Error
+		case nodeRes.PackageMsg != "success":
+			res.Txs[i].Err = nodeRes.PackageMsg
+		}
+	}
+	return res, nil
+}
+
+// relayPackage relays a parent and its child over p2p. The node reports no
+// rejection, a tx is failed only when it could not be sent. It takes w.mu
+// like BroadcastTX, the p2p client serves one request at a time.
+func (w *W) relayPackage(
+	ctx context.Context, rawTxs [][]byte, res *PackageResult,
+) error {
+	if len(rawTxs) != 2 {
+		return stackerr.Wrap(ErrNoNodeRPC)
+	}
+	err := w.lock(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	for i := range rawTxs {
+		err := w.bcli.BroadcastWTX(ctx, rawTxs[i])
+		if err != nil {
+			res.Txs[i].Err = err.Error()
+		}
+	}
+	return nil
+}
+
+// checkPackage checks txs is a child with its parents as the node requires:
+// parents first, none spending another, no duplicate or conflicting txs and
+// the TRUC limits when the txs are v3
+func checkPackage(txs []bitcoin.Transaction, rawTxs [][]byte) error {
+	if len(txs) < 2 || len(txs) > maxPackageCount {
+		return fmt.Errorf(
+			"%w: %d txs, from 2 to %d",
+			ErrInvalidPackage, len(txs), maxPackageCount,
+		)
+	}
+	var (
+		buf      []byte
+		txids    = make(map[[32]byte]int, len(txs))
+		spent    = make(map[txidVout]struct{})
+		weights  = make([]int, len(txs))
+		total    int
+		trucs    int
+		childIdx = len(txs) - 1
+	)
+	for i := range txs {
+		txid := txs[i].Txid(&buf)
+		// Txid leaves the serialization without witness in buf
+		weights[i] = 3*len(buf) + len(rawTxs[i])
+		total += weights[i]
+		if _, ok := txids[txid]; ok {
+			return fmt.Errorf("%w: duplicate tx", ErrInvalidPackage)
+		}
+		txids[txid] = i
+		if txs[i].Version == trucVersion {
+			trucs++
+		}
+	}
+	if total > maxPackageWeight {
+		return fmt.Errorf(
+			"%w: weight %d over %d",
+			ErrInvalidPackage, total, maxPackageWeight,
+		)
+	}
+	parentsSpent := make(map[int]struct{})
+	for i := range txs {
+		for _, in := range txs[i].Inputs {
+			var txVout txidVout
+			makeTxidVout(&in.Txid, in.Vout, &txVout)
+			if _, ok := spent[txVout]; ok {
+				return fmt.Errorf(
+					"%w: conflicting txs", ErrInvalidPackage,
+				)
+			}
+			spent[txVout] = struct{}{}
+			j, ok := txids[in.Txid]
+			if !ok {
+				continue
+			}
+			if i != childIdx {
+				return fmt.Errorf(
+					"%w: not a child with its parents, tx %d spends tx %d",
+					ErrInvalidPackage, i, j,
+				)
+			}
+			if in.Vout >= uint32(len(txs[j].Outputs)) {
+				return fmt.Errorf(
+					"%w: missing output %d of tx %d",
+					ErrInvalidPackage, in.Vout, j,
+				)
+			}
+			parentsSpent[j] = struct{}{}
+		}
+	}
+	if len(parentsSpent) != childIdx {
+		return fmt.Errorf(
+			"%w: not a child with its parents", ErrInvalidPackage,
+		)
+	}
+	if trucs == 0 {
+		return nil
+	}
+	if trucs != len(txs) {
+		return fmt.Errorf(
+			"%w: v3 txs mixed with other versions", ErrInvalidPackage,
+		)
+	}
+	if len(txs) > 2 {
+		return fmt.Errorf(
+			"%w: v3 child with more than one parent", ErrInvalidPackage,
+		)
+	}
+	for i := range txs {
+		vsize := (weights[i] + 3) / 4
+		if vsize > maxTrucVsize ||
+			i == childIdx && vsize > maxTrucChildVsize {
+			return fmt.Errorf(
+				"%w: v3 tx %d of %d vbytes", ErrInvalidPackage, i, vsize,
+			)
+		}
+	}
+	return nil
+}
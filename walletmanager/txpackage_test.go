@@ -0,0 +1,91 @@
+package walletmanager
+
+import (
+	"errors"
+	"testing"
+
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+)
+
+func TestCheckPackage(t *testing.T) {
+	tx := func(version uint32, inputs ...bitcoin.Input) bitcoin.Transaction {
+		return bitcoin.Transaction{
+			Version: version,
+			Inputs:  inputs,
+			Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: []byte{0x51}}},
+		}
+	}
+	spend := func(parent bitcoin.Transaction) bitcoin.Input {
+		return bitcoin.Input{Txid: parent.Txid(nil)}
+	}
+	p1 := tx(2, bitcoin.Input{Txid: [32]byte{1}})
+	p2 := tx(2, bitcoin.Input{Txid: [32]byte{2}})
+	p3 := tx(2, spend(p1))
+	conflict := tx(2, p1.Inputs[0])
+	conflict.Locktime = 1
+	v3p := tx(3, bitcoin.Input{Txid: [32]byte{3}})
+	large := tx(3, spend(v3p))
+	large.Outputs[0].ScriptPubkey = make([]byte, 1000)
+	for _, c := range []struct {
+		txs   []bitcoin.Transaction
+		valid bool
+	}{
+		{[]bitcoin.Transaction{p1, tx(2, spend(p1))}, true},
+		{[]bitcoin.Transaction{p1, p2, tx(2, spend(p1), spend(p2))}, true},
+		{[]bitcoin.Transaction{v3p, tx(3, spend(v3p))}, true},
+		// a single tx
+		{[]bitcoin.Transaction{p1}, false},
+		// child first
+		{[]bitcoin.Transaction{tx(2, spend(p1)), p1}, false},
+		// p2 is not a parent
+		{[]bitcoin.Transaction{p1, p2, tx(2, spend(p1))}, false},
+		// a parent spending another
+		{[]bitcoin.Transaction{p1, p3, tx(2, spend(p1), spend(p3))}, false},
+		// duplicate
+		{[]bitcoin.Transaction{p1, p1, tx(2, spend(p1))}, false},
+		// conflicting parents
+		{
+			[]bitcoin.Transaction{
+				p1, conflict, tx(2, spend(p1), spend(conflict)),
+			},
+			false,
+		},
+		// v3 child of a v2 parent
+		{[]bitcoin.Transaction{p1, tx(3, spend(p1))}, false},
+		// v3 child over 1000 vbytes
+		{[]bitcoin.Transaction{v3p, large}, false},
+	} {
+		raws := make([][]byte, len(c.txs))
+		for i := range c.txs {
+			raws[i] = c.txs[i].Serialize(nil)
+		}
+		err := checkPackage(c.txs, raws)
+		assert.MustEqual(t, c.valid, err == nil)
+		if err != nil {
+			assert.MustEqual(t, true, errors.Is(err, ErrInvalidPackage))
+		}
+	}
+}
+
+func TestBroadcastPackageNoRPC(t *testing.T) {
+	tx := func(inputs ...bitcoin.Input) bitcoin.Transaction {
+		return bitcoin.Transaction{
+			Version: 2,
+			Inputs:  inputs,
+			Outputs: []bitcoin.Output{{Amount: 1, ScriptPubkey: []byte{0x51}}},
+		}
+	}
+	p1 := tx(bitcoin.Input{Txid: [32]byte{1}})
+	p2 := tx(bitcoin.Input{Txid: [32]byte{2}})
+	child := tx(
+		bitcoin.Input{Txid: p1.Txid(nil)}, bitcoin.Input{Txid: p2.Txid(nil)},
+	)
+	// without the node rpc only a single parent goes over p2p
+	w := &W{}
+	_, err := w.BroadcastPackage(
+		t.Context(),
+		[][]byte{p1.Serialize(nil), p2.Serialize(nil), child.Serialize(nil)},
+	)
+	assert.MustEqual(t, true, errors.Is(err, ErrNoNodeRPC))
+}
@@ -0,0 +1,268 @@
+package walletmanager
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"github.com/ncodysoftware/eps-go/headerstore"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/stackerr"
+)
+
+// VerifyReport is the result of Verify
+type VerifyReport struct {
+	// Headers counts the genesis
+	Headers      int
+	Transactions int
+	Utxos        int
+	Problems     []string
+	// RepairHeight is the height the index has to be rolled back to, -1
+	// when no rollback fixes the problems found
+	RepairHeight int
+	Repaired     bool
+}
+
+// Verify checks the consistency of the index stored in db against the
+// headers: the block and the merkle proof of every tx and the unspent
+// outputs against the spent ones and the tx inputs. With repair the index
+// is rolled back below the lowest inconsistent height, the next sync
+// rescans it. eps-go must be stopped to repair, the caller holds
+// epsgo.LockDB. The headers still stored in db by older versions are moved
+// to headers first.
+func Verify(
+	ctx context.Context,
+	db sql.Database,
+	headers *headerstore.Store,
+	repair bool,
+) (VerifyReport, error) {
+	repo, err := newSQLRepository(ctx, db)
+	if err != nil {
+		return VerifyReport{}, stackerr.Wrap(err)
+	}
+	_, err = repo.importBlockHeaders(ctx, db, headers)
+	if err != nil {
+		return VerifyReport{}, stackerr.Wrap(err)
+	}
+	return verifyIndex(ctx, repo, db, headers, repair)
+}
+
+type verifier struct {
+	report VerifyReport
+}
+
+// problem records an inconsistency, the rollback to height-1 fixes it.
+// height is -1 when no rollback does.
+func (v *verifier) problem(height int, format string, args ...any) {
+	v.report.Problems = append(v.report.Problems, fmt.Sprintf(format, args...))
+	if height < 0 {
+		return
+	}
+	if v.report.RepairHeight < 0 || height-1 < v.report.RepairHeight {
+		v.report.RepairHeight = max(0, height-1)
+	}
+}
+
+func verifyIndex(
+	ctx context.Context,
+	repo Repository,
+	db sql.Database,
+	headers *headerstore.Store,
+	repair bool,
+) (VerifyReport, error) {
+	v := verifier{report: VerifyReport{RepairHeight: -1}}
+	tip := headers.Tip()
+	v.report.Headers = tip + 1
+	txHeights := make(map[[32]byte]int)
+	spentBy := make(map[txidVout][32]byte)
+	var (
+		buf    []byte
+		header [80]byte
+	)
+	err := repo.forEachTransaction(
+		ctx,
+		db,
+		func(t *transactionData) error {
+			txHeights[t.Txid] = t.Height
+			var tx bitcoin.Transaction
+			err := tx.Deserialize(bytes.NewReader(t.Raw))
+			if err != nil {
+				v.problem(-1, "tx %x: %s", t.Txid, err)
+				return nil
+			}
+			if tx.Txid(&buf) != t.Txid {
+				v.problem(-1, "tx %x: txid does not match", t.Txid)
+			}
+			for _, in := range tx.Inputs {
+				var txVout txidVout
+				makeTxidVout(&in.Txid, in.Vout, &txVout)
+				spentBy[txVout] = t.Txid
+			}
+			switch hash, _ := headers.Hash(t.Height); {
+			case t.Height < 0:
+				v.problem(
+					-1, "tx %x: block %x not indexed", t.Txid, t.BlockHash,
+				)
+				return nil
+			case t.Height > tip:
+				v.problem(
+					tip+1,
+					"tx %x: height %d above the tip",
+					t.Txid,
+					t.Height,
+				)
+				return nil
+			case hash != t.BlockHash:
+				v.problem(
+					t.Height,
+					"tx %x: block %x is not the header %d",
+					t.Txid,
+					t.BlockHash,
+					t.Height,
+				)
+				return nil
+			}
+			var branch [][32]byte
+			for i := 0; i+32 <= len(t.MerkleProof); i += 32 {
+				branch = append(branch, [32]byte(t.MerkleProof[i:]))
+			}
+			headers.Header(t.Height, &header)
+			root := [32]byte(header[36:68])
+			if !checkMerkleProof(t.Txid, t.Pos, root, branch) {
+				v.problem(
+					t.Height,
+					"tx %x: merkle proof does not match header %d",
+					t.Txid,
+					t.Height,
+				)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	v.report.Transactions = len(txHeights)
+	spent, err := repo.selectAllSpentOutputs(ctx, db)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	spentHeight := make(map[txidVout]int, len(spent))
+	for _, s := range spent {
+		spentHeight[s.TxidVout] = s.SpentHeight
+		if s.SpentHeight > tip {
+			v.problem(
+				tip+1,
+				"output %x: spent at %d above the tip",
+				s.TxidVout,
+				s.SpentHeight,
+			)
+		}
+	}
+	utxos, err := repo.selectAllUtxos(ctx, db)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	v.report.Utxos = len(utxos)
+	for i := range utxos {
+		txVout := utxos[i].TxidVout
+		if h, ok := spentHeight[txVout]; ok {
+			v.problem(h, "output %x: both spent and unspent", txVout)
+		}
+		if _, ok := txHeights[[32]byte(txVout[:32])]; !ok {
+			v.problem(-1, "output %x: tx not indexed", txVout)
+		}
+		if spender, ok := spentBy[txVout]; ok {
+			v.problem(
+				txHeights[spender],
+				"output %x: spent by tx %x",
+				txVout,
+				spender,
+			)
+		}
+	}
+	wallets, err := repo.selectAllWalletData(ctx, db)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	for _, wd := range wallets {
+		if wd.Height > tip {
+			v.problem(
+				tip+1, "wallet %x: height %d above the tip", wd.Hash, wd.Height,
+			)
+		}
+	}
+	if !repair || v.report.RepairHeight < 0 {
+		return v.report, nil
+	}
+	err = repo.deleteAllSinceBlock(ctx, db, v.report.RepairHeight)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	err = repo.reloadCaches(ctx, db)
+	if err != nil {
+		return v.report, stackerr.Wrap(err)
+	}
+	v.report.Repaired = true
+	return v.report, nil
+}
+
+// Reconcile rolls the index stored in db back below the lowest tx whose
+// block is not the header at its height and returns the height rolled back
+// to, -1 when every block matches. The txs above the headers tip are not
+// checked, a headers file behind the index does not roll it back. It runs
+// after a restore, the headers may follow a reorg the backup predates and
+// the sync only rescans above the wallet heights. The caller holds
+// epsgo.LockDB.
+func Reconcile(
+	ctx context.Context, db sql.Database, headers *headerstore.Store,
+) (int, error) {
+	repo, err := newSQLRepository(ctx, db)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	_, err = repo.importBlockHeaders(ctx, db, headers)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	return reconcileIndex(ctx, repo, db, headers)
+}
+
+func reconcileIndex(
+	ctx context.Context,
+	repo Repository,
+	db sql.Database,
+	headers *headerstore.Store,
+) (int, error) {
+	v := verifier{report: VerifyReport{RepairHeight: -1}}
+	tip := headers.Tip()
+	err := repo.forEachTransaction(
+		ctx,
+		db,
+		func(t *transactionData) error {
+			if t.Height < 0 || t.Height > tip {
+				return nil
+			}
+			if hash, _ := headers.Hash(t.Height); hash != t.BlockHash {
+				v.problem(t.Height, "tx %x: stale block", t.Txid)
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	if v.report.RepairHeight < 0 {
+		return -1, nil
+	}
+	err = repo.deleteAllSinceBlock(ctx, db, v.report.RepairHeight)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	err = repo.reloadCaches(ctx, db)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	return v.report.RepairHeight, nil
+}
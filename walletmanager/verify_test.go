@@ -0,0 +1,159 @@
+package walletmanager
+
+import (
+	"path/filepath"
+	"testing"
+
+	epsgo "github.com/ncodysoftware/eps-go"
+	"github.com/ncodysoftware/eps-go/headerstore"
+	"ncody.com/ncgo.git/assert"
+	"ncody.com/ncgo.git/bitcoin"
+	"ncody.com/ncgo.git/database/sql"
+	"ncody.com/ncgo.git/database/sql/migrator"
+	"ncody.com/ncgo.git/log"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	pb, headers := tVerifyIndex(t, repo, nil)
+	wd := walletData{Hash: [32]byte{1}, Height: 2}
+	assert.Must(t, repo.insertWalletData(ctx, nil, &wd))
+	r, err := verifyIndex(ctx, repo, nil, headers, false)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(r.Problems))
+	assert.MustEqual(t, 3, r.Headers)
+	assert.MustEqual(t, 2, r.Transactions)
+	assert.MustEqual(t, -1, r.RepairHeight)
+	// the tx at pos 5 gets the branch of pos 6 and the wallet goes above
+	// the tip
+	tx := repo.(*memRepository).txs[pb.txids[5]]
+	tx.merkleProof = pb.merkleBranch(6, nil)
+	repo.(*memRepository).txs[pb.txids[5]] = tx
+	wd.Height = 10
+	assert.Must(t, repo.insertWalletData(ctx, nil, &wd))
+	r, err = verifyIndex(ctx, repo, nil, headers, true)
+	assert.Must(t, err)
+	assert.MustEqual(t, 2, len(r.Problems))
+	assert.MustEqual(t, 1, r.RepairHeight)
+	assert.MustEqual(t, true, r.Repaired)
+	r, err = verifyIndex(ctx, repo, nil, headers, false)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(r.Problems))
+	assert.MustEqual(t, 1, r.Transactions)
+	wd, err = repo.selectWalletData(ctx, nil, &wd.Hash)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, wd.Height)
+}
+
+// TestVerifySpentUnspent repairs an output stored as both spent and unspent,
+// the rollback restores a spent output that is still in unspent_output
+func TestVerifySpentUnspent(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		tVerifySpentUnspent(t, NewMemRepository(), nil)
+	})
+	t.Run("sqlite", func(t *testing.T) {
+		db, err := epsgo.OpenDB(
+			t.Context(),
+			log.New(log.LevelFromString("error"), "eps-go"),
+			epsgo.DBOpts{Path: filepath.Join(t.TempDir(), "db.sqlite3")},
+			migrator.FlagMigrateFresh,
+		)
+		assert.Must(t, err)
+		defer db.Close(t.Context())
+		r, err := newSQLRepository(t.Context(), db)
+		assert.Must(t, err)
+		tVerifySpentUnspent(t, r, db)
+	})
+}
+
+func tVerifySpentUnspent(t *testing.T, repo Repository, db sql.Database) {
+	ctx := t.Context()
+	pb, headers := tVerifyIndex(t, repo, db)
+	// an output of the tx at height 1 spent at height 2 and inserted again
+	var txVout txidVout
+	makeTxidVout(&pb.txids[0], 0, &txVout)
+	sh := [32]byte{0xaa}
+	assert.Must(t, repo.insertUnspentOutput(ctx, db, &txVout, 1000, &sh))
+	err := repo.deleteUnspentOutput(ctx, db, &txVout, 2, &pb.txids[5])
+	assert.Must(t, err)
+	assert.Must(t, repo.insertUnspentOutput(ctx, db, &txVout, 1000, &sh))
+	r, err := verifyIndex(ctx, repo, db, headers, true)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, len(r.Problems))
+	assert.MustEqual(t, 1, r.RepairHeight)
+	assert.MustEqual(t, true, r.Repaired)
+	r, err = verifyIndex(ctx, repo, db, headers, false)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(r.Problems))
+	assert.MustEqual(t, 1, r.Transactions)
+	assert.MustEqual(t, 1, r.Utxos)
+}
+
+// tVerifyIndex stores two headers sharing the test block merkle root, the
+// tx at pos 0 is stored in the first one and the tx at pos 5 in the second
+func tVerifyIndex(
+	t *testing.T, repo Repository, db sql.Database,
+) (*preparedBlock, *headerstore.Store) {
+	ctx := t.Context()
+	block := testBlock()
+	var buf []byte
+	pb := &preparedBlock{block: block}
+	indexBlock(pb, &buf)
+	headers, err := OpenHeaders("", bitcoin.Regtest)
+	assert.Must(t, err)
+	prev := genesisBlockData[bitcoin.Regtest].Hash
+	for height, pos := range []int{0, 5} {
+		height++
+		var raw [80]byte
+		copy(raw[4:36], prev[:])
+		copy(raw[36:68], block.MerkleRoot[:])
+		raw[79] = byte(height)
+		hash := doubleSha256(raw[:])
+		assert.Must(t, headers.Append(raw[:]))
+		err = repo.insertTransaction(
+			ctx,
+			db,
+			&pb.txids[pos],
+			&hash,
+			height,
+			pos,
+			block.Transactions[pos].Serialize(nil),
+			pb.merkleBranch(pos, nil),
+		)
+		assert.Must(t, err)
+		prev = hash
+	}
+	return pb, headers
+}
+
+func TestReconcile(t *testing.T) {
+	ctx := t.Context()
+	repo := NewMemRepository()
+	pb, headers := tVerifyIndex(t, repo, nil)
+	height, err := reconcileIndex(ctx, repo, nil, headers)
+	assert.Must(t, err)
+	assert.MustEqual(t, -1, height)
+	// a tx of a replaced block at height 2 and one above the tip
+	block := pb.block
+	for height, pos := range map[int]int{2: 6, 5: 7} {
+		err = repo.insertTransaction(
+			ctx,
+			nil,
+			&pb.txids[pos],
+			&[32]byte{0xee},
+			height,
+			pos,
+			block.Transactions[pos].Serialize(nil),
+			pb.merkleBranch(pos, nil),
+		)
+		assert.Must(t, err)
+	}
+	height, err = reconcileIndex(ctx, repo, nil, headers)
+	assert.Must(t, err)
+	assert.MustEqual(t, 1, height)
+	r, err := verifyIndex(ctx, repo, nil, headers, false)
+	assert.Must(t, err)
+	assert.MustEqual(t, 0, len(r.Problems))
+	assert.MustEqual(t, 1, r.Transactions)
+}
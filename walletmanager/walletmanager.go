@@ -5,13 +5,16 @@ import (
 	"context"
 	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"errors"
 	"fmt"
-	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ncodysoftware/eps-go/blockdir"
+	"github.com/ncodysoftware/eps-go/headerstore"
+	"github.com/ncodysoftware/eps-go/noderpc"
+	"github.com/ncodysoftware/eps-go/p2p"
 	"ncody.com/ncgo.git/bitcoin"
 	"ncody.com/ncgo.git/bitcoin/bip32"
 	"ncody.com/ncgo.git/bitcoin/scriptpubkey"
@@ -30,6 +33,8 @@ type wallet struct {
 	nChangeDerived   uint32
 	height           int
 	hash             [32]byte
+	// needs blocks the node no longer has
+	stalled bool
 }
 
 type scriptPubkeyInfo struct {
@@ -47,11 +52,35 @@ type WalletConfig struct {
 
 type txidVout [32 + 4]byte
 
+type Opts struct {
+	// NodeAddr is the node p2p address used to download blocks
+	NodeAddr string
+	// BlocksDir is the node blocks directory, when set historical blocks
+	// are read from disk instead of downloaded
+	BlocksDir string
+	// ScanFromFirstBlock moves wallets older than the first block a pruned
+	// node has up to that block instead of leaving them unsynced
+	ScanFromFirstBlock bool
+	// Repo stores the index, nil stores it in the db passed to New. See
+	// NewMemRepository.
+	Repo Repository
+	// HeadersFile is the block headers file, empty keeps the headers in
+	// memory and downloads them again on every start
+	HeadersFile string
+	// RPCURL is the node JSON-RPC url with its credentials, optional, it
+	// submits the tx packages
+	RPCURL string
+	// MaxHistory is the most txs GetScriptHashHistory returns, zero has
+	// no limit
+	MaxHistory int
+}
+
 type W struct {
 	db             sql.Database
 	log            *log.Logger
 	bcli           *bitcoin.Client
-	repo           *repository
+	repo           Repository
+	headers        *headerstore.Store
 	net            bitcoin.Network
 	bestHeader     int
 	bestHeaderHash [32]byte
@@ -59,14 +88,55 @@ type W struct {
 	cancel        func()
 	done          chan struct{}
 	initCompleted chan struct{}
+	// closed once the headers caught up with the node, before the wallets
+	headersSynced chan struct{}
 	//
-	mu sync.Mutex
+	mu ctxMutex
+	// guards headers against the readers not holding mu, the sync reads
+	// them unlocked as their only writer
+	hmu sync.RWMutex
+	// height of the least synchronized wallet, see storeSyncHeight
+	syncHeight atomic.Int64
 	//
 	wallets       []wallet
 	scriptPubkeys map[[32]byte]scriptPubkeyInfo
+	// derived scriptpubkeys in derivation order, matched against filters
+	scripts [][]byte
+	//
+	nodeAddr string
+	peer     *p2p.Peer
+	// nil when no node rpc is configured
+	rpc *noderpc.Client
+	// nil when no blocks dir is configured
+	blocks *blockdir.Dir
+	// lowest height whose block can be fetched, above zero when the node
+	// is pruned
+	firstBlock         int
+	scanFromFirstBlock bool
+	// parents of stored transactions not found by fetchParent
+	missingParents map[[32]byte]struct{}
+	// height where fetchParent resumes the search of a parent
+	parentSearches map[[32]byte]int
+	// serializes the use of peer by the sync and by fetchParent, which
+	// runs without mu. mu is never taken while holding it.
+	pmu        ctxMutex
+	maxHistory int
+	// status hash state of the tracked scripthashes
+	shStatuses map[[32]byte]shStatusState
+	// notifications of the batch being processed, sent once it commits
+	pendingSH  map[[32]byte][32]byte
+	pendingOps map[txidVout]OutpointStatus
+	// last verified compact filter header
+	cfHeader       [32]byte
+	cfHeaderHeight int
 	//
 	shSubs map[[32]byte]map[uint32]func([32]byte)
 	hSubs  map[uint32]func(int, [80]byte)
+	// scripthashes subscribed by each connection
+	connSubs map[uint32]map[[32]byte]struct{}
+	opSubs   map[txidVout]map[uint32]func(OutpointStatus)
+	// outpoints subscribed by each connection
+	connOpSubs map[uint32]map[txidVout]struct{}
 }
 
 func New(
@@ -76,35 +146,107 @@ func New(
 	bcli *bitcoin.Client,
 	wallets []WalletConfig,
 	net bitcoin.Network,
+	opts Opts,
 ) (*W, error) {
-	repo, err := newRepository(ctx, db)
+	if opts.NodeAddr == "" {
+		return nil, fmt.Errorf("missing node address")
+	}
+	var err error
+	repo := opts.Repo
+	if repo == nil {
+		err = recordNetwork(ctx, db, net)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+		repo, err = newSQLRepository(ctx, db)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+	var blocks *blockdir.Dir
+	if opts.BlocksDir != "" {
+		blocks, err = blockdir.Open(opts.BlocksDir, net)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+	var rpc *noderpc.Client
+	if opts.RPCURL != "" {
+		rpc, err = noderpc.New(opts.RPCURL)
+		if err != nil {
+			return nil, stackerr.Wrap(err)
+		}
+	}
+	headers, err := OpenHeaders(opts.HeadersFile, net)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
+	if headers.Recovered() > 0 {
+		log.Warnf(
+			"%d damaged headers dropped from %s",
+			headers.Recovered(),
+			opts.HeadersFile,
+		)
+	}
 	ctx, cancel := context.WithCancel(ctx)
 	w := &W{
-		db:            db,
-		log:           log,
-		bcli:          bcli,
-		repo:          repo,
-		net:           net,
-		scriptPubkeys: make(map[[32]byte]scriptPubkeyInfo),
-		cancel:        cancel,
-		done:          make(chan struct{}),
-		initCompleted: make(chan struct{}),
-		wallets:       make([]wallet, len(wallets)),
-		shSubs:        make(map[[32]byte]map[uint32]func([32]byte)),
-		hSubs:         make(map[uint32]func(int, [80]byte)),
+		db:             db,
+		log:            log,
+		bcli:           bcli,
+		repo:           repo,
+		headers:        headers,
+		net:            net,
+		nodeAddr:       opts.NodeAddr,
+		rpc:            rpc,
+		blocks:         blocks,
+		cfHeaderHeight: -1,
+		scriptPubkeys:  make(map[[32]byte]scriptPubkeyInfo),
+		missingParents: make(map[[32]byte]struct{}),
+		parentSearches: make(map[[32]byte]int),
+		maxHistory:     opts.MaxHistory,
+		shStatuses:     make(map[[32]byte]shStatusState),
+		pendingSH:      make(map[[32]byte][32]byte),
+		pendingOps:     make(map[txidVout]OutpointStatus),
+		cancel:         cancel,
+		done:           make(chan struct{}),
+		initCompleted:  make(chan struct{}),
+		headersSynced:  make(chan struct{}),
+		wallets:        make([]wallet, len(wallets)),
+		shSubs:         make(map[[32]byte]map[uint32]func([32]byte)),
+		hSubs:          make(map[uint32]func(int, [80]byte)),
+		connSubs:       make(map[uint32]map[[32]byte]struct{}),
+		opSubs:         make(map[txidVout]map[uint32]func(OutpointStatus)),
+		connOpSubs:     make(map[uint32]map[txidVout]struct{}),
+		//
+		scanFromFirstBlock: opts.ScanFromFirstBlock,
+	}
+	err = w.setupHeaders(ctx)
+	if err != nil {
+		headers.Close()
+		return nil, stackerr.Wrap(err)
+	}
+	err = w.runBackfills(ctx)
+	if err != nil {
+		headers.Close()
+		return nil, stackerr.Wrap(err)
 	}
 	var buf []byte
 	for i := range wallets {
 		err := w.setupWallet(ctx, i, &wallets[i], &buf)
 		if err != nil {
+			headers.Close()
 			return nil, stackerr.Wrap(err)
 		}
 	}
+	w.storeSyncHeight()
 	go func() {
 		defer close(w.done)
+		defer w.headers.Close()
+		defer func() {
+			w.pmu.Lock()
+			w.closePeer()
+			w.pmu.Unlock()
+		}()
 		err := w.run(ctx)
 		if err != nil {
 			w.log.Err(stackerr.Wrap(err))
@@ -135,70 +277,74 @@ func (w *W) WaitInit(ctx context.Context) error {
 func (w *W) GetBlockHeader(
 	ctx context.Context, height int, out *[80]byte,
 ) error {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	if height == 0 {
-		copy(out[:], genesisBlockData[w.net].Serialized[:80])
-		return nil
-	}
-	err := w.repo.selectRawBlockHeaderByHeight(ctx, w.db, height, out)
+	err := w.rlockHeaders(ctx)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	defer w.hmu.RUnlock()
+	if !w.headers.Header(height, out) {
+		return fmt.Errorf("no header at height %d", height)
+	}
 	return nil
 }
 
+// GetBlockHeaders appends up to limit serialized headers starting at height
+// to out
 func (w *W) GetBlockHeaders(
-	ctx context.Context, height, limit int,
-) ([][80]byte, error) {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	headers, err := w.repo.selectRawBlockHeadersByHeight(
-		ctx, w.db, height, limit,
-	)
-	if height == 0 {
-		var h [80]byte
-		copy(h[:], genesisBlockData[w.net].Serialized[:80])
-		headers = slices.Insert(headers, 0, h)
-		if len(headers) > limit {
-			headers = headers[:len(headers)-1]
-		}
-	}
+	ctx context.Context, height, limit int, out []byte,
+) ([]byte, error) {
+	err := w.rlockHeaders(ctx)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
-	return headers, nil
+	defer w.hmu.RUnlock()
+	return append(out, w.headers.Headers(height, limit)...), nil
+}
+
+// GetHeaderBranch returns the checkpoint proof of the header at height, see
+// headerstore.Store.Branch
+func (w *W) GetHeaderBranch(
+	ctx context.Context, height, cpHeight int,
+) ([][32]byte, [32]byte, error) {
+	err := w.rlockHeaders(ctx)
+	if err != nil {
+		return nil, [32]byte{}, stackerr.Wrap(err)
+	}
+	defer w.hmu.RUnlock()
+	branch, root, err := w.headers.Branch(height, cpHeight)
+	if err != nil {
+		return nil, root, stackerr.Wrap(err)
+	}
+	return branch, root, nil
 }
 
 func (w *W) GetTipHeader(
 	ctx context.Context, outHeight *int, outHeader *[80]byte,
 ) error {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	err := w.repo.selectLastBlockHeaderHeightAndRaw(
-		ctx, w.db, outHeight, outHeader,
-	)
+	err := w.rlockHeaders(ctx)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	defer w.hmu.RUnlock()
+	*outHeight = w.headers.Tip()
+	w.headers.Header(*outHeight, outHeader)
 	return nil
 }
 
 func (w *W) GetScriptHashBalance(
 	ctx context.Context, sh *[32]byte, outConf, outUnconf *uint64,
 ) error {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	_, ok := w.scriptPubkeys[*sh]
 	if !ok {
 		*outConf, *outUnconf = 0, 0
 		return nil
 	}
-	err := w.repo.selectScriptHashBalance(ctx, w.db, sh, outConf)
+	err = w.repo.selectScriptHashBalance(ctx, w.db, sh, outConf)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -206,24 +352,40 @@ func (w *W) GetScriptHashBalance(
 	return nil
 }
 
+// GetScriptHashHistory returns the txs of sh from fromHeight up to toHeight
+// excluded, a negative toHeight has no bound. It returns ErrHistoryTooLarge
+// when there are more than the MaxHistory option.
 func (w *W) GetScriptHashHistory(
-	ctx context.Context, sh *[32]byte,
+	ctx context.Context, sh *[32]byte, fromHeight, toHeight int,
 ) ([]TxData, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
-	hist, err := w.repo.selectScriptHashHistory(ctx, w.db, sh)
+	limit := -1
+	if w.maxHistory > 0 {
+		limit = w.maxHistory + 1
+	}
+	hist, err := w.repo.selectScriptHashHistory(
+		ctx, w.db, sh, fromHeight, toHeight, limit,
+	)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
+	if w.maxHistory > 0 && len(hist) > w.maxHistory {
+		return nil, ErrHistoryTooLarge
+	}
 	return hist, nil
 }
 
 func (w *W) GetScriptHashUnspent(
 	ctx context.Context, sh *[32]byte,
 ) ([]UtxoData, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	utxos, err := w.repo.selectScriptHashUnspent(ctx, w.db, sh)
 	if err != nil {
@@ -235,31 +397,25 @@ func (w *W) GetScriptHashUnspent(
 func (w *W) GetScriptHashStatus(
 	ctx context.Context, sh *[32]byte, buf *[]byte,
 ) ([]byte, error) {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	return w.getScriptHashStatus(ctx, w.db, sh, buf)
-}
-
-func (w *W) getScriptHashStatus(
-	ctx context.Context, db sql.Database, sh *[32]byte, buf *[]byte,
-) ([]byte, error) {
-	hist, err := w.repo.selectScriptHashHistory(ctx, db, sh)
+	err := w.lock(ctx)
 	if err != nil {
 		return nil, stackerr.Wrap(err)
 	}
-	return shStatus(hist, buf), nil
+	defer w.mu.Unlock()
+	return w.getScriptHashStatus(ctx, w.db, sh, buf)
 }
 
 func (w *W) BroadcastTX(
 	ctx context.Context, rawTx []byte, buf *[]byte,
 ) ([32]byte, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return [32]byte{}, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	var txid [32]byte
 	var tx bitcoin.Transaction
-	err := tx.Deserialize(bytes.NewReader(rawTx))
+	err = tx.Deserialize(bytes.NewReader(rawTx))
 	if err != nil {
 		return txid, stackerr.Wrap(err)
 	}
@@ -274,8 +430,25 @@ func (w *W) BroadcastTX(
 func (w *W) GetRawTx(
 	ctx context.Context, txid *[32]byte,
 ) ([]byte, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	raw, err := w.GetStoredRawTx(ctx, txid)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		// the parents of the wallet transactions, asked to compute fees
+		raw, err = w.fetchParent(ctx, txid)
+	}
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
+	return raw, nil
+}
+
+// GetStoredRawTx is GetRawTx without fetching the parents not stored yet
+func (w *W) GetStoredRawTx(
+	ctx context.Context, txid *[32]byte,
+) ([]byte, error) {
+	err := w.lock(ctx)
+	if err != nil {
+		return nil, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	raw, err := w.repo.selectRawTransaction(ctx, w.db, txid)
 	if err != nil {
@@ -284,6 +457,103 @@ func (w *W) GetRawTx(
 	return raw, nil
 }
 
+// TransactionInfo is a stored transaction with its block
+type TransactionInfo struct {
+	Raw           []byte
+	BlockHash     [32]byte
+	Height        int
+	Confirmations int
+	BlockTime     uint32
+}
+
+// GetTransaction returns the transaction txid and the block it confirmed in
+func (w *W) GetTransaction(
+	ctx context.Context, txid *[32]byte,
+) (TransactionInfo, error) {
+	info, err := w.getTransaction(ctx, txid)
+	if err != nil && errors.Is(err, sql.ErrNoRows) {
+		_, err = w.fetchParent(ctx, txid)
+		if err != nil {
+			return info, stackerr.Wrap(err)
+		}
+		info, err = w.getTransaction(ctx, txid)
+	}
+	if err != nil {
+		return info, stackerr.Wrap(err)
+	}
+	return info, nil
+}
+
+func (w *W) getTransaction(
+	ctx context.Context, txid *[32]byte,
+) (TransactionInfo, error) {
+	err := w.lock(ctx)
+	if err != nil {
+		return TransactionInfo{}, stackerr.Wrap(err)
+	}
+	defer w.mu.Unlock()
+	var info TransactionInfo
+	txData, err := w.repo.selectTransactionFromTxid(ctx, w.db, txid)
+	if err != nil {
+		return info, stackerr.Wrap(err)
+	}
+	info.Raw = txData.Raw
+	info.BlockHash = txData.BlockHash
+	info.Height = txData.Height
+	var header [80]byte
+	if w.headers.Header(txData.Height, &header) {
+		info.Confirmations = w.headers.Tip() - txData.Height + 1
+		info.BlockTime = binary.LittleEndian.Uint32(header[68:72])
+	}
+	return info, nil
+}
+
+// Network returns the network of the indexed chain
+func (w *W) Network() bitcoin.Network {
+	return w.net
+}
+
+// Stats are the server figures shown in the banner
+type Stats struct {
+	TipHeight int
+	// SyncHeight is the height of the least synchronized wallet
+	SyncHeight int
+	Wallets    int
+}
+
+// Progress returns the percentage of the chain the wallets are synced to
+func (st *Stats) Progress() float64 {
+	if st.TipHeight <= 0 {
+		return 100
+	}
+	return float64(st.SyncHeight) * 100 / float64(st.TipHeight)
+}
+
+// GetStats does not wait for the initial sync, it reports its progress
+func (w *W) GetStats() Stats {
+	w.hmu.RLock()
+	tip := w.headers.Tip()
+	w.hmu.RUnlock()
+	return Stats{
+		TipHeight:  tip,
+		SyncHeight: min(tip, int(w.syncHeight.Load())),
+		Wallets:    len(w.wallets),
+	}
+}
+
+// MempoolSize returns the number of txs in the node mempool, -1 without
+// the node rpc. The mempool is not indexed, it is asked to the node.
+func (w *W) MempoolSize(ctx context.Context) (int, error) {
+	if w.rpc == nil {
+		return -1, nil
+	}
+	n, err := w.rpc.GetMempoolSize(ctx)
+	if err != nil {
+		return -1, stackerr.Wrap(err)
+	}
+	return n, nil
+}
+
 type MerkleData struct {
 	Merkle [][32]byte
 	Pos    int
@@ -292,8 +562,10 @@ type MerkleData struct {
 func (w *W) GetTransactionMerkle(
 	ctx context.Context, txid *[32]byte,
 ) (MerkleData, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return MerkleData{}, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	var md MerkleData
 	txData, err := w.repo.selectTransactionFromTxid(ctx, w.db, txid)
@@ -320,8 +592,10 @@ type MerkleFromPosData struct {
 func (w *W) GetTransactionMerkleFromPos(
 	ctx context.Context, height, pos int,
 ) (MerkleFromPosData, error) {
-	<-w.initCompleted
-	w.mu.Lock()
+	err := w.lock(ctx)
+	if err != nil {
+		return MerkleFromPosData{}, stackerr.Wrap(err)
+	}
 	defer w.mu.Unlock()
 	var md MerkleFromPosData
 	txData, err := w.repo.selectTransactionFromHeightPos(
@@ -342,63 +616,6 @@ func (w *W) GetTransactionMerkleFromPos(
 	}, nil
 }
 
-func (w *W) HeadersSubscribe(id uint32, cb func(height int, header [80]byte)) {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	w.hSubs[id] = cb
-}
-
-func (w *W) notifyHeaderSubscribers(height int, buf *[]byte) {
-	var (
-		buf2 [80]byte
-	)
-	if len(w.hSubs) == 0 {
-		return
-	}
-	copy(buf2[:], (*buf)[:])
-	for _, cb := range w.hSubs {
-		cb(height, buf2)
-	}
-}
-
-func (w *W) ScriptHashSubscribe(
-	id uint32, sh [32]byte, cb func(status [32]byte),
-) {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	m := w.shSubs[sh]
-	if m == nil {
-		m = make(map[uint32]func([32]byte))
-	}
-	m[id] = cb
-	w.shSubs[sh] = m
-}
-
-func (w *W) notifyScriptHashSubscribers(sh [32]byte, status [32]byte) {
-	if len(w.shSubs[sh]) == 0 {
-		return
-	}
-	for _, cb := range w.shSubs[sh] {
-		cb(status)
-	}
-}
-
-func (w *W) UnsubscribeAll(id uint32) {
-	<-w.initCompleted
-	w.mu.Lock()
-	defer w.mu.Unlock()
-	delete(w.hSubs, id)
-	for k, v := range w.shSubs {
-		delete(v, id)
-		if len(v) == 0 {
-			delete(w.shSubs, k)
-		}
-	}
-	delete(w.hSubs, id)
-}
-
 func (w *W) setupWallet(
 	ctx context.Context, i int, wc *WalletConfig, buf *[]byte,
 ) error {
@@ -439,9 +656,25 @@ func (w *W) setupWallet(
 	return nil
 }
 
+// initialSyncer is implemented by databases relaxing durability while the
+// index catches up with the node
+type initialSyncer interface {
+	SetInitialSync(on bool)
+}
+
+func (w *W) setInitialSync(on bool) {
+	db, ok := w.db.(initialSyncer)
+	if !ok {
+		return
+	}
+	db.SetInitialSync(on)
+}
+
 func (w *W) run(ctx context.Context) error {
 	var buf []byte
 	var errReorg reorgError
+	w.setInitialSync(true)
+	defer w.setInitialSync(false)
 	err := w.syncHeaders(ctx, &buf)
 	if err != nil && errors.As(err, &errReorg) {
 		err := w.processReorg(ctx, errReorg)
@@ -451,10 +684,12 @@ func (w *W) run(ctx context.Context) error {
 	} else if err != nil {
 		return stackerr.Wrap(err)
 	}
+	close(w.headersSynced)
 	err = w.syncWallets(ctx, &buf)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	w.setInitialSync(false)
 	close(w.initCompleted)
 	ticker := time.NewTicker(time.Second * 30)
 	defer ticker.Stop()
@@ -465,10 +700,14 @@ func (w *W) run(ctx context.Context) error {
 			return nil
 		}
 		err := func() error {
-			w.mu.Lock()
+			err := w.mu.LockCtx(ctx)
+			if err != nil {
+				// closing
+				return nil
+			}
 			defer w.mu.Unlock()
 			var errReorg reorgError
-			err := w.syncHeaders(ctx, &buf)
+			err = w.syncHeaders(ctx, &buf)
 			if err != nil && errors.As(err, &errReorg) {
 				err := w.processReorg(ctx, errReorg)
 				if err != nil {
@@ -490,18 +729,20 @@ func (w *W) run(ctx context.Context) error {
 }
 
 func (w *W) syncHeaders(ctx context.Context, buf *[]byte) error {
-	var hd blockHeaderData
-	err := w.repo.selectLastBlockHeaderData(ctx, w.db, &hd)
-	if err != nil && errors.Is(err, sql.ErrNoRows) {
-		hd = genesisBlockData[w.net]
-	} else if err != nil {
-		return stackerr.Wrap(err)
-	}
 	var (
-		headerHashes = [1][32]byte{hd.Hash}
+		headerHashes [1][32]byte
+		batch        []byte
 	)
-	w.bestHeader = hd.Height
-	w.bestHeaderHash = hd.Hash
+	w.bestHeader = w.headers.Tip()
+	w.bestHeaderHash, _ = w.headers.Hash(w.bestHeader)
+	// subscribers get the new tip once per round, not every header of a
+	// catch-up
+	start := w.bestHeader
+	defer func() {
+		if w.bestHeader > start {
+			w.notifyHeaderSubscribers(w.bestHeader)
+		}
+	}()
 	for ctx.Err() == nil {
 		headerHashes[0] = w.bestHeaderHash
 		headers, err := w.bcli.GetHeaders(
@@ -514,56 +755,57 @@ func (w *W) syncHeaders(ctx context.Context, buf *[]byte) error {
 			// up to date
 			return nil
 		}
+		batch = batch[:0]
+		prev := w.bestHeaderHash
 		for i := range headers {
-			if !bytes.Equal(
-				headers[i].PreviousBlock[:],
-				w.bestHeaderHash[:],
-			) {
+			if headers[i].PreviousBlock != prev {
+				if i > 0 {
+					break
+				}
 				err := w.checkReorg(ctx)
 				if err != nil {
 					return stackerr.Wrap(err)
 				}
 				return fmt.Errorf("unexpected block")
 			}
-			if i == 0 {
-				w.log.Debugf(
-					"NEW HEADERS: best header: %d",
-					w.bestHeader+len(headers),
-				)
-			}
-			clearBuf(buf)
-			hash := headers[i].Hash(buf)
 			clearBuf(buf)
-			*buf = headers[i].Serialize(*buf)
-			w.notifyHeaderSubscribers(w.bestHeader+1, buf)
-			err = w.repo.insertBlockHeader(
-				ctx, w.db, &hash, w.bestHeader+1, *buf,
-			)
-			if err != nil {
-				return stackerr.Wrap(err)
-			}
-			w.bestHeader++
-			w.bestHeaderHash = hash
+			prev = headers[i].Hash(buf)
+			// Serialize appends the tx count after the 80 bytes
+			n := len(batch)
+			batch = headers[i].Serialize(batch)[:n+80]
+		}
+		w.log.Debugf(
+			"NEW HEADERS: best header: %d", w.bestHeader+len(batch)/80,
+		)
+		w.hmu.Lock()
+		err = w.headers.Append(batch)
+		w.hmu.Unlock()
+		if err != nil {
+			return stackerr.Wrap(err)
 		}
+		w.bestHeader += len(batch) / 80
+		w.bestHeaderHash = prev
 	}
 	return nil
 }
 
+// processReorg rolls the index back before the headers, a crash in between
+// leaves the stale headers that are detected again on the next sync
 func (w *W) processReorg(ctx context.Context, errReorg reorgError) error {
 	w.log.Warnf(
 		"PROCESSING REORG ROLLBACK TO BLOCK %d",
 		errReorg.LastHeightOnChain,
 	)
-	var hashes [][32]byte
-	err := w.repo.selectBlockHashesAtHeight(
-		ctx, w.db, errReorg.LastHeightOnChain, 1, &hashes,
-	)
+	hash, ok := w.headers.Hash(errReorg.LastHeightOnChain)
+	if !ok {
+		panic("unreachable")
+	}
+	// the subscribed outpoints funded or spent by the rolled back blocks
+	// are notified with their new status
+	opStatuses, err := w.outpointStatuses(ctx)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	if len(hashes) < 1 {
-		panic("unreachable")
-	}
 	err = w.repo.deleteAllSinceBlock(ctx, w.db, errReorg.LastHeightOnChain)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -572,12 +814,27 @@ func (w *W) processReorg(ctx context.Context, errReorg reorgError) error {
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	err = w.notifyChangedOutpoints(ctx, opStatuses)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	w.hmu.Lock()
+	err = w.headers.Truncate(errReorg.LastHeightOnChain)
+	w.hmu.Unlock()
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	for i := range w.wallets {
 		wal := &w.wallets[i]
 		wal.height = min(errReorg.LastHeightOnChain, wal.height)
 	}
-	w.bestHeader = min(errReorg.LastHeightOnChain)
-	w.bestHeaderHash = hashes[0]
+	w.storeSyncHeight()
+	w.bestHeader = errReorg.LastHeightOnChain
+	w.bestHeaderHash = hash
+	w.cfHeaderHeight = -1
+	clear(w.missingParents)
+	clear(w.parentSearches)
+	clear(w.shStatuses)
 	w.log.Warn("REORG PROCESSED")
 	return nil
 }
@@ -595,104 +852,36 @@ func (w *W) checkReorg(ctx context.Context) error {
 		return nil
 	}
 	height := w.bestHeader
-	var (
-		blockHashes [][32]byte
-		headersGet  [][32]byte
-	)
+	var headersGet [1][32]byte
 	for ; ; height-- {
 		if w.bestHeader-(height-1) > 6 {
 			panic("REORG WITH DELTA > 6")
 		}
-		clearBuf(&blockHashes)
-		err := w.repo.selectBlockHashesAtHeight(
-			ctx, w.db, height-1, 1, &blockHashes,
-		)
-		if err != nil {
-			return stackerr.Wrap(err)
-		}
-		if len(blockHashes) < 1 {
+		hash, ok := w.headers.Hash(height - 1)
+		if !ok {
 			panic("unreachable")
 		}
-		clearBuf(&headersGet)
-		headersGet = append(headersGet, blockHashes[0])
-		headers, err := w.bcli.GetHeaders(ctx, headersGet, [32]byte{})
+		headersGet[0] = hash
+		headers, err := w.bcli.GetHeaders(ctx, headersGet[:], [32]byte{})
 		if err != nil {
 			return stackerr.Wrap(err)
 		}
 		if len(headers) == 0 || len(headers) > 0 &&
-			headers[0].PreviousBlock == blockHashes[0] {
+			headers[0].PreviousBlock == hash {
 			return reorgError{height - 1}
 		}
 	}
-	return nil
-}
-
-func (w *W) syncWallets(ctx context.Context, buf *[]byte) error {
-	if len(w.wallets) == 0 {
-		return nil
-	}
-	height := w.wallets[0].height
-	for i := range w.wallets {
-		height = min(height, w.wallets[i].height)
-	}
-	if height >= w.bestHeader {
-		return nil
-	}
-	hbuf := make([][32]byte, 0, 2000)
-	var (
-		buf2    []byte
-		txidBuf [][32]byte
-		rem     estimateTime
-	)
-	height++
-	for height <= w.bestHeader {
-		hbuf := hbuf[:0]
-		err := w.repo.selectBlockHashesAtHeight(
-			ctx, w.db, height, cap(hbuf), &hbuf,
-		)
-		if err != nil {
-			return stackerr.Wrap(err)
-		}
-		for _, bh := range hbuf {
-			block, err := w.bcli.GetBlock(ctx, bh)
-			if err != nil {
-				return stackerr.Wrap(err)
-			}
-			err = sql.Execute(
-				ctx,
-				w.db,
-				func(db sql.Database) error {
-					return w.processBlock(
-						ctx,
-						db,
-						&block,
-						height,
-						&rem,
-						buf,
-						&buf2,
-						&txidBuf,
-					)
-				},
-			)
-			if err != nil {
-				return stackerr.Wrap(err)
-			}
-			height++
-		}
-	}
-	return nil
 }
 
 func (w *W) processBlock(
 	ctx context.Context,
 	db sql.Database,
-	block *bitcoin.Block,
-	height int,
+	pb *preparedBlock,
 	est *estimateTime,
 	buf *[]byte,
 	buf2 *[]byte,
-	txidBuf *[][32]byte,
 ) error {
+	height := pb.height
 	updateRemaining(height, w.bestHeader, est)
 	if est.remainingHours > -1 {
 		w.log.Debugf(
@@ -705,22 +894,18 @@ func (w *W) processBlock(
 		w.log.Debugf("NEW BLOCK; height: %d", height)
 	}
 	updatedSH := make(map[[32]byte]struct{})
-	for i := range block.Transactions {
-		tx := &block.Transactions[i]
+	for i := range pb.block.Transactions {
+		tx := &pb.block.Transactions[i]
 		for j := range tx.Outputs {
 			err := w.processOutput(
 				ctx,
 				db,
-				block,
-				height,
-				tx,
+				pb,
 				i,
-				&tx.Outputs[j],
 				uint32(j),
 				updatedSH,
 				buf,
 				buf2,
-				txidBuf,
 			)
 			if err != nil {
 				return stackerr.Wrap(err)
@@ -730,33 +915,28 @@ func (w *W) processBlock(
 			err := w.processInput(
 				ctx,
 				db,
-				block,
-				height,
-				tx,
+				pb,
 				i,
 				&tx.Inputs[j],
 				updatedSH,
 				buf,
 				buf2,
-				txidBuf,
 			)
 			if err != nil {
 				return stackerr.Wrap(err)
 			}
 		}
 	}
-	for i := range w.wallets {
-		wl := &w.wallets[i]
-		if wl.height >= height {
-			continue
-		}
-		err := w.repo.updateWalletHeight(ctx, db, &wl.hash, height)
-		if err != nil {
-			return stackerr.Wrap(err)
-		}
-		wl.height = height
+	err := w.updateWalletsHeight(ctx, db, height)
+	if err != nil {
+		return stackerr.Wrap(err)
 	}
 	for sh := range updatedSH {
+		// the status continues from the cached state only when the block
+		// comes after it
+		if st, ok := w.shStatuses[sh]; ok && st.height >= height {
+			delete(w.shStatuses, sh)
+		}
 		clearBuf(buf)
 		var status2 [32]byte
 		status, err := w.getScriptHashStatus(ctx, db, &sh, buf)
@@ -764,7 +944,26 @@ func (w *W) processBlock(
 			return stackerr.Wrap(err)
 		}
 		copy(status2[:], status)
-		w.notifyScriptHashSubscribers(sh, status2)
+		if len(w.shSubs[sh]) > 0 {
+			w.pendingSH[sh] = status2
+		}
+	}
+	return nil
+}
+
+func (w *W) updateWalletsHeight(
+	ctx context.Context, db sql.Database, height int,
+) error {
+	for i := range w.wallets {
+		wl := &w.wallets[i]
+		if wl.stalled || wl.height >= height {
+			continue
+		}
+		err := w.repo.updateWalletHeight(ctx, db, &wl.hash, height)
+		if err != nil {
+			return stackerr.Wrap(err)
+		}
+		wl.height = height
 	}
 	return nil
 }
@@ -772,48 +971,38 @@ func (w *W) processBlock(
 func (w *W) processOutput(
 	ctx context.Context,
 	db sql.Database,
-	block *bitcoin.Block,
-	height int,
-	tx *bitcoin.Transaction,
+	pb *preparedBlock,
 	txPos int,
-	out *bitcoin.Output,
 	vout uint32,
 	updatedSH map[[32]byte]struct{},
 	buf *[]byte,
 	buf2 *[]byte,
-	txidBuf *[][32]byte,
 ) error {
-	sh := sha256.Sum256(out.ScriptPubkey)
+	sh := pb.outSH[txPos][vout]
 	info, ok := w.scriptPubkeys[sh]
 	if !ok {
 		return nil
 	}
 	updatedSH[sh] = struct{}{}
-	clearBuf(buf)
-	blockHash := block.Hash(buf)
-	clearBuf(buf)
-	txid := tx.Txid(buf)
+	tx := &pb.block.Transactions[txPos]
+	out := &tx.Outputs[vout]
+	txid := pb.txids[txPos]
 	clearBuf(buf)
 	rawTx := tx.Serialize(*buf)
 	*buf = rawTx
 	clearBuf(buf2)
-	clearBuf(txidBuf)
-	*txidBuf = block.TXIDs(*txidBuf, buf2)
-	pos, merkleP := MerkleProof(*txidBuf, txid)
-	if pos != txPos {
-		panic("unreachable")
-	}
-	clearBuf(buf2)
-	for i := range merkleP {
-		*buf2 = append(*buf2, merkleP[i][:]...)
-	}
+	*buf2 = pb.merkleBranch(txPos, *buf2)
 	sMerkle := *buf2
 	err := w.repo.insertTransaction(
-		ctx, db, &txid, &blockHash, txPos, rawTx, sMerkle,
+		ctx, db, &txid, &pb.hash, pb.height, txPos, rawTx, sMerkle,
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	err = w.repo.insertTransactionInputs(ctx, db, &txid, txParents(tx))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	err = w.repo.insertScriptPubkeyTransaction(
 		ctx, db, &sh, &txid,
 	)
@@ -824,7 +1013,7 @@ func (w *W) processOutput(
 	makeTxidVout(&txid, vout, &txVout)
 	w.log.Debugf(
 		"ADD OUTPUT; height %d; outpoint: %x:%d; sat: %d",
-		height,
+		pb.height,
 		txid,
 		vout,
 		out.Amount,
@@ -835,6 +1024,10 @@ func (w *W) processOutput(
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	err = w.queueOutpointStatus(ctx, db, &txVout)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	err = w.walletUpdateIndexes(ctx, db, info)
 	if err != nil {
 		return stackerr.Wrap(err)
@@ -849,15 +1042,12 @@ func (w *W) processOutput(
 func (w *W) processInput(
 	ctx context.Context,
 	db sql.Database,
-	block *bitcoin.Block,
-	height int,
-	tx *bitcoin.Transaction,
+	pb *preparedBlock,
 	txPos int,
 	in *bitcoin.Input,
 	updatedSH map[[32]byte]struct{},
 	buf *[]byte,
 	buf2 *[]byte,
-	txidBuf *[][32]byte,
 ) error {
 	var txVout txidVout
 	makeTxidVout(&in.Txid, in.Vout, &txVout)
@@ -873,43 +1063,40 @@ func (w *W) processInput(
 	updatedSH[utxoD.ScriptPubkeyHash] = struct{}{}
 	w.log.Debugf(
 		"SPENT OUTPUT; height: %d; outpoint: %x:%d; sat: %d",
-		height,
+		pb.height,
 		in.Txid,
 		in.Vout,
 		utxoD.Satoshi,
 	)
-	clearBuf(buf)
-	blockHash := block.Hash(buf)
-	clearBuf(buf)
-	txid := tx.Txid(buf)
+	tx := &pb.block.Transactions[txPos]
+	txid := pb.txids[txPos]
 	clearBuf(buf)
 	*buf = tx.Serialize(*buf)
 	rawTx := *buf
 	clearBuf(buf2)
-	clearBuf(txidBuf)
-	*txidBuf = block.TXIDs(*txidBuf, buf2)
-	pos, merkleP := MerkleProof(*txidBuf, txid)
-	if pos != txPos {
-		panic("unreachable")
-	}
-	clearBuf(buf2)
-	for i := range merkleP {
-		*buf2 = append(*buf2, merkleP[i][:]...)
-	}
+	*buf2 = pb.merkleBranch(txPos, *buf2)
 	sMerkle := *buf2
 	err = w.repo.insertTransaction(
-		ctx, db, &txid, &blockHash, txPos, rawTx, sMerkle,
+		ctx, db, &txid, &pb.hash, pb.height, txPos, rawTx, sMerkle,
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
+	err = w.repo.insertTransactionInputs(ctx, db, &txid, txParents(tx))
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
 	err = w.repo.insertScriptPubkeyTransaction(
 		ctx, db, &utxoD.ScriptPubkeyHash, &txid,
 	)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
-	err = w.repo.deleteUnspentOutput(ctx, db, &txVout, height)
+	err = w.repo.deleteUnspentOutput(ctx, db, &txVout, pb.height, &txid)
+	if err != nil {
+		return stackerr.Wrap(err)
+	}
+	err = w.queueOutpointStatus(ctx, db, &txVout)
 	if err != nil {
 		return stackerr.Wrap(err)
 	}
@@ -987,6 +1174,7 @@ func (w *W) refillWallet(wIdx int) error {
 		nDerivedPrev uint32,
 		scriptPubkeys [][]byte,
 	) {
+		w.scripts = append(w.scripts, scriptPubkeys...)
 		for i, p := range scriptPubkeys {
 			w.scriptPubkeys[sha256.Sum256(p)] = scriptPubkeyInfo{
 				walletIdx: wIdx,
@@ -1076,26 +1264,6 @@ func clearBuf[T any](buf *[]T) {
 	*buf = (*buf)[:0]
 }
 
-func shStatus(txs []TxData, buf *[]byte) []byte {
-	var buf2 []byte
-	if buf == nil {
-		buf = &buf2
-	}
-	if len(txs) == 0 {
-		return nil
-	}
-	for i := range txs {
-		var hx [64]byte
-		slices.Reverse(txs[i].Txid[:])
-		hex.Encode(hx[:], txs[i].Txid[:])
-		*buf = fmt.Appendf(*buf, `%s:%d:`, hx[:], txs[i].Height)
-	}
-	hash := sha256.Sum256(*buf)
-	clearBuf(buf)
-	*buf = append(*buf, hash[:]...)
-	return *buf
-}
-
 func catDoubleSha256(left, right [32]byte) [32]byte {
 	var buf [64]byte
 	copy(buf[:], left[:])
@@ -1124,33 +1292,47 @@ func findPos(txids [][32]byte, txid [32]byte) int {
 }
 
 func MerkleProof(txids [][32]byte, txid [32]byte) (int, [][32]byte) {
-	var (
-		branch     [][32]byte
-		level      = make([][32]byte, len(txids))
-		txpos, pos int
-	)
-	copy(level[:], txids[:])
-	txpos = findPos(txids, txid)
+	txpos := findPos(txids, txid)
 	if txpos < 0 {
 		return -1, nil
 	}
-	pos = txpos
-	if len(level) == 1 {
-		return txpos, [][32]byte{}
-	}
-	if len(level)%2 != 0 {
-		level = append(level, level[len(level)-1])
+	tree := newMerkleTree(txids)
+	return txpos, tree.branch(txpos, make([][32]byte, 0, len(tree)-1))
+}
+
+// merkleTree holds every level of a merkle tree, the first level are the
+// leaves and the last one is the root
+type merkleTree [][][32]byte
+
+func newMerkleTree(leaves [][32]byte) merkleTree {
+	tree := merkleTree{leaves}
+	lvl := leaves
+	for len(lvl) > 1 {
+		next := make([][32]byte, (len(lvl)+1)/2)
+		for i := range next {
+			left := lvl[i*2]
+			right := left
+			if i*2+1 < len(lvl) {
+				right = lvl[i*2+1]
+			}
+			next[i] = catDoubleSha256(left, right)
+		}
+		tree = append(tree, next)
+		lvl = next
 	}
-	for len(level) > 1 {
-		if pos%2 == 0 {
-			branch = append(branch, level[pos+1])
-		} else {
-			branch = append(branch, level[pos-1])
+	return tree
+}
+
+func (t merkleTree) branch(pos int, out [][32]byte) [][32]byte {
+	for _, lvl := range t[:len(t)-1] {
+		sibling := pos ^ 1
+		if sibling >= len(lvl) {
+			sibling = pos
 		}
-		level = hashPairs(level)
+		out = append(out, lvl[sibling])
 		pos /= 2
 	}
-	return txpos, branch
+	return out
 }
 
 func hashPairs(hashes [][32]byte) [][32]byte {
@@ -37,7 +37,13 @@ func TestIntegration_W(t *testing.T) {
 		Height: 0,
 	}
 	w, err := New(
-		tc.C, tc.D, tc.L, bcli, []WalletConfig{wc}, bitcoin.Regtest,
+		tc.C,
+		tc.D,
+		tc.L,
+		bcli,
+		[]WalletConfig{wc},
+		bitcoin.Regtest,
+		Opts{NodeAddr: tc.Cfg.BTCNodeAddr},
 	)
 	assert.Must(t, err)
 	defer func() {
@@ -117,6 +123,94 @@ func TestMerkle(t *testing.T) {
 	assert.MustEqual(t, true, ok)
 }
 
+func TestBlockMerkleBranches(t *testing.T) {
+	block := testBlock()
+	var (
+		buf     []byte
+		matches []int
+	)
+	// pretend every 40th transaction has a wallet output
+	for i := 0; i < len(block.Transactions); i += 40 {
+		matches = append(matches, i)
+	}
+	pb := preparedBlock{block: block}
+	indexBlock(&pb, &buf)
+	for i := range pb.txids {
+		var branch []byte
+		branch = pb.merkleBranch(i, branch)
+		proof := make([][32]byte, 0, len(branch)/32)
+		for j := 0; j < len(branch); j += 32 {
+			proof = append(proof, [32]byte(branch[j:j+32]))
+		}
+		ok := checkMerkleProof(pb.txids[i], i, block.MerkleRoot, proof)
+		assert.MustEqual(t, true, ok)
+	}
+	for _, i := range matches {
+		pos, expect := tMerkleProofPerTx(pb.txids, pb.txids[i])
+		assert.MustEqual(t, i, pos)
+		_, proof := MerkleProof(pb.txids, pb.txids[i])
+		assert.MustEqual(t, expect, proof)
+	}
+	testutil.Bench(
+		t,
+		3,
+		testutil.BenchParams{
+			Name: "merkle branches per match",
+			Fn: func(t *testing.T) {
+				var txidBuf [][32]byte
+				for _, i := range matches {
+					txid := block.Transactions[i].Txid(&buf)
+					txidBuf = block.TXIDs(txidBuf[:0], &buf)
+					tMerkleProofPerTx(txidBuf, txid)
+				}
+			},
+		},
+		testutil.BenchParams{
+			Name: "merkle branches per block",
+			Fn: func(t *testing.T) {
+				var branch []byte
+				pb := preparedBlock{block: block}
+				indexBlock(&pb, &buf)
+				for _, i := range matches {
+					branch = pb.merkleBranch(i, branch[:0])
+				}
+			},
+		},
+	)
+}
+
+// tMerkleProofPerTx rebuilds the whole tree for a single branch, as block
+// processing did before the tree was shared by every match in a block
+func tMerkleProofPerTx(txids [][32]byte, txid [32]byte) (int, [][32]byte) {
+	var (
+		branch     [][32]byte
+		level      = make([][32]byte, len(txids))
+		txpos, pos int
+	)
+	copy(level[:], txids[:])
+	txpos = findPos(txids, txid)
+	if txpos < 0 {
+		return -1, nil
+	}
+	pos = txpos
+	if len(level) == 1 {
+		return txpos, [][32]byte{}
+	}
+	if len(level)%2 != 0 {
+		level = append(level, level[len(level)-1])
+	}
+	for len(level) > 1 {
+		if pos%2 == 0 {
+			branch = append(branch, level[pos+1])
+		} else {
+			branch = append(branch, level[pos-1])
+		}
+		level = hashPairs(level)
+		pos /= 2
+	}
+	return txpos, branch
+}
+
 func testBlock() bitcoin.Block {
 	rawBlock := testutil.MustHexDecode(
 		string(bytes.Trim(testdata.Block919939, "\n")),